@@ -0,0 +1,183 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// FileVault on APFS keeps the wrapped volume encryption keys in the
+// container keybag, found through the container superblock. Older Macs use
+// CoreStorage, whose volume header holds the key to its encrypted metadata.
+
+const (
+	apfsMagic          = "NXSB"
+	apfsTypeSuperblock = 0x0001
+	apfsKeylockerOff   = 0x510
+	apfsXpNonContig    = 0x80000000
+	apfsMaxBlockSize   = 64 << 10
+)
+
+type apfsSuperblock struct {
+	Checksum     uint64
+	Oid          uint64
+	Xid          uint64
+	Type         uint32
+	Subtype      uint32
+	Magic        [4]byte
+	BlockSize    uint32
+	BlockCount   uint64
+	Features     [3]uint64
+	Uuid         [16]byte
+	NextOid      uint64
+	NextXid      uint64
+	XpDescBlocks uint32
+	XpDataBlocks uint32
+	XpDescBase   uint64
+}
+
+// apfsRange is a prange_t, a run of blocks.
+type apfsRange struct {
+	Start, Count uint64
+}
+
+func isAPFS(r io.ReaderAt) bool {
+	var magic [4]byte
+	_, err := r.ReadAt(magic[:], 32)
+	return err == nil && string(magic[:]) == apfsMagic
+}
+
+// parseAPFSSuperblock decodes a container superblock and its keylocker.
+func parseAPFSSuperblock(b []byte) (sb apfsSuperblock, keylocker apfsRange, ok bool) {
+	if len(b) < apfsKeylockerOff+16 {
+		return
+	}
+	binary.Read(bytes.NewReader(b), binary.LittleEndian, &sb)
+	if string(sb.Magic[:]) != apfsMagic || sb.Type&0xffff != apfsTypeSuperblock {
+		return
+	}
+	binary.Read(bytes.NewReader(b[apfsKeylockerOff:]), binary.LittleEndian, &keylocker)
+	return sb, keylocker, true
+}
+
+func inspectAPFS(r io.ReaderAt, size int64) (string, []RegionDesc, error) {
+	buf := make([]byte, 4096)
+	if err := readFullAt(r, buf, 0); err != nil {
+		return "", nil, fmt.Errorf("can't read APFS superblock: %v", err)
+	}
+	sb, keylocker, ok := parseAPFSSuperblock(buf)
+	if !ok {
+		return "", nil, errors.New("no APFS container superblock found")
+	}
+
+	bs := int64(sb.BlockSize)
+	if bs < 4096 || bs > apfsMaxBlockSize || bs&(bs-1) != 0 {
+		return "", nil, fmt.Errorf("invalid APFS block size %d", bs)
+	}
+
+	regions := []RegionDesc{{"APFS container superblock", 0, bs}}
+	keybags := map[apfsRange]bool{}
+	if keylocker.Count != 0 {
+		keybags[keylocker] = true
+	}
+
+	// older superblocks in the checkpoint area may point to older keybags
+	if sb.XpDescBlocks&apfsXpNonContig == 0 && sb.XpDescBlocks != 0 {
+		desc := RegionDesc{"APFS checkpoint descriptors", int64(sb.XpDescBase) * bs,
+			int64(sb.XpDescBlocks) * bs}
+		regions = append(regions, desc)
+
+		block := make([]byte, bs)
+		for off := desc.Offset; off < desc.Offset+desc.Size; off += bs {
+			if err := readFullAt(r, block, off); err != nil {
+				return "", nil, fmt.Errorf("can't read APFS checkpoint area: %v", err)
+			}
+			if _, kl, ok := parseAPFSSuperblock(block); ok && kl.Count != 0 {
+				keybags[kl] = true
+			}
+		}
+	} else {
+		fmt.Printf("APFS checkpoint area is not contiguous, only the current keybag is wiped\n")
+	}
+
+	if len(keybags) == 0 {
+		return "", nil, errors.New("APFS container has no keybag, its volumes are not encrypted")
+	}
+	var ranges []apfsRange
+	for kb := range keybags {
+		ranges = append(ranges, kb)
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	for _, kb := range ranges {
+		regions = append(regions, RegionDesc{fmt.Sprintf("APFS keybag at block %d", kb.Start),
+			int64(kb.Start) * bs, int64(kb.Count) * bs})
+	}
+
+	u := sb.Uuid
+	desc := fmt.Sprintf("APFS container %X-%X-%X-%X-%X, block size %d, %d blocks",
+		u[0:4], u[4:6], u[6:8], u[8:10], u[10:], bs, sb.BlockCount)
+	return desc, regions, nil
+}
+
+// CoreStorage physical volume header
+type coreStorageHeader struct {
+	Checksum       uint32
+	InitialValue   uint32
+	Version        uint16
+	BlockType      uint16
+	SerialNumber   uint32
+	_              [48]byte
+	PhysicalSize   uint64
+	_              [16]byte
+	Signature      [2]byte
+	ChecksumAlg    uint32
+	_              uint16
+	BlockSize      uint32
+	MetadataSize   uint32
+	MetadataBlocks [4]uint64
+}
+
+func isCoreStorage(r io.ReaderAt) bool {
+	buf := make([]byte, 512)
+	if err := readFullAt(r, buf, 0); err != nil {
+		return false
+	}
+	var hdr coreStorageHeader
+	binary.Read(bytes.NewReader(buf), binary.LittleEndian, &hdr)
+	return string(hdr.Signature[:]) == "CS" && hdr.Version == 1 && hdr.BlockType == 0x10
+}
+
+func inspectCoreStorage(r io.ReaderAt, size int64) (string, []RegionDesc, error) {
+	if !isCoreStorage(r) {
+		return "", nil, errors.New("no CoreStorage volume header found")
+	}
+	buf := make([]byte, 512)
+	readFullAt(r, buf, 0)
+	var hdr coreStorageHeader
+	binary.Read(bytes.NewReader(buf), binary.LittleEndian, &hdr)
+
+	// the header holds the key for the encrypted metadata, which in turn
+	// holds the wrapped volume keys
+	regions := []RegionDesc{{"CoreStorage volume header", 0, 512}}
+	if hdr.PhysicalSize > 512 {
+		regions = append(regions, RegionDesc{"CoreStorage backup volume header",
+			int64(hdr.PhysicalSize) - 512, 512})
+	}
+	for i, blk := range hdr.MetadataBlocks {
+		if blk != 0 && hdr.MetadataSize != 0 {
+			regions = append(regions, RegionDesc{fmt.Sprintf("CoreStorage metadata %d", i),
+				int64(blk) * int64(hdr.BlockSize), int64(hdr.MetadataSize)})
+		}
+	}
+
+	desc := fmt.Sprintf("CoreStorage physical volume, size %d, block size %d",
+		hdr.PhysicalSize, hdr.BlockSize)
+	return desc, regions, nil
+}
@@ -0,0 +1,226 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Sending the progress of a report to central logging: syslog in the
+// RFC 5424 format (optionally carrying CEF), or the Windows event log.
+
+const (
+	facilityLogAudit  = 13
+	sevError          = 3
+	sevNotice         = 5
+	auditEnterpriseId = 32473 // the example enterprise number, from RFC 5612
+)
+
+// auditRecord is one event of a report: its start, a step, or its end.
+type auditRecord struct {
+	Report   *Report
+	Step     *reportStep // nil for the start and end of the report
+	Severity int
+	Message  string
+}
+
+type auditSink interface {
+	Send(rec auditRecord) error
+	Close() error
+}
+
+// auditSinks receive every change to a report.
+var auditSinks []auditSink
+
+func audit(r *Report, step *reportStep, severity int, format string, a ...interface{}) {
+	rec := auditRecord{r, step, severity, fmt.Sprintf(format, a...)}
+	for _, s := range auditSinks {
+		if err := s.Send(rec); err != nil {
+			fmt.Fprintf(os.Stderr, "can't send audit record: %v\n", err)
+		}
+	}
+}
+
+type auditConfig struct {
+	syslog   string
+	cef      bool
+	eventLog bool
+}
+
+// auditFlags adds the flags that choose where records are sent.
+func auditFlags(fs *flag.FlagSet) *auditConfig {
+	c := &auditConfig{}
+	fs.StringVar(&c.syslog, "syslog", "", "send records to syslog: \"local\", udp://host:514 or tcp://host:601")
+	fs.BoolVar(&c.cef, "cef", false, "send syslog records in the Common Event Format")
+	fs.BoolVar(&c.eventLog, "eventlog", false, "send records to the Windows event log")
+	return c
+}
+
+func (c *auditConfig) enabled() bool {
+	return c.syslog != "" || c.eventLog
+}
+
+// args returns the flags to pass the configuration on to a wipe.
+func (c *auditConfig) args() []string {
+	var args []string
+	if c.syslog != "" {
+		args = append(args, "-syslog", c.syslog)
+	}
+	if c.cef {
+		args = append(args, "-cef")
+	}
+	if c.eventLog {
+		args = append(args, "-eventlog")
+	}
+	return args
+}
+
+// open sets up auditSinks, replacing any that were set up before, and
+// exits if that fails.
+func (c *auditConfig) open() {
+	for _, s := range auditSinks {
+		s.Close()
+	}
+	auditSinks = nil
+
+	if c.cef && c.syslog == "" {
+		fatal("-cef needs -syslog")
+	}
+	if c.syslog != "" {
+		s, err := dialSyslog(c.syslog, c.cef)
+		if err != nil {
+			fatal("can't connect to syslog: %v", err)
+		}
+		auditSinks = append(auditSinks, s)
+	}
+	if c.eventLog {
+		s, err := openEventLog()
+		if err != nil {
+			fatal("can't open the event log: %v", err)
+		}
+		auditSinks = append(auditSinks, s)
+	}
+}
+
+type syslogSink struct {
+	conn   net.Conn
+	framed bool // octet counting, for TCP
+	cef    bool
+	host   string
+}
+
+func dialSyslog(addr string, cef bool) (*syslogSink, error) {
+	network, address := "", ""
+	if addr == "local" {
+		for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+			if _, err := os.Stat(path); err == nil {
+				network, address = "unixgram", path
+				break
+			}
+		}
+		if network == "" {
+			return nil, fmt.Errorf("no local syslog socket found")
+		}
+	} else {
+		u, err := url.Parse(addr)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("invalid syslog address %q", addr)
+		}
+		network, address = u.Scheme, u.Host
+	}
+
+	conn, err := net.DialTimeout(network, address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	return &syslogSink{conn, network == "tcp", cef, host}, nil
+}
+
+// sdEscape escapes a structured data parameter value.
+func sdEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+func cefEscapeHeader(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`).Replace(s)
+}
+
+func cefEscapeValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`).Replace(s)
+}
+
+// formatCEF formats a record as a CEF event, whose severity is from 0 to 10.
+func formatCEF(rec auditRecord) string {
+	r := rec.Report
+	name, event := r.Command+" "+r.Result, r.Command
+	if rec.Step != nil {
+		name, event = rec.Step.Name, r.Command+".step"
+	}
+	severity := 3
+	if rec.Severity <= sevError {
+		severity = 8
+	}
+
+	ext := []string{
+		"rt=" + cefEscapeValue(fmt.Sprint(time.Now().UnixNano()/1e6)),
+		"dvchost=" + cefEscapeValue(r.Host),
+		"filePath=" + cefEscapeValue(r.Target),
+		"outcome=" + cefEscapeValue(r.Result),
+		"msg=" + cefEscapeValue(rec.Message),
+	}
+	if r.Operator != "" {
+		ext = append(ext, "suser="+cefEscapeValue(r.Operator))
+	}
+	if r.AssetTag != "" {
+		ext = append(ext, "cs1Label=assetTag", "cs1="+cefEscapeValue(r.AssetTag))
+	}
+	if r.WorkOrder != "" {
+		ext = append(ext, "cs2Label=workOrder", "cs2="+cefEscapeValue(r.WorkOrder))
+	}
+	if r.Identity != nil {
+		ext = append(ext, "cs3Label=drive", "cs3="+cefEscapeValue(r.Identity.String()))
+	}
+	return fmt.Sprintf("CEF:0|geekman|blwipe|1|%s|%s|%d|%s", cefEscapeHeader(event),
+		cefEscapeHeader(name), severity, strings.Join(ext, " "))
+}
+
+func (s *syslogSink) Send(rec auditRecord) error {
+	r := rec.Report
+	sd := fmt.Sprintf(`[blwipe@%d command="%s" target="%s" result="%s"`,
+		auditEnterpriseId, sdEscape(r.Command), sdEscape(r.Target), sdEscape(r.Result))
+	for _, p := range []struct{ name, value string }{
+		{"assetTag", r.AssetTag}, {"operator", r.Operator}, {"workOrder", r.WorkOrder},
+		{"drive", r.identityString()},
+	} {
+		if p.value != "" {
+			sd += fmt.Sprintf(` %s="%s"`, p.name, sdEscape(p.value))
+		}
+	}
+	sd += "]"
+
+	msg := rec.Message
+	if s.cef {
+		msg = formatCEF(rec)
+	}
+	line := fmt.Sprintf("<%d>1 %s %s blwipe %d %s %s %s",
+		facilityLogAudit*8+rec.Severity, time.Now().UTC().Format(time.RFC3339Nano),
+		s.host, os.Getpid(), r.Command, sd, msg)
+	if s.framed {
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+	_, err := s.conn.Write([]byte(line))
+	return err
+}
+
+func (s *syslogSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,13 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+//go:build !windows
+
+package main
+
+import "errors"
+
+func openEventLog() (auditSink, error) {
+	return nil, errors.New("the event log is only available on Windows")
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	eventlogErrorType       = 1
+	eventlogInformationType = 4
+)
+
+var (
+	advapi32                = syscall.NewLazyDLL("advapi32.dll")
+	procRegisterEventSource = advapi32.NewProc("RegisterEventSourceW")
+	procReportEvent         = advapi32.NewProc("ReportEventW")
+	procDeregisterEventSrc  = advapi32.NewProc("DeregisterEventSource")
+)
+
+// eventLogSink writes records to the Application log, with "blwipe" as
+// the source. Without a registered message file, the event viewer shows
+// the record text as an insertion string.
+type eventLogSink struct {
+	handle uintptr
+}
+
+func openEventLog() (auditSink, error) {
+	name, _ := syscall.UTF16PtrFromString("blwipe")
+	h, _, err := procRegisterEventSource.Call(0, uintptr(unsafe.Pointer(name)))
+	if h == 0 {
+		return nil, err
+	}
+	return &eventLogSink{h}, nil
+}
+
+func (s *eventLogSink) Send(rec auditRecord) error {
+	r := rec.Report
+	text := fmt.Sprintf("%s\r\ncommand: %s\r\ntarget: %s\r\nresult: %s", rec.Message,
+		r.Command, r.Target, r.Result)
+	for _, p := range []struct{ name, value string }{
+		{"asset tag", r.AssetTag}, {"operator", r.Operator}, {"work order", r.WorkOrder},
+		{"drive", r.identityString()},
+	} {
+		if p.value != "" {
+			text += fmt.Sprintf("\r\n%s: %s", p.name, p.value)
+		}
+	}
+
+	etype := eventlogInformationType
+	if rec.Severity <= sevError {
+		etype = eventlogErrorType
+	}
+	str, err := syscall.UTF16PtrFromString(text)
+	if err != nil {
+		return err
+	}
+	ok, _, err := procReportEvent.Call(s.handle, uintptr(etype), 0, 1, 0, 1, 0,
+		uintptr(unsafe.Pointer(&str)), 0)
+	if ok == 0 {
+		return err
+	}
+	return nil
+}
+
+func (s *eventLogSink) Close() error {
+	procDeregisterEventSrc.Call(s.handle)
+	return nil
+}
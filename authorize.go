@@ -0,0 +1,178 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Under the two-person rule a wipe only goes ahead once enough operators
+// have approved it. Every operator has an ed25519 key pair; the wipe prints
+// a challenge and each approver signs it with "blwipe approve", giving a
+// token that is typed back in. The tokens must come from distinct keys.
+
+const approvalPrefix = "blwipe wipe approval "
+
+type approvalFlags struct {
+	approvers string
+	needed    int
+}
+
+func addApprovalFlags(fs *flag.FlagSet) *approvalFlags {
+	a := &approvalFlags{}
+	fs.StringVar(&a.approvers, "approvers", "", "comma-separated public key files of the operators who may approve the wipe")
+	fs.IntVar(&a.needed, "approvals", 2, "number of distinct approvers needed with -approvers")
+	return a
+}
+
+func (a *approvalFlags) enabled() bool {
+	return a != nil && a.approvers != ""
+}
+
+// loadApprovers reads the public keys, failing when fewer than the number
+// of approvals needed are given.
+func (a *approvalFlags) loadApprovers() []ed25519.PublicKey {
+	var keys []ed25519.PublicKey
+	seen := make(map[string]bool)
+	for _, path := range strings.Split(a.approvers, ",") {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fatal("can't read approver key: %v", err)
+		}
+		b, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			fatal("%s is not a public key made by approve -generate", path)
+		}
+		if !seen[string(b)] {
+			seen[string(b)] = true
+			keys = append(keys, ed25519.PublicKey(b))
+		}
+	}
+	if a.needed < 2 {
+		fatal("-approvals must be at least 2")
+	}
+	if len(keys) < a.needed {
+		fatal("-approvals %d needs as many distinct keys in -approvers, only %d given", a.needed, len(keys))
+	}
+	return keys
+}
+
+func keyFingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// newChallenge makes a challenge that is unique to this run of the wipe, so
+// that tokens can't be reused for another one.
+func newChallenge(target string) string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	sum := sha256.Sum256(append(nonce, target...))
+	s := hex.EncodeToString(sum[:10])
+	return s[:5] + "-" + s[5:10] + "-" + s[10:15] + "-" + s[15:]
+}
+
+// authorizeWipe asks for approval tokens on stdin until enough distinct
+// approvers have signed the challenge, and exits if they haven't.
+func (a *approvalFlags) authorizeWipe(target string) {
+	keys := a.loadApprovers()
+	challenge := newChallenge(target)
+	msg := []byte(approvalPrefix + challenge)
+
+	fmt.Printf("%s %s\n", warning("wiping needs the approval of"), highlight(fmt.Sprintf("%d operators", a.needed)))
+	fmt.Printf("each of them has to run: blwipe approve -key <key file> %s\n", challenge)
+
+	in := bufio.NewReader(os.Stdin)
+	approved := make(map[int]bool)
+	for attempts := 0; len(approved) < a.needed; attempts++ {
+		if attempts >= a.needed+3 {
+			fatal("wipe not approved")
+		}
+		token := prompt(in, fmt.Sprintf("approval token %d of %d", len(approved)+1, a.needed), "")
+		if token == "" {
+			fatal("wipe not approved")
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			fmt.Printf("not an approval token\n")
+			continue
+		}
+		found := -1
+		for i, k := range keys {
+			if ed25519.Verify(k, msg, sig) {
+				found = i
+				break
+			}
+		}
+		switch {
+		case found < 0:
+			fmt.Printf("token is not signed by any of the approvers\n")
+		case approved[found]:
+			fmt.Printf("this approver has already approved, another one is needed\n")
+		default:
+			approved[found] = true
+			fmt.Printf("approved by key %s\n", keyFingerprint(keys[found]))
+			if activeReport != nil {
+				activeReport.Step("approval", "run", "approved by key "+keyFingerprint(keys[found]))
+			}
+		}
+	}
+}
+
+func cmdApprove(args []string) {
+	fs := newFlagSet("approve", "<challenge>")
+	keyPath := fs.String("key", "", "private key file of the approver")
+	generate := fs.String("generate", "", "create a key pair, written to NAME.key and NAME.pub")
+	parseFlags(fs, args)
+
+	if *generate != "" {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			fatal("can't generate key: %v", err)
+		}
+		writeKeyFile(*generate+".key", hex.EncodeToString(priv.Seed()), 0600)
+		writeKeyFile(*generate+".pub", hex.EncodeToString(pub), 0644)
+		fmt.Printf("key %s written to %s.key, give %s.pub to whoever runs the wipes\n",
+			keyFingerprint(pub), *generate, *generate)
+		return
+	}
+
+	if fs.NArg() != 1 || *keyPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	data, err := os.ReadFile(*keyPath)
+	if err != nil {
+		fatal("can't read key: %v", err)
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		fatal("%s is not a private key made by approve -generate", *keyPath)
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	sig := ed25519.Sign(priv, []byte(approvalPrefix+strings.TrimSpace(fs.Arg(0))))
+	fmt.Printf("%s\n", base64.RawURLEncoding.EncodeToString(sig))
+}
+
+func writeKeyFile(path, s string, mode os.FileMode) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		fatal("can't create key file: %v", err)
+	}
+	if _, err := f.WriteString(s + "\n"); err != nil {
+		fatal("can't write key file: %v", err)
+	}
+	f.Close()
+}
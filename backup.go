@@ -0,0 +1,205 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Backups of the regions a wipe is about to overwrite. They hold the key
+// material itself, so they only make sense where it has to be proven
+// afterwards that the wipe destroyed it, and must be kept as safe as the
+// volume was.
+
+type metadataBackup struct {
+	Target  string         `json:"target"`
+	Size    int64          `json:"size,omitempty"`   // of the target
+	Offset  int64          `json:"offset"`           // of the volume
+	Volume  string         `json:"volume,omitempty"` // BitLocker volume GUID
+	Created time.Time      `json:"created"`
+	Regions []backupRegion `json:"regions"`
+}
+
+type backupRegion struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"` // from the start of the target
+	Data   []byte `json:"data"`
+}
+
+// backupPath, if set by -backup, is where wipeRegions saves the regions
+// before overwriting them.
+var backupPath string
+
+// backupFile and journalFile are created before privileges are given up,
+// and removed if the wipe ends before anything is saved to them.
+var backupFile, journalFile *os.File
+
+// createBackupFiles creates the files for -backup and -journal, readable
+// only by their owner.
+func createBackupFiles() {
+	var err error
+	if backupPath != "" {
+		if backupFile, err = os.OpenFile(backupPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			fatal("not wiping, can't create backup: %v", err)
+		}
+	}
+	if journalPath != "" {
+		if journalFile, err = os.OpenFile(journalPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			removeUnsavedBackups()
+			fatal("not wiping, can't create journal: %v", err)
+		}
+	}
+}
+
+// removeUnsavedBackups removes the backup and journal files that are
+// still empty.
+func removeUnsavedBackups() {
+	for _, f := range []**os.File{&backupFile, &journalFile} {
+		if *f != nil {
+			(*f).Close()
+			os.Remove((*f).Name())
+			*f = nil
+		}
+	}
+}
+
+// backupTarget and backupSize are recorded in backups to show where they
+// came from.
+var (
+	backupTarget string
+	backupSize   int64
+)
+
+// readBackup reads the regions of the volume at offset.
+func readBackup(r io.ReaderAt, offset int64, regions []RegionDesc) *metadataBackup {
+	b := &metadataBackup{Target: backupTarget, Size: backupSize, Offset: offset, Created: time.Now().UTC()}
+	if guid, err := volumeGuid(r, offset); err == nil {
+		b.Volume = guid.String()
+	}
+	for _, region := range regions {
+		data := make([]byte, region.Size)
+		if err := readFullAt(r, data, offset+region.Offset); err != nil {
+			b.zeroize()
+			fatal("not wiping, can't back up %s: %v", region.Name, err)
+		}
+		b.Regions = append(b.Regions, backupRegion{region.Name, offset + region.Offset, data})
+	}
+	return b
+}
+
+// saveBackup reads the regions of the volume at offset and saves them to
+// backupPath, readable only by its owner.
+func saveBackup(r io.ReaderAt, offset int64, regions []RegionDesc) {
+	b := readBackup(r, offset, regions)
+	data, _ := json.Marshal(b)
+	b.zeroize()
+
+	out := backupFile
+	backupFile = nil
+	if out == nil {
+		zeroize(data)
+		fatal("not wiping, the backup file was not created")
+	}
+	// appending the newline could copy data where it isn't zeroized, and
+	// fatal doesn't run deferred calls
+	_, err := out.Write(data)
+	zeroize(data)
+	if err == nil {
+		_, err = out.Write([]byte{'\n'})
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		// don't leave part of the key material behind
+		shredOpenFile(out)
+	}
+	out.Close()
+	if err != nil {
+		fatal("not wiping, can't save backup: %v", err)
+	}
+	fmt.Printf("backed up %d regions to %s\n", len(regions), backupPath)
+}
+
+// backupChunkSize is the granularity at which remains of a backed up
+// region are looked for.
+const backupChunkSize = 16
+
+// remainingChunks counts the chunks of data that are found unchanged in
+// current. Chunks of a single repeated byte are skipped, since a wipe that
+// zeroes or trims can leave them as they were.
+func remainingChunks(data, current []byte) (remaining, checked int) {
+	for i := 0; i+backupChunkSize <= len(data); i += backupChunkSize {
+		chunk := data[i : i+backupChunkSize]
+		if bytes.Count(chunk, chunk[:1]) == len(chunk) {
+			continue
+		}
+		checked++
+		if bytes.Equal(chunk, current[i:i+backupChunkSize]) {
+			remaining++
+		}
+	}
+	return
+}
+
+func cmdVerify(args []string) {
+	fs := newFlagSet("verify", "<device>")
+	backup := fs.String("backup", "", "backup saved by wipe -backup")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 || *backup == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	data, err := os.ReadFile(*backup)
+	if err != nil {
+		fatal("can't open backup: %v", err)
+	}
+	var b metadataBackup
+	err = json.Unmarshal(data, &b)
+	zeroize(data)
+	if err != nil {
+		fatal("can't read backup: %v", err)
+	}
+
+	f, err := openTarget(fs.Arg(0), false)
+	if err != nil {
+		fatal("can't open file: %s", err)
+	}
+	defer f.Close()
+
+	fmt.Printf("backup of %s taken %s\n", b.Target, b.Created.Format(time.RFC3339))
+	failed := 0
+	for _, region := range b.Regions {
+		current := make([]byte, len(region.Data))
+		if err := readFullAt(f, current, region.Offset); err != nil {
+			fmt.Printf("%s at offset 0x%x: %s\n", region.Name, region.Offset, warning(fmt.Sprintf("can't read: %v", err)))
+			failed++
+			continue
+		}
+		remaining, checked := remainingChunks(region.Data, current)
+		zeroize(current)
+		status := success("destroyed")
+		if remaining > 0 {
+			status = warning(fmt.Sprintf("%d of %d chunks REMAIN", remaining, checked))
+			failed++
+		}
+		fmt.Printf("%s at offset 0x%x size %s: %s\n", region.Name, region.Offset,
+			sizeString(int64(len(region.Data))), status)
+	}
+	b.zeroize()
+
+	if failed > 0 {
+		result("FAIL: %d of %d regions were not destroyed", failed, len(b.Regions))
+		os.Exit(1)
+	}
+	result("PASS: none of the backed up data remains in %d regions", len(b.Regions))
+}
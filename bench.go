@@ -0,0 +1,162 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Measuring how fast a drive can be overwritten, to estimate how long a
+// full overwrite will take before starting one. The area written to is
+// read beforehand and put back afterwards, unless -no-restore is given.
+
+// rate is n bytes over d as a human-readable speed.
+func rate(n int64, d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return humanSize(int64(float64(n)/d.Seconds())) + "/s"
+}
+
+func cmdBench(args []string) {
+	fs := newFlagSet("bench", "<device>")
+	offset := fs.Int64("offset", 0, "start writing at this offset")
+	size := fs.Int64("size", 64<<20, "number of bytes to write")
+	blockSize := fs.Int64("bs", 1<<20, "size of each write")
+	pattern := fs.String("pattern", "random", "data to write: random or zero")
+	noRestore := fs.Bool("no-restore", false, "do not put back what was there, for blank drives")
+	seed := seedFlag(fs)
+	addRNGFlag(fs)
+	progressFd := progressFlag(fs)
+	addDurabilityFlags(fs)
+	addSectorFlags(fs)
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := checkRawSectorSize(); err != nil {
+		fatal("%v", err)
+	}
+	if *blockSize < 512 || *blockSize > 64<<20 || *blockSize%512 != 0 {
+		fatal("-bs must be a multiple of 512 up to 64 MiB")
+	}
+	if *size < *blockSize || *offset < 0 || *offset%512 != 0 {
+		fatal("-size must be at least -bs, and -offset a multiple of 512")
+	}
+	*size -= *size % *blockSize
+	if *pattern != "random" && *pattern != "zero" {
+		fatal("-pattern must be random or zero")
+	}
+	useRNG(*seed)
+	openProgress(*progressFd)
+
+	f, err := openTarget(fs.Arg(0), true)
+	if err != nil {
+		fatal("can't open file: %s", err)
+	}
+	defer f.Close()
+	if isReadOnly(f) {
+		fatal("%s is a read-only evidence container", fs.Arg(0))
+	}
+
+	total, err := imageSize(f)
+	if err != nil || total < 0 {
+		fatal("can't determine size of %s", fs.Arg(0))
+	}
+	if *offset+*size > total {
+		*size = (total - *offset) / *blockSize * *blockSize
+		if *size <= 0 {
+			fatal("%s is too small to write %d bytes at 0x%x", fs.Arg(0), *blockSize, *offset)
+		}
+	}
+
+	var saved []byte
+	if !*noRestore {
+		saved = make([]byte, *size)
+		if err := readFullAt(f, saved, *offset); err != nil {
+			fatal("can't read what is there to put it back later: %v", err)
+		}
+	}
+	restore := func() {
+		if saved == nil {
+			return
+		}
+		fmt.Printf("putting back the original contents...\n")
+		if _, err := f.WriteAt(saved, *offset); err != nil {
+			fatal("unable to put back the original contents at 0x%x: %v", *offset, err)
+		}
+		if err := syncImage(f); err != nil {
+			fatal("unable to sync %s: %v", fs.Arg(0), err)
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	fmt.Printf("writing %s at offset 0x%x in blocks of %s (%s data)...\n",
+		sizeString(*size), *offset, humanSize(*blockSize), *pattern)
+
+	// generating the data is part of a wipe too, so it is timed as well
+	buf := make([]byte, *blockSize)
+	var generating time.Duration
+	var written int64
+	start := time.Now()
+	for written < *size {
+		select {
+		case sig := <-sigs:
+			restore()
+			fatal("interrupted by %v", sig)
+		default:
+		}
+
+		if *pattern == "random" {
+			t := time.Now()
+			if _, err := io.ReadFull(randSource, buf); err != nil {
+				fatal("unable to generate rand bytes: %v", err)
+			}
+			generating += time.Since(t)
+		}
+		if _, err := f.WriteAt(buf, *offset+written); err != nil {
+			restore()
+			fatal("unable to write at 0x%x: %v", *offset+written, err)
+		}
+		ev := progressEvent{Phase: "bench", Offset: *offset + written, Bytes: *blockSize, Total: *size}
+		written += *blockSize
+		if durability.syncRegions {
+			if err := syncImage(f); err != nil {
+				restore()
+				fatal("unable to sync %s: %v", fs.Arg(0), err)
+			}
+		}
+		ev.Done = written
+		progress(ev)
+	}
+	if err := syncImage(f); err != nil {
+		restore()
+		fatal("unable to sync %s: %v", fs.Arg(0), err)
+	}
+	if durability.flushCache {
+		flushImage(f)
+	}
+	elapsed := time.Since(start)
+	restore()
+
+	if *pattern == "random" {
+		fmt.Printf("pattern: %s\n", rate(written, generating))
+	}
+	fmt.Printf("writes:  %s\n", rate(written, elapsed-generating))
+	result("%s in %v, %s", humanSize(written), elapsed.Round(time.Millisecond), rate(written, elapsed))
+
+	estimate := time.Duration(float64(elapsed) * float64(total) / float64(written))
+	fmt.Printf("overwriting all %s would take about %v\n", humanSize(total), estimate.Round(time.Second))
+}
@@ -6,13 +6,19 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"math"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type Guid struct {
@@ -81,72 +87,247 @@ type InfoStruct struct {
 	HeaderSectorsOffset uint64
 }
 
-func (s *InfoStruct) Read(r io.ReadSeeker) (size int64, err error) {
+func (s *InfoStruct) Read(r io.ReaderAt, off int64) (size int64, err error) {
+	var buf []byte
+	buf, size, err = s.ReadRaw(r, off)
+	zeroize(buf)
+	return
+}
+
+// ReadRaw is like Read, but also returns the block contents covered by
+// the validation checksum.
+func (s *InfoStruct) ReadRaw(r io.ReaderAt, off int64) (buf []byte, size int64, err error) {
 	var hdr InfoStructHeader
 	size = -1
+	defer func() {
+		// a block that fails to validate can still hold keys
+		if err != nil {
+			zeroize(buf)
+			buf = nil
+		}
+	}()
 
-	err = binary.Read(r, binary.LittleEndian, &hdr)
+	err = binary.Read(io.NewSectionReader(r, off, int64(binary.Size(hdr))), binary.LittleEndian, &hdr)
 	if err != nil {
+		err = readError("metadata block", err)
 		return
 	}
 
 	if !VerifySignature(hdr.Signature) {
-		err = fmt.Errorf("invalid signature %q", hdr.Signature)
-		return
-	}
-
-	size = int64(hdr.Size)
-	switch hdr.Version {
-	case 1:
-		// no op
-
-	case 2:
-		size *= 16
-
-	default:
-		err = fmt.Errorf("unknown version %x")
+		err = formatError(ErrNotBitLocker, "invalid signature %q", hdr.Signature)
 		return
 	}
 
-	if size < 64 {
-		err = fmt.Errorf("size too small")
+	if size, err = metadataBlockSize(hdr.Version, hdr.Size); err != nil {
 		return
 	}
 
-	// rewind and read struct in full
-	r.Seek(int64(-binary.Size(hdr)), 1)
-
-	buf := make([]byte, size)
-	_, err = io.ReadFull(r, buf)
+	// read struct in full
+	buf = make([]byte, size)
+	err = readFullAt(r, buf, off)
 	if err != nil {
+		err = readError("metadata block", err)
 		return
 	}
 
 	var validation ValidationHeader
-	err = binary.Read(r, binary.LittleEndian, &validation)
+	err = binary.Read(io.NewSectionReader(r, off+size, int64(binary.Size(validation))),
+		binary.LittleEndian, &validation)
 	if err != nil {
-		err = fmt.Errorf("cannot read validation header: %+v", err)
+		err = readError("validation header", err)
 		return
 	}
 
 	// verify CRC
 	checksum := crc32.ChecksumIEEE(buf)
 	if checksum != validation.Crc32 {
-		err = fmt.Errorf("validation checksum mismatch: stored %08x, computed %08x",
+		err = formatError(ErrBadChecksum, "validation checksum mismatch: stored %08x, computed %08x",
 			validation.Crc32, checksum)
 		return
 	}
 
+	if validation.Size < uint16(binary.Size(validation)) || size+int64(validation.Size) > maxMetadataSize {
+		err = &ValidationError{"validation header", "Size", uint64(validation.Size), "is out of range"}
+		return
+	}
+
+	// the validation structure is part of the block as far as wiping
+	// is concerned
 	size += int64(validation.Size)
 
 	// parse whatever we read & verified
 	r2 := bytes.NewReader(buf)
-	err = binary.Read(r2, binary.LittleEndian, s)
+	if err = binary.Read(r2, binary.LittleEndian, s); err != nil {
+		return
+	}
+	err = s.validate(size)
 	return
 }
 
+// metadataBlockSize returns the number of bytes of a metadata block that
+// are covered by its validation checksum, from the size in its header.
+// Version 1 records it in bytes, version 2 in units of 16 bytes. The
+// validation structure follows those bytes.
+func metadataBlockSize(version, size uint16) (int64, error) {
+	n := int64(size)
+	switch version {
+	case 1:
+	case 2:
+		n *= 16
+	default:
+		return -1, formatError(ErrUnsupportedVersion, "unknown version %x", version)
+	}
+
+	// the block has to hold at least the InfoStruct and leave room for
+	// the validation structure
+	if n < int64(binary.Size(InfoStruct{})) {
+		return n, formatError(ErrTruncated, "size too small")
+	}
+	if n > maxMetadataSize-int64(binary.Size(ValidationHeader{})) {
+		return n, &ValidationError{"metadata block", "Size", uint64(n), "exceeds the metadata area"}
+	}
+	return n, nil
+}
+
+// metadataExtent returns how much to overwrite, from the start of a
+// metadata block, to destroy the size bytes of the block and its
+// validation structure: the sectors they occupy. Metadata blocks start on
+// a sector boundary, so the rounding only takes in the rest of the last
+// sector, never the data after it. A 1104-byte block is 1536 bytes on
+// volumes with 512-byte sectors (including 512e drives, whose logical
+// sectors are 512 bytes) and 4096 on 4Kn drives. It fails if that would go
+// past the space reserved for the block.
+func metadataExtent(size, sectorSize int64) (int64, error) {
+	if size <= 0 || sectorSize <= 0 {
+		return -1, fmt.Errorf("invalid metadata size %d with %d-byte sectors", size, sectorSize)
+	}
+	n := roundUp(size, sectorSize)
+	if n > maxMetadataSize {
+		return n, &ValidationError{"metadata block", "Size", uint64(size),
+			fmt.Sprintf("exceeds the metadata area once rounded to %d-byte sectors", sectorSize)}
+	}
+	return n, nil
+}
+
+// validate checks that the offsets of an InfoStruct, whose block is size
+// bytes, can be used as erase regions.
+func (s *InfoStruct) validate(size int64) error {
+	if s.VolumeSize > math.MaxInt64 {
+		return &ValidationError{"metadata block", "VolumeSize", s.VolumeSize, "is too large"}
+	}
+	if s.HeaderSectorsOffset > math.MaxInt64 {
+		return &ValidationError{"metadata block", "HeaderSectorsOffset", s.HeaderSectorsOffset, "is too large"}
+	}
+	return validateInfoOffsets("metadata block", s.InfoOffsets, size)
+}
+
+// validateInfoOffsets checks that the metadata offsets are positive and
+// that blocks of size bytes at them do not overlap.
+func validateInfoOffsets(structName string, offsets [3]uint64, size int64) error {
+	for i, off := range offsets {
+		field := fmt.Sprintf("InfoOffsets[%d]", i)
+		if off == 0 {
+			return &ValidationError{structName, field, off, "points at the volume header"}
+		}
+		if off > math.MaxInt64-maxMetadataSize {
+			return &ValidationError{structName, field, off, "is too large"}
+		}
+		for j := 0; j < i; j++ {
+			other := offsets[j]
+			if off < other+uint64(size) && other < off+uint64(size) {
+				return &ValidationError{structName, field, off,
+					fmt.Sprintf("overlaps metadata block %d at 0x%x", j, other)}
+			}
+		}
+	}
+	return nil
+}
+
+// readHeader reads and validates the volume header at offset.
+func readHeader(r io.ReaderAt, offset int64) (*VolumeHeader, error) {
+	hdr := &VolumeHeader{}
+	err := binary.Read(io.NewSectionReader(r, offset, int64(binary.Size(hdr))), binary.LittleEndian, hdr)
+	if err != nil {
+		return nil, readError("header", err)
+	}
+
+	// validate headers
+	if !VerifySignature(hdr.Signature) {
+		if d := diagnose(r, offset); d != "" {
+			return nil, formatError(ErrNotBitLocker, "invalid volume header signature %q: %s", hdr.Signature, d)
+		}
+		return nil, formatError(ErrNotBitLocker, "invalid volume header signature %q", hdr.Signature)
+	}
+
+	if hdr.Guid.String() != INFO_GUID {
+		return nil, formatError(ErrUnsupportedVersion, "unsupported GUID %v", hdr.Guid)
+	}
+
+	// the sector size may be overridden, so allow for the largest one
+	if hdr.NumSectors > math.MaxInt64/4096 {
+		return nil, &ValidationError{"volume header", "NumSectors", hdr.NumSectors, "is too large"}
+	}
+	if err := validateInfoOffsets("volume header", hdr.InfoOffsets, 1); err != nil {
+		return nil, err
+	}
+
+	return hdr, nil
+}
+
 func VerifySignature(b [8]byte) bool { return string(b[:]) == "-FVE-FS-" }
 
+// validSectorSize reports whether n is a plausible logical sector size.
+func validSectorSize(n int64) bool {
+	return n >= 512 && n <= 4096 && n&(n-1) == 0
+}
+
+// humanSize formats n bytes with a binary suffix, e.g. "64 KiB".
+func humanSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 && n > -1024 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	f, i := float64(n)/1024, 0
+	for ; (f >= 1024 || f <= -1024) && i < len(units)-1; i++ {
+		f /= 1024
+	}
+	s := fmt.Sprintf("%.1f", f)
+	s = strings.TrimSuffix(s, ".0")
+	return fmt.Sprintf("%s %ciB", s, units[i])
+}
+
+// sizeString formats n bytes as the exact number followed by its
+// human-readable form, unless it is small enough to read at a glance.
+func sizeString(n int64) string {
+	if n < 1024 && n > -1024 {
+		return fmt.Sprint(n)
+	}
+	return fmt.Sprintf("%d (%s)", n, humanSize(n))
+}
+
+// roundUp rounds n up to a multiple of align.
+func roundUp(n, align int64) int64 {
+	return (n + align - 1) / align * align
+}
+
+// alignRegion widens r so that it starts and ends on sector boundaries,
+// which is the granularity devices can actually be written at.
+func alignRegion(r RegionDesc, sectorSize int64) RegionDesc {
+	start := r.Offset / sectorSize * sectorSize
+	end := roundUp(r.Offset+r.Size, sectorSize)
+	return RegionDesc{r.Name, start, end - start}
+}
+
+// outOfBounds reports whether the n bytes at off do not fit within avail
+// bytes. A negative avail means the size is unknown.
+func outOfBounds(off, n, avail int64) bool {
+	return avail >= 0 && (off < 0 || n < 0 || off > avail || n > avail-off)
+}
+
+// maxMetadataSize is the space reserved for each metadata block, which
+// the block and its validation structure must fit in.
+const maxMetadataSize = 64 << 10
+
 const INFO_GUID string = "4967D63B-2E29-4AD8-8399-F6A339E3D001"
 
 func fatal(format string, a ...interface{}) {
@@ -154,92 +335,749 @@ func fatal(format string, a ...interface{}) {
 		format += "\n"
 	}
 	fmt.Fprintf(os.Stderr, format, a...)
+	if activeReport != nil {
+		activeReport.Finish(fmt.Errorf(strings.TrimSuffix(format, "\n"), a...))
+	}
+	removeUnsavedBackups()
 	os.Exit(1)
 }
 
+type command struct {
+	name string
+	desc string
+	run  func(args []string)
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"list", "list the block devices and the encrypted volumes on them", cmdList},
+		{"interactive", "choose volumes to wipe from a menu", cmdInteractive},
+		{"watch", "report or wipe volumes on drives as they are attached", cmdWatch},
+		{"daemon", "accept JSON-RPC requests to list devices and run wipes", cmdDaemon},
+		{"remote", "run blwipe on another machine over ssh", cmdRemote},
+		{"probe", "print the type and UUID of volumes like blkid", cmdProbe},
+		{"info", "show details about a BitLocker volume", cmdInfo},
+		{"explain", "hexdump the metadata structures with each field annotated", cmdExplain},
+		{"wipe", "wipe the key material of a BitLocker volume", cmdWipe},
+		{"approve", "approve a wipe as one of the operators required by -approvers", cmdApprove},
+		{"undo", "restore the regions saved by wipe -journal", cmdUndo},
+		{"wipefs", "list or erase signatures, like wipefs from util-linux", cmdWipefs},
+		{"verify", "check that none of the data saved by wipe -backup remains", cmdVerify},
+		{"compare", "check that a wipe done elsewhere left no valid structures", cmdCompare},
+		{"repair", "rebuild corrupt metadata blocks from a valid copy", cmdRepair},
+		{"remove-protector", "remove a key protector from the metadata", cmdRemoveProtector},
+		{"reprotect", "resume protection by removing the clear key", cmdReprotect},
+		{"bench", "measure how fast a drive can be overwritten", cmdBench},
+		{"sanitize", "crypto-erase a drive using the best methods available", cmdSanitize},
+		{"scan", "search a disk for BitLocker metadata, including orphaned copies", cmdScan},
+		{"find-keys", "find and shred saved copies of the volume's keys", cmdFindKeys},
+		{"loop", "attach a raw image to a loop device for other tools to use", cmdLoop},
+		{"mkimage", "create a BitLocker volume image for testing", cmdMkimage},
+	}
+}
+
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: blwipe [flags] <bitlocker-vol.img>\n\n")
-	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "usage: blwipe <command> [flags] <bitlocker-vol.img>\n\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-17s %s\n", c.name, c.desc)
+	}
+	fmt.Fprintf(os.Stderr, "\nuse \"blwipe <command> -h\" for the flags of each command.\n")
+}
+
+// newFlagSet creates the flag set for a command taking the given arguments.
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.BoolVar(&noColor, "no-color", false, "do not color the output, even on a terminal")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: blwipe %s [flags] %s\n\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// openTarget opens the image named on the command line, where "-" reads
+// an image from stdin.
+func openTarget(path string, writable bool) (Image, error) {
+	if path == "-" {
+		if writable {
+			return nil, errors.New("images read from stdin cannot be written to")
+		}
+		return newPipeImage(os.Stdin), nil
+	}
+	if isISCSI(path) {
+		return openISCSI(path, writable)
+	}
+	return openImage(path, writable)
+}
+
+// refuseInUse stops, unless force is set, if anything is using the device
+// img was opened from.
+func refuseInUse(path string, img Image, force bool) {
+	f, ok := deviceFile(img)
+	if !ok {
+		return
+	}
+	users, err := deviceUsers(f)
+	if err != nil {
+		fmt.Printf("can't tell whether %s is in use: %v\n", path, err)
+		return
+	}
+	if len(users) == 0 {
+		return
+	}
+	for _, u := range users {
+		fmt.Printf("%s\n", warning(u))
+	}
+	if !force {
+		fatal("refusing to write to %s while it is in use, use -force to override", path)
+	}
+	fmt.Printf("writing to it anyway, as -force was given\n")
 }
 
+func cmdInfo(args []string) { runVolume("info", args, false) }
+func cmdWipe(args []string) { runVolume("wipe", args, true) }
+
 func main() {
-	offset := flag.Int64("offset", 0, "offset into volume")
-	verbose := flag.Bool("v", false, "show more information")
-	doWipe := flag.Bool("wipe", false, "wipes cleartext data")
-	flag.Usage = usage
-	flag.Parse()
-
-	if flag.NArg() != 1 {
-		flag.Usage()
+	if len(os.Args) > 1 {
+		for _, c := range commands {
+			if os.Args[1] == c.name {
+				c.run(os.Args[2:])
+				return
+			}
+		}
+	}
+
+	if len(os.Args) < 2 || os.Args[1] == "help" {
+		usage()
 		os.Exit(2)
 	}
 
+	// no command given, accept the original flags for compatibility
+	runVolume("", os.Args[1:], false)
+}
+
+func runVolume(name string, args []string, wipe bool) {
+	fs := newFlagSet(name, "<bitlocker-vol.img>")
+	offset := fs.Int64("offset", 0, "offset into volume")
+	var sel partitionSelector
+	fs.IntVar(&sel.index, "partition", 0, "use partition N of a whole disk instead of -offset")
+	fs.StringVar(&sel.guid, "part-guid", "", "use the partition with this unique GUID")
+	fs.StringVar(&sel.typeGuid, "part-type", "", "use the partition with this type GUID (or MBR type)")
+	verbosityFlags := addVerbosityFlags(fs)
+	sectorOverride := fs.Int("sector-size", 0, "override the sector size from the volume header")
+	addSectorFlags(fs)
+	addMemoryFlag(fs)
+	addPrivilegeFlag(fs)
+	force := fs.Bool("force", false, "wipe even if the device is in use, the image appears to be truncated or the metadata offsets disagree")
+	showProtectors := fs.Bool("protectors", false, "list the key protectors of the volume")
+	escrowURL := fs.String("escrow", "", "check recovery key escrow at this ldap(s):// or http(s):// URL")
+	escrowUser := fs.String("escrow-user", "", "user to authenticate to the escrow service as")
+	requireEscrow := fs.Bool("require-escrow", false, "refuse to wipe unless all recovery passwords are escrowed")
+	format := fs.String("format", "", "volume format, detected if not given: "+formatNames())
+	regionsFile := fs.String("regions-file", "", "wipe exactly the regions listed in this file instead")
+	entropySamples := fs.Int("entropy", 0, "sample this many blocks of the data area to check they look encrypted")
+	exportPath := fs.String("export", "", "save the metadata to this sparse image for dislocker or libbde (before wiping)")
+	progressFd := progressFlag(fs)
+	outputFormat := fs.String("output", "text", "print the result as text, json or proto (messages in blwipe.proto)")
+	jsonOut, jsonSchema := new(bool), new(bool)
+	if !wipe {
+		jsonOut = fs.Bool("json", false, "print the details as a JSON document instead")
+		jsonSchema = fs.Bool("json-schema", false, "print the JSON schema of the -json document")
+	}
+	var reportPath, seed *string
+	all := new(bool)
+	skipHeader, includeEOW, clearPartition := new(bool), new(bool), new(bool)
+	wipeTable, writeMarker, punch := new(bool), new(bool), new(bool)
+	output, after := new(string), new(string)
+	onlyMetadata := new(string)
+	var rec *recordInfo
+	var auditCfg *auditConfig
+	var hooks *hookFlags
+	var approvals *approvalFlags
+	policyPath := new(string)
+	if wipe {
+		reportPath = fs.String("report", "", "write a JSON report of the wipe to this file")
+		seed = seedFlag(fs)
+		addRNGFlag(fs)
+		fs.StringVar(&backupPath, "backup", "", "save the regions to this file before overwriting them, for verify -backup")
+		fs.StringVar(&journalPath, "journal", "", "save the regions to this passphrase-encrypted file before overwriting them, for undo")
+		addDurabilityFlags(fs)
+		after = afterFlag(fs)
+		output = fs.String("o", "", "leave the target as it is and wipe a copy written to this file")
+		all = fs.Bool("all", false, "wipe every BitLocker volume found on the disk")
+		skipHeader = fs.Bool("skip-header", false, "leave the volume header as it is")
+		onlyMetadata = fs.String("only-metadata", "", "wipe only these metadata blocks, e.g. 0,2")
+		fs.Int64Var(&wipeMargin, "margin", 0, "also overwrite this many sectors on both sides of each region")
+		includeEOW = fs.Bool("include-eow", false, "also wipe the encrypt-on-write information")
+		clearPartition = fs.Bool("clear-partition", false, "remove the partition of the volume from the partition table")
+		wipeTable = fs.Bool("wipe-partition-table", false, "zero the MBR and both copies of the GPT afterwards")
+		punch = fs.Bool("punch-holes", false, "deallocate the volume afterwards if the target is an image file")
+		writeMarker = fs.Bool("tombstone", false, "write a sector of text at the start of the volume saying it was erased")
+		rec = recordFlags(fs, true)
+		auditCfg = auditFlags(fs)
+		hooks = addHookFlags(fs)
+		approvals = addApprovalFlags(fs)
+		policyPath = fs.String("policy", "", "enforce the conditions in this JSON policy file before writing")
+	}
+	doWipe := &wipe
+	if name == "" {
+		doWipe = fs.Bool("wipe", false, "wipes cleartext data")
+		fs.Usage = func() {
+			fmt.Fprintf(os.Stderr, "usage: blwipe [flags] <bitlocker-vol.img>\n\n")
+			fs.PrintDefaults()
+		}
+	}
+	parseFlags(fs, args)
+
+	if *jsonSchema {
+		fmt.Print(infoSchema)
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	verbosityFlags.apply()
+	openProgress(*progressFd)
+	if err := checkRawSectorSize(); err != nil {
+		fatal("%v", err)
+	}
+	if err := checkMaxMemory(); err != nil {
+		fatal("%v", err)
+	}
+
+	if *jsonOut {
+		*outputFormat = "json"
+	}
+	switch *outputFormat {
+	case "text", "json", "proto":
+	default:
+		fatal("-output must be text, json or proto")
+	}
+
+	// the document (or the report, for wipe) replaces the usual output
+	docOut := io.Writer(os.Stdout)
+	if *outputFormat != "text" {
+		if (!wipe && *doWipe) || *regionsFile != "" {
+			fatal("-output %s cannot be combined with -wipe or -regions-file", *outputFormat)
+		}
+		null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			fatal("%v", err)
+		}
+		if resultOut != nil {
+			docOut = resultOut
+		}
+		resultOut, os.Stdout = null, null
+	}
+
 	if *offset < 0 {
 		fatal("offset cannot be negative")
 	}
+	if sel.index < 0 {
+		fatal("partition numbers start at 1")
+	}
+	for _, g := range []*string{&sel.guid, &sel.typeGuid} {
+		if *g != "" {
+			var err error
+			if *g, err = normalizeGuid(*g); err != nil {
+				fatal("%v", err)
+			}
+		}
+	}
+	if sel.enabled() && *offset != 0 {
+		fatal("-offset cannot be combined with -partition, -part-guid or -part-type")
+	}
 
-	f, err := os.OpenFile(flag.Arg(0), os.O_RDWR, 0644)
-	if err != nil {
-		fatal("can't open file: %s", err)
+	if dropPrivs && (durability.flushCache || *after != "") {
+		fatal("-drop-privileges cannot be combined with -flush-cache or -after, which need them")
+	}
+	if *requireEscrow && *escrowURL == "" {
+		fatal("-require-escrow needs an escrow service given with -escrow")
+	}
+
+	if *writeMarker && (*skipHeader || *regionsFile != "") {
+		fatal("-tombstone cannot be combined with -skip-header or -regions-file")
+	}
+
+	checkAfter(*after)
+	if seed != nil {
+		useRNG(*seed)
+	}
+
+	var policy *wipePolicy
+	if *policyPath != "" {
+		var err error
+		if policy, err = loadPolicy(*policyPath); err != nil {
+			fatal("%v", err)
+		}
+		enforcePolicy(policy.checkRun(rec, *reportPath))
+	}
+
+	if backupPath != "" && *all {
+		fatal("-backup cannot be combined with -all")
+	}
+	if journalPath != "" {
+		if *all {
+			fatal("-journal cannot be combined with -all")
+		}
+		journalPassphrase()
+	}
+	// what is wiped, and so what an undo journal applies to
+	backupTarget = fs.Arg(0)
+	if *output != "" {
+		backupTarget = *output
+	}
+
+	if *clearPartition && *offset == 0 && !sel.enabled() && !*all {
+		fatal("-clear-partition needs the whole disk, with the volume given by -offset or -partition")
+	}
+
+	if *all && (*offset != 0 || sel.enabled() || *exportPath != "" || *regionsFile != "" || (*format != "" && *format != "bitlocker")) {
+		fatal("-all cannot be combined with -offset, -partition, -export, -regions-file or -format")
+	}
+
+	if wipeMargin < 0 || wipeMargin > maxWipeMargin {
+		fatal("-margin must be from 0 to %d sectors", maxWipeMargin)
+	}
+
+	metadataBlocks := []int{0, 1, 2}
+	if *onlyMetadata != "" {
+		metadataBlocks = nil
+		for _, s := range strings.Split(*onlyMetadata, ",") {
+			i, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || i < 0 || i > 2 {
+				fatal("invalid metadata block %q, must be 0, 1 or 2", s)
+			}
+			metadataBlocks = append(metadataBlocks, i)
+		}
+	}
+
+	// only ask for write access when we are going to wipe
+	var f Image
+	if *output != "" {
+		f = copyToImage(fs.Arg(0), *output)
+	} else {
+		var err error
+		if f, err = openTarget(fs.Arg(0), *doWipe); err != nil {
+			fatal("can't open file: %s", err)
+		}
 	}
 	defer f.Close()
 
-	f.Seek(*offset, 0)
-	hdr := VolumeHeader{}
-	err = binary.Read(f, binary.LittleEndian, &hdr)
+	if *doWipe && isReadOnly(f) {
+		fatal("%s is a read-only evidence container", fs.Arg(0))
+	}
+	if v, ok := f.(*virtualDisk); ok {
+		if d, ok := v.disk.(*interleavedDisk); ok {
+			fmt.Printf("%d-byte sectors, using the %d bytes of data in each\n", d.sector, dataSectorSize)
+		}
+	}
+
+	if auditCfg != nil && auditCfg.enabled() {
+		auditCfg.open()
+	}
+	var rep *Report
+	if reportPath != nil && (*reportPath != "" || auditCfg.enabled() || hooks.enabled() || *outputFormat != "text") {
+		rep = newReport("wipe", fs.Arg(0), *reportPath, *rec)
+		rep.postHook = hooks.post
+		rep.Stats = &stats
+		rep.RNG = rngName
+		if *outputFormat != "text" {
+			rep.out, rep.outFormat = docOut, *outputFormat
+		}
+		defer rep.Finish(nil)
+	}
+	if *doWipe {
+		createBackupFiles()
+		defer removeUnsavedBackups()
+	}
+
+	// every file that is written to is open by now
+	giveUpPrivileges()
+	if rep != nil {
+		hooks.runPreHook(rep)
+		if *output != "" {
+			rep.Done(rep.Step("copy", "run", "the target is left as it is, a copy is wiped"), "written to "+*output)
+		}
+	}
+	if *output == "" {
+		explainMapper(fs.Arg(0), f, *doWipe, *force)
+	}
+	if *doWipe && *output == "" {
+		refuseInUse(fs.Arg(0), f, *force)
+	}
+	if approvals.enabled() {
+		approvals.authorizeWipe(fs.Arg(0))
+	}
+
+	size, err := imageSize(f)
 	if err != nil {
-		fatal("can't read header: %s", err)
+		fatal("can't determine size of %s: %v", fs.Arg(0), err)
 	}
+	backupSize = size
 
-	// validate headers
-	if !VerifySignature(hdr.Signature) {
-		fatal("invalid volume header signature %q", hdr.Signature)
+	var part partition
+	if sel.enabled() {
+		if part, err = selectPartition(f, sel); err != nil {
+			fatal("can't select partition: %v", err)
+		}
+		*offset = part.Offset
+		fmt.Printf("using partition %d at offset 0x%x size %s\n", part.Index, part.Offset, sizeString(part.Size))
+	} else if *offset == 0 && !*all && *regionsFile == "" && size >= 0 {
+		// the whole disk may have been given instead of the volume
+		if st, err := imageStorage(f); err == nil {
+			var ok bool
+			if part, ok = findPartitionedVolume(st, *format); ok {
+				*offset = part.Offset
+				fmt.Printf("partitioned disk, using partition %d at offset 0x%x size %s\n",
+					part.Index, part.Offset, sizeString(part.Size))
+			}
+		}
 	}
 
-	if hdr.SectorSize < 512 {
-		fatal("weird sector size: %d", hdr.SectorSize)
+	// space available to the volume, unknown for pipes
+	avail := int64(-1)
+	if size >= 0 {
+		if *offset >= size {
+			fatal("offset 0x%x is beyond the end of the image (size 0x%x)", *offset, size)
+		}
+		avail = size - *offset
+	}
+	if part.Size > 0 && (avail < 0 || part.Size < avail) {
+		avail = part.Size
+	}
+	if size >= 0 && *offset != 0 {
+		warnHybridMBR(f, *offset)
 	}
 
-	if hdr.Guid.String() != INFO_GUID {
-		fatal("unsupported GUID %v", hdr.Guid)
+	if *regionsFile != "" {
+		regions, err := readRegionsFile(*regionsFile)
+		if err != nil {
+			fatal("%v", err)
+		}
+
+		sectorSize := int64(512)
+		if *sectorOverride != 0 {
+			if !validSectorSize(int64(*sectorOverride)) {
+				fatal("invalid sector size override: %d", *sectorOverride)
+			}
+			sectorSize = int64(*sectorOverride)
+		}
+		for _, r := range regions {
+			fmt.Printf("%s at offset 0x%x size %s\n", r.Name, r.Offset, sizeString(r.Size))
+		}
+		if *doWipe {
+			n := wipeRegions(f, *offset, avail, sectorSize, regions)
+			result("%d of %d regions overwritten", n, len(regions))
+			printStats()
+		}
+		return
+	}
+
+	opts := &volumeOptions{
+		sectorOverride: *sectorOverride,
+		force:          *force,
+		showProtectors: *showProtectors,
+		escrowURL:      *escrowURL,
+		escrowUser:     *escrowUser,
+		requireEscrow:  *requireEscrow,
+		format:         *format,
+		entropySamples: *entropySamples,
+		exportPath:     *exportPath,
+		wipe:           *doWipe,
+		skipHeader:     *skipHeader,
+		metadataBlocks: metadataBlocks,
+		includeEOW:     *includeEOW,
+		tombstone:      *writeMarker,
+		punchHoles:     *punch,
+		policy:         policy,
+	}
+	if *all {
+		wipeAllVolumes(f, opts, size, *clearPartition)
+	} else {
+		if !wipe && *outputFormat != "text" {
+			infoJSON = newInfoDocument(fs.Arg(0), *offset)
+		}
+		runOneVolume(f, opts, *offset, avail)
+		if infoJSON != nil {
+			infoJSON.write(docOut, *outputFormat)
+		}
+		if *clearPartition {
+			clearVolumePartition(f, *offset)
+		}
+	}
+	if *wipeTable {
+		zeroPartitionTable(f, size)
+	}
+	if *doWipe && durability.flushCache {
+		flushImage(f)
+	}
+	if *doWipe {
+		printStats()
+		runAfter(f, *after)
+	}
+}
+
+// zeroPartitionTable overwrites the partition table of the disk with
+// zeros, so that it comes back blank.
+func zeroPartitionTable(f Image, size int64) {
+	regions, err := partitionTableRegions(f, size)
+	if err != nil {
+		fmt.Printf("not zeroing the partition table: %v\n", err)
+		return
+	}
+	for _, r := range regions {
+		if outOfBounds(r.Offset, r.Size, size) {
+			fmt.Printf("%s at offset 0x%x lies beyond the end of the disk\n", r.Name, r.Offset)
+			continue
+		}
+		fmt.Printf("%s %s at offset 0x%x size %s...\n", warning("zeroing"), r.Name, r.Offset, sizeString(r.Size))
+		var step *reportStep
+		if activeReport != nil {
+			step = activeReport.Step("zero "+r.Name, "run", fmt.Sprintf("offset 0x%x size %d", r.Offset, r.Size))
+		}
+		if _, err := f.WriteAt(make([]byte, r.Size), r.Offset); err != nil {
+			if step != nil {
+				activeReport.Done(step, "failed: "+err.Error())
+			}
+			fatal("unable to zero %s: %v", r.Name, err)
+		}
+		if step != nil {
+			activeReport.Done(step, "done")
+		}
+	}
+}
+
+// clearVolumePartition removes the partition that the wiped volume at
+// offset was on from the partition table.
+func clearVolumePartition(f Image, offset int64) {
+	var step *reportStep
+	if activeReport != nil {
+		step = activeReport.Step("clear partition entry", "run", fmt.Sprintf("partition at offset 0x%x", offset))
+	}
+	desc, err := clearPartitionEntry(f, offset)
+	if err != nil {
+		if step != nil {
+			activeReport.Done(step, "failed: "+err.Error())
+		}
+		fatal("can't clear the partition entry: %v", err)
+	}
+	if step != nil {
+		activeReport.Done(step, "done")
+	}
+	fmt.Printf("%s %s\n", warning("cleared"), desc)
+}
+
+// wipeAllVolumes wipes every BitLocker volume on a disk of the given size,
+// which is either the disk itself or its partitions, optionally clearing
+// the partition entries of those that are partitions.
+func wipeAllVolumes(f Image, o *volumeOptions, size int64, clearPartition bool) {
+	st, err := imageStorage(f)
+	if err != nil {
+		fatal("-all: %v", err)
+	}
+
+	var offsets []int64
+	for _, v := range findVolumes(st) {
+		if v.Format != "bitlocker" {
+			fmt.Printf("skipping %s volume at offset 0x%x\n", v.Format, v.Offset)
+			continue
+		}
+		offsets = append(offsets, v.Offset)
+	}
+	if len(offsets) == 0 {
+		fatal("no BitLocker volumes found")
+	}
+
+	o.format = "bitlocker"
+	for i, off := range offsets {
+		fmt.Printf("\n%s\n", highlight(fmt.Sprintf("BitLocker volume %d of %d at offset 0x%x",
+			i+1, len(offsets), off)))
+		if activeReport != nil {
+			activeReport.BeginVolume(off)
+		}
+		warnHybridMBR(f, off)
+		runOneVolume(f, o, off, size-off)
+		if clearPartition && off != 0 {
+			clearVolumePartition(f, off)
+		}
+		if activeReport != nil {
+			activeReport.EndVolume("success")
+		}
+	}
+	result("%d BitLocker volume(s) wiped", len(offsets))
+}
+
+// warnHybridMBR warns when a hybrid MBR disagrees with the GPT about the
+// partition of the volume at offset, since tools that only read the MBR
+// will see it somewhere else.
+func warnHybridMBR(r io.ReaderAt, offset int64) {
+	for _, m := range hybridMismatches(r, offset) {
+		fmt.Printf("%s %s\n", warning("hybrid MBR disagrees with GPT:"), m)
+	}
+}
+
+// volumeOptions are the flags of info and wipe that apply to each volume.
+type volumeOptions struct {
+	sectorOverride int
+	force          bool
+	showProtectors bool
+	escrowURL      string
+	escrowUser     string
+	requireEscrow  bool
+	format         string
+	entropySamples int
+	exportPath     string
+	wipe           bool
+
+	// what to wipe of a BitLocker volume
+	skipHeader     bool
+	metadataBlocks []int
+	includeEOW     bool
+	punchHoles     bool
+	tombstone      bool
+	policy         *wipePolicy
+}
+
+// runOneVolume shows, and wipes if o.wipe is set, the volume at offset,
+// of which avail bytes are present (-1 if unknown).
+func runOneVolume(f Image, o *volumeOptions, offset, avail int64) {
+	// other formats need random access, so pipes can only be BitLocker
+	if st, err := imageStorage(f); err != nil && o.format != "" && o.format != "bitlocker" {
+		fatal("-format %s: %v", o.format, err)
+	} else if err == nil {
+		vf, err := findFormat(st, offset, o.format)
+		if err != nil {
+			fatal("%v", err)
+		}
+		if vf != nil {
+			if o.escrowURL != "" || o.showProtectors || o.entropySamples > 0 || o.exportPath != "" {
+				fatal("-escrow, -protectors, -entropy and -export are only supported for BitLocker")
+			}
+
+			sectorSize := int64(512)
+			if o.sectorOverride != 0 {
+				if !validSectorSize(int64(o.sectorOverride)) {
+					fatal("invalid sector size override: %d", o.sectorOverride)
+				}
+				sectorSize = int64(o.sectorOverride)
+			}
+			runFormat(f, vf, offset, avail, sectorSize, o)
+			return
+		}
+	}
+
+	hdr, err := readHeader(f, offset)
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	sectorSize := int64(hdr.SectorSize)
+	if o.sectorOverride != 0 {
+		if !validSectorSize(int64(o.sectorOverride)) {
+			fatal("invalid sector size override: %d", o.sectorOverride)
+		}
+		if sectorSize != int64(o.sectorOverride) {
+			fmt.Printf("using sector size %d instead of %d from volume header\n",
+				o.sectorOverride, sectorSize)
+		}
+		sectorSize = int64(o.sectorOverride)
+	} else if !validSectorSize(sectorSize) {
+		fatal("weird sector size: %d", hdr.SectorSize)
 	}
 
 	for i := 0; i < len(hdr.InfoOffsets); i++ {
 		fmt.Printf("metadata offset %d: 0x%08x\n", i, hdr.InfoOffsets[i])
 	}
 
-	if *verbose {
-		fmt.Printf("volume header:\n%+v\n", &hdr)
+	if verbosity >= levelVerbose {
+		printHeaderFields(hdr, avail)
 	}
 
 	var validInfoSize int64
 	var validInfoOffsets [3]int64
+	var headerSectors RegionDesc
+	var offsetsMismatch bool
+	var volumeSize int64
+	var copies [3][]byte
 
-	// check info structs
-	info := InfoStruct{}
+	// check info structs, read all at once and then gone through in order
+	reads := readMetadataCopies(f, offset, hdr.InfoOffsets, sectorSize, avail)
+	defer func() {
+		for _, c := range reads {
+			if c != nil {
+				zeroize(c.raw)
+			}
+		}
+	}()
 	for i := 0; i < len(hdr.InfoOffsets); i++ {
-		f.Seek(*offset+int64(hdr.InfoOffsets[i]), 0)
+		block := infoMetadataBlock{Index: i, Offset: int64(hdr.InfoOffsets[i])}
+		if outOfBounds(int64(hdr.InfoOffsets[i]), sectorSize, avail) {
+			fmt.Printf("metadata block %d at 0x%x lies beyond the end of the image\n",
+				i, hdr.InfoOffsets[i])
+			block.Error = "lies beyond the end of the image"
+			infoJSON.addBlock(block)
+			continue
+		}
 
-		infoSize, err := info.Read(f)
+		info := &reads[i].info
+		raw, infoSize, err := reads[i].raw, reads[i].size, reads[i].err
 		if err != nil {
 			fmt.Printf("can't parse metadata block %d: %+v\n", i, err)
+			block.Error = err.Error()
+			infoJSON.addBlock(block)
 			continue
 		}
+		copies[i] = raw
 
-		// record valid data here
-		validInfoSize = infoSize
+		if n, err := metadataExtent(infoSize, sectorSize); err != nil {
+			fmt.Printf("metadata block %d: %v, only its %d bytes are wiped\n", i, err, infoSize)
+		} else {
+			infoSize = n
+		}
+
+		block.Size, block.Valid, block.Version = infoSize, true, int(info.Version)
+		infoJSON.addBlock(block)
+
+		// record valid data here, the largest of the sizes so that no
+		// copy is left partly intact
+		if infoSize > validInfoSize {
+			validInfoSize = infoSize
+		}
+		volumeSize = int64(info.VolumeSize)
+		headerSectors = RegionDesc{"relocated boot sectors", int64(info.HeaderSectorsOffset),
+			int64(info.HeaderSectors) * sectorSize}
 		for idx, off := range info.InfoOffsets {
 			validInfoOffsets[idx] = int64(off)
 		}
 
-		// round up to sector size
-		infoSize = (infoSize + int64(hdr.SectorSize) - 1) & ^(int64(hdr.SectorSize) - 1)
-
 		fmt.Printf("metadata block %d (size %d):", i, infoSize)
-		if *verbose {
-			fmt.Printf("\n%+v\n", &info)
-		} else {
-			fmt.Printf(" parsed OK\n")
+		switch {
+		case verbosity >= levelDebug:
+			fmt.Printf("\n")
+			explainMetadata(os.Stdout, f, offset+int64(hdr.InfoOffsets[i]))
+		case verbosity >= levelVerbose:
+			fmt.Printf("\n%+v\n", info)
+		default:
+			fmt.Printf(" %s\n", success("parsed OK"))
+		}
+
+		if outOfBounds(int64(info.HeaderSectorsOffset),
+			int64(info.HeaderSectors)*sectorSize, avail) {
+			fmt.Printf("metadata block %d: header sectors at 0x%x extend beyond the end of the image\n",
+				i, info.HeaderSectorsOffset)
+		}
+
+		if info.InfoOffsets != hdr.InfoOffsets {
+			offsetsMismatch = true
+			fmt.Printf("%s metadata block %d records the metadata offsets as 0x%x, 0x%x, 0x%x, "+
+				"but the volume header has 0x%x, 0x%x, 0x%x\n", warning("warning:"), i,
+				info.InfoOffsets[0], info.InfoOffsets[1], info.InfoOffsets[2],
+				hdr.InfoOffsets[0], hdr.InfoOffsets[1], hdr.InfoOffsets[2])
 		}
 	}
 
@@ -247,31 +1085,487 @@ func main() {
 		fatal("invalid or no metadata blocks found!")
 	}
 
-	if *doWipe {
-		eraseRegions := []RegionDesc{
-			{"volume header", 0, int64(hdr.SectorSize)},
-			{"metadata block 0", validInfoOffsets[0], validInfoSize},
-			{"metadata block 1", validInfoOffsets[1], validInfoSize},
-			{"metadata block 2", validInfoOffsets[2], validInfoSize},
+	reportMetadataDiff(copies[:])
+
+	for _, raw := range copies {
+		if raw != nil {
+			gen, reasons := windowsGeneration(hdr, raw)
+			fmt.Printf("created by %s (%s)\n", gen, strings.Join(reasons, ", "))
+			if activeReport != nil {
+				activeReport.SetCreatedBy(gen)
+			}
+			break
 		}
+	}
 
-		for _, region := range eraseRegions {
-			eraseBuf := make([]byte, region.Size)
-			_, err = rand.Read(eraseBuf)
-			if err != nil {
-				fatal("unable to generate rand bytes: %v", err)
+	if o.showProtectors {
+		printProtectors(copies[:])
+	}
+
+	if !o.wipe && isSuspended(firstProtectors(copies[:])) {
+		fmt.Printf("protection is suspended (clear key present), use \"blwipe reprotect\" to resume it\n")
+	}
+
+	var escrowed, escrowChecked bool
+	if o.escrowURL != "" {
+		checker, err := newEscrowChecker(o.escrowURL, o.escrowUser)
+		if err != nil {
+			fatal("can't connect to escrow service: %v", err)
+		}
+		escrowed = checkEscrow(checker, firstProtectors(copies[:]))
+		escrowChecked = true
+		checker.Close()
+
+		if o.wipe && o.requireEscrow && !escrowed {
+			fatal("refusing to wipe, recovery key escrow could not be verified")
+		}
+	}
+
+	// a partial image may have metadata copies beyond what we can see
+	if hdrSize := int64(hdr.NumSectors) * sectorSize; hdrSize > volumeSize {
+		volumeSize = hdrSize
+	}
+	if offsetsMismatch {
+		fmt.Printf("the volume may have been moved or tampered with, or the header is stale\n")
+		if o.wipe && !o.force {
+			fatal("refusing to wipe, the metadata may not be where it is expected, use -force to override")
+		}
+	}
+	if avail >= 0 && volumeSize > avail {
+		fmt.Printf("image appears truncated: volume size is %d bytes (%s), but only %d bytes (%s) are present\n",
+			volumeSize, humanSize(volumeSize), avail, humanSize(avail))
+		if o.wipe && !o.force {
+			fatal("refusing to wipe a truncated image, use -force to override")
+		}
+	}
+
+	if o.entropySamples > 0 {
+		st, err := imageStorage(f)
+		if err != nil {
+			fatal("can't sample entropy: %v", err)
+		}
+
+		dataSize := volumeSize
+		if avail >= 0 && dataSize > avail {
+			dataSize = avail
+		}
+		skip := []RegionDesc{{"volume header", 0, sectorSize}}
+		for _, off := range validInfoOffsets {
+			skip = append(skip, RegionDesc{"metadata", off, 64 << 10})
+		}
+
+		samples, err := sampleEntropy(&subStorage{st, offset}, dataSize, skip, o.entropySamples)
+		if err != nil {
+			fmt.Printf("entropy: sampling stopped: %v\n", err)
+		}
+		reportEntropy(samples)
+	}
+
+	if o.exportPath != "" {
+		regions := []RegionDesc{{"volume header", 0, sectorSize}}
+		for i, off := range validInfoOffsets {
+			regions = append(regions, RegionDesc{fmt.Sprintf("metadata block %d", i), off, validInfoSize})
+		}
+		if headerSectors.Size > 0 {
+			regions = append(regions, headerSectors)
+		}
+		for i, off := range hdr.EOWOffsets {
+			if off != 0 {
+				regions = append(regions,
+					RegionDesc{fmt.Sprintf("encrypt-on-write information %d", i), int64(off), maxMetadataSize})
+			}
+		}
+		exportMetadata(f, offset, volumeSize, regions, o.exportPath)
+	}
+
+	if o.wipe && o.policy != nil {
+		valid := 0
+		for _, c := range copies {
+			if c != nil {
+				valid++
+			}
+		}
+		_, err := imageStorage(f)
+		enforcePolicy(o.policy.checkVolume(policyFacts{
+			escrowChecked: escrowChecked,
+			escrowed:      escrowed,
+			validCopies:   valid,
+			copies:        len(copies),
+			clearKey:      isSuspended(firstProtectors(copies[:])),
+			verifiable:    err == nil,
+		}))
+	}
+
+	if o.wipe {
+		var eraseRegions []RegionDesc
+		if !o.skipHeader {
+			eraseRegions = append(eraseRegions, RegionDesc{"volume header", 0, sectorSize})
+		}
+		for _, i := range o.metadataBlocks {
+			eraseRegions = append(eraseRegions,
+				RegionDesc{fmt.Sprintf("metadata block %d", i), validInfoOffsets[i], validInfoSize})
+
+			// with -force, also where the header says the block is
+			off := int64(hdr.InfoOffsets[i])
+			if offsetsMismatch && off != validInfoOffsets[i] && !outOfBounds(off, validInfoSize, avail) {
+				eraseRegions = append(eraseRegions,
+					RegionDesc{fmt.Sprintf("metadata block %d at the header offset", i), off, validInfoSize})
+			}
+		}
+		if o.includeEOW {
+			// its size is not recorded in the volume header, so as much
+			// as the largest metadata block is overwritten
+			for i, off := range hdr.EOWOffsets {
+				if off != 0 {
+					eraseRegions = append(eraseRegions,
+						RegionDesc{fmt.Sprintf("encrypt-on-write information %d", i), int64(off), maxMetadataSize})
+				}
+			}
+		}
+		if len(eraseRegions) == 0 {
+			fatal("nothing to wipe")
+		}
+
+		n := wipeRegions(f, offset, avail, sectorSize, eraseRegions)
+
+		// make sure nothing mountable was left behind
+		if st, err := imageStorage(f); err == nil {
+			dataSize := volumeSize
+			if avail >= 0 && dataSize > avail {
+				dataSize = avail
+			}
+			progress(progressEvent{Phase: "verify", Offset: offset, Bytes: dataSize})
+			if !verifyWiped(&subStorage{st, offset}, dataSize, sectorSize, o.skipHeader) {
+				fatal("verification failed, plaintext filesystem signatures remain on the volume")
+			}
+		}
+		if o.punchHoles && n == len(eraseRegions) {
+			dataSize := volumeSize
+			if avail >= 0 && dataSize > avail {
+				dataSize = avail
+			}
+			punchVolume(f, offset, dataSize)
+		}
+		if o.tombstone && n == len(eraseRegions) {
+			writeTombstone(f, offset, sectorSize)
+		}
+		result("%d of %d regions overwritten", n, len(eraseRegions))
+		return
+	}
+
+	valid := 0
+	for _, c := range copies {
+		if c != nil {
+			valid++
+		}
+	}
+	if infoJSON != nil {
+		infoJSON.setBitLocker(hdr, sectorSize, volumeSize, avail >= 0 && volumeSize > avail, copies[:])
+		regions := []RegionDesc{{"volume header", 0, sectorSize}}
+		for i, off := range validInfoOffsets {
+			regions = append(regions, RegionDesc{fmt.Sprintf("metadata block %d", i), off, validInfoSize})
+		}
+		infoJSON.addRegions(regions)
+	}
+	result("BitLocker volume, %d of %d metadata blocks valid", valid, len(copies))
+}
+
+// exitInterrupted is the exit code when a wipe is stopped by a signal.
+const exitInterrupted = 3
+
+// wipeInterrupted reports which regions were overwritten before a wipe
+// was stopped by sig, and exits.
+func wipeInterrupted(sig os.Signal, done, failed, left []RegionDesc) {
+	fmt.Printf("%s\n", warning(fmt.Sprintf("interrupted by %v, stopping before the next write", sig)))
+	for _, r := range done {
+		fmt.Printf("  overwritten: %s at offset 0x%x size %s\n", r.Name, r.Offset, sizeString(r.Size))
+	}
+	for _, r := range append(failed, left...) {
+		fmt.Printf("  %s   %s at offset 0x%x size %s\n", warning("NOT wiped:"), r.Name, r.Offset, sizeString(r.Size))
+	}
+	result("%d of %d regions overwritten", len(done), len(done)+len(failed)+len(left))
+
+	if rep := activeReport; rep != nil {
+		// saved once by Finish
+		for _, r := range left {
+			rep.Step("overwrite "+r.Name, "skip", "interrupted")
+		}
+		rep.Result = "cancelled"
+		rep.Finish(fmt.Errorf("interrupted by %v", sig))
+	}
+	os.Exit(exitInterrupted)
+}
+
+// wipeProgress, if set, is told how many bytes of the regions have been
+// overwritten so far.
+var wipeProgress func(done, total int64)
+
+// writeRetries is how many times a sector is written before it is given
+// up on, waiting retryDelay, then twice as long and so on between tries.
+const writeRetries = 4
+
+var retryDelay = 100 * time.Millisecond
+
+// writeBySector writes buf at off one sector at a time, retrying those
+// that fail, and returns the LBAs of the sectors that could not be
+// written at all, along with how many writes were retried.
+func writeBySector(w io.WriterAt, buf []byte, off, sectorSize int64) (bad []int64, retries int) {
+	for i := int64(0); i < int64(len(buf)); i += sectorSize {
+		end := i + sectorSize
+		if end > int64(len(buf)) {
+			end = int64(len(buf))
+		}
+		var err error
+		for try := 0; try < writeRetries; try++ {
+			if try > 0 {
+				time.Sleep(retryDelay << uint(try-1))
+				retries++
+			}
+			if _, err = w.WriteAt(buf[i:end], off+i); err == nil {
 				break
 			}
+		}
+		if err != nil {
+			bad = append(bad, (off+i)/sectorSize)
+		}
+	}
+	return bad, retries
+}
+
+// formatLBAs lists sector numbers, collapsing consecutive ones to ranges.
+func formatLBAs(lbas []int64) string {
+	var s []string
+	for i := 0; i < len(lbas); {
+		j := i
+		for j+1 < len(lbas) && lbas[j+1] == lbas[j]+1 {
+			j++
+		}
+		if j > i {
+			s = append(s, fmt.Sprintf("%d-%d", lbas[i], lbas[j]))
+		} else {
+			s = append(s, fmt.Sprint(lbas[i]))
+		}
+		i = j + 1
+	}
+	return strings.Join(s, ", ")
+}
+
+// wipeMargin is the number of sectors that erase regions are extended by
+// on both sides, for those who would rather overwrite too much.
+var wipeMargin int64
+
+// maxWipeMargin keeps the margin, in bytes, well away from overflowing.
+const maxWipeMargin = 1 << 24
+
+// widenRegion extends r by margin bytes on both sides, without going
+// below the start of the volume or past avail bytes.
+func widenRegion(r RegionDesc, margin, avail int64) RegionDesc {
+	start := r.Offset - margin
+	if start < 0 {
+		start = 0
+	}
+	end := r.Offset + r.Size + margin
+	if avail >= 0 && end > avail && r.Offset+r.Size <= avail {
+		end = avail
+	}
+	return RegionDesc{r.Name, start, end - start}
+}
 
-			fmt.Printf("overwriting %s at offset 0x%x size %d...\n",
+// wipeRegions overwrites the regions of the volume at offset with random
+// data, after checking that all of them lie within avail bytes, and
+// returns how many were overwritten.
+func wipeRegions(w io.WriterAt, offset, avail, sectorSize int64, eraseRegions []RegionDesc) int {
+	// refuse to write anything if part of the plan cannot be carried out
+	outside := false
+	margin := wipeMargin * sectorSize
+	for i, region := range eraseRegions {
+		if region.Offset < 0 || region.Size < 0 || region.Size > math.MaxInt64-region.Offset-sectorSize-2*margin {
+			fatal("not wiping, %s at 0x%x size %d is not a valid region",
 				region.Name, region.Offset, region.Size)
+		}
+		eraseRegions[i] = alignRegion(region, sectorSize)
+		if margin > 0 {
+			eraseRegions[i] = widenRegion(eraseRegions[i], margin, avail)
+		}
+		if outOfBounds(eraseRegions[i].Offset, eraseRegions[i].Size, avail) {
+			fmt.Printf("%s at 0x%x size %s lies beyond the end of the image\n",
+				region.Name, region.Offset, sizeString(region.Size))
+			outside = true
+		}
+	}
+	if outside {
+		fatal("not wiping, erase regions fall outside the image")
+	}
+
+	var done, total int64
+	for _, region := range eraseRegions {
+		total += region.Size
+	}
+
+	// both are kept in memory several times over while they are encoded
+	if (backupPath != "" || journalPath != "") && maxMemory != 0 && 4*total > int64(maxMemory) {
+		fatal("not wiping, a backup or journal of %s would not fit in -max-memory", humanSize(total))
+	}
+	if backupPath != "" {
+		r, ok := w.(io.ReaderAt)
+		if !ok {
+			fatal("not wiping, the regions can't be read back to back them up")
+		}
+		saveBackup(r, offset, eraseRegions)
+	}
+	if journalPath != "" {
+		r, ok := w.(io.ReaderAt)
+		if !ok {
+			fatal("not wiping, the regions can't be read back to journal them")
+		}
+		saveJournal(r, offset, eraseRegions)
+	}
+
+	// a signal stops the wipe between writes, never in the middle of one
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
 
-			f.Seek(*offset+region.Offset, 0)
-			_, err = f.Write(eraseBuf)
-			if err != nil {
-				fmt.Printf("unable to write region: %v\n", err)
-				continue
+	// several regions are in flight at once where the target allows,
+	// but the random data is still drawn in order, for -seed
+	workers := 1
+	if concurrentIO(w) && !regionsOverlap(eraseRegions) {
+		workers = ioConcurrency
+	}
+	var largest int64
+	for _, region := range eraseRegions {
+		if region.Size > largest {
+			largest = region.Size
+		}
+	}
+	// with -max-memory, the regions that do not fit are written in pieces
+	workers, piece := bufferShare(workers, largest, sectorSize)
+
+	var written, failed []RegionDesc
+	var pending []*regionWrite
+	finish := func(rw *regionWrite) {
+		<-rw.done
+		region, step := rw.region, rw.step
+		ev := progressEvent{Phase: "overwrite", Region: region.Name,
+			Offset: offset + region.Offset, Bytes: region.Size, Total: total}
+		if rw.err != nil {
+			fmt.Printf("unable to write %s: %v, retried sector by sector\n", region.Name, rw.err)
+		}
+		if len(rw.bad) > 0 {
+			stats.Retries += rw.retries
+			fmt.Printf("%s\n", warning(fmt.Sprintf("%d unwritable sectors in %s: LBA %s",
+				len(rw.bad), region.Name, formatLBAs(rw.bad))))
+			msg := fmt.Sprintf("%d unwritable sectors", len(rw.bad))
+			ev.Done, ev.Error = done, msg
+			progress(ev)
+			if step != nil {
+				activeReport.BadSectors = append(activeReport.BadSectors, rw.bad...)
+				activeReport.Done(step, "failed: "+msg)
+			}
+			failed = append(failed, region)
+			return
+		}
+		if rw.syncErr != nil {
+			stats.Retries += rw.retries
+			fmt.Printf("unable to sync %s: %v\n", region.Name, rw.syncErr)
+			if step != nil {
+				activeReport.Done(step, "failed: "+rw.syncErr.Error())
 			}
+			failed = append(failed, region)
+			return
 		}
+		if step != nil {
+			activeReport.Done(step, "done")
+		}
+		written = append(written, region)
+		stats.addRegion(region, offset, rw.elapsed, rw.retries)
+
+		done += region.Size
+		ev.Done = done
+		progress(ev)
+		if wipeProgress != nil {
+			wipeProgress(done, total)
+		}
+	}
+
+	started := time.Now()
+	for i, region := range eraseRegions {
+		select {
+		case sig := <-sigs:
+			for _, rw := range pending {
+				finish(rw)
+			}
+			wipeInterrupted(sig, written, failed, eraseRegions[i:])
+		default:
+		}
+
+		var eraseBuf []byte
+		if region.Size <= piece {
+			eraseBuf = make([]byte, region.Size)
+			if _, err := io.ReadFull(randSource, eraseBuf); err != nil {
+				fatal("unable to generate rand bytes: %v", err)
+			}
+		}
+
+		fmt.Printf("%s %s at offset 0x%x size %s...\n",
+			warning("overwriting"), region.Name, region.Offset, sizeString(region.Size))
+		rw := &regionWrite{region: region}
+		if activeReport != nil {
+			rw.step = activeReport.Step("overwrite "+region.Name, "run",
+				fmt.Sprintf("offset 0x%x size %d", offset+region.Offset, region.Size))
+		}
+		if eraseBuf == nil {
+			// alone, so that the random data is still drawn in order
+			for _, rw := range pending {
+				finish(rw)
+			}
+			pending = nil
+			if err := rw.writePieces(w, offset, sectorSize, piece); err != nil {
+				fatal("unable to generate rand bytes: %v", err)
+			}
+		} else {
+			rw.start(w, eraseBuf, offset, sectorSize)
+		}
+
+		pending = append(pending, rw)
+		if len(pending) >= workers {
+			finish(pending[0])
+			pending = pending[1:]
+		}
+	}
+	for _, rw := range pending {
+		finish(rw)
+	}
+	stats.addWriting(time.Since(started))
+	return len(written)
+}
+
+// punchVolume deallocates the n bytes of the wiped volume at offset, if
+// the target is a regular file, so that the image shrinks on disk.
+func punchVolume(img Image, offset, n int64) {
+	f, ok := deviceFile(img)
+	if ok {
+		fi, err := f.Stat()
+		ok = err == nil && fi.Mode().IsRegular()
+	}
+	if !ok {
+		fmt.Printf("not punching holes, the target is not a regular file\n")
+		return
+	}
+
+	var step *reportStep
+	if activeReport != nil {
+		step = activeReport.Step("punch holes", "run", fmt.Sprintf("offset 0x%x size %d", offset, n))
+	}
+	fmt.Printf("punching a hole at offset 0x%x size %s...\n", offset, sizeString(n))
+	if err := punchHole(f, offset, n); err != nil {
+		if step != nil {
+			activeReport.Done(step, "failed: "+err.Error())
+		}
+		fmt.Printf("unable to punch holes: %v\n", err)
+		return
+	}
+	if step != nil {
+		activeReport.Done(step, "done")
 	}
 }
@@ -0,0 +1,243 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+)
+
+// validationSize is the size of the validation structure after a block.
+const validationSize = 8
+
+func TestMetadataExtent(t *testing.T) {
+	tests := []struct {
+		version, size uint16
+		block         int64 // bytes covered by the checksum
+		extent512     int64 // to overwrite with 512-byte (and 512e) sectors
+		extent4096    int64 // and with 4Kn sectors
+	}{
+		{1, 64, 64, 512, 4096}, // the smallest block, a bare InfoStruct
+		{1, 1096, 1096, 1536, 4096},
+		{2, 0x44, 1088, 1536, 4096},
+		{2, 0x3f, 1008, 1024, 4096},
+
+		// ending on a sector boundary, and one byte past it
+		{1, 504, 504, 512, 4096},
+		{1, 4088, 4088, 4096, 4096},
+		{1, 4089, 4089, 4608, 8192},
+		{2, 0xff, 4080, 4096, 4096},
+		{2, 0x100, 4096, 4608, 8192},
+
+		// the largest blocks that fit in the metadata area
+		{1, maxMetadataSize - validationSize, maxMetadataSize - validationSize, maxMetadataSize, maxMetadataSize},
+		{2, (maxMetadataSize - validationSize) / 16, maxMetadataSize - 16, maxMetadataSize, maxMetadataSize},
+	}
+	for _, tt := range tests {
+		block, err := metadataBlockSize(tt.version, tt.size)
+		if err != nil || block != tt.block {
+			t.Errorf("metadataBlockSize(%d, %d) = %d, %v, want %d", tt.version, tt.size, block, err, tt.block)
+			continue
+		}
+		for _, s := range []struct{ sector, want int64 }{{512, tt.extent512}, {4096, tt.extent4096}} {
+			n, err := metadataExtent(block+validationSize, s.sector)
+			if err != nil || n != s.want {
+				t.Errorf("v%d block of %d bytes with %d-byte sectors: extent %d, %v, want %d",
+					tt.version, block, s.sector, n, err, s.want)
+			}
+		}
+	}
+}
+
+func TestMetadataBlockSizeErrors(t *testing.T) {
+	tests := []struct {
+		version, size uint16
+		want          error
+	}{
+		{0, 1096, ErrUnsupportedVersion},
+		{3, 1096, ErrUnsupportedVersion},
+		{1, 0, ErrTruncated},
+		{1, 63, ErrTruncated},
+		{2, 3, ErrTruncated},
+		{1, maxMetadataSize - validationSize + 1, ErrInvalidField},
+		{1, 0xffff, ErrInvalidField},
+		{2, maxMetadataSize / 16, ErrInvalidField},
+		{2, 0xffff, ErrInvalidField},
+	}
+	for _, tt := range tests {
+		if _, err := metadataBlockSize(tt.version, tt.size); !errors.Is(err, tt.want) {
+			t.Errorf("metadataBlockSize(%d, %d) = %v, want %v", tt.version, tt.size, err, tt.want)
+		}
+	}
+}
+
+func TestMetadataExtentErrors(t *testing.T) {
+	tests := []struct {
+		size, sectorSize int64
+		invalidField     bool
+	}{
+		{0, 512, false},
+		{-1, 512, false},
+		{1104, 0, false},
+		{1104, -512, false},
+		{maxMetadataSize + 1, 512, true},
+		{maxMetadataSize + 1, 4096, true},
+		{maxMetadataSize - 1, 3 << 14, true}, // rounds up past the area
+	}
+	for _, tt := range tests {
+		n, err := metadataExtent(tt.size, tt.sectorSize)
+		if err == nil {
+			t.Errorf("metadataExtent(%d, %d) = %d, want an error", tt.size, tt.sectorSize, n)
+		} else if errors.Is(err, ErrInvalidField) != tt.invalidField {
+			t.Errorf("metadataExtent(%d, %d): %v, matching ErrInvalidField should be %v",
+				tt.size, tt.sectorSize, err, tt.invalidField)
+		}
+	}
+}
+
+// Every block size that can be parsed is covered by whole sectors, without
+// taking in a sector more or leaving the metadata area.
+func TestMetadataExtentCoversBlock(t *testing.T) {
+	for _, sector := range []int64{512, 4096} {
+		for size := 0; size <= 0xffff; size++ {
+			block, err := metadataBlockSize(1, uint16(size))
+			if err != nil {
+				continue
+			}
+			total := block + validationSize
+			n, err := metadataExtent(total, sector)
+			if err != nil {
+				t.Fatalf("block of %d bytes with %d-byte sectors: %v", block, sector, err)
+			}
+			if n%sector != 0 || n < total || n-total >= sector || n > maxMetadataSize {
+				t.Fatalf("block of %d bytes with %d-byte sectors: extent %d", block, sector, n)
+			}
+		}
+	}
+}
+
+// makeInfoBlock returns a version 1 metadata block holding a bare
+// InfoStruct, and its validation structure, after edit changes them.
+func makeInfoBlock(edit func(*InfoStruct, *ValidationHeader)) []byte {
+	s := InfoStruct{VolumeSize: 1 << 30, InfoOffsets: [3]uint64{0x100000, 0x200000, 0x300000}}
+	copy(s.Signature[:], "-FVE-FS-")
+	s.Size, s.Version = uint16(binary.Size(s)), 1
+	v := ValidationHeader{Size: validationSize, Version: 1}
+	if edit != nil {
+		edit(&s, &v)
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &s)
+	if v.Crc32 == 0 {
+		v.Crc32 = crc32.ChecksumIEEE(buf.Bytes())
+	}
+	binary.Write(&buf, binary.LittleEndian, &v)
+	return buf.Bytes()
+}
+
+func TestInfoStructRead(t *testing.T) {
+	var s InfoStruct
+	size, err := s.Read(bytes.NewReader(makeInfoBlock(nil)), 0)
+	if err != nil || size != 64+validationSize {
+		t.Fatalf("read %d, %v, want %d", size, err, 64+validationSize)
+	}
+	if s.VolumeSize != 1<<30 || s.InfoOffsets[2] != 0x300000 {
+		t.Errorf("read as %+v", s)
+	}
+
+	tests := []struct {
+		name  string
+		block []byte
+		want  error
+	}{
+		{"signature", makeInfoBlock(func(s *InfoStruct, _ *ValidationHeader) { s.Signature[0] = 'x' }),
+			ErrNotBitLocker},
+		{"version", makeInfoBlock(func(s *InfoStruct, _ *ValidationHeader) { s.Version = 3 }),
+			ErrUnsupportedVersion},
+		{"too small", makeInfoBlock(func(s *InfoStruct, _ *ValidationHeader) { s.Size = 63 }), ErrTruncated},
+		{"oversized", makeInfoBlock(func(s *InfoStruct, _ *ValidationHeader) { s.Size = 0xffff }),
+			ErrInvalidField},
+		{"past the end", makeInfoBlock(func(s *InfoStruct, _ *ValidationHeader) { s.Size = 1000 }),
+			ErrTruncated},
+		{"truncated", makeInfoBlock(nil)[:40], ErrTruncated},
+		{"no validation", makeInfoBlock(nil)[:64], ErrTruncated},
+		{"checksum", makeInfoBlock(func(_ *InfoStruct, v *ValidationHeader) { v.Crc32 = 1 }), ErrBadChecksum},
+		{"validation size", makeInfoBlock(func(_ *InfoStruct, v *ValidationHeader) { v.Size = 4 }),
+			ErrInvalidField},
+		{"oversized validation", makeInfoBlock(func(_ *InfoStruct, v *ValidationHeader) { v.Size = 0xffff }),
+			ErrInvalidField},
+		{"negative volume size", makeInfoBlock(func(s *InfoStruct, _ *ValidationHeader) { s.VolumeSize = 1 << 63 }),
+			ErrInvalidField},
+		{"negative header offset", makeInfoBlock(func(s *InfoStruct, _ *ValidationHeader) {
+			s.HeaderSectorsOffset = 1 << 63
+		}), ErrInvalidField},
+		{"offset at the header", makeInfoBlock(func(s *InfoStruct, _ *ValidationHeader) { s.InfoOffsets[1] = 0 }),
+			ErrInvalidField},
+		{"huge offset", makeInfoBlock(func(s *InfoStruct, _ *ValidationHeader) { s.InfoOffsets[2] = 1<<63 - 1 }),
+			ErrInvalidField},
+		{"overlapping offsets", makeInfoBlock(func(s *InfoStruct, _ *ValidationHeader) {
+			s.InfoOffsets[2] = s.InfoOffsets[0] + 32
+		}), ErrInvalidField},
+	}
+	for _, tt := range tests {
+		var s InfoStruct
+		if size, err := s.Read(bytes.NewReader(tt.block), 0); !errors.Is(err, tt.want) {
+			t.Errorf("%s: read %d, %v, want %v", tt.name, size, err, tt.want)
+		}
+	}
+}
+
+// makeVolumeHeader returns a volume header after edit changes it.
+func makeVolumeHeader(edit func(*VolumeHeader)) []byte {
+	g, err := parseGuid(INFO_GUID)
+	if err != nil {
+		panic(err)
+	}
+	hdr := VolumeHeader{NumSectors: 1 << 21, Guid: g, InfoOffsets: [3]uint64{0x100000, 0x200000, 0x300000}}
+	copy(hdr.Signature[:], "-FVE-FS-")
+	if edit != nil {
+		edit(&hdr)
+	}
+	b := make([]byte, 512)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &hdr)
+	copy(b, buf.Bytes())
+	return b
+}
+
+func TestReadHeader(t *testing.T) {
+	hdr, err := readHeader(bytes.NewReader(makeVolumeHeader(nil)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.NumSectors != 1<<21 || hdr.InfoOffsets[1] != 0x200000 {
+		t.Errorf("read as %+v", hdr)
+	}
+
+	tests := []struct {
+		name string
+		hdr  []byte
+		want error
+	}{
+		{"signature", makeVolumeHeader(func(h *VolumeHeader) { h.Signature[0] = 'x' }), ErrNotBitLocker},
+		{"GUID", makeVolumeHeader(func(h *VolumeHeader) { h.Guid.A = 0 }), ErrUnsupportedVersion},
+		{"oversized", makeVolumeHeader(func(h *VolumeHeader) { h.NumSectors = 1 << 60 }), ErrInvalidField},
+		{"offset at the header", makeVolumeHeader(func(h *VolumeHeader) { h.InfoOffsets[0] = 0 }),
+			ErrInvalidField},
+		{"huge offset", makeVolumeHeader(func(h *VolumeHeader) { h.InfoOffsets[1] = 1 << 63 }), ErrInvalidField},
+		{"same offset", makeVolumeHeader(func(h *VolumeHeader) { h.InfoOffsets[2] = h.InfoOffsets[0] }),
+			ErrInvalidField},
+		{"truncated", makeVolumeHeader(nil)[:100], ErrTruncated},
+	}
+	for _, tt := range tests {
+		if _, err := readHeader(bytes.NewReader(tt.hdr), 0); !errors.Is(err, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
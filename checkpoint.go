@@ -0,0 +1,119 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Scanning a multi-terabyte disk takes hours, so its progress is saved
+// to a checkpoint file every so often, and when it is interrupted, for
+// scan -resume to carry on from.
+
+// checkpointInterval is how often the checkpoint is saved while scanning.
+const checkpointInterval = 10 * time.Second
+
+type scanCheckpoint struct {
+	Target  string          `json:"target"`
+	Size    int64           `json:"size"`
+	Scanned int64           `json:"scanned"` // all of the disk before this was searched
+	Hits    []checkpointHit `json:"hits"`
+
+	path  string
+	saved time.Time
+}
+
+// checkpointHit is a structure found before the scan was stopped, which is
+// read again when resuming.
+type checkpointHit struct {
+	Offset int64  `json:"offset"`
+	Kind   string `json:"kind"`
+}
+
+// newCheckpoint starts a checkpoint at path for scanning target, or picks
+// up the one saved there if resume is set.
+func newCheckpoint(path, target string, size int64, resume bool) (*scanCheckpoint, error) {
+	cp := &scanCheckpoint{Target: target, Size: size, path: path, saved: time.Now()}
+	if !resume {
+		return cp, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		fmt.Printf("no checkpoint in %s, starting from the beginning\n", path)
+		return cp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %v", path, err)
+	}
+	if cp.Target != target || cp.Size != size {
+		return nil, fmt.Errorf("checkpoint %s is for %s of %d bytes, not this disk", path, cp.Target, cp.Size)
+	}
+	if cp.Scanned < 0 || cp.Scanned > size || cp.Scanned%carveAlign != 0 && cp.Scanned != size {
+		return nil, fmt.Errorf("invalid checkpoint %s: scanned up to 0x%x", path, cp.Scanned)
+	}
+	fmt.Printf("resuming from offset 0x%x with %d structure(s) found so far\n", cp.Scanned, len(cp.Hits))
+	return cp, nil
+}
+
+// found reads the structures found before the scan was stopped again.
+func (cp *scanCheckpoint) found(r io.ReaderAt) []carvedBlock {
+	var blocks []carvedBlock
+	for _, h := range cp.Hits {
+		var b carvedBlock
+		var ok bool
+		if h.Kind == "volume header" {
+			b, ok = carveHeader(r, h.Offset)
+		} else {
+			b, ok = carveMetadata(r, h.Offset)
+		}
+		if ok {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+// update records that everything up to scanned was searched, saving the
+// checkpoint if it has not been for a while.
+func (cp *scanCheckpoint) update(scanned int64, blocks []carvedBlock) {
+	cp.Scanned = scanned
+	cp.Hits = cp.Hits[:0]
+	for _, b := range blocks {
+		cp.Hits = append(cp.Hits, checkpointHit{b.Offset, b.Kind})
+	}
+	if time.Since(cp.saved) >= checkpointInterval {
+		cp.save()
+	}
+}
+
+// save writes the checkpoint, replacing the previous one atomically.
+func (cp *scanCheckpoint) save() {
+	cp.saved = time.Now()
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err == nil {
+		tmp := filepath.Join(filepath.Dir(cp.path), "."+filepath.Base(cp.path)+".tmp")
+		if err = os.WriteFile(tmp, append(b, '\n'), 0644); err == nil {
+			err = os.Rename(tmp, cp.path)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't save checkpoint: %v\n", err)
+	}
+}
+
+// remove deletes the checkpoint of a scan that finished.
+func (cp *scanCheckpoint) remove() {
+	if err := os.Remove(cp.path); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "can't remove checkpoint: %v\n", err)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// Colours for terminal output. They are only used when stdout is a
+// terminal, and neither -no-color nor NO_COLOR (see no-color.org) is set,
+// so that piped output and logs stay plain.
+
+const (
+	colorRed   = "31"
+	colorGreen = "32"
+	colorCyan  = "36"
+)
+
+var noColor bool
+
+var (
+	colorOnce    sync.Once
+	colorEnabled bool
+)
+
+func useColor() bool {
+	colorOnce.Do(func() {
+		if noColor || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+			return
+		}
+		fi, err := os.Stdout.Stat()
+		if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return
+		}
+		colorEnabled = enableTerminalColor(os.Stdout)
+	})
+	return colorEnabled
+}
+
+func colorize(color, s string) string {
+	if !useColor() {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+// warning marks destructive actions.
+func warning(s string) string { return colorize(colorRed, s) }
+
+// success marks checks that passed.
+func success(s string) string { return colorize(colorGreen, s) }
+
+// highlight marks volumes that were found.
+func highlight(s string) string { return colorize(colorCyan, s) }
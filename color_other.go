@@ -0,0 +1,11 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+//go:build !windows
+
+package main
+
+import "os"
+
+func enableTerminalColor(f *os.File) bool { return true }
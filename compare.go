@@ -0,0 +1,149 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// Verification of wipes done by other tools, by comparing images taken
+// before and after: every structure found in the first must be gone from
+// the second.
+
+// compareStructure checks that the structure of size bytes at off, which
+// is valid in before, is no longer valid or unchanged in after. It returns
+// "" if it was wiped.
+func compareStructure(before, after storage, off, size int64, valid func(storage) bool) string {
+	if valid(after) {
+		return "still valid"
+	}
+	a, b := make([]byte, size), make([]byte, size)
+	defer zeroize(a, b)
+	if err := readFullAt(after, a, off); err != nil {
+		return fmt.Sprintf("can't read: %v", err)
+	}
+	if err := readFullAt(before, b, off); err == nil && bytes.Equal(a, b) {
+		return "unchanged"
+	}
+	return ""
+}
+
+func cmdCompare(args []string) {
+	fs := newFlagSet("compare", "<before.img> <after.img>")
+	offset := fs.Int64("offset", -1, "offset of the volume, all BitLocker volumes are checked if not given")
+	reportPath := fs.String("report", "", "write a JSON verification report to this file")
+	rec := recordFlags(fs, true)
+	addMmapFlag(fs)
+	parseFlags(fs, args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	open := func(path string) storage {
+		img, err := openTarget(path, false)
+		if err != nil {
+			fatal("can't open file: %s", err)
+		}
+		st, err := imageStorage(mapImage(img))
+		if err != nil {
+			fatal("%s: %v", path, err)
+		}
+		return st
+	}
+	before, after := open(fs.Arg(0)), open(fs.Arg(1))
+
+	var offsets []int64
+	if *offset >= 0 {
+		offsets = []int64{*offset}
+	} else {
+		for _, v := range findVolumes(before) {
+			if v.Format == "bitlocker" {
+				offsets = append(offsets, v.Offset)
+			}
+		}
+	}
+	if len(offsets) == 0 {
+		fatal("no BitLocker volumes found in %s", fs.Arg(0))
+	}
+
+	var rep *Report
+	if *reportPath != "" {
+		rep = newReport("compare", fs.Arg(1), *reportPath, *rec)
+	}
+
+	checked, failed := 0, 0
+	check := func(name string, off, size int64, valid func(storage) bool) {
+		var step *reportStep
+		if rep != nil {
+			step = rep.Step(name, "run", fmt.Sprintf("offset 0x%x size %d", off, size))
+		}
+		checked++
+		status := success("wiped")
+		problem := compareStructure(before, after, off, size, valid)
+		if problem != "" {
+			failed++
+			status = warning(problem)
+		}
+		fmt.Printf("  %s at offset 0x%x: %s\n", name, off, status)
+		if step != nil {
+			if problem != "" {
+				rep.Done(step, "failed: "+problem)
+			} else {
+				rep.Done(step, "passed")
+			}
+		}
+	}
+
+	for _, vol := range offsets {
+		hdr, err := readHeader(before, vol)
+		if err != nil {
+			fatal("volume at 0x%x: %v", vol, err)
+		}
+		fmt.Printf("%s\n", highlight(fmt.Sprintf("BitLocker volume at offset 0x%x:", vol)))
+		if rep != nil {
+			rep.BeginVolume(vol)
+		}
+
+		check("volume header", vol, int64(hdr.SectorSize), func(r storage) bool {
+			_, err := readHeader(r, vol)
+			return err == nil
+		})
+		for i, off := range hdr.InfoOffsets {
+			var info InfoStruct
+			blockOff := vol + int64(off)
+			size, err := info.Read(before, blockOff)
+			if err != nil {
+				fmt.Printf("  metadata block %d at offset 0x%x: not valid before either, skipped\n", i, blockOff)
+				continue
+			}
+			check(fmt.Sprintf("metadata block %d", i), blockOff, size, func(r storage) bool {
+				var info InfoStruct
+				_, err := info.Read(r, blockOff)
+				return err == nil
+			})
+		}
+
+		if rep != nil {
+			rep.EndVolume("checked")
+		}
+	}
+
+	if failed > 0 {
+		result("FAIL: %d of %d structures were not wiped", failed, checked)
+		if rep != nil {
+			rep.Result = "failed"
+			rep.Finish(nil)
+		}
+		os.Exit(1)
+	}
+	result("PASS: all %d structures were wiped", checked)
+	if rep != nil {
+		rep.Finish(nil)
+	}
+}
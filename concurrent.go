@@ -0,0 +1,154 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// The metadata copies are far apart on the volume, so on slow media such
+// as USB bridges it pays to have them all in flight at once rather than
+// waiting for each one in turn. Only targets that are accessed with
+// positional I/O on plain files can take this; the others keep state
+// between requests.
+
+// ioConcurrency is how many regions are read or written at once.
+const ioConcurrency = 4
+
+// concurrentIO reports whether r can be used from several goroutines.
+func concurrentIO(r interface{}) bool {
+	switch v := r.(type) {
+	case *os.File, *mappedImage:
+		return true
+	case *virtualDisk:
+		switch d := v.disk.(type) {
+		case *splitDisk, *directDisk:
+			return true
+		case *interleavedDisk:
+			return concurrentIO(d.s)
+		}
+	}
+	return false
+}
+
+// regionsOverlap reports whether any of the regions share a byte, in which
+// case what ends up there depends on the order they are written in.
+func regionsOverlap(regions []RegionDesc) bool {
+	sorted := append([]RegionDesc(nil), regions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i-1].Offset+sorted[i-1].Size > sorted[i].Offset {
+			return true
+		}
+	}
+	return false
+}
+
+// metadataCopy is one metadata block as read from the volume.
+type metadataCopy struct {
+	info InfoStruct
+	raw  []byte
+	size int64
+	err  error
+}
+
+// readMetadataCopies reads the metadata blocks at the offsets that lie
+// within avail bytes of the volume at offset, all at once if r allows.
+func readMetadataCopies(r io.ReaderAt, offset int64, offsets [3]uint64, sectorSize, avail int64) [3]*metadataCopy {
+	var copies [3]*metadataCopy
+	done := make(chan struct{}, len(offsets))
+	parallel := concurrentIO(r)
+	for i, off := range offsets {
+		if outOfBounds(int64(off), sectorSize, avail) {
+			continue
+		}
+		c := &metadataCopy{}
+		copies[i] = c
+		read := func(off int64) {
+			c.raw, c.size, c.err = c.info.ReadRaw(r, offset+off)
+			done <- struct{}{}
+		}
+		if parallel {
+			go read(int64(off))
+		} else {
+			read(int64(off))
+		}
+	}
+	for _, c := range copies {
+		if c != nil {
+			<-done
+		}
+	}
+	return copies
+}
+
+// regionWrite is a region being overwritten in the background.
+type regionWrite struct {
+	region  RegionDesc
+	step    *reportStep
+	err     error   // the region could not be written in one go
+	bad     []int64 // LBAs of the sectors that could not be written at all
+	syncErr error
+	retries int
+	elapsed time.Duration
+	done    chan struct{}
+}
+
+// write writes buf at off, one sector at a time if it has to, and reports
+// whether every sector of the region so far could be written.
+func (rw *regionWrite) write(w io.WriterAt, buf []byte, off, sectorSize int64) bool {
+	if _, err := w.WriteAt(buf, off); err != nil {
+		if rw.err == nil {
+			rw.err = err
+		}
+		bad, retries := writeBySector(w, buf, off, sectorSize)
+		rw.bad = append(rw.bad, bad...)
+		rw.retries += retries + 1 // for writing it sector by sector
+	}
+	return len(rw.bad) == 0
+}
+
+// start writes buf over the region of the volume at offset.
+func (rw *regionWrite) start(w io.WriterAt, buf []byte, offset, sectorSize int64) {
+	rw.done = make(chan struct{})
+	go func() {
+		defer close(rw.done)
+		started := time.Now()
+		defer func() { rw.elapsed = time.Since(started) }()
+
+		if rw.write(w, buf, offset+rw.region.Offset, sectorSize) && durability.syncRegions {
+			rw.syncErr = syncImage(w)
+		}
+	}()
+}
+
+// writePieces overwrites the region of the volume at offset with random
+// data, piece bytes at a time, for regions too large to hold in memory.
+// It returns once it is done.
+func (rw *regionWrite) writePieces(w io.WriterAt, offset, sectorSize, piece int64) error {
+	rw.done = make(chan struct{})
+	defer close(rw.done)
+	started := time.Now()
+	defer func() { rw.elapsed = time.Since(started) }()
+
+	buf := make([]byte, piece)
+	for pos := int64(0); pos < rw.region.Size; pos += piece {
+		n := rw.region.Size - pos
+		if n > piece {
+			n = piece
+		}
+		if _, err := io.ReadFull(randSource, buf[:n]); err != nil {
+			return err
+		}
+		rw.write(w, buf[:n], offset+rw.region.Offset+pos, sectorSize)
+	}
+	if len(rw.bad) == 0 && durability.syncRegions {
+		rw.syncErr = syncImage(w)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Sanitized copies, for when the source must not be touched: the image is
+// copied to a new file, which is then wiped instead.
+
+const copyChunkSize = 1 << 20
+
+// copyToImage copies the image at path to a new raw image at output, and
+// returns the copy opened for writing. Runs of zeros are left as holes.
+func copyToImage(path, output string) Image {
+	src, err := openTarget(path, false)
+	if err != nil {
+		fatal("can't open file: %s", err)
+	}
+	defer src.Close()
+	size, err := imageSize(src)
+	if err != nil {
+		fatal("can't determine size of %s: %v", path, err)
+	}
+
+	dst, err := os.OpenFile(output, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		fatal("can't create output: %v", err)
+	}
+
+	fmt.Printf("copying %s to %s...\n", path, output)
+	buf := make([]byte, copyChunkSize)
+	var off int64
+	for size < 0 || off < size {
+		n, err := src.ReadAt(buf, off)
+		if n > 0 && !allZero(buf[:n]) {
+			if _, err := dst.WriteAt(buf[:n], off); err != nil {
+				fatal("unable to write %s: %v", output, err)
+			}
+		}
+		off += int64(n)
+		progress(progressEvent{Phase: "copy", Offset: off - int64(n), Bytes: int64(n), Done: off, Total: size})
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fatal("unable to read %s: %v", path, err)
+		}
+	}
+	if err := dst.Truncate(off); err != nil {
+		fatal("%v", err)
+	}
+	fmt.Printf("copied %s\n", sizeString(off))
+	return dst
+}
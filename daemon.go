@@ -0,0 +1,389 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A long-running daemon that front-ends and orchestration systems can
+// drive. Every wipe runs as a separate blwipe process, whose output is
+// turned into progress events, so it can be cancelled by killing it.
+
+const maxEvents = 10000
+
+// Job is a wipe started through the daemon.
+type Job struct {
+	ID       int        `json:"id"`
+	Device   string     `json:"device"`
+	Drive    string     `json:"drive,omitempty"` // a persistent name of the drive
+	Format   string     `json:"format,omitempty"`
+	State    string     `json:"state"` // running, done, failed or cancelled
+	Error    string     `json:"error,omitempty"`
+	Report   string     `json:"report,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	cmd *exec.Cmd
+}
+
+// Event is a line of output from a job, or a change of its state.
+type Event struct {
+	Seq     int       `json:"seq"`
+	Job     int       `json:"job"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// WipeRequest describes a wipe to start.
+type WipeRequest struct {
+	Device string `json:"device"`
+	Format string `json:"format,omitempty"` // detected if empty
+	Offset int64  `json:"offset,omitempty"`
+	recordInfo
+}
+
+type jobManager struct {
+	mu        sync.Mutex
+	jobs      []*Job
+	events    []Event
+	seq       int
+	changed   chan struct{} // closed and replaced on every event
+	reportDir string
+	wipeArgs  []string // passed on to every wipe
+
+	// totals for the metrics
+	devicesScanned int
+	bytesWritten   int64
+	wipesFinished  map[string]int // by final state
+	verifyFailures int
+}
+
+func newJobManager(reportDir string, wipeArgs []string) *jobManager {
+	return &jobManager{changed: make(chan struct{}), reportDir: reportDir, wipeArgs: wipeArgs,
+		wipesFinished: map[string]int{}}
+}
+
+// event records an event, with m.mu held.
+func (m *jobManager) event(job int, format string, a ...interface{}) {
+	m.seq++
+	m.events = append(m.events, Event{m.seq, job, time.Now().UTC(), fmt.Sprintf(format, a...)})
+	if len(m.events) > maxEvents {
+		m.events = m.events[len(m.events)-maxEvents:]
+	}
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *jobManager) start(req WipeRequest) (*Job, error) {
+	if req.Device == "" {
+		return nil, errors.New("no device given")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	drive := ""
+	if id := identifyDrive(req.Device); id != nil {
+		drive = id.String()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.jobs {
+		if j.Device == req.Device && j.State == "running" {
+			return nil, fmt.Errorf("%s is already being wiped by job %d", req.Device, j.ID)
+		}
+	}
+
+	j := &Job{ID: len(m.jobs) + 1, Device: req.Device, Drive: drive, Format: req.Format,
+		State: "running", Started: time.Now().UTC()}
+	args := append([]string{"wipe", "-offset", strconv.FormatInt(req.Offset, 10)}, m.wipeArgs...)
+	args = append(args, req.args()...)
+	if req.Format != "" {
+		args = append(args, "-format", req.Format)
+	}
+	if m.reportDir != "" {
+		j.Report = req.reportName(m.reportDir, req.Device)
+		if filepath.Dir(j.Report) != filepath.Clean(m.reportDir) {
+			return nil, fmt.Errorf("asset tag %q is not usable as a report name", req.AssetTag)
+		}
+		args = append(args, "-report", j.Report)
+	}
+	// the device comes from the client, and must not be taken for a flag
+	j.cmd = exec.Command(exe, append(args, "--", req.Device)...)
+
+	r, w := io.Pipe()
+	j.cmd.Stdout, j.cmd.Stderr = w, w
+	if err := j.cmd.Start(); err != nil {
+		return nil, err
+	}
+	m.jobs = append(m.jobs, j)
+	if j.Drive != "" {
+		m.event(j.ID, "started wiping %s (%s)", j.Device, j.Drive)
+	} else {
+		m.event(j.ID, "started wiping %s", j.Device)
+	}
+
+	scanned := make(chan bool)
+	go func() {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			m.mu.Lock()
+			m.event(j.ID, "%s", s.Text())
+			m.countOutput(s.Text())
+			m.mu.Unlock()
+		}
+		close(scanned)
+	}()
+	go func() {
+		err := j.cmd.Wait()
+		w.Close()
+		<-scanned
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		now := time.Now().UTC()
+		j.Finished = &now
+		switch {
+		case j.State == "cancelled":
+		case err != nil:
+			j.State, j.Error = "failed", err.Error()
+		default:
+			j.State = "done"
+		}
+		m.wipesFinished[j.State]++
+		m.event(j.ID, "job %s", j.State)
+	}()
+	return j, nil
+}
+
+// countOutput updates the metrics from a line of output of a wipe, with
+// m.mu held.
+func (m *jobManager) countOutput(line string) {
+	switch {
+	case strings.HasPrefix(line, "overwriting "):
+		var off, size int64
+		i := strings.LastIndex(line, " at offset ")
+		if i < 0 {
+			return
+		}
+		if _, err := fmt.Sscanf(line[i:], " at offset 0x%x size %d", &off, &size); err == nil {
+			m.bytesWritten += size
+		}
+	case strings.HasPrefix(line, "verification failed"):
+		m.verifyFailures++
+	}
+}
+
+func (m *jobManager) listDevices() ([]DeviceEntry, error) {
+	devs, err := listDeviceEntries()
+	m.mu.Lock()
+	m.devicesScanned += len(devs)
+	m.mu.Unlock()
+	return devs, err
+}
+
+func (m *jobManager) cancel(id int) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id < 1 || id > len(m.jobs) {
+		return nil, fmt.Errorf("no job %d", id)
+	}
+	j := m.jobs[id-1]
+	if j.State != "running" {
+		return nil, fmt.Errorf("job %d is not running", id)
+	}
+	// let the wipe stop between writes, if the system can
+	j.State = "cancelled"
+	if err := j.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		j.cmd.Process.Kill()
+	}
+	return j, nil
+}
+
+// job returns a copy of job id, if there is one.
+func (m *jobManager) job(id int) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id < 1 || id > len(m.jobs) {
+		return Job{}, false
+	}
+	return *m.jobs[id-1], true
+}
+
+func (m *jobManager) list() []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]Job, len(m.jobs))
+	for i, j := range m.jobs {
+		jobs[i] = *j
+	}
+	return jobs
+}
+
+// eventsSince returns the events after seq, waiting up to wait for one to
+// arrive if there are none yet.
+func (m *jobManager) eventsSince(seq int, wait time.Duration) []Event {
+	timeout := time.After(wait)
+	for {
+		m.mu.Lock()
+		var evs []Event
+		for _, e := range m.events {
+			if e.Seq > seq {
+				evs = append(evs, e)
+			}
+		}
+		changed := m.changed
+		m.mu.Unlock()
+
+		if len(evs) > 0 || wait <= 0 {
+			return evs
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+// DeviceEntry is a block device and the encrypted volume on it, if any.
+type DeviceEntry struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Model     string `json:"model,omitempty"`
+	Partition bool   `json:"partition"`
+	Volume    string `json:"volume,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func listDeviceEntries() ([]DeviceEntry, error) {
+	devs, err := blockDevices()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]DeviceEntry, len(devs))
+	for i, d := range devs {
+		entries[i] = DeviceEntry{Path: d.Path, Size: d.Size, Model: d.Model, Partition: d.Partition}
+		f, err := os.Open(d.Path)
+		if err != nil {
+			entries[i].Error = err.Error()
+			continue
+		}
+		entries[i].Volume = describeVolume(f)
+		f.Close()
+	}
+	return entries, nil
+}
+
+func cmdDaemon(args []string) {
+	fs := newFlagSet("daemon", "")
+	socket := fs.String("socket", "/run/blwipe.sock", "unix socket to accept gRPC connections on")
+	reportDir := fs.String("report-dir", "", "write a JSON report of each wipe to this directory")
+	httpAddr := fs.String("http", "", "also serve the REST API on this address, e.g. :8443")
+	tlsCert := fs.String("tls-cert", "", "certificate file for serving the REST API over HTTPS")
+	tlsKey := fs.String("tls-key", "", "key file for serving the REST API over HTTPS")
+	auditCfg := auditFlags(fs)
+	metricsAddr := fs.String("metrics", "", "serve Prometheus metrics on this address, e.g. :9425")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	m := newJobManager(*reportDir, auditCfg.args())
+
+	if *httpAddr != "" {
+		token := os.Getenv("BLWIPE_API_TOKEN")
+		if token == "" {
+			fatal("-http needs a token for clients to authenticate with in BLWIPE_API_TOKEN")
+		}
+		if (*tlsCert == "") != (*tlsKey == "") {
+			fatal("-tls-cert and -tls-key must be given together")
+		}
+
+		api := &httpAPI{m, token}
+		go func() {
+			var err error
+			if *tlsCert != "" {
+				err = http.ListenAndServeTLS(*httpAddr, *tlsCert, *tlsKey, api)
+			} else {
+				err = http.ListenAndServe(*httpAddr, api)
+			}
+			fatal("can't serve HTTP on %s: %v", *httpAddr, err)
+		}()
+		fmt.Printf("serving REST API on %s\n", *httpAddr)
+	}
+
+	if *metricsAddr != "" {
+		go func() {
+			err := http.ListenAndServe(*metricsAddr, http.HandlerFunc(m.serveMetrics))
+			fatal("can't serve metrics on %s: %v", *metricsAddr, err)
+		}()
+		fmt.Printf("serving metrics on %s\n", *metricsAddr)
+	}
+
+	// only the owner of the socket may control the daemon. A stale socket
+	// is replaced, but nothing else at that path.
+	if fi, err := os.Lstat(*socket); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			fatal("%s exists and is not a socket", *socket)
+		}
+		os.Remove(*socket)
+	}
+	l, err := listenSocket(*socket)
+	if err != nil {
+		fatal("can't listen on %s: %v", *socket, err)
+	}
+	fmt.Printf("listening on %s\n", *socket)
+
+	// gRPC clients talk HTTP/2 straight away, without TLS
+	srv := &http.Server{Handler: &grpcServer{m}, Protocols: new(http.Protocols)}
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	fatal("%v", srv.Serve(l))
+}
+
+// listenSocket listens on a unix socket at path that only the owner can
+// connect to. It is created in a directory of its own, which nobody else
+// can reach, and only moved into place once it is made private.
+func listenSocket(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".blwipe-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
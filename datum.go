@@ -0,0 +1,213 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+	"unicode/utf16"
+)
+
+// Metadata entries ("datums") follow the MetadataHeader, and can also be
+// nested inside the value of another datum.
+
+const datumHeaderSize = 8
+
+// entry types
+const (
+	EntryTypeProperty          = 0x0000
+	EntryTypeVMK               = 0x0002
+	EntryTypeFVEK              = 0x0003
+	EntryTypeValidation        = 0x0004
+	EntryTypeStartupKey        = 0x0006
+	EntryTypeDescription       = 0x0007
+	EntryTypeFVEKBackup        = 0x000b
+	EntryTypeVolumeHeaderBlock = 0x000f
+)
+
+// value types
+const (
+	ValueTypeErased        = 0x0000
+	ValueTypeKey           = 0x0001
+	ValueTypeUnicodeString = 0x0002
+	ValueTypeStretchKey    = 0x0003
+	ValueTypeUseKey        = 0x0004
+	ValueTypeAesCcmKey     = 0x0005
+	ValueTypeTpmKey        = 0x0006
+	ValueTypeValidation    = 0x0007
+	ValueTypeVMK           = 0x0008
+	ValueTypeExternalKey   = 0x0009
+	ValueTypeUpdate        = 0x000a
+	ValueTypeError         = 0x000b
+	ValueTypeOffsetSize    = 0x000f
+)
+
+// key protection types of VMK datums
+const (
+	ProtectionClearKey         = 0x0000
+	ProtectionTPM              = 0x0100
+	ProtectionStartupKey       = 0x0200
+	ProtectionTPMAndPIN        = 0x0500
+	ProtectionRecoveryPassword = 0x0800
+	ProtectionPassword         = 0x2000
+)
+
+var entryTypeNames = map[uint16]string{
+	EntryTypeProperty:          "property",
+	EntryTypeVMK:               "VMK",
+	EntryTypeFVEK:              "FVEK",
+	EntryTypeValidation:        "validation",
+	EntryTypeStartupKey:        "startup key",
+	EntryTypeDescription:       "description",
+	EntryTypeFVEKBackup:        "FVEK backup",
+	EntryTypeVolumeHeaderBlock: "volume header block",
+}
+
+var protectionNames = map[uint16]string{
+	ProtectionClearKey:         "clear key",
+	ProtectionTPM:              "TPM",
+	ProtectionStartupKey:       "startup key",
+	ProtectionTPMAndPIN:        "TPM and PIN",
+	ProtectionRecoveryPassword: "recovery password",
+	ProtectionPassword:         "password",
+}
+
+type DatumHeader struct {
+	Size      uint16
+	EntryType uint16
+	ValueType uint16
+	Version   uint16
+}
+
+// Datum is a metadata entry along with where it was found.
+type Datum struct {
+	DatumHeader
+	Offset int    // offset of the datum within the buffer it was parsed from
+	Value  []byte // value following the header
+}
+
+func (d *Datum) String() string {
+	name, ok := entryTypeNames[d.EntryType]
+	if !ok {
+		name = fmt.Sprintf("type 0x%04x", d.EntryType)
+	}
+	return fmt.Sprintf("%s datum", name)
+}
+
+// parseDatums parses consecutive datums in b[start:end], stopping at the
+// first one that does not fit.
+func parseDatums(b []byte, start, end int) []Datum {
+	if end > len(b) {
+		end = len(b)
+	}
+
+	var datums []Datum
+	for off := start; off+datumHeaderSize <= end; {
+		var d Datum
+		binary.Read(bytes.NewReader(b[off:]), binary.LittleEndian, &d.DatumHeader)
+		if int(d.Size) < datumHeaderSize || off+int(d.Size) > end {
+			break
+		}
+
+		d.Offset = off
+		d.Value = b[off+datumHeaderSize : off+int(d.Size)]
+		datums = append(datums, d)
+		off += int(d.Size)
+	}
+	return datums
+}
+
+// metadataDatums returns the top-level datums of a raw metadata block.
+func metadataDatums(raw []byte) []Datum {
+	_, mh := parseMetadataBlock(raw)
+	start := metadataHeaderOffset + binary.Size(mh)
+	return parseDatums(raw, start, metadataHeaderOffset+int(mh.MetadataSize))
+}
+
+// Protector is a VMK datum, which holds the volume master key protected
+// by one kind of key.
+type Protector struct {
+	KeyId          Guid
+	LastModified   uint64
+	_              uint16
+	ProtectionType uint16
+}
+
+const protectorHeaderSize = 28
+
+// parseProtector decodes the value of a VMK datum.
+func parseProtector(d *Datum) (p Protector, ok bool) {
+	if d.ValueType != ValueTypeVMK || len(d.Value) < protectorHeaderSize {
+		return
+	}
+	binary.Read(bytes.NewReader(d.Value), binary.LittleEndian, &p)
+	return p, true
+}
+
+func (p *Protector) TypeName() string {
+	if name, ok := protectionNames[p.ProtectionType]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (0x%04x)", p.ProtectionType)
+}
+
+// protectors returns the key protectors recorded in a raw metadata block.
+func protectors(raw []byte) []Protector {
+	var ps []Protector
+	for _, d := range metadataDatums(raw) {
+		if d.EntryType != EntryTypeVMK {
+			continue
+		}
+		if p, ok := parseProtector(&d); ok {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// isSuspended reports whether protection is suspended, which leaves the
+// VMK stored with a clear key in the metadata.
+func isSuspended(ps []Protector) bool {
+	for _, p := range ps {
+		if p.ProtectionType == ProtectionClearKey {
+			return true
+		}
+	}
+	return false
+}
+
+// description returns the volume description string of a metadata block,
+// usually the computer name, drive letter and date of encryption.
+func description(raw []byte) string {
+	for _, d := range metadataDatums(raw) {
+		if d.EntryType == EntryTypeDescription && d.ValueType == ValueTypeUnicodeString {
+			return decodeUTF16(d.Value)
+		}
+	}
+	return ""
+}
+
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[i*2:])
+	}
+	for len(u) > 0 && u[len(u)-1] == 0 {
+		u = u[:len(u)-1]
+	}
+	return string(utf16.Decode(u))
+}
+
+// filetimeToTime converts a Windows FILETIME to a time.Time.
+func filetimeToTime(ft uint64) time.Time {
+	const epochDiff = 116444736000000000 // 1601 to 1970 in 100ns units
+	if ft < epochDiff {
+		return time.Time{}
+	}
+	ft -= epochDiff
+	return time.Unix(int64(ft/1e7), int64(ft%1e7)*100).UTC()
+}
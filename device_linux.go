@@ -0,0 +1,824 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Block device properties from sysfs, and the commands that sanitize a
+// whole drive: TRIM, ATA security erase and NVMe format.
+
+const (
+	_BLKDISCARD           = 0x1277
+	_BLKFLSBUF            = 0x1261
+	_SG_IO                = 0x2285
+	_NVME_IOCTL_ID        = 0x4e40
+	_NVME_IOCTL_ADMIN_CMD = 0xc0484e41
+
+	sgDxferNone    = -1
+	sgDxferToDev   = -2
+	sgDxferFromDev = -3
+)
+
+type sgIoHdr struct {
+	InterfaceId    int32
+	DxferDirection int32
+	CmdLen         uint8
+	MxSbLen        uint8
+	IovecCount     uint16
+	DxferLen       uint32
+	Dxferp         unsafe.Pointer
+	Cmdp           unsafe.Pointer
+	Sbp            unsafe.Pointer
+	Timeout        uint32 // in ms
+	Flags          uint32
+	PackId         int32
+	UsrPtr         unsafe.Pointer
+	Status         uint8
+	MaskedStatus   uint8
+	MsgStatus      uint8
+	SbLenWr        uint8
+	HostStatus     uint16
+	DriverStatus   uint16
+	Resid          int32
+	Duration       uint32
+	Info           uint32
+}
+
+type nvmeAdminCmd struct {
+	Opcode      uint8
+	Flags       uint8
+	_           uint16
+	Nsid        uint32
+	Cdw2, Cdw3  uint32
+	Metadata    uint64
+	Addr        uint64
+	MetadataLen uint32
+	DataLen     uint32
+	Cdw10       uint32
+	Cdw11       uint32
+	Cdw12       uint32
+	Cdw13       uint32
+	Cdw14       uint32
+	Cdw15       uint32
+	TimeoutMs   uint32
+	Result      uint32
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) (uintptr, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return r, errno
+	}
+	return r, nil
+}
+
+func readSysfs(path string) string {
+	b, _ := os.ReadFile(path)
+	return strings.TrimSpace(string(b))
+}
+
+// devNumber formats rdev as major:minor.
+func devNumber(rdev uint64) string {
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&^0xff
+	return fmt.Sprintf("%d:%d", major, minor)
+}
+
+// sysfsBlock returns the sysfs directory of the block device rdev.
+func sysfsBlock(rdev uint64) (string, error) {
+	return filepath.EvalSymlinks("/sys/dev/block/" + devNumber(rdev))
+}
+
+// blockDevNumber returns the major:minor of the block device at path.
+func blockDevNumber(path string) (string, bool) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return "", false
+	}
+	return devNumber(uint64(st.Rdev)), true
+}
+
+// mountPoints maps the major:minor of block devices to where they are
+// mounted. Filesystems such as btrfs report a device number of their own,
+// so the source device is looked up as well.
+func mountPoints() map[string][]string {
+	mounts := make(map[string][]string)
+	b, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return mounts
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+		mnt := fields[4]
+		mounts[fields[2]] = append(mounts[fields[2]], mnt)
+		if dev, ok := blockDevNumber(fields[sep+2]); ok && dev != fields[2] {
+			mounts[dev] = append(mounts[dev], mnt)
+		}
+	}
+	return mounts
+}
+
+// swapDevices returns the major:minor of the block devices used as swap.
+func swapDevices() map[string]bool {
+	swaps := make(map[string]bool)
+	b, err := os.ReadFile("/proc/swaps")
+	if err != nil {
+		return swaps
+	}
+	for _, line := range strings.Split(string(b), "\n")[1:] {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			if dev, ok := blockDevNumber(fields[0]); ok {
+				swaps[dev] = true
+			}
+		}
+	}
+	return swaps
+}
+
+// sysfsName names the block device at sys, with its device-mapper name
+// (as for dm-crypt and LVM volumes) if it has one.
+func sysfsName(sys string) string {
+	name := filepath.Base(sys)
+	if dm := readSysfs(filepath.Join(sys, "dm", "name")); dm != "" {
+		name += " (" + dm + ")"
+	}
+	return name
+}
+
+// deviceUsers lists what is using the block device f, or the partitions on
+// it: mounted filesystems, swap, and the device-mapper and md devices
+// (dm-crypt, LVM, RAID) built on them, and in turn whatever uses those.
+// /proc/mounts alone would miss a dm-crypt mapping left open.
+func deviceUsers(f *os.File) ([]string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return nil, err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return nil, nil
+	}
+	sys, err := sysfsBlock(uint64(st.Rdev))
+	if err != nil {
+		return nil, err
+	}
+
+	mounts, swaps := mountPoints(), swapDevices()
+	var users []string
+	var walk func(sys string, depth int)
+	walk = func(sys string, depth int) {
+		name, dev := sysfsName(sys), readSysfs(filepath.Join(sys, "dev"))
+		for _, mnt := range mounts[dev] {
+			users = append(users, fmt.Sprintf("%s is mounted on %s", name, mnt))
+		}
+		if swaps[dev] {
+			users = append(users, fmt.Sprintf("%s is in use as swap", name))
+		}
+		holders, _ := os.ReadDir(filepath.Join(sys, "holders"))
+		for _, h := range holders {
+			holder, err := filepath.EvalSymlinks(filepath.Join(sys, "holders", h.Name()))
+			if err != nil {
+				continue
+			}
+			users = append(users, fmt.Sprintf("%s is held by %s", name, sysfsName(holder)))
+			if depth < 8 {
+				walk(holder, depth+1)
+			}
+		}
+	}
+
+	for _, dir := range withPartitions(sys) {
+		walk(dir, 0)
+	}
+	return users, nil
+}
+
+// withPartitions returns the sysfs directory of a block device, followed
+// by those of its partitions if it is a whole drive.
+func withPartitions(sys string) []string {
+	dirs := []string{sys}
+	if _, err := os.Stat(filepath.Join(sys, "partition")); err == nil {
+		return dirs
+	}
+	entries, _ := os.ReadDir(sys)
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(sys, e.Name(), "partition")); err == nil {
+			dirs = append(dirs, filepath.Join(sys, e.Name()))
+		}
+	}
+	return dirs
+}
+
+// readMapper describes the block device at sys, if it is a device-mapper
+// device.
+func readMapper(sys string) *mapperDevice {
+	name := readSysfs(filepath.Join(sys, "dm", "name"))
+	if name == "" {
+		return nil
+	}
+	m := &mapperDevice{Name: name, UUID: readSysfs(filepath.Join(sys, "dm", "uuid"))}
+	slaves, _ := os.ReadDir(filepath.Join(sys, "slaves"))
+	for _, s := range slaves {
+		path := "/dev/" + s.Name()
+		if slave, err := filepath.EvalSymlinks(filepath.Join(sys, "slaves", s.Name())); err == nil {
+			if dm := readSysfs(filepath.Join(slave, "dm", "name")); dm != "" {
+				path = "/dev/mapper/" + dm
+			}
+		}
+		m.Slaves = append(m.Slaves, path)
+	}
+	return m
+}
+
+// deviceMappers returns the device-mapper device that f is, if it is one,
+// and those built directly on f or on its partitions.
+func deviceMappers(f *os.File) (self *mapperDevice, above []*mapperDevice, err error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return nil, nil, err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return nil, nil, nil
+	}
+	sys, err := sysfsBlock(uint64(st.Rdev))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	self = readMapper(sys)
+	for _, dir := range withPartitions(sys) {
+		holders, _ := os.ReadDir(filepath.Join(dir, "holders"))
+		for _, h := range holders {
+			holder, err := filepath.EvalSymlinks(filepath.Join(dir, "holders", h.Name()))
+			if err != nil {
+				continue
+			}
+			if m := readMapper(holder); m != nil {
+				above = append(above, m)
+			}
+		}
+	}
+	return self, above, nil
+}
+
+// diskID names the drive that the block device rdev is on, the same for
+// the drive and every partition on it.
+func diskID(rdev uint64) string {
+	sys, err := sysfsBlock(rdev)
+	if err != nil {
+		return fmt.Sprintf("%x", rdev)
+	}
+	if _, err := os.Stat(filepath.Join(sys, "partition")); err == nil {
+		sys = filepath.Dir(sys)
+	}
+	if dev := readSysfs(filepath.Join(sys, "dev")); dev != "" {
+		return strings.Replace(dev, ":", "-", 1)
+	}
+	return fmt.Sprintf("%x", rdev)
+}
+
+// probeDevice describes the drive that f is on, or returns nil if f is
+// not a block device.
+func probeDevice(f *os.File) (*deviceInfo, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return nil, err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return nil, nil
+	}
+
+	sys, err := sysfsBlock(uint64(st.Rdev))
+	if err != nil {
+		return nil, err
+	}
+
+	dev := &deviceInfo{}
+	disk := sys
+	if _, err := os.Stat(filepath.Join(sys, "partition")); err == nil {
+		dev.Partition = true
+		disk = filepath.Dir(sys)
+	}
+
+	dev.Name = filepath.Base(disk)
+	dev.Model = readSysfs(filepath.Join(disk, "device", "model"))
+	dev.Rotational = readSysfs(filepath.Join(disk, "queue", "rotational")) == "1"
+	dm := readSysfs(filepath.Join(disk, "queue", "discard_max_bytes"))
+	dev.Discard = dm != "" && dm != "0"
+
+	switch {
+	case strings.Contains(disk, "/usb"):
+		dev.Transport = "usb"
+	case strings.HasPrefix(dev.Name, "nvme"):
+		dev.Transport = "nvme"
+	case strings.Contains(disk, "/ata"):
+		dev.Transport = "ata"
+	case strings.Contains(disk, "/virtual/"):
+		dev.Transport = "virtual"
+	default:
+		dev.Transport = "scsi"
+	}
+
+	dev.Opal, dev.Locking = opalDiscovery(f, dev.Transport)
+	return dev, nil
+}
+
+// blockDevices lists the disks in /sys/block and the partitions on them.
+func blockDevices() ([]blockDevice, error) {
+	disks, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return nil, err
+	}
+
+	var devs []blockDevice
+	add := func(sys string, partition bool, model string) {
+		size, _ := strconv.ParseInt(readSysfs(filepath.Join(sys, "size")), 10, 64)
+		if size == 0 {
+			return // empty loop devices and drives without media
+		}
+		devs = append(devs, blockDevice{
+			Path:      "/dev/" + filepath.Base(sys),
+			Size:      size * 512,
+			Partition: partition,
+			Model:     model,
+		})
+	}
+
+	for _, d := range disks {
+		if strings.HasPrefix(d.Name(), "ram") || strings.HasPrefix(d.Name(), "zram") {
+			continue
+		}
+		sys := filepath.Join("/sys/block", d.Name())
+		model := readSysfs(filepath.Join(sys, "device", "model"))
+		add(sys, false, model)
+
+		parts, _ := os.ReadDir(sys)
+		for _, p := range parts {
+			if _, err := os.Stat(filepath.Join(sys, p.Name(), "partition")); err == nil {
+				add(filepath.Join(sys, p.Name()), true, model)
+			}
+		}
+	}
+	return devs, nil
+}
+
+// discardRange tells the drive that n bytes at off are no longer used.
+func discardRange(f *os.File, off, n int64) error {
+	r := [2]uint64{uint64(off), uint64(n)}
+	_, err := ioctl(f, _BLKDISCARD, unsafe.Pointer(&r))
+	if err != nil {
+		return os.NewSyscallError("BLKDISCARD", err)
+	}
+	return nil
+}
+
+// flushDevice syncs f and flushes the buffer cache of a block device,
+// then asks a SCSI or SATA drive to write out its volatile cache.
+func flushDevice(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeDevice == 0 {
+		return err
+	}
+	if _, err := ioctl(f, _BLKFLSBUF, nil); err != nil {
+		return os.NewSyscallError("BLKFLSBUF", err)
+	}
+
+	// SYNCHRONIZE CACHE (10), which NVMe drives do not take, but the
+	// fsync above already flushed them
+	cdb := []byte{0x35, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if err := sgio(f, cdb, nil, sgDxferNone, 60000); err != nil && !errors.Is(err, syscall.ENOTTY) && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	return nil
+}
+
+// punchHole deallocates n bytes at off of a file, which then read as
+// zeros, keeping the size of the file.
+func punchHole(f *os.File, off, n int64) error {
+	const (
+		fallocKeepSize  = 0x01
+		fallocPunchHole = 0x02
+	)
+	if err := syscall.Fallocate(int(f.Fd()), fallocKeepSize|fallocPunchHole, off, n); err != nil {
+		return os.NewSyscallError("fallocate", err)
+	}
+	return nil
+}
+
+// sgio sends a SCSI command, transferring data in the direction dir.
+func sgio(f *os.File, cdb, data []byte, dir int32, timeoutMs uint32) error {
+	sense := make([]byte, 32)
+	hdr := sgIoHdr{
+		InterfaceId:    'S',
+		DxferDirection: dir,
+		CmdLen:         uint8(len(cdb)),
+		MxSbLen:        uint8(len(sense)),
+		DxferLen:       uint32(len(data)),
+		Cmdp:           unsafe.Pointer(&cdb[0]),
+		Sbp:            unsafe.Pointer(&sense[0]),
+		Timeout:        timeoutMs,
+	}
+	if len(data) > 0 {
+		hdr.Dxferp = unsafe.Pointer(&data[0])
+	}
+
+	_, err := ioctl(f, _SG_IO, unsafe.Pointer(&hdr))
+	runtime.KeepAlive(cdb)
+	runtime.KeepAlive(data)
+	if err != nil {
+		return os.NewSyscallError("SG_IO", err)
+	}
+	if hdr.Status != 0 || hdr.HostStatus != 0 {
+		return fmt.Errorf("command 0x%02x failed, status 0x%x, sense %x",
+			cdb[0], hdr.Status, sense[:hdr.SbLenWr])
+	}
+	return nil
+}
+
+// ATA PASS-THROUGH (16) protocols
+const (
+	ataNonData   = 3
+	ataPioIn     = 4
+	ataPioOut    = 5
+	ataPassThru  = 0x85
+	ataTimeoutMs = 30 * 1000
+)
+
+// ataCommand sends an ATA command with at most one sector of data.
+func ataCommand(f *os.File, cmd byte, protocol byte, data []byte, timeoutMs uint32) error {
+	cdb := make([]byte, 16)
+	cdb[0] = ataPassThru
+	cdb[1] = protocol << 1
+	dir := int32(sgDxferNone)
+	switch protocol {
+	case ataPioIn:
+		cdb[2] = 0x0e // from device, length in sector count
+		dir = sgDxferFromDev
+	case ataPioOut:
+		cdb[2] = 0x06
+		dir = sgDxferToDev
+	}
+	if len(data) > 0 {
+		cdb[6] = 1
+	}
+	cdb[14] = cmd
+	return sgio(f, cdb, data, dir, timeoutMs)
+}
+
+// ataIdentify returns the IDENTIFY DEVICE data.
+func ataIdentify(f *os.File) ([]byte, error) {
+	id := make([]byte, 512)
+	return id, ataCommand(f, 0xec, ataPioIn, id, ataTimeoutMs)
+}
+
+// deviceAction spins down, ejects or powers off the drive that f is on.
+func deviceAction(f *os.File, action string) error {
+	dev, err := probeDevice(f)
+	if err != nil {
+		return err
+	}
+	if dev == nil {
+		return errors.New("not a block device")
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if dev.Transport == "nvme" || dev.Transport == "virtual" {
+		return fmt.Errorf("not supported for %s drives", dev.Transport)
+	}
+
+	d, err := os.OpenFile("/dev/"+dev.Name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	switch action {
+	case "eject":
+		return startStopUnit(d, 0x02) // load/eject, stop
+	case "standby":
+		return spinDown(d, dev)
+	case "poweroff":
+		if err := spinDown(d, dev); err != nil {
+			return err
+		}
+		// the kernel forgets the drive, and USB bridges turn it off
+		return os.WriteFile(filepath.Join("/sys/block", dev.Name, "device", "delete"), []byte("1"), 0)
+	}
+	return fmt.Errorf("unknown action %q", action)
+}
+
+// spinDown puts the drive into standby.
+func spinDown(f *os.File, dev *deviceInfo) error {
+	if dev.Transport == "ata" {
+		return ataCommand(f, 0xe0, ataNonData, nil, ataTimeoutMs) // STANDBY IMMEDIATE
+	}
+	return startStopUnit(f, 0)
+}
+
+// startStopUnit sends START STOP UNIT with the given power flags.
+func startStopUnit(f *os.File, flags byte) error {
+	return sgio(f, []byte{0x1b, 0, 0, 0, flags, 0}, nil, sgDxferNone, 60000)
+}
+
+// errFrozen explains why a drive with frozen security cannot be erased.
+var errFrozen = errors.New("drive security is frozen: the BIOS issued SECURITY FREEZE LOCK at boot, " +
+	"so no security command is accepted until the drive is power cycled")
+
+// ataSecurityFrozen reports whether the security feature set of the drive
+// is frozen.
+func ataSecurityFrozen(f *os.File) (bool, error) {
+	id, err := ataIdentify(f)
+	if err != nil {
+		return false, err
+	}
+	return binary.LittleEndian.Uint16(id[128*2:])&0x08 != 0, nil
+}
+
+// unfreezeBySuspend suspends the machine to RAM for a few seconds, waking
+// it with the RTC alarm. Most BIOSes do not freeze drives again on resume,
+// and the drives come back up unfrozen.
+func unfreezeBySuspend() error {
+	const alarm = "/sys/class/rtc/rtc0/wakealarm"
+	if err := os.WriteFile(alarm, []byte("0"), 0); err != nil {
+		return fmt.Errorf("can't set wake alarm: %v", err)
+	}
+	if err := os.WriteFile(alarm, []byte("+10"), 0); err != nil {
+		return fmt.Errorf("can't set wake alarm: %v", err)
+	}
+	fmt.Printf("suspending to RAM, the machine will wake up in 10 seconds...\n")
+	if err := os.WriteFile("/sys/power/state", []byte("mem"), 0); err != nil {
+		return fmt.Errorf("can't suspend: %v", err)
+	}
+	return nil
+}
+
+// ataSecurityErase sets a temporary user password and issues SECURITY
+// ERASE UNIT, which clears the password again when it completes.
+func ataSecurityErase(f *os.File) error {
+	id, err := ataIdentify(f)
+	if err != nil {
+		return err
+	}
+	security := binary.LittleEndian.Uint16(id[128*2:])
+	if security&1 == 0 {
+		return errors.New("drive does not support the ATA security feature set")
+	}
+	if security&0x08 != 0 {
+		return errFrozen
+	}
+
+	// word 89 is the estimated erase time in units of 2 minutes
+	minutes := uint32(binary.LittleEndian.Uint16(id[89*2:])&0xff) * 2
+	if minutes == 0 {
+		minutes = 240
+	}
+	timeout := (minutes + 60) * 60 * 1000
+
+	pw := make([]byte, 512)
+	copy(pw[2:], "blwipe")
+	if err := ataCommand(f, 0xf1, ataPioOut, pw, ataTimeoutMs); err != nil {
+		return fmt.Errorf("SECURITY SET PASSWORD: %v", err)
+	}
+	if err := ataCommand(f, 0xf3, ataNonData, nil, ataTimeoutMs); err != nil {
+		return fmt.Errorf("SECURITY ERASE PREPARE: %v", err)
+	}
+
+	// enhanced erase also covers reallocated sectors, if supported
+	if security&0x20 != 0 {
+		pw[0] = 0x02
+	}
+	fmt.Printf("ATA security erase in progress, this may take up to %d minutes...\n", minutes)
+	if err := ataCommand(f, 0xf4, ataPioOut, pw, timeout); err != nil {
+		return fmt.Errorf("SECURITY ERASE UNIT: %v (the drive may be left locked with password \"blwipe\")", err)
+	}
+	return nil
+}
+
+// nvmeAdmin sends an admin command to the controller of namespace nsid.
+func nvmeAdmin(f *os.File, cmd *nvmeAdminCmd, data []byte) error {
+	if len(data) > 0 {
+		cmd.Addr = uint64(uintptr(unsafe.Pointer(&data[0])))
+		cmd.DataLen = uint32(len(data))
+	}
+	_, err := ioctl(f, _NVME_IOCTL_ADMIN_CMD, unsafe.Pointer(cmd))
+	runtime.KeepAlive(data)
+	if err != nil {
+		return os.NewSyscallError("NVME_IOCTL_ADMIN_CMD", err)
+	}
+	return nil
+}
+
+// nvmeFormat formats the namespace with the user data erase setting,
+// keeping its current LBA format.
+func nvmeFormat(f *os.File) error {
+	nsid, err := ioctl(f, _NVME_IOCTL_ID, nil)
+	if err != nil {
+		return os.NewSyscallError("NVME_IOCTL_ID", err)
+	}
+
+	ns := make([]byte, 4096)
+	err = nvmeAdmin(f, &nvmeAdminCmd{Opcode: 0x06, Nsid: uint32(nsid)}, ns)
+	if err != nil {
+		return fmt.Errorf("identify namespace: %v", err)
+	}
+	lbaf := uint32(ns[26] & 0x0f)
+
+	fmt.Printf("NVMe format in progress...\n")
+	err = nvmeAdmin(f, &nvmeAdminCmd{
+		Opcode:    0x80,
+		Nsid:      uint32(nsid),
+		Cdw10:     lbaf | 1<<9, // user data erase
+		TimeoutMs: 4 * 60 * 60 * 1000,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("format: %v", err)
+	}
+	return nil
+}
+
+// secureErase erases the whole drive using its own sanitize command.
+func secureErase(f *os.File, dev *deviceInfo) error {
+	switch dev.Transport {
+	case "nvme":
+		return nvmeFormat(f)
+	case "ata":
+		return ataSecurityErase(f)
+	}
+	return fmt.Errorf("secure erase is not supported over %s", dev.Transport)
+}
+
+// opalDiscovery reads the TCG level 0 discovery data to find out whether
+// the drive is a self-encrypting drive, and whether locking is enabled.
+func opalDiscovery(f *os.File, transport string) (opal, locking bool) {
+	data := make([]byte, 2048)
+	var err error
+	switch transport {
+	case "nvme":
+		// security receive, protocol 1, ComID 1
+		err = nvmeAdmin(f, &nvmeAdminCmd{Opcode: 0x82, Cdw10: 1<<24 | 1<<8,
+			Cdw11: uint32(len(data))}, data)
+	case "ata", "scsi":
+		cdb := []byte{0xa2, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0x08, 0x00, 0, 0}
+		err = sgio(f, cdb, data, sgDxferFromDev, ataTimeoutMs)
+	default:
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	n := int(binary.BigEndian.Uint32(data)) + 4
+	if n > len(data) {
+		n = len(data)
+	}
+	for off := 48; off+4 <= n; {
+		code := binary.BigEndian.Uint16(data[off:])
+		flen := int(data[off+3])
+		switch {
+		case code == 0x0002 && off+4 < n:
+			locking = data[off+4]&0x02 != 0
+		case code == 0x0200 || code == 0x0203:
+			opal = true
+		}
+		off += 4 + flen
+	}
+	return
+}
+
+// readCapacity returns the number of logical blocks on a SCSI drive and
+// their length, which may include PI that the kernel does not support.
+func readCapacity(f *os.File) (blocks int64, length int, err error) {
+	data := make([]byte, 32)
+	cdb := []byte{0x9e, 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, byte(len(data)), 0, 0}
+	if err := sgio(f, cdb, data, sgDxferFromDev, 30000); err != nil {
+		return 0, 0, err
+	}
+	return int64(binary.BigEndian.Uint64(data)) + 1, int(binary.BigEndian.Uint32(data[8:])), nil
+}
+
+// scsiDisk reads and writes whole logical blocks of a drive with READ(16)
+// and WRITE(16), for block sizes that the block layer will not handle.
+type scsiDisk struct {
+	f      *os.File
+	blocks int64
+	length int64
+}
+
+// scsiMaxBlocks limits the size of a single transfer.
+const scsiMaxBlocks = 128
+
+func (d *scsiDisk) Size() int64 { return d.blocks * d.length }
+
+func (d *scsiDisk) transfer(op byte, lba int64, buf []byte, dir int32) error {
+	cdb := make([]byte, 16)
+	cdb[0] = op
+	binary.BigEndian.PutUint64(cdb[2:], uint64(lba))
+	binary.BigEndian.PutUint32(cdb[10:], uint32(int64(len(buf))/d.length))
+	return sgio(d.f, cdb, buf, dir, 60000)
+}
+
+func (d *scsiDisk) ReadAt(p []byte, off int64) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if off >= d.Size() {
+			return total, io.EOF
+		}
+		lba, within := off/d.length, off%d.length
+		count := (within + int64(len(p)) + d.length - 1) / d.length
+		if count > scsiMaxBlocks {
+			count = scsiMaxBlocks
+		}
+		if count > d.blocks-lba {
+			count = d.blocks - lba
+		}
+
+		buf := make([]byte, count*d.length)
+		if err := d.transfer(0x88, lba, buf, sgDxferFromDev); err != nil {
+			return total, err
+		}
+		n := copy(p, buf[within:])
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
+
+// WriteAt reads back the blocks that are only partly written, so the rest
+// of them, such as their PI, is preserved.
+func (d *scsiDisk) WriteAt(p []byte, off int64) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if off >= d.Size() {
+			return total, errors.New("scsi: write past the end of the drive")
+		}
+		lba, within := off/d.length, off%d.length
+		count := (within + int64(len(p)) + d.length - 1) / d.length
+		if count > scsiMaxBlocks {
+			count = scsiMaxBlocks
+		}
+		if count > d.blocks-lba {
+			count = d.blocks - lba
+		}
+
+		buf := make([]byte, count*d.length)
+		n := len(p)
+		if n > len(buf)-int(within) {
+			n = len(buf) - int(within)
+		}
+		if within != 0 || n%int(d.length) != 0 {
+			if err := d.transfer(0x88, lba, buf, sgDxferFromDev); err != nil {
+				return total, err
+			}
+		}
+		copy(buf[within:], p[:n])
+		if err := d.transfer(0x8a, lba, buf, sgDxferToDev); err != nil {
+			return total, err
+		}
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
+
+// rawSectors returns the drive that f is on if its sectors have PI
+// interleaved, reading it through SCSI commands when the kernel cannot.
+func rawSectors(f *os.File) (storage, int64, int) {
+	fi, err := f.Stat()
+	if err != nil || fi.Mode().IsRegular() {
+		return nil, 0, 0
+	}
+	blocks, length, err := readCapacity(f)
+	if err != nil || !isPISectorSize(length) {
+		return nil, 0, 0
+	}
+	return &scsiDisk{f: f, blocks: blocks, length: int64(length)}, blocks * int64(length), length
+}
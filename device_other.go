@@ -0,0 +1,49 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var errNoDeviceSupport = errors.New("not supported on this system")
+
+// probeDevice is only implemented on Linux, other systems treat every
+// target as an image.
+func probeDevice(f *os.File) (*deviceInfo, error) { return nil, nil }
+
+// diskID names the device rdev. Partitions aren't traced back to their
+// drive here.
+func diskID(rdev uint64) string { return fmt.Sprintf("%x", rdev) }
+
+func deviceUsers(f *os.File) ([]string, error) { return nil, nil }
+
+func deviceMappers(f *os.File) (*mapperDevice, []*mapperDevice, error) { return nil, nil, nil }
+
+func blockDevices() ([]blockDevice, error) { return nil, errNoDeviceSupport }
+
+func iscsiDevice(t *iscsiTarget) (string, error) {
+	return "", errors.New("iSCSI targets are only supported on Linux")
+}
+
+func discardRange(f *os.File, off, n int64) error { return errNoDeviceSupport }
+
+func flushDevice(f *os.File) error { return f.Sync() }
+
+func punchHole(f *os.File, off, n int64) error { return errNoDeviceSupport }
+
+func ataSecurityFrozen(f *os.File) (bool, error) { return false, errNoDeviceSupport }
+
+func unfreezeBySuspend() error { return errNoDeviceSupport }
+
+func deviceAction(f *os.File, action string) error { return errNoDeviceSupport }
+
+func secureErase(f *os.File, dev *deviceInfo) error { return errNoDeviceSupport }
+
+func rawSectors(f *os.File) (storage, int64, int) { return nil, 0, 0 }
@@ -0,0 +1,102 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// With -direct, writes bypass the operating system's cache and go straight
+// to the device: O_DIRECT on Linux, unbuffered and overlapped I/O on
+// Windows. Such writes must be aligned to the sector size, in offset,
+// length and memory, so those that are not still go through the cache.
+
+const (
+	directMemAlign = 4096
+	directChunk    = 1 << 20
+)
+
+// directWriter writes to the target without caching.
+type directWriter interface {
+	io.WriterAt
+	io.Closer
+}
+
+// directDisk reads through f as usual, and writes what it can through w.
+type directDisk struct {
+	f     *os.File
+	w     directWriter
+	size  int64
+	align int64
+
+	bufs sync.Pool
+}
+
+// openDirect opens path, which is already open as f, for direct writes.
+func openDirect(path string, f *os.File, size int64) (*directDisk, error) {
+	w, align, err := openDirectWriter(path, f)
+	if err != nil {
+		return nil, fmt.Errorf("can't open %s for direct I/O: %v", path, err)
+	}
+	d := &directDisk{f: f, w: w, size: size, align: align}
+	d.bufs.New = func() interface{} { return alignedBuffer(directChunk) }
+	fmt.Printf("writing directly to the device, in multiples of %d bytes\n", align)
+	return d, nil
+}
+
+// alignedBuffer returns n bytes starting at an address that direct I/O
+// accepts.
+func alignedBuffer(n int) []byte {
+	b := make([]byte, n+directMemAlign)
+	skip := int(-uintptr(unsafe.Pointer(&b[0])) & (directMemAlign - 1))
+	return b[skip : skip+n]
+}
+
+func (d *directDisk) Size() int64 { return d.size }
+
+func (d *directDisk) ReadAt(p []byte, off int64) (int, error) { return d.f.ReadAt(p, off) }
+
+func (d *directDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off%d.align != 0 {
+		return d.f.WriteAt(p, off)
+	}
+
+	buf := d.bufs.Get().([]byte)
+	defer d.bufs.Put(buf)
+	total := 0
+	for int64(len(p)) >= d.align {
+		n := copy(buf, p[:int64(len(p))/d.align*d.align])
+		if _, err := d.w.WriteAt(buf[:n], off); err != nil {
+			return total, err
+		}
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+
+	// a tail shorter than a sector
+	if len(p) > 0 {
+		n, err := d.f.WriteAt(p, off)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (d *directDisk) Sync() error { return d.f.Sync() }
+
+func (d *directDisk) Close() error {
+	err := d.w.Close()
+	if cerr := d.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const _BLKSSZGET = 0x1268
+
+// openDirectWriter opens path with O_DIRECT, returning the alignment its
+// writes need: the logical sector size of a block device, or a page for
+// files, which is enough for any filesystem.
+func openDirectWriter(path string, f *os.File) (directWriter, int64, error) {
+	align := int64(directMemAlign)
+	if size := logicalSectorSize(f); size > 0 && size <= directMemAlign {
+		align = size
+	}
+
+	mode := os.O_WRONLY | syscall.O_DIRECT
+	if durability.writeThrough {
+		mode |= os.O_SYNC
+	}
+	w, err := os.OpenFile(path, mode, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return w, align, nil
+}
+
+// logicalSectorSize returns the logical sector size of the block device f,
+// or 0 if it is not one.
+func logicalSectorSize(f *os.File) int64 {
+	if fi, err := f.Stat(); err != nil || fi.Mode()&os.ModeDevice == 0 {
+		return 0
+	}
+	var size int32
+	if _, err := ioctl(f, _BLKSSZGET, unsafe.Pointer(&size)); err != nil || size <= 0 {
+		return 0
+	}
+	return int64(size)
+}
@@ -0,0 +1,18 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+//go:build !linux && !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func openDirectWriter(path string, f *os.File) (directWriter, int64, error) {
+	return nil, 0, errors.New("not supported on this system")
+}
+
+func logicalSectorSize(f *os.File) int64 { return 0 }
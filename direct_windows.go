@@ -0,0 +1,111 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	_FILE_FLAG_NO_BUFFERING  = 0x20000000
+	_FILE_FLAG_WRITE_THROUGH = 0x80000000
+
+	_IOCTL_DISK_GET_DRIVE_GEOMETRY = 0x00070000
+)
+
+var (
+	procCreateEvent         = kernel32.NewProc("CreateEventW")
+	procGetOverlappedResult = kernel32.NewProc("GetOverlappedResult")
+)
+
+// overlappedFile writes to a handle opened for unbuffered, write-through,
+// overlapped I/O, so that the writes of several goroutines are all in
+// flight at once.
+type overlappedFile struct {
+	name string
+	h    syscall.Handle
+}
+
+// openDirectWriter opens path without buffering, returning the alignment
+// its writes need: the sector size of a drive, or a page for files.
+func openDirectWriter(path string, f *os.File) (directWriter, int64, error) {
+	align := int64(directMemAlign)
+	if size := logicalSectorSize(f); size > 0 && size <= directMemAlign {
+		align = size
+	}
+
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_WRITE,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING,
+		_FILE_FLAG_NO_BUFFERING|_FILE_FLAG_WRITE_THROUGH|syscall.FILE_FLAG_OVERLAPPED, 0)
+	if err != nil {
+		return nil, 0, os.NewSyscallError("CreateFile", err)
+	}
+	return &overlappedFile{path, h}, align, nil
+}
+
+func (o *overlappedFile) WriteAt(p []byte, off int64) (int, error) {
+	ev, _, err := procCreateEvent.Call(0, 1, 0, 0)
+	if ev == 0 {
+		return 0, os.NewSyscallError("CreateEvent", err)
+	}
+	defer syscall.CloseHandle(syscall.Handle(ev))
+
+	// on the heap, as the write refers to it until it completes
+	ov := new(syscall.Overlapped)
+	total := 0
+	for len(p) > 0 {
+		*ov = syscall.Overlapped{Offset: uint32(off), OffsetHigh: uint32(off >> 32), HEvent: syscall.Handle(ev)}
+		var done uint32
+		err := syscall.WriteFile(o.h, p, &done, ov)
+		if err == syscall.ERROR_IO_PENDING {
+			r, _, e := procGetOverlappedResult.Call(uintptr(o.h), uintptr(unsafe.Pointer(ov)),
+				uintptr(unsafe.Pointer(&done)), 1)
+			err = nil
+			if r == 0 {
+				err = e
+			}
+		}
+		runtime.KeepAlive(p)
+		if err != nil {
+			return total, &os.PathError{Op: "write", Path: o.name, Err: err}
+		}
+		if done == 0 {
+			return total, io.ErrShortWrite
+		}
+		p = p[done:]
+		off += int64(done)
+		total += int(done)
+	}
+	return total, nil
+}
+
+func (o *overlappedFile) Close() error { return syscall.CloseHandle(o.h) }
+
+// logicalSectorSize returns the sector size of the drive or volume f, or
+// 0 if it is not one.
+func logicalSectorSize(f *os.File) int64 {
+	var geometry struct {
+		Cylinders         int64
+		MediaType         uint32
+		TracksPerCylinder uint32
+		SectorsPerTrack   uint32
+		BytesPerSector    uint32
+	}
+	var returned uint32
+	err := syscall.DeviceIoControl(syscall.Handle(f.Fd()), _IOCTL_DISK_GET_DRIVE_GEOMETRY, nil, 0,
+		(*byte)(unsafe.Pointer(&geometry)), uint32(unsafe.Sizeof(geometry)), &returned, nil)
+	if err != nil {
+		return 0
+	}
+	return int64(geometry.BytesPerSector)
+}
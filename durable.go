@@ -0,0 +1,55 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+)
+
+// Making sure that what was written has reached the media, and is not
+// just sitting in a cache that a power cut would lose.
+
+type durabilityFlags struct {
+	syncRegions  bool // fsync after each region
+	writeThrough bool // open with O_SYNC, which is sent as FUA writes
+	flushCache   bool // flush the drive cache at the end
+	direct       bool // bypass the operating system's cache
+}
+
+var durability durabilityFlags
+
+func addDurabilityFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&durability.syncRegions, "fsync", false, "sync after each region is written")
+	fs.BoolVar(&durability.writeThrough, "fua", false, "write through the drive cache (FUA) where supported")
+	fs.BoolVar(&durability.flushCache, "flush-cache", false, "flush the drive cache when done")
+	fs.BoolVar(&durability.direct, "direct", false, "write straight to the device, bypassing the system cache")
+}
+
+// syncImage flushes what was written to w to the storage behind it.
+func syncImage(w io.WriterAt) error {
+	if v, ok := w.(*virtualDisk); ok {
+		w, _ = v.closer.(io.WriterAt)
+	}
+	if s, ok := w.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// flushImage syncs img and, for drives, flushes their volatile cache.
+func flushImage(img Image) {
+	fmt.Printf("flushing the drive cache...\n")
+	var err error
+	if f, ok := deviceFile(img); ok {
+		err = flushDevice(f)
+	} else {
+		err = syncImage(img)
+	}
+	if err != nil {
+		fatal("unable to flush the drive cache: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Editing of the metadata entries, keeping all three copies consistent.
+//
+// Note that the validation structure also carries an integrity datum keyed
+// with the VMK, which cannot be recomputed here; only the CRC is updated.
+
+var protectionFlagNames = map[string]uint16{
+	"clear-key":         ProtectionClearKey,
+	"tpm":               ProtectionTPM,
+	"startup-key":       ProtectionStartupKey,
+	"tpm-pin":           ProtectionTPMAndPIN,
+	"recovery-password": ProtectionRecoveryPassword,
+	"password":          ProtectionPassword,
+}
+
+// parseProtectionType accepts a protection type name or a hex value.
+func parseProtectionType(s string) (uint16, error) {
+	if t, ok := protectionFlagNames[s]; ok {
+		return t, nil
+	}
+	t, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		var names []string
+		for n := range protectionFlagNames {
+			names = append(names, n)
+		}
+		return 0, fmt.Errorf("unknown protector type %q, use one of %s", s, strings.Join(names, ", "))
+	}
+	return uint16(t), nil
+}
+
+// parseGuid parses a GUID in its usual string form, with or without braces.
+func parseGuid(s string) (Guid, error) {
+	var g Guid
+	s = strings.Trim(s, "{}")
+	var d [8]byte
+	var e [6]byte
+	_, err := fmt.Sscanf(strings.ToUpper(s), "%08X-%04X-%04X-%02X%02X-%02X%02X%02X%02X%02X%02X",
+		&g.A, &g.B, &g.C, &d[0], &d[1], &e[0], &e[1], &e[2], &e[3], &e[4], &e[5])
+	if err != nil || len(s) != 36 {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	copy(g.D[:], d[:2])
+	g.E = e
+	return g, nil
+}
+
+// rebuildMetadata returns the metadata block raw with its top-level datums
+// replaced by keep, sizes fixed up, followed by validation with an updated
+// CRC.
+func rebuildMetadata(raw, validation []byte, keep []Datum) []byte {
+	info, mh := parseMetadataBlock(raw)
+	entriesStart := metadataHeaderOffset + binary.Size(mh)
+
+	block := append([]byte(nil), raw[:entriesStart]...)
+	for _, d := range keep {
+		block = append(block, raw[d.Offset:d.Offset+int(d.Size)]...)
+	}
+
+	metaSize := uint32(len(block) - metadataHeaderOffset)
+	binary.LittleEndian.PutUint32(block[metadataHeaderOffset:], metaSize)
+	binary.LittleEndian.PutUint32(block[metadataHeaderOffset+12:], metaSize)
+
+	// version 2 sizes are in 16-byte units
+	if info.Version == 2 {
+		for len(block)%16 != 0 {
+			block = append(block, 0)
+		}
+		binary.LittleEndian.PutUint16(block[8:], uint16(len(block)/16))
+	} else {
+		binary.LittleEndian.PutUint16(block[8:], uint16(len(block)))
+	}
+
+	v := append([]byte(nil), validation...)
+	binary.LittleEndian.PutUint32(v[4:], crc32.ChecksumIEEE(block))
+	return append(block, v...)
+}
+
+// readValidCopy reads the first valid metadata copy, returning both its
+// checksummed part and all of it including the validation structure.
+func readValidCopy(r io.ReaderAt, offset int64, hdr *VolumeHeader) (info InfoStruct, raw, full []byte, err error) {
+	for i, off := range hdr.InfoOffsets {
+		b, size, err := info.ReadRaw(r, offset+int64(off))
+		if err != nil {
+			fmt.Printf("metadata block %d at 0x%x is bad: %v\n", i, off, err)
+			continue
+		}
+
+		full = make([]byte, size)
+		if err := readFullAt(r, full, offset+int64(off)); err != nil {
+			zeroize(b)
+			return info, nil, nil, err
+		}
+		return info, b, full, nil
+	}
+	return info, nil, nil, errors.New("no valid metadata block found")
+}
+
+// editMetadata applies edit to the datums of the first valid metadata
+// copy, and writes the result over all three copies.
+func editMetadata(f storage, offset int64, hdr *VolumeHeader, dryRun bool,
+	edit func([]Datum) ([]Datum, error)) error {
+
+	good, raw, full, err := readValidCopy(f, offset, hdr)
+	if err != nil {
+		return err
+	}
+	defer zeroize(raw, full)
+
+	datums := metadataDatums(raw)
+	keep, err := edit(datums)
+	if err != nil {
+		return err
+	}
+	if len(keep) == len(datums) {
+		return errors.New("nothing to change")
+	}
+
+	updated := rebuildMetadata(raw, full[len(raw):], keep)
+
+	// pad to cover everything the old copy occupied
+	if len(updated) < len(full) {
+		updated = append(updated, make([]byte, len(full)-len(updated))...)
+	}
+	defer zeroize(updated)
+
+	for i, off := range good.InfoOffsets {
+		fmt.Printf("rewriting metadata block %d at 0x%x size %s...\n", i, off, sizeString(int64(len(updated))))
+		if dryRun {
+			continue
+		}
+
+		if _, err := f.WriteAt(updated, offset+int64(off)); err != nil {
+			return fmt.Errorf("unable to write metadata block %d: %v", i, err)
+		}
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	for i, off := range good.InfoOffsets {
+		var info InfoStruct
+		if _, err := info.Read(f, offset+int64(off)); err != nil {
+			return fmt.Errorf("metadata block %d is bad after rewriting: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func cmdRemoveProtector(args []string) {
+	fs := newFlagSet("remove-protector", "<bitlocker-vol.img>")
+	offset := fs.Int64("offset", 0, "offset into volume")
+	id := fs.String("id", "", "identifier GUID of the key protector to remove")
+	typ := fs.String("type", "", "remove all key protectors of this type")
+	dryRun := fs.Bool("n", false, "only show what would be removed")
+	force := fs.Bool("force", false, "allow removing the last key protector")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 || (*id == "") == (*typ == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var match func(p *Protector) bool
+	if *id != "" {
+		guid, err := parseGuid(*id)
+		if err != nil {
+			fatal("%v", err)
+		}
+		match = func(p *Protector) bool { return p.KeyId == guid }
+	} else {
+		t, err := parseProtectionType(*typ)
+		if err != nil {
+			fatal("%v", err)
+		}
+		match = func(p *Protector) bool { return p.ProtectionType == t }
+	}
+
+	f, err := openTarget(fs.Arg(0), !*dryRun)
+	if err != nil {
+		fatal("can't open file: %s", err)
+	}
+	defer f.Close()
+
+	hdr, err := readHeader(f, *offset)
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	err = editMetadata(f, *offset, hdr, *dryRun, func(datums []Datum) ([]Datum, error) {
+		return removeProtectors(datums, match, *force)
+	})
+	if err != nil {
+		fatal("%v", err)
+	}
+}
+
+// removeProtectors drops the VMK datums matched by match.
+func removeProtectors(datums []Datum, match func(*Protector) bool, force bool) ([]Datum, error) {
+	var keep []Datum
+	remaining := 0
+	for _, d := range datums {
+		p, ok := parseProtector(&d)
+		if d.EntryType == EntryTypeVMK && ok && match(&p) {
+			fmt.Printf("removing key protector {%v} (%s)\n", p.KeyId, p.TypeName())
+			continue
+		}
+		if d.EntryType == EntryTypeVMK && ok {
+			remaining++
+		}
+		keep = append(keep, d)
+	}
+
+	if len(keep) == len(datums) {
+		return nil, errors.New("no matching key protector found")
+	}
+	if remaining == 0 && !force {
+		return nil, errors.New("refusing to remove the last key protector, use -force to override")
+	}
+	return keep, nil
+}
+
+func cmdReprotect(args []string) {
+	fs := newFlagSet("reprotect", "<bitlocker-vol.img>")
+	offset := fs.Int64("offset", 0, "offset into volume")
+	dryRun := fs.Bool("n", false, "only show what would be removed")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	f, err := openTarget(fs.Arg(0), !*dryRun)
+	if err != nil {
+		fatal("can't open file: %s", err)
+	}
+	defer f.Close()
+
+	hdr, err := readHeader(f, *offset)
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	err = editMetadata(f, *offset, hdr, *dryRun, func(datums []Datum) ([]Datum, error) {
+		var ps []Protector
+		for _, d := range datums {
+			if p, ok := parseProtector(&d); ok && d.EntryType == EntryTypeVMK {
+				ps = append(ps, p)
+			}
+		}
+		if !isSuspended(ps) {
+			return nil, errors.New("volume is not suspended, no clear key found")
+		}
+
+		return removeProtectors(datums, func(p *Protector) bool {
+			return p.ProtectionType == ProtectionClearKey
+		}, false)
+	})
+	if err != nil {
+		fatal("%v", err)
+	}
+}
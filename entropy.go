@@ -0,0 +1,139 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Wiping the metadata only amounts to a crypto-erase if the data area is
+// actually encrypted, so it is sampled to look for plaintext.
+
+const (
+	entropyBlockSize = 4096
+
+	// ciphertext comes out close to 8 bits per byte even for one block
+	entropyThreshold = 7.5
+)
+
+type entropySample struct {
+	Offset  int64
+	Entropy float64
+	Zero    bool
+}
+
+func (s *entropySample) low() bool { return !s.Zero && s.Entropy < entropyThreshold }
+
+// shannonEntropy returns the entropy of b in bits per byte.
+func shannonEntropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+
+	e := 0.0
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(b))
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+// sampleEntropy reads n randomly chosen blocks from the first size bytes
+// of r, leaving out the skip regions, and returns them sorted by offset.
+func sampleEntropy(r io.ReaderAt, size int64, skip []RegionDesc, n int) ([]entropySample, error) {
+	blocks := size / entropyBlockSize
+	if blocks == 0 {
+		return nil, nil
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	buf := make([]byte, entropyBlockSize)
+	seen := map[int64]bool{}
+
+	var samples []entropySample
+	for tries := 0; len(samples) < n && tries < n*4; tries++ {
+		off := rnd.Int63n(blocks) * entropyBlockSize
+		if seen[off] || overlapsAny(off, entropyBlockSize, skip) {
+			continue
+		}
+		seen[off] = true
+
+		if err := readFullAt(r, buf, off); err != nil {
+			return samples, err
+		}
+
+		s := entropySample{Offset: off, Zero: true}
+		for _, c := range buf {
+			if c != 0 {
+				s.Zero = false
+				break
+			}
+		}
+		if !s.Zero {
+			s.Entropy = shannonEntropy(buf)
+		}
+		samples = append(samples, s)
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Offset < samples[j].Offset })
+	return samples, nil
+}
+
+func overlapsAny(off, size int64, regions []RegionDesc) bool {
+	for _, r := range regions {
+		if off < r.Offset+r.Size && r.Offset < off+size {
+			return true
+		}
+	}
+	return false
+}
+
+// reportEntropy summarizes the samples, listing the ranges where
+// consecutive samples look like plaintext. It returns false if any did.
+func reportEntropy(samples []entropySample) bool {
+	if len(samples) == 0 {
+		fmt.Printf("entropy: nothing to sample\n")
+		return true
+	}
+
+	low, zero := 0, 0
+	for i := 0; i < len(samples); i++ {
+		if samples[i].Zero {
+			zero++
+			continue
+		}
+		if !samples[i].low() {
+			continue
+		}
+
+		j := i
+		for j+1 < len(samples) && samples[j+1].low() {
+			j++
+		}
+		low += j - i + 1
+		fmt.Printf("entropy: possible plaintext between 0x%x and 0x%x (%d sample(s), %.2f bits/byte)\n",
+			samples[i].Offset, samples[j].Offset+entropyBlockSize, j-i+1, samples[i].Entropy)
+		i = j
+	}
+
+	fmt.Printf("entropy: sampled %d blocks, %d low entropy, %d zero-filled\n",
+		len(samples), low, zero)
+	if zero > 0 {
+		fmt.Printf("entropy: zero-filled blocks are usually free space left by encrypting used space only\n")
+	}
+	if low > 0 {
+		fmt.Printf("WARNING: parts of the volume do not look encrypted, wiping the metadata will not make them unreadable\n")
+		return false
+	}
+	return true
+}
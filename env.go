@@ -0,0 +1,62 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+)
+
+// Flags can also be given in the environment, for deployments where the
+// command line is fixed. For the flag -sector-size of wipe, the first of
+// these that is set is used:
+//
+//	-sector-size on the command line
+//	BLWIPE_WIPE_SECTOR_SIZE
+//
+// Only flags of a command can be set this way, so a variable never
+// applies to commands it wasn't meant for, and not those that make a
+// command write where it otherwise wouldn't or override a safety check:
+// they have to be given on the command line every time.
+
+// envUnsafeFlags are the flags never taken from the environment.
+var envUnsafeFlags = map[string]bool{
+	"wipe": true, "all": true, "a": true, "force": true, "f": true, "yes": true,
+	"w": true, "shred": true, "tombstone": true, "clear-partition": true,
+	"wipe-partition-table": true, "punch-holes": true, "fix-header": true,
+	"unfreeze": true, "discard": true, "no-restore": true, "skip-header": true,
+}
+
+// flagEnvName returns the environment variable for flag name of the
+// command, or "" if it can't be set in the environment.
+func flagEnvName(command, name string) string {
+	if command == "" || envUnsafeFlags[name] {
+		return ""
+	}
+	upper := func(s string) string { return strings.ToUpper(strings.Replace(s, "-", "_", -1)) }
+	return "BLWIPE_" + upper(command) + "_" + upper(name)
+}
+
+// parseFlags parses args, then sets the flags that were not given from
+// the environment.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	fs.VisitAll(func(f *flag.Flag) {
+		env := flagEnvName(fs.Name(), f.Name)
+		if given[f.Name] || env == "" {
+			return
+		}
+		if val, ok := os.LookupEnv(env); ok {
+			if err := fs.Set(f.Name, val); err != nil {
+				fatal("invalid value %q for %s: %v", val, env, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestFlagEnvName(t *testing.T) {
+	tests := []struct {
+		command, flag, want string
+	}{
+		{"wipe", "report", "BLWIPE_WIPE_REPORT"},
+		{"wipe", "sector-size", "BLWIPE_WIPE_SECTOR_SIZE"},
+		{"find-keys", "offset", "BLWIPE_FIND_KEYS_OFFSET"},
+		{"", "report", ""}, // no command given
+		{"", "wipe", ""},
+		{"wipe", "force", ""},
+		{"sanitize", "force", ""},
+		{"wipefs", "all", ""},
+		{"wipefs", "a", ""},
+		{"wipefs", "f", ""},
+		{"scan", "wipe", ""},
+		{"find-keys", "shred", ""},
+		{"loop", "w", ""},
+	}
+	for _, tt := range tests {
+		if got := flagEnvName(tt.command, tt.flag); got != tt.want {
+			t.Errorf("flagEnvName(%q, %q) = %q, want %q", tt.command, tt.flag, got, tt.want)
+		}
+	}
+}
+
+func TestParseFlagsEnvironment(t *testing.T) {
+	t.Setenv("BLWIPE_WIPE_REPORT", "env.json")
+	t.Setenv("BLWIPE_WIPE_OPERATOR", "env")
+	t.Setenv("BLWIPE_WIPE_FORCE", "1")
+	t.Setenv("BLWIPE_WIPE", "1")
+	t.Setenv("BLWIPE_FORCE", "1")
+	t.Setenv("BLWIPE_SECTOR_SIZE", "4096")
+
+	newSet := func(name string) (*flag.FlagSet, *string, *string, *bool, *bool, *int) {
+		fs := flag.NewFlagSet(name, flag.ContinueOnError)
+		return fs, fs.String("report", "", ""), fs.String("operator", "", ""),
+			fs.Bool("force", false, ""), fs.Bool("wipe", false, ""), fs.Int("sector-size", 0, "")
+	}
+
+	fs, report, operator, force, wipe, sector := newSet("wipe")
+	parseFlags(fs, []string{"-operator", "alice", "img"})
+	if *report != "env.json" {
+		t.Errorf("-report is %q, want it from BLWIPE_WIPE_REPORT", *report)
+	}
+	if *operator != "alice" {
+		t.Errorf("-operator is %q, the command line should win", *operator)
+	}
+	if *force || *wipe {
+		t.Errorf("-force %v and -wipe %v were taken from the environment", *force, *wipe)
+	}
+	if *sector != 0 {
+		t.Errorf("-sector-size %d was taken from BLWIPE_SECTOR_SIZE", *sector)
+	}
+
+	// with no command, as in "blwipe img", nothing comes from it
+	fs, report, _, force, wipe, _ = newSet("")
+	parseFlags(fs, []string{"img"})
+	if *report != "" || *force || *wipe {
+		t.Errorf("without a command, -report %q, -force %v and -wipe %v", *report, *force, *wipe)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Reasons why BitLocker structures could not be parsed. Errors returned by
+// readHeader and InfoStruct.Read match one of these with errors.Is, and
+// still unwrap to the I/O error that caused them, if any.
+var (
+	ErrNotBitLocker       = errors.New("not a BitLocker volume")
+	ErrBadChecksum        = errors.New("checksum mismatch")
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	ErrTruncated          = errors.New("truncated structure")
+	ErrInvalidField       = errors.New("invalid field")
+)
+
+// FormatError is a parse failure of kind Kind, one of the sentinels above.
+type FormatError struct {
+	Kind error
+	Msg  string
+	Err  error // underlying error, if any
+}
+
+func (e *FormatError) Error() string {
+	if e.Err != nil {
+		return e.Msg + ": " + e.Err.Error()
+	}
+	return e.Msg
+}
+
+func (e *FormatError) Unwrap() error { return e.Err }
+
+func (e *FormatError) Is(target error) bool { return target == e.Kind }
+
+// ValidationError is a field of an on-disk structure holding a value that
+// is impossible, or would make the regions derived from it unsafe to use.
+// It matches ErrInvalidField.
+type ValidationError struct {
+	Struct string // e.g. "volume header"
+	Field  string
+	Value  uint64
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s 0x%x %s", e.Struct, e.Field, e.Value, e.Reason)
+}
+
+func (e *ValidationError) Is(target error) bool { return target == ErrInvalidField }
+
+func formatError(kind error, format string, a ...interface{}) error {
+	return &FormatError{Kind: kind, Msg: fmt.Sprintf(format, a...)}
+}
+
+// readError wraps an error from reading what, which is a truncated
+// structure if the data ran out.
+func readError(what string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &FormatError{ErrTruncated, "truncated " + what, err}
+	}
+	return fmt.Errorf("can't read %s: %w", what, err)
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// escrowChecker looks up whether the recovery key of a key protector has
+// been escrowed.
+type escrowChecker interface {
+	Escrowed(keyId Guid) (bool, error)
+	Close() error
+}
+
+// newEscrowChecker creates a checker for the escrow location u, which is
+// an ldap:// or ldaps:// URL of a directory with the base DN as the path,
+// graph://tenant for Entra ID, or an http(s):// URL template containing
+// "{guid}".
+func newEscrowChecker(u, user string) (escrowChecker, error) {
+	password := os.Getenv("BLWIPE_ESCROW_PASSWORD")
+
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsed.Scheme {
+	case "ldap", "ldaps":
+		c, err := dialLDAP(parsed.Scheme, parsed.Host)
+		if err != nil {
+			return nil, err
+		}
+		if user != "" {
+			if err := c.Bind(user, password); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+		return &adEscrow{c, strings.TrimPrefix(parsed.Path, "/")}, nil
+
+	case "graph":
+		return newGraphEscrow(graphTenant(parsed), user)
+
+	case "http", "https":
+		if !strings.Contains(u, "{guid}") {
+			return nil, fmt.Errorf("escrow URL %q must contain {guid}", u)
+		}
+		return &httpEscrow{
+			template: u,
+			user:     user,
+			password: password,
+			token:    os.Getenv("BLWIPE_ESCROW_TOKEN"),
+			client:   &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported escrow URL %q", u)
+}
+
+// adEscrow looks for the msFVE-RecoveryInformation objects that Active
+// Directory stores for each backed up recovery password.
+type adEscrow struct {
+	c    *ldapConn
+	base string
+}
+
+func (e *adEscrow) Escrowed(keyId Guid) (bool, error) {
+	var guid bytes.Buffer
+	binary.Write(&guid, binary.LittleEndian, keyId)
+
+	n, err := e.c.SearchEqual(e.base, map[string][]byte{
+		"objectClass":        []byte("msFVE-RecoveryInformation"),
+		"msFVE-RecoveryGuid": guid.Bytes(),
+	}, 1)
+	return n > 0, err
+}
+
+func (e *adEscrow) Close() error { return e.c.Close() }
+
+// httpEscrow queries a web service, such as an MBAM helpdesk or recovery
+// front-end, that answers 200 for escrowed keys and 404 for unknown ones.
+type httpEscrow struct {
+	template       string
+	user, password string
+	token          string
+	client         *http.Client
+
+	header    http.Header
+	lowercase bool
+}
+
+func (e *httpEscrow) Escrowed(keyId Guid) (bool, error) {
+	guid := keyId.String()
+	if e.lowercase {
+		guid = strings.ToLower(guid)
+	}
+
+	u := strings.Replace(e.template, "{guid}", guid, -1)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	for k, v := range e.header {
+		req.Header[k] = v
+	}
+	if e.token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.token)
+	} else if e.user != "" {
+		req.SetBasicAuth(e.user, e.password)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("escrow service returned %s", resp.Status)
+}
+
+func (e *httpEscrow) Close() error { return nil }
+
+// checkEscrow verifies that every recovery password protector in ps has
+// been escrowed, printing the result for each.
+func checkEscrow(c escrowChecker, ps []Protector) bool {
+	ok := true
+	found := false
+	for _, p := range ps {
+		if p.ProtectionType != ProtectionRecoveryPassword {
+			continue
+		}
+		found = true
+
+		escrowed, err := c.Escrowed(p.KeyId)
+		switch {
+		case err != nil:
+			fmt.Printf("recovery password {%v}: escrow lookup failed: %v\n", p.KeyId, err)
+			ok = false
+		case escrowed:
+			fmt.Printf("recovery password {%v}: escrowed\n", p.KeyId)
+		default:
+			fmt.Printf("recovery password {%v}: NOT escrowed\n", p.KeyId)
+			ok = false
+		}
+	}
+
+	if !found {
+		fmt.Printf("volume has no recovery password protector that could be escrowed\n")
+		return false
+	}
+	return ok
+}
@@ -0,0 +1,412 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EnCase Expert Witness (EWF/E01) evidence container support.
+// Evidence files are only ever opened for reading.
+
+const (
+	ewfSignature  = "EVF\x09\x0d\x0a\xff\x00"
+	ewf2Signature = "EVF2\x0d\x0a\x81\x00"
+
+	ewfFileHeaderSize  = 13
+	ewfSectionSize     = 76
+	ewfTableHeaderSize = 24
+
+	ewfCompressed = 1 << 31
+)
+
+var errReadOnly = errors.New("image is read-only")
+
+type ewfSectionDesc struct {
+	Type     [16]byte
+	Next     uint64
+	Size     uint64
+	_        [40]byte
+	Checksum uint32
+}
+
+// ewfTable locates the chunk offset table of one "table" section.
+type ewfTable struct {
+	seg        int
+	entriesOff int64
+	count      int64
+	base       int64
+	firstChunk int64
+
+	// end of the data of the last chunk in this table
+	end int64
+}
+
+type ewfDisk struct {
+	segs      []*os.File
+	size      int64
+	chunkSize int64
+	tables    []ewfTable
+
+	// most recently used table entries and chunk
+	cachedTable   int
+	cachedEntries []uint32
+	cachedChunk   int64
+	chunkBuf      []byte
+}
+
+func isEWF(f io.ReaderAt) bool {
+	sig := make([]byte, 8)
+	return readFullAt(f, sig, 0) == nil &&
+		(string(sig) == ewfSignature || string(sig) == ewf2Signature)
+}
+
+// ewfSegmentPath returns the path of segment n (1-based) of the set whose
+// first segment is at path, following the E01..E99, EAA..EZZ, FAA..
+// extension sequence.
+func ewfSegmentPath(path string, n int) string {
+	ext := filepath.Ext(path)
+	if len(ext) != 4 {
+		return ""
+	}
+
+	var next string
+	if n <= 99 {
+		next = fmt.Sprintf("%c%02d", ext[1], n)
+	} else {
+		n -= 100
+		next = fmt.Sprintf("%c%c%c", ext[1]+byte(n/(26*26)), 'A'+byte(n/26%26), 'A'+byte(n%26))
+	}
+	if ext[1] >= 'a' {
+		next = strings.ToLower(next)
+	} else {
+		next = strings.ToUpper(next)
+	}
+	return path[:len(path)-3] + next
+}
+
+func openEWF(path string) (*ewfDisk, error) {
+	d := &ewfDisk{cachedTable: -1, cachedChunk: -1}
+
+	for n := 1; ; n++ {
+		segPath := path
+		if n > 1 {
+			segPath = ewfSegmentPath(path, n)
+			if segPath == "" {
+				break
+			}
+		}
+
+		f, err := os.Open(segPath)
+		if os.IsNotExist(err) && n > 1 {
+			break
+		} else if err != nil {
+			d.Close()
+			return nil, err
+		}
+		d.segs = append(d.segs, f)
+
+		done, err := d.readSegment(len(d.segs)-1, f)
+		if err != nil {
+			d.Close()
+			return nil, fmt.Errorf("ewf: segment %s: %v", filepath.Base(segPath), err)
+		}
+		if done {
+			break
+		}
+	}
+
+	if d.chunkSize == 0 {
+		d.Close()
+		return nil, errors.New("ewf: volume section not found")
+	}
+
+	var chunks int64
+	for _, t := range d.tables {
+		chunks += t.count
+	}
+	if need := (d.size-1)/d.chunkSize + 1; chunks < need {
+		d.Close()
+		return nil, fmt.Errorf("ewf: only %d of %d chunks present, missing segments?", chunks, need)
+	}
+
+	return d, nil
+}
+
+// readSegment walks the section list of one segment file, recording its
+// chunk tables. It reports whether this is the last segment of the set.
+func (d *ewfDisk) readSegment(seg int, f *os.File) (done bool, err error) {
+	hdr := make([]byte, ewfFileHeaderSize)
+	if err = readFullAt(f, hdr, 0); err != nil {
+		return
+	}
+	if string(hdr[:8]) == ewf2Signature {
+		return false, errors.New("EWF2 (Ex01) containers are not supported yet, convert with ewfexport")
+	}
+	if string(hdr[:8]) != ewfSignature {
+		return false, errors.New("invalid signature")
+	}
+	if segNum := binary.LittleEndian.Uint16(hdr[9:]); int(segNum) != seg+1 {
+		return false, fmt.Errorf("unexpected segment number %d", segNum)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	fileSize := fi.Size()
+
+	var sections []int64
+	var tables []ewfTable
+
+	off := int64(ewfFileHeaderSize)
+	for {
+		buf := make([]byte, ewfSectionSize)
+		if err = readFullAt(f, buf, off); err != nil {
+			return false, fmt.Errorf("cannot read section at 0x%x: %v", off, err)
+		}
+
+		var desc ewfSectionDesc
+		binary.Read(bytes.NewReader(buf), binary.LittleEndian, &desc)
+		if sum := adler32.Checksum(buf[:72]); sum != desc.Checksum {
+			return false, fmt.Errorf("section checksum mismatch at 0x%x", off)
+		}
+
+		sections = append(sections, off)
+		typ := string(bytes.TrimRight(desc.Type[:], "\x00"))
+		data := off + ewfSectionSize
+
+		switch typ {
+		case "volume", "disk":
+			if err = d.readVolume(f, data); err != nil {
+				return
+			}
+
+		case "table":
+			// the entries have to be in the section, and the file
+			end := fileSize
+			if desc.Size >= ewfSectionSize && desc.Size <= uint64(fileSize-off) {
+				end = off + int64(desc.Size)
+			}
+			t, err := readEWFTable(f, data, end)
+			if err != nil {
+				return false, err
+			}
+			t.seg = seg
+			tables = append(tables, t)
+
+		case "done":
+			done = true
+		}
+
+		if typ == "next" || typ == "done" || int64(desc.Next) <= off {
+			break
+		}
+		off = int64(desc.Next)
+	}
+
+	// the last chunk of each table extends up to the next section
+	for i := range tables {
+		t := &tables[i]
+		entries, err := t.entries(f)
+		if err != nil {
+			return false, err
+		}
+		if t.count == 0 {
+			continue
+		}
+
+		last := t.base + int64(entries[t.count-1]&^ewfCompressed)
+		for _, s := range sections {
+			if s > last && (t.end == 0 || s < t.end) {
+				t.end = s
+			}
+		}
+		if t.end == 0 {
+			return false, errors.New("cannot find end of chunk data")
+		}
+
+		var first int64
+		if n := len(d.tables); n > 0 {
+			first = d.tables[n-1].firstChunk + d.tables[n-1].count
+		}
+		t.firstChunk = first
+		d.tables = append(d.tables, *t)
+	}
+
+	return done, nil
+}
+
+func (d *ewfDisk) readVolume(f io.ReaderAt, off int64) error {
+	buf := make([]byte, 24)
+	if err := readFullAt(f, buf, off); err != nil {
+		return fmt.Errorf("cannot read volume section: %v", err)
+	}
+
+	sectorsPerChunk := int64(binary.LittleEndian.Uint32(buf[8:]))
+	bytesPerSector := int64(binary.LittleEndian.Uint32(buf[12:]))
+	numSectors := binary.LittleEndian.Uint64(buf[16:])
+
+	// each is checked before they are multiplied, so that can't overflow
+	if sectorsPerChunk == 0 || bytesPerSector == 0 || sectorsPerChunk > 64<<20 || bytesPerSector > 64<<20 ||
+		sectorsPerChunk*bytesPerSector > 64<<20 {
+		return fmt.Errorf("invalid chunk geometry %d x %d", sectorsPerChunk, bytesPerSector)
+	}
+	if numSectors == 0 || numSectors > uint64(math.MaxInt64/bytesPerSector) {
+		return fmt.Errorf("invalid size of %d sectors of %d bytes", numSectors, bytesPerSector)
+	}
+
+	d.chunkSize = sectorsPerChunk * bytesPerSector
+	d.size = int64(numSectors) * bytesPerSector
+	return nil
+}
+
+// readEWFTable reads the header of the table section whose data is at
+// off, and whose entries must end by end.
+func readEWFTable(f io.ReaderAt, off, end int64) (ewfTable, error) {
+	buf := make([]byte, ewfTableHeaderSize)
+	if err := readFullAt(f, buf, off); err != nil {
+		return ewfTable{}, fmt.Errorf("cannot read table section: %v", err)
+	}
+	if sum := adler32.Checksum(buf[:20]); sum != binary.LittleEndian.Uint32(buf[20:]) {
+		return ewfTable{}, fmt.Errorf("table header checksum mismatch at 0x%x", off)
+	}
+
+	t := ewfTable{
+		entriesOff: off + ewfTableHeaderSize,
+		count:      int64(binary.LittleEndian.Uint32(buf)),
+		base:       int64(binary.LittleEndian.Uint64(buf[8:])),
+	}
+	if t.count > (end-t.entriesOff)/4 {
+		return ewfTable{}, fmt.Errorf("table at 0x%x of %d entries doesn't fit in its section", off, t.count)
+	}
+	if t.base < 0 {
+		return ewfTable{}, fmt.Errorf("table at 0x%x has an invalid base offset", off)
+	}
+	return t, nil
+}
+
+func (t *ewfTable) entries(f io.ReaderAt) ([]uint32, error) {
+	buf := make([]byte, t.count*4)
+	if err := readFullAt(f, buf, t.entriesOff); err != nil {
+		return nil, fmt.Errorf("cannot read table entries: %v", err)
+	}
+
+	entries := make([]uint32, t.count)
+	for i := range entries {
+		entries[i] = binary.LittleEndian.Uint32(buf[i*4:])
+	}
+	return entries, nil
+}
+
+func (d *ewfDisk) Size() int64 { return d.size }
+
+// chunk returns the decompressed contents of chunk n.
+func (d *ewfDisk) chunk(n int64) ([]byte, error) {
+	if n == d.cachedChunk {
+		return d.chunkBuf, nil
+	}
+
+	ti := 0
+	for ti < len(d.tables) && n >= d.tables[ti].firstChunk+d.tables[ti].count {
+		ti++
+	}
+	if ti == len(d.tables) {
+		return nil, fmt.Errorf("ewf: chunk %d not found", n)
+	}
+	t := &d.tables[ti]
+	f := d.segs[t.seg]
+
+	if ti != d.cachedTable {
+		entries, err := t.entries(f)
+		if err != nil {
+			return nil, err
+		}
+		d.cachedTable, d.cachedEntries = ti, entries
+	}
+
+	i := n - t.firstChunk
+	entry := d.cachedEntries[i]
+	start := t.base + int64(entry&^ewfCompressed)
+	end := t.end
+	if i+1 < t.count {
+		end = t.base + int64(d.cachedEntries[i+1]&^ewfCompressed)
+	}
+	if end <= start+4 {
+		return nil, fmt.Errorf("ewf: invalid extent for chunk %d", n)
+	}
+
+	data := make([]byte, d.chunkSize)
+	if entry&ewfCompressed != 0 {
+		zr, err := zlib.NewReader(io.NewSectionReader(f, start, end-start))
+		if err != nil {
+			return nil, fmt.Errorf("ewf: chunk %d: %v", n, err)
+		}
+		if _, err := io.ReadFull(zr, data); err != nil && err != io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("ewf: chunk %d: %v", n, err)
+		}
+	} else {
+		// uncompressed chunks carry a trailing adler32
+		size := end - start - 4
+		if size > d.chunkSize {
+			size = d.chunkSize
+		}
+		if err := readFullAt(f, data[:size], start); err != nil {
+			return nil, fmt.Errorf("ewf: chunk %d: %v", n, err)
+		}
+	}
+
+	d.cachedChunk, d.chunkBuf = n, data
+	return data, nil
+}
+
+func (d *ewfDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("ewf: negative offset")
+	}
+
+	total := 0
+	for len(p) > 0 {
+		if off >= d.size {
+			return total, io.EOF
+		}
+
+		data, err := d.chunk(off / d.chunkSize)
+		if err != nil {
+			return total, err
+		}
+
+		n := copy(p, data[off%d.chunkSize:])
+		if rem := d.size - off; int64(n) > rem {
+			n = int(rem)
+		}
+
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
+
+func (d *ewfDisk) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errReadOnly
+}
+
+func (d *ewfDisk) Close() error {
+	for _, f := range d.segs {
+		f.Close()
+	}
+	return nil
+}
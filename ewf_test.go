@@ -0,0 +1,152 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/adler32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ewfTestImage describes a single segment EWF image of two uncompressed
+// 512-byte chunks, filled with 0x11 and 0x22, for the tests to break.
+type ewfTestImage struct {
+	sectorsPerChunk, bytesPerSector uint32
+	numSectors                      uint64
+
+	tableCount uint32
+	tableBase  uint64
+	fileSize   int // to truncate to, if set
+}
+
+func newEWFTestImage() *ewfTestImage {
+	return &ewfTestImage{sectorsPerChunk: 1, bytesPerSector: 512, numSectors: 2, tableCount: 2}
+}
+
+// ewfSection appends a section descriptor and its data to b.
+func ewfSection(b []byte, typ string, data []byte, last bool) []byte {
+	desc := make([]byte, ewfSectionSize)
+	copy(desc, typ)
+	next := uint64(len(b) + ewfSectionSize + len(data))
+	if last {
+		next = uint64(len(b))
+	}
+	binary.LittleEndian.PutUint64(desc[16:], next)
+	binary.LittleEndian.PutUint64(desc[24:], uint64(ewfSectionSize+len(data)))
+	binary.LittleEndian.PutUint32(desc[72:], adler32.Checksum(desc[:72]))
+	return append(append(b, desc...), data...)
+}
+
+func (im *ewfTestImage) bytes() []byte {
+	b := append([]byte(ewfSignature), 1, 1, 0, 0, 0)
+
+	vol := make([]byte, 24)
+	binary.LittleEndian.PutUint32(vol[8:], im.sectorsPerChunk)
+	binary.LittleEndian.PutUint32(vol[12:], im.bytesPerSector)
+	binary.LittleEndian.PutUint64(vol[16:], im.numSectors)
+	b = ewfSection(b, "volume", vol, false)
+
+	var chunks []byte
+	var offsets []int
+	for _, c := range []byte{0x11, 0x22} {
+		offsets = append(offsets, len(b)+ewfSectionSize+len(chunks))
+		chunk := bytes.Repeat([]byte{c}, 512)
+		chunks = append(chunks, chunk...)
+		chunks = binary.LittleEndian.AppendUint32(chunks, adler32.Checksum(chunk))
+	}
+	b = ewfSection(b, "sectors", chunks, false)
+
+	table := make([]byte, ewfTableHeaderSize)
+	binary.LittleEndian.PutUint32(table, im.tableCount)
+	binary.LittleEndian.PutUint64(table[8:], im.tableBase)
+	binary.LittleEndian.PutUint32(table[20:], adler32.Checksum(table[:20]))
+	for _, off := range offsets {
+		table = binary.LittleEndian.AppendUint32(table, uint32(off))
+	}
+	b = ewfSection(b, "table", table, false)
+
+	b = ewfSection(b, "done", nil, true)
+	if im.fileSize != 0 {
+		b = b[:im.fileSize]
+	}
+	return b
+}
+
+// openEWFTestImage writes b to an E01 file and opens it.
+func openEWFTestImage(t *testing.T, b []byte) (*ewfDisk, error) {
+	path := filepath.Join(t.TempDir(), "test.E01")
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return openEWF(path)
+}
+
+func TestEWF(t *testing.T) {
+	d, err := openEWFTestImage(t, newEWFTestImage().bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.Size() != 1024 {
+		t.Errorf("size %d, want 1024", d.Size())
+	}
+	p := make([]byte, 1024)
+	if _, err := d.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := append(bytes.Repeat([]byte{0x11}, 512), bytes.Repeat([]byte{0x22}, 512)...)
+	if !bytes.Equal(p, want) {
+		t.Errorf("reads back as %x", p)
+	}
+	if _, err := d.WriteAt(p[:1], 0); err != errReadOnly {
+		t.Errorf("write: %v, want %v", err, errReadOnly)
+	}
+}
+
+func TestEWFMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*ewfTestImage)
+		want string
+	}{
+		{"no sectors", func(im *ewfTestImage) { im.numSectors = 0 }, "invalid size"},
+		{"oversized", func(im *ewfTestImage) { im.numSectors = 1 << 62 }, "invalid size"},
+		{"negative size", func(im *ewfTestImage) { im.numSectors = 1 << 63 }, "invalid size"},
+		{"sector size", func(im *ewfTestImage) { im.bytesPerSector = 0 }, "chunk geometry"},
+		{"huge sectors", func(im *ewfTestImage) { im.bytesPerSector = 0xffffffff }, "chunk geometry"},
+		{"huge chunks", func(im *ewfTestImage) { im.sectorsPerChunk = 1 << 20 }, "chunk geometry"},
+		{"oversized table", func(im *ewfTestImage) { im.tableCount = 0xffffffff }, "doesn't fit"},
+		{"table past its section", func(im *ewfTestImage) { im.tableCount = 3 }, "doesn't fit"},
+		{"negative base", func(im *ewfTestImage) { im.tableBase = 1 << 63 }, "invalid base offset"},
+		{"missing chunks", func(im *ewfTestImage) { im.tableCount = 1 }, "only 1 of 2 chunks"},
+		{"truncated table", func(im *ewfTestImage) { im.fileSize = 1325 }, "doesn't fit"},
+		{"truncated", func(im *ewfTestImage) { im.fileSize = 600 }, "cannot read section"},
+		{"no volume", func(im *ewfTestImage) { im.fileSize = 50 }, "cannot read section"},
+	}
+	for _, tt := range tests {
+		im := newEWFTestImage()
+		tt.edit(im)
+		d, err := openEWFTestImage(t, im.bytes())
+		if err == nil {
+			d.Close()
+			t.Errorf("%s: opened, size %d", tt.name, d.Size())
+		} else if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want an error about %q", tt.name, err, tt.want)
+		}
+	}
+
+	b := newEWFTestImage().bytes()
+	b[ewfFileHeaderSize+20] ^= 1
+	if d, err := openEWFTestImage(t, b); err == nil || !strings.Contains(err.Error(), "checksum") {
+		if d != nil {
+			d.Close()
+		}
+		t.Errorf("corrupt section descriptor: %v, want a checksum error", err)
+	}
+}
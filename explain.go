@@ -0,0 +1,247 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Annotated hexdumps of the on-disk structures, naming every field next
+// to the bytes that hold it.
+
+var valueTypeNames = map[uint16]string{
+	ValueTypeErased:        "erased",
+	ValueTypeKey:           "key",
+	ValueTypeUnicodeString: "unicode string",
+	ValueTypeStretchKey:    "stretch key",
+	ValueTypeUseKey:        "use key",
+	ValueTypeAesCcmKey:     "AES-CCM encrypted key",
+	ValueTypeTpmKey:        "TPM encoded key",
+	ValueTypeValidation:    "validation",
+	ValueTypeVMK:           "VMK",
+	ValueTypeExternalKey:   "external key",
+	ValueTypeUpdate:        "update",
+	ValueTypeError:         "error",
+	ValueTypeOffsetSize:    "offset and size",
+}
+
+// structField is a field of an on-disk structure and where it lies.
+type structField struct {
+	Offset int
+	Size   int
+	Name   string
+	Value  interface{} // nil for reserved fields
+}
+
+// structFields lists the fields of the struct pointed to by v, as laid
+// out by encoding/binary, starting at base. Embedded structs are flattened.
+func structFields(v interface{}, base int) []structField {
+	var fields []structField
+	val := reflect.Indirect(reflect.ValueOf(v))
+	off := base
+	for i := 0; i < val.NumField(); i++ {
+		f := val.Type().Field(i)
+		size := binary.Size(reflect.New(f.Type).Interface())
+		switch {
+		case f.Anonymous:
+			fields = append(fields, structFields(val.Field(i).Addr().Interface(), off)...)
+		case f.Name == "_":
+			fields = append(fields, structField{off, size, "reserved", nil})
+		default:
+			fields = append(fields, structField{off, size, f.Name, val.Field(i).Interface()})
+		}
+		off += size
+	}
+	return fields
+}
+
+// formatFieldValue shows a field value the way it is usually written.
+func formatFieldValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case Guid:
+		return "{" + v.String() + "}"
+	case [8]byte:
+		return fmt.Sprintf("%q", v[:])
+	case [3]byte:
+		return fmt.Sprintf("%x", v[:])
+	case uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%d (0x%x)", v, v)
+	case [3]uint64, [2]uint64:
+		var s []string
+		rv := reflect.ValueOf(v)
+		for i := 0; i < rv.Len(); i++ {
+			s = append(s, fmt.Sprintf("0x%x", rv.Index(i).Uint()))
+		}
+		return strings.Join(s, ", ")
+	}
+	return fmt.Sprint(v)
+}
+
+// hexField prints the bytes of b at off, 16 to a line, with note next to
+// the first line. Long runs of zeros are collapsed.
+func hexField(w io.Writer, base int64, off int, b []byte, note string) {
+	if len(b) > 32 && allZero(b) {
+		fmt.Fprintf(w, "  0x%06x  %-48s  %s\n", base+int64(off), fmt.Sprintf("(%d zero bytes)", len(b)), note)
+		return
+	}
+	for i := 0; i < len(b) || i == 0; i += 16 {
+		end := i + 16
+		if end > len(b) {
+			end = len(b)
+		}
+		var hex strings.Builder
+		for _, c := range b[i:end] {
+			fmt.Fprintf(&hex, "%02x ", c)
+		}
+		fmt.Fprintf(w, "  0x%06x  %-48s  %s\n", base+int64(off+i), hex.String(), note)
+		note = ""
+	}
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// explainStruct dumps raw, which holds the struct v at off, field by field.
+func explainStruct(w io.Writer, base int64, raw []byte, v interface{}, off int) {
+	for _, f := range structFields(v, off) {
+		if f.Offset+f.Size > len(raw) {
+			break
+		}
+		note := f.Name
+		if s := formatFieldValue(f.Value); s != "" {
+			note += " = " + s
+		}
+		hexField(w, base, f.Offset, raw[f.Offset:f.Offset+f.Size], note)
+	}
+}
+
+// explainDatums dumps the datums in raw[start:end], showing nested ones
+// inside key protectors.
+func explainDatums(w io.Writer, base int64, raw []byte, start, end int, depth int) {
+	indent := strings.Repeat("  ", depth)
+	for _, d := range parseDatums(raw, start, end) {
+		name, ok := entryTypeNames[d.EntryType]
+		if !ok {
+			name = fmt.Sprintf("type 0x%04x", d.EntryType)
+		}
+		vt, ok := valueTypeNames[d.ValueType]
+		if !ok {
+			vt = fmt.Sprintf("0x%04x", d.ValueType)
+		}
+		fmt.Fprintf(w, "%s%s datum (%s value), %d bytes:\n", indent, name, vt, d.Size)
+		explainStruct(w, base, raw, &d.DatumHeader, d.Offset)
+
+		value := d.Offset + datumHeaderSize
+		valueEnd := d.Offset + int(d.Size)
+		switch d.ValueType {
+		case ValueTypeVMK:
+			if p, ok := parseProtector(&d); ok {
+				explainStruct(w, base, raw, &p, value)
+				explainDatums(w, base, raw, value+protectorHeaderSize, valueEnd, depth+1)
+				continue
+			}
+		case ValueTypeUnicodeString:
+			hexField(w, base, value, raw[value:valueEnd], fmt.Sprintf("value = %q", decodeUTF16(d.Value)))
+			continue
+		}
+		if valueEnd > value {
+			hexField(w, base, value, raw[value:valueEnd], "value")
+		}
+	}
+}
+
+// explainMetadata dumps the metadata block at base, including its
+// validation structure.
+func explainMetadata(w io.Writer, r io.ReaderAt, base int64) error {
+	var info InfoStruct
+	raw, size, err := info.ReadRaw(r, base)
+	if err != nil {
+		// show what is there anyway, it may show why it is bad
+		raw = make([]byte, binary.Size(info))
+		if err := readFullAt(r, raw, base); err != nil {
+			return err
+		}
+		binary.Read(bytes.NewReader(raw), binary.LittleEndian, &info)
+		explainStruct(w, base, raw, &info, 0)
+		return err
+	}
+
+	defer zeroize(raw)
+	fmt.Fprintf(w, "information structure:\n")
+	explainStruct(w, base, raw, &info, 0)
+
+	_, mh := parseMetadataBlock(raw)
+	fmt.Fprintf(w, "metadata header:\n")
+	explainStruct(w, base, raw, &mh, metadataHeaderOffset)
+
+	entries := metadataHeaderOffset + binary.Size(mh)
+	explainDatums(w, base, raw, entries, metadataHeaderOffset+int(mh.MetadataSize), 0)
+
+	// validation follows the checksummed part
+	vraw := make([]byte, size-int64(len(raw)))
+	if err := readFullAt(r, vraw, base+int64(len(raw))); err != nil {
+		return err
+	}
+	var v ValidationHeader
+	binary.Read(bytes.NewReader(vraw), binary.LittleEndian, &v)
+	fmt.Fprintf(w, "validation (CRC32 of the %d bytes above, computed %08x):\n",
+		len(raw), crc32.ChecksumIEEE(raw))
+	explainStruct(w, base+int64(len(raw)), vraw, &v, 0)
+	if hdrSize := binary.Size(v); len(vraw) > hdrSize {
+		hexField(w, base+int64(len(raw)), hdrSize, vraw[hdrSize:], "integrity data")
+	}
+	return nil
+}
+
+func cmdExplain(args []string) {
+	fs := newFlagSet("explain", "<bitlocker-vol.img>")
+	offset := fs.Int64("offset", 0, "offset into volume")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	f, err := openTarget(fs.Arg(0), false)
+	if err != nil {
+		fatal("can't open file: %s", err)
+	}
+	defer f.Close()
+
+	hdr, err := readHeader(f, *offset)
+	if err != nil {
+		fatal("%v", err)
+	}
+	raw := make([]byte, binary.Size(hdr))
+	if err := readFullAt(f, raw, *offset); err != nil {
+		fatal("can't read header: %v", err)
+	}
+
+	fmt.Printf("volume header at 0x%x:\n", *offset)
+	explainStruct(os.Stdout, *offset, raw, hdr, 0)
+
+	for i, off := range hdr.InfoOffsets {
+		fmt.Printf("\nmetadata block %d at 0x%x:\n", i, *offset+int64(off))
+		if err := explainMetadata(os.Stdout, f, *offset+int64(off)); err != nil {
+			fmt.Printf("metadata block %d is bad: %v\n", i, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// exportMetadata saves the structures of a BitLocker volume to a sparse
+// image of the same size, with everything else left as holes. The
+// structures are at their original offsets, so dislocker (dislocker-metadata)
+// and libbde (bdeinfo) read the export as they would the volume itself,
+// and it can be kept for analysis after the volume is wiped. It holds the
+// key material, so it is only readable by its owner.
+func exportMetadata(r io.ReaderAt, offset, volumeSize int64, regions []RegionDesc, path string) {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fatal("can't create export: %v", err)
+	}
+	if err := out.Truncate(volumeSize); err != nil {
+		out.Close()
+		os.Remove(path)
+		fatal("can't create export: %v", err)
+	}
+
+	for _, region := range regions {
+		size := region.Size
+		if region.Offset+size > volumeSize {
+			size = volumeSize - region.Offset
+		}
+		if size <= 0 {
+			continue
+		}
+		data := make([]byte, size)
+		if err := readFullAt(r, data, offset+region.Offset); err != nil {
+			fmt.Printf("can't export %s: %v\n", region.Name, err)
+			continue
+		}
+		_, err := out.WriteAt(data, region.Offset)
+		zeroize(data)
+		if err != nil {
+			out.Close()
+			fatal("can't write export: %v", err)
+		}
+		fmt.Printf("exported %s at offset 0x%x size %s\n", region.Name, region.Offset, sizeString(size))
+	}
+	if err := out.Close(); err != nil {
+		fatal("can't write export: %v", err)
+	}
+	fmt.Printf("metadata exported to %s\n", path)
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Support for reproducible runs, so that the output of a wipe can be
+// compared byte for byte against a known good one.
+
+// randSource supplies all random data that is written. Only -seed
+// replaces it.
+var randSource io.Reader = rand.Reader
+
+// seedFlag adds the -seed flag to fs.
+func seedFlag(fs *flag.FlagSet) *string {
+	return fs.String("seed", "", "INSECURE, for testing only: make the random data predictable from this seed")
+}
+
+// useSeed makes randSource deterministic if seed is set. The data it
+// produces can be recreated by anyone who knows the seed, so it must never
+// be used on real volumes.
+func useSeed(seed string) bool {
+	if seed == "" {
+		return false
+	}
+	n, err := strconv.ParseInt(seed, 0, 64)
+	if err != nil {
+		fatal("invalid seed %q", seed)
+	}
+	fmt.Printf("%s\n", warning(fmt.Sprintf("WARNING: using seed %d, the random data written is NOT secure", n)))
+	randSource = mathrand.New(mathrand.NewSource(n))
+	return true
+}
+
+// A fake device, named "fake:<image>", is the contents of an image file
+// held in memory. Writes to it never reach the file, and the digest of the
+// contents is printed when it is closed, so that a test can check the
+// result of a wipe without keeping copies of images around.
+type memDisk struct {
+	name     string
+	data     []byte
+	modified bool
+}
+
+func isFakeDevice(path string) bool {
+	return strings.HasPrefix(path, "fake:")
+}
+
+func openFakeDevice(path string) (*memDisk, error) {
+	name := strings.TrimPrefix(path, "fake:")
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &memDisk{name: name, data: data}, nil
+}
+
+func (d *memDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(len(d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *memDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(d.data)) {
+		return 0, errors.New("write beyond the end of the fake device")
+	}
+	d.modified = true
+	return copy(d.data[off:], p), nil
+}
+
+func (d *memDisk) Size() int64 { return int64(len(d.data)) }
+
+func (d *memDisk) Close() error {
+	if d.modified {
+		result("fake device %s: sha256 %x", d.name, sha256.Sum256(d.data))
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// The test binary runs as blwipe when this is set, as commands exit the
+// process and so have to be run in one of their own.
+const runMainEnv = "BLWIPE_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		os.Args = append([]string{"blwipe"}, os.Args[2:]...) // after the "--"
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// blwipe runs a command in dir, and returns its output.
+func blwipe(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"--"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), runMainEnv+"=1", lockDirEnv+"="+dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("blwipe %v: %v\n%s", args, err, out)
+	}
+	return string(out)
+}
+
+// wipeGolden is what a seeded wipe of a seeded test volume must produce.
+type wipeGolden struct {
+	SHA256 string        `json:"sha256"` // of the wiped fake device
+	Steps  []*reportStep `json:"steps"`
+}
+
+func TestSeededWipe(t *testing.T) {
+	for _, ss := range []string{"512", "4096"} {
+		t.Run(ss, func(t *testing.T) {
+			dir := t.TempDir()
+			blwipe(t, dir, "mkimage", "-seed", "1", "-sector-size", ss, "v.img")
+			out := blwipe(t, dir, "wipe", "-seed", "7", "-report", "r.json", "fake:v.img")
+
+			m := regexp.MustCompile(`fake device v\.img: sha256 ([0-9a-f]{64})`).FindStringSubmatch(out)
+			if m == nil {
+				t.Fatalf("no digest of the fake device in the output:\n%s", out)
+			}
+			got := wipeGolden{SHA256: m[1]}
+			b, err := os.ReadFile(filepath.Join(dir, "r.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rep Report
+			if err := json.Unmarshal(b, &rep); err != nil {
+				t.Fatal(err)
+			}
+			got.Steps = rep.Steps
+			if rep.Result != "success" {
+				t.Errorf("report result %q, want success", rep.Result)
+			}
+
+			golden := filepath.Join("testdata", "wipe-seed-"+ss+".json")
+			if *update {
+				b, _ := json.MarshalIndent(got, "", "  ")
+				if err := os.WriteFile(golden, append(b, '\n'), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b, err = os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want wipeGolden
+			if err := json.Unmarshal(b, &want); err != nil {
+				t.Fatal(err)
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("wipe differs from %s:\ngot  %s\nwant %s", golden, gotJSON, wantJSON)
+			}
+
+			// and the image itself is left alone
+			again := blwipe(t, dir, "info", "v.img")
+			if !regexp.MustCompile(`(?i)bitlocker`).MatchString(again) {
+				t.Errorf("v.img no longer looks like a BitLocker volume:\n%s", again)
+			}
+		})
+	}
+}
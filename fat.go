@@ -0,0 +1,436 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// A minimal FAT12/16/32 and exFAT reader, enough to find files on a USB
+// stick and locate the clusters they occupy.
+
+const (
+	fatAttrDirectory = 0x10
+	fatAttrVolumeId  = 0x08
+	fatAttrLongName  = 0x0f
+
+	fatMaxDirSize = 4 << 20
+	fatMaxDepth   = 16
+)
+
+// extent is a contiguous run of bytes on the filesystem's device.
+type extent struct {
+	Offset, Size int64
+}
+
+type fatFile struct {
+	Path    string
+	Size    int64
+	Extents []extent // whole clusters, including slack
+}
+
+type fatFS struct {
+	r     io.ReaderAt
+	exfat bool
+
+	bits        int // FAT entry size
+	fatStart    int64
+	clusterSize int64
+	dataStart   int64 // offset of cluster 2
+	clusters    uint32
+
+	rootCluster uint32
+	rootDir     extent // fixed root directory of FAT12/16
+}
+
+// openFAT opens the FAT or exFAT filesystem whose boot sector is at the
+// start of r.
+func openFAT(r io.ReaderAt) (*fatFS, error) {
+	bs := make([]byte, 512)
+	if err := readFullAt(r, bs, 0); err != nil {
+		return nil, err
+	}
+	if bs[510] != 0x55 || bs[511] != 0xaa {
+		return nil, errors.New("no boot sector signature")
+	}
+
+	le := binary.LittleEndian
+	fs := &fatFS{r: r}
+
+	if string(bs[3:11]) == "EXFAT   " {
+		bpsShift, spcShift := uint(bs[108]), uint(bs[109])
+		if bpsShift < 9 || bpsShift > 12 || bpsShift+spcShift > 25 {
+			return nil, errors.New("invalid exFAT boot sector")
+		}
+		bps := int64(1) << bpsShift
+		fs.exfat = true
+		fs.bits = 32
+		fs.fatStart = int64(le.Uint32(bs[80:])) * bps
+		fs.dataStart = int64(le.Uint32(bs[88:])) * bps
+		fs.clusterSize = bps << spcShift
+		fs.clusters = le.Uint32(bs[92:])
+		fs.rootCluster = le.Uint32(bs[96:])
+		return fs, nil
+	}
+
+	// NTFS and BitLocker boot sectors carry a BPB that looks like FAT
+	switch string(bs[3:11]) {
+	case "NTFS    ", "-FVE-FS-":
+		return nil, errors.New("not a FAT filesystem")
+	}
+
+	bps := int64(le.Uint16(bs[11:]))
+	spc := int64(bs[13])
+	reserved := int64(le.Uint16(bs[14:]))
+	numFats := int64(bs[16])
+	rootEntries := int64(le.Uint16(bs[17:]))
+	total := int64(le.Uint16(bs[19:]))
+	fatSize := int64(le.Uint16(bs[22:]))
+	if total == 0 {
+		total = int64(le.Uint32(bs[32:]))
+	}
+	if fatSize == 0 {
+		fatSize = int64(le.Uint32(bs[36:]))
+	}
+
+	if !validSectorSize(bps) || spc == 0 || spc&(spc-1) != 0 ||
+		reserved == 0 || numFats == 0 || numFats > 2 || fatSize == 0 {
+		return nil, errors.New("not a FAT filesystem")
+	}
+
+	rootSectors := (rootEntries*32 + bps - 1) / bps
+	firstData := reserved + numFats*fatSize + rootSectors
+	if total <= firstData {
+		return nil, errors.New("invalid FAT geometry")
+	}
+
+	fs.fatStart = reserved * bps
+	fs.clusterSize = spc * bps
+	fs.dataStart = firstData * bps
+	fs.clusters = uint32((total - firstData) / spc)
+
+	switch {
+	case fs.clusters < 4085:
+		fs.bits = 12
+	case fs.clusters < 65525:
+		fs.bits = 16
+	default:
+		fs.bits = 32
+		fs.rootCluster = le.Uint32(bs[44:])
+	}
+	if fs.bits != 32 {
+		fs.rootDir = extent{(reserved + numFats*fatSize) * bps, rootSectors * bps}
+	}
+	return fs, nil
+}
+
+// next returns the cluster following n in its chain, or 0 at the end.
+func (fs *fatFS) next(n uint32) (uint32, error) {
+	var buf [4]byte
+	var v uint32
+	switch fs.bits {
+	case 12:
+		if err := readFullAt(fs.r, buf[:2], fs.fatStart+int64(n+n/2)); err != nil {
+			return 0, err
+		}
+		v = uint32(binary.LittleEndian.Uint16(buf[:]))
+		if n&1 != 0 {
+			v >>= 4
+		}
+		v &= 0xfff
+		if v >= 0xff7 {
+			return 0, nil
+		}
+	case 16:
+		if err := readFullAt(fs.r, buf[:2], fs.fatStart+int64(n)*2); err != nil {
+			return 0, err
+		}
+		v = uint32(binary.LittleEndian.Uint16(buf[:]))
+		if v >= 0xfff7 {
+			return 0, nil
+		}
+	default:
+		if err := readFullAt(fs.r, buf[:], fs.fatStart+int64(n)*4); err != nil {
+			return 0, err
+		}
+		v = binary.LittleEndian.Uint32(buf[:])
+		if !fs.exfat {
+			v &= 0x0fffffff
+		}
+		if v >= 0x0ffffff7 {
+			return 0, nil
+		}
+	}
+
+	if v < 2 || v >= fs.clusters+2 {
+		return 0, fmt.Errorf("invalid cluster %d in chain", v)
+	}
+	return v, nil
+}
+
+// chain returns the extents of the cluster chain starting at start. If
+// contiguous is set, as with exFAT files without a FAT chain, the FAT is
+// not consulted and size determines the length.
+func (fs *fatFS) chain(start uint32, size int64, contiguous bool) ([]extent, error) {
+	if start == 0 {
+		return nil, nil
+	}
+	if start < 2 || start >= fs.clusters+2 {
+		return nil, fmt.Errorf("invalid start cluster %d", start)
+	}
+
+	if contiguous {
+		if size < 0 {
+			return nil, fmt.Errorf("invalid size %d", size)
+		}
+		n := (size + fs.clusterSize - 1) / fs.clusterSize
+		if int64(start-2)+n > int64(fs.clusters) {
+			return nil, errors.New("file extends beyond the filesystem")
+		}
+		return []extent{{fs.dataStart + int64(start-2)*fs.clusterSize, n * fs.clusterSize}}, nil
+	}
+
+	var exts []extent
+	for c, count := start, uint32(0); c != 0; count++ {
+		if count > fs.clusters {
+			return nil, errors.New("cluster chain loops")
+		}
+
+		off := fs.dataStart + int64(c-2)*fs.clusterSize
+		if n := len(exts); n > 0 && exts[n-1].Offset+exts[n-1].Size == off {
+			exts[n-1].Size += fs.clusterSize
+		} else {
+			exts = append(exts, extent{off, fs.clusterSize})
+		}
+
+		var err error
+		if c, err = fs.next(c); err != nil {
+			return nil, err
+		}
+	}
+	return exts, nil
+}
+
+// readExtents reads up to limit bytes from exts. As they can be key
+// files, they are read into a single buffer, which the caller zeroizes,
+// and nothing else is left holding them.
+func readExtents(r io.ReaderAt, exts []extent, limit int64) ([]byte, error) {
+	total := int64(0)
+	for _, e := range exts {
+		total += e.Size
+		if total >= limit {
+			total = limit
+			break
+		}
+	}
+
+	out := make([]byte, total)
+	pos := int64(0)
+	for _, e := range exts {
+		if pos >= total {
+			break
+		}
+		n := e.Size
+		if remain := total - pos; n > remain {
+			n = remain
+		}
+		if err := readFullAt(r, out[pos:pos+n], e.Offset); err != nil {
+			zeroize(out)
+			return nil, err
+		}
+		pos += n
+	}
+	return out, nil
+}
+
+// Walk calls fn for every file on the filesystem.
+func (fs *fatFS) Walk(fn func(f *fatFile) error) error {
+	root := []extent{fs.rootDir}
+	if fs.rootCluster != 0 {
+		var err error
+		if root, err = fs.chain(fs.rootCluster, 0, false); err != nil {
+			return err
+		}
+	}
+	return fs.walkDir("", root, 0, fn)
+}
+
+func (fs *fatFS) walkDir(dir string, exts []extent, depth int, fn func(f *fatFile) error) error {
+	if depth > fatMaxDepth {
+		return fmt.Errorf("%s: directories nested too deeply", dir)
+	}
+
+	buf, err := readExtents(fs.r, exts, fatMaxDirSize)
+	if err != nil {
+		return err
+	}
+
+	var entries []fatDirEntry
+	if fs.exfat {
+		entries = parseExfatDir(buf)
+	} else {
+		entries = parseFatDir(buf)
+	}
+
+	for _, e := range entries {
+		exts, err := fs.chain(e.cluster, e.size, e.contiguous)
+		if err != nil {
+			return fmt.Errorf("%s/%s: %v", dir, e.name, err)
+		}
+
+		path := dir + "/" + e.name
+		if e.dir {
+			if err := fs.walkDir(path, exts, depth+1, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(&fatFile{path, e.size, exts}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type fatDirEntry struct {
+	name       string
+	dir        bool
+	cluster    uint32
+	size       int64
+	contiguous bool
+}
+
+func parseFatDir(buf []byte) []fatDirEntry {
+	var entries []fatDirEntry
+	var lfn []uint16
+	for off := 0; off+32 <= len(buf); off += 32 {
+		e := buf[off : off+32]
+		if e[0] == 0 {
+			break
+		}
+		if e[0] == 0xe5 {
+			lfn = nil
+			continue
+		}
+
+		attr := e[11]
+		if attr&0x3f == fatAttrLongName {
+			// long name entries precede the short entry in reverse order
+			var part []uint16
+			for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+				for i := r[0]; i < r[1]; i += 2 {
+					part = append(part, binary.LittleEndian.Uint16(e[i:]))
+				}
+			}
+			if e[0]&0x40 != 0 {
+				lfn = nil
+			}
+			lfn = append(part, lfn...)
+			continue
+		}
+		if attr&fatAttrVolumeId != 0 {
+			lfn = nil
+			continue
+		}
+
+		name := shortName(e)
+		if lfn != nil {
+			for i, c := range lfn {
+				if c == 0 {
+					lfn = lfn[:i]
+					break
+				}
+			}
+			name = string(utf16.Decode(lfn))
+			lfn = nil
+		}
+		if name == "." || name == ".." {
+			continue
+		}
+
+		cluster := uint32(binary.LittleEndian.Uint16(e[26:]))
+		cluster |= uint32(binary.LittleEndian.Uint16(e[20:])) << 16
+		entries = append(entries, fatDirEntry{
+			name:    name,
+			dir:     attr&fatAttrDirectory != 0,
+			cluster: cluster,
+			size:    int64(binary.LittleEndian.Uint32(e[28:])),
+		})
+	}
+	return entries
+}
+
+func shortName(e []byte) string {
+	base := strings.TrimRight(string(e[0:8]), " ")
+	if base != "" && base[0] == 0x05 {
+		base = "\xe5" + base[1:]
+	}
+	if ext := strings.TrimRight(string(e[8:11]), " "); ext != "" {
+		return base + "." + ext
+	}
+	return base
+}
+
+// exFAT directory entry types
+const (
+	exfatFile       = 0x85
+	exfatStream     = 0xc0
+	exfatFileName   = 0xc1
+	exfatNoFatChain = 0x02
+)
+
+func parseExfatDir(buf []byte) []fatDirEntry {
+	var entries []fatDirEntry
+	for off := 0; off+32 <= len(buf); off += 32 {
+		e := buf[off : off+32]
+		if e[0] == 0 {
+			break
+		}
+		if e[0] != exfatFile {
+			continue
+		}
+
+		secondary := int(e[1])
+		if secondary < 2 || off+(secondary+1)*32 > len(buf) {
+			continue
+		}
+		attr := binary.LittleEndian.Uint16(e[4:])
+
+		stream := buf[off+32 : off+64]
+		if stream[0] != exfatStream {
+			continue
+		}
+		nameLen := int(stream[3])
+
+		var name []uint16
+		for i := 2; i <= secondary; i++ {
+			ne := buf[off+i*32 : off+(i+1)*32]
+			if ne[0] != exfatFileName {
+				break
+			}
+			for j := 2; j < 32; j += 2 {
+				name = append(name, binary.LittleEndian.Uint16(ne[j:]))
+			}
+		}
+		if len(name) > nameLen {
+			name = name[:nameLen]
+		}
+
+		entries = append(entries, fatDirEntry{
+			name:       string(utf16.Decode(name)),
+			dir:        attr&fatAttrDirectory != 0,
+			cluster:    binary.LittleEndian.Uint32(stream[20:]),
+			size:       int64(binary.LittleEndian.Uint64(stream[24:])),
+			contiguous: stream[1]&exfatNoFatChain != 0,
+		})
+		off += secondary * 32
+	}
+	return entries
+}
@@ -0,0 +1,215 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// fat12Set sets FAT12 entry n in fat to v.
+func fat12Set(fat []byte, n, v uint32) {
+	off := n + n/2
+	old := uint32(binary.LittleEndian.Uint16(fat[off:]))
+	if n&1 != 0 {
+		old = old&0x000f | v<<4
+	} else {
+		old = old&0xf000 | v
+	}
+	binary.LittleEndian.PutUint16(fat[off:], uint16(old))
+}
+
+// fatEntry encodes a short directory entry.
+func fatEntry(name string, attr byte, cluster uint32, size uint32) []byte {
+	e := make([]byte, 32)
+	copy(e, name)
+	e[11] = attr
+	binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(e[28:], size)
+	return e
+}
+
+// fatLongName encodes the single long name entry for a name of up to 13
+// characters.
+func fatLongName(name string) []byte {
+	e := make([]byte, 32)
+	e[0] = 0x41
+	e[11] = fatAttrLongName
+	chars := append(utf16.Encode([]rune(name)), 0)
+	for len(chars) < 13 {
+		chars = append(chars, 0xffff)
+	}
+	i := 0
+	for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+		for off := r[0]; off < r[1]; off += 2 {
+			binary.LittleEndian.PutUint16(e[off:], chars[i])
+			i++
+		}
+	}
+	return e
+}
+
+// makeFAT12 returns a FAT12 filesystem of 64 512-byte sectors, with one
+// cluster per sector, its FAT in sector 1, its root directory in sector 2,
+// and cluster 2 in sector 3. HELLO.TXT is in clusters 2 and 3, and
+// SUB/key.bek, which has a long name, in cluster 5. edit can change the
+// boot sector, the FAT and the directories of SUB in cluster 4.
+func makeFAT12(edit func(bs, fat, root, sub []byte)) []byte {
+	b := make([]byte, 64*512)
+	bs, fat, root := b[:512], b[512:1024], b[1024:1536]
+	sub := b[1536+2*512 : 1536+3*512]
+
+	copy(bs[3:], "MSDOS5.0")
+	binary.LittleEndian.PutUint16(bs[11:], 512)
+	bs[13] = 1
+	binary.LittleEndian.PutUint16(bs[14:], 1)
+	bs[16] = 1
+	binary.LittleEndian.PutUint16(bs[17:], 16)
+	binary.LittleEndian.PutUint16(bs[19:], 64)
+	binary.LittleEndian.PutUint16(bs[22:], 1)
+	bs[510], bs[511] = 0x55, 0xaa
+
+	fat12Set(fat, 2, 3)
+	fat12Set(fat, 3, 0xfff)
+	fat12Set(fat, 4, 0xfff)
+	fat12Set(fat, 5, 0xfff)
+
+	copy(root, fatEntry("NO NAME    ", fatAttrVolumeId, 0, 0))
+	copy(root[32:], fatEntry("HELLO   TXT", 0, 2, 700))
+	copy(root[64:], fatEntry("SUB        ", fatAttrDirectory, 4, 0))
+	copy(sub, fatEntry(".          ", fatAttrDirectory, 4, 0))
+	copy(sub[32:], fatLongName("key.bek"))
+	copy(sub[64:], fatEntry("KEY     BEK", 0, 5, 10))
+
+	if edit != nil {
+		edit(bs, fat, root, sub)
+	}
+	return b
+}
+
+// makeExFAT returns an exFAT filesystem of 512-byte clusters, with its
+// FAT in sector 1, cluster 2 (the root directory) in sector 2, and key,
+// without a FAT chain, in clusters 3 and 4. edit can change the boot
+// sector and the stream extension entry of key.
+func makeExFAT(edit func(bs, stream []byte)) []byte {
+	b := make([]byte, 10*512)
+	bs := b[:512]
+	copy(bs[3:], "EXFAT   ")
+	binary.LittleEndian.PutUint32(bs[80:], 1)
+	binary.LittleEndian.PutUint32(bs[88:], 2)
+	binary.LittleEndian.PutUint32(bs[92:], 8)
+	binary.LittleEndian.PutUint32(bs[96:], 2)
+	bs[108], bs[109] = 9, 0
+	bs[510], bs[511] = 0x55, 0xaa
+
+	binary.LittleEndian.PutUint32(b[512+8:], 0xffffffff)
+
+	root := b[1024:1536]
+	root[0], root[1] = exfatFile, 2
+	stream := root[32:64]
+	stream[0], stream[1], stream[3] = exfatStream, exfatNoFatChain|1, 3
+	binary.LittleEndian.PutUint32(stream[20:], 3)
+	binary.LittleEndian.PutUint64(stream[24:], 600)
+	root[64] = exfatFileName
+	for i, c := range utf16.Encode([]rune("key")) {
+		binary.LittleEndian.PutUint16(root[64+2+2*i:], c)
+	}
+
+	if edit != nil {
+		edit(bs, stream)
+	}
+	return b
+}
+
+// walkFAT opens the filesystem in b and returns its files.
+func walkFAT(b []byte) (map[string]fatFile, error) {
+	fs, err := openFAT(&memDisk{data: b})
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]fatFile{}
+	err = fs.Walk(func(f *fatFile) error {
+		files[f.Path] = *f
+		return nil
+	})
+	return files, err
+}
+
+func TestFAT(t *testing.T) {
+	files, err := walkFAT(makeFAT12(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]fatFile{
+		"/HELLO.TXT":   {"/HELLO.TXT", 700, []extent{{1536, 1024}}},
+		"/SUB/key.bek": {"/SUB/key.bek", 10, []extent{{1536 + 3*512, 512}}},
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("FAT12: got %v, want %v", files, want)
+	}
+
+	files, err = walkFAT(makeExFAT(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]fatFile{"/key": {"/key", 600, []extent{{1536, 1024}}}}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("exFAT: got %v, want %v", files, want)
+	}
+}
+
+func TestFATMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		image []byte
+		want  string
+	}{
+		{"no signature", makeFAT12(func(bs, _, _, _ []byte) { bs[511] = 0 }), "signature"},
+		{"NTFS", makeFAT12(func(bs, _, _, _ []byte) { copy(bs[3:], "NTFS    ") }), "not a FAT"},
+		{"BitLocker", makeFAT12(func(bs, _, _, _ []byte) { copy(bs[3:], "-FVE-FS-") }), "not a FAT"},
+		{"sector size", makeFAT12(func(bs, _, _, _ []byte) { bs[12] = 0 }), "not a FAT"},
+		{"cluster size", makeFAT12(func(bs, _, _, _ []byte) { bs[13] = 3 }), "not a FAT"},
+		{"too many FATs", makeFAT12(func(bs, _, _, _ []byte) { bs[16] = 3 }), "not a FAT"},
+		{"oversized FAT", makeFAT12(func(bs, _, _, _ []byte) {
+			binary.LittleEndian.PutUint16(bs[22:], 0xffff)
+		}), "invalid FAT geometry"},
+		{"oversized root directory", makeFAT12(func(bs, _, _, _ []byte) {
+			binary.LittleEndian.PutUint16(bs[17:], 0xffff)
+		}), "invalid FAT geometry"},
+		{"invalid cluster", makeFAT12(func(_, fat, _, _ []byte) { fat12Set(fat, 2, 1000) }), "invalid cluster"},
+		{"loop", makeFAT12(func(_, fat, _, _ []byte) { fat12Set(fat, 3, 2) }), "loops"},
+		{"start cluster", makeFAT12(func(_, _, root, _ []byte) {
+			copy(root[32:], fatEntry("HELLO   TXT", 0, 1000, 700))
+		}), "invalid start cluster"},
+		{"directory in itself", makeFAT12(func(_, _, _, sub []byte) {
+			copy(sub[96:], fatEntry("LOOP       ", fatAttrDirectory, 4, 0))
+		}), "nested too deeply"},
+		{"truncated", makeFAT12(nil)[:1536], "EOF"},
+		{"truncated boot sector", makeFAT12(nil)[:100], "EOF"},
+		{"exFAT sector size", makeExFAT(func(bs, _ []byte) { bs[108] = 13 }), "invalid exFAT"},
+		{"exFAT cluster size", makeExFAT(func(bs, _ []byte) { bs[109] = 20 }), "invalid exFAT"},
+		{"exFAT negative size", makeExFAT(func(_, stream []byte) {
+			binary.LittleEndian.PutUint64(stream[24:], 1<<63)
+		}), "invalid size"},
+		{"exFAT oversized", makeExFAT(func(_, stream []byte) {
+			binary.LittleEndian.PutUint64(stream[24:], 1<<62)
+		}), "beyond the filesystem"},
+		{"exFAT root cluster", makeExFAT(func(bs, _ []byte) {
+			binary.LittleEndian.PutUint32(bs[96:], 0xffffffff)
+		}), "invalid start cluster"},
+	}
+	for _, tt := range tests {
+		files, err := walkFAT(tt.image)
+		if err == nil {
+			t.Errorf("%s: walked, found %v", tt.name, files)
+		} else if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want an error about %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Encrypted volume formats other than BitLocker, which are wiped the same
+// way: by destroying the regions that hold their key material.
+
+type volumeFormat struct {
+	name string
+
+	// detect recognizes the format, or is nil if it cannot be recognized
+	// and has to be asked for with -format
+	detect func(r io.ReaderAt) bool
+
+	// inspect describes the volume of size bytes (or -1 if unknown) and
+	// returns the regions holding its key material.
+	inspect func(r io.ReaderAt, size int64) (desc string, regions []RegionDesc, err error)
+}
+
+var volumeFormats = []volumeFormat{
+	{"luks", isLUKS, inspectLUKS},
+	{"veracrypt", nil, inspectVeraCrypt},
+	{"apfs", isAPFS, inspectAPFS},
+	{"corestorage", isCoreStorage, inspectCoreStorage},
+}
+
+func formatNames() string {
+	names := []string{"bitlocker"}
+	for _, vf := range volumeFormats {
+		names = append(names, vf.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// findFormat returns the format named name, or the one detected at off
+// if name is empty. It returns nil for BitLocker.
+func findFormat(r io.ReaderAt, off int64, name string) (*volumeFormat, error) {
+	if name == "bitlocker" {
+		return nil, nil
+	}
+
+	vol := io.NewSectionReader(r, off, 1<<62)
+	for i, vf := range volumeFormats {
+		if name == vf.name || (name == "" && vf.detect != nil && vf.detect(vol)) {
+			return &volumeFormats[i], nil
+		}
+	}
+
+	if name != "" {
+		return nil, fmt.Errorf("unknown format %q, use one of %s", name, formatNames())
+	}
+	return nil, nil
+}
+
+// runFormat shows and optionally wipes the key material of a volume in
+// one of the volumeFormats.
+func runFormat(f Image, vf *volumeFormat, offset, avail, sectorSize int64, o *volumeOptions) {
+	wipe := o.wipe
+	st, err := imageStorage(f)
+	if err != nil {
+		fatal("%v", err)
+	}
+	vol := &subStorage{st, offset}
+
+	desc, regions, err := vf.inspect(vol, avail)
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	if infoJSON != nil {
+		infoJSON.Format, infoJSON.Description = vf.name, desc
+		infoJSON.addRegions(regions)
+	}
+	if !wipe {
+		result("%s", desc)
+	} else {
+		fmt.Printf("%s\n", highlight(desc))
+	}
+	for _, r := range regions {
+		fmt.Printf("%s at offset 0x%x size %s\n", r.Name, r.Offset, sizeString(r.Size))
+	}
+
+	if wipe {
+		n := wipeRegions(f, offset, avail, sectorSize, regions)
+		if avail >= 0 {
+			progress(progressEvent{Phase: "verify", Offset: offset, Bytes: avail})
+		}
+		if avail >= 0 && !verifyWiped(vol, avail, sectorSize, false) {
+			fatal("verification failed, plaintext filesystem signatures remain on the volume")
+		}
+		if o.punchHoles && avail >= 0 && n == len(regions) {
+			punchVolume(f, offset, avail)
+		}
+		if o.tombstone && n == len(regions) {
+			writeTombstone(f, offset, sectorSize)
+		}
+		result("%d of %d regions overwritten", n, len(regions))
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Recognizing filesystems by their signatures.
+
+const fsProbeSize = 0x8800
+
+// fsMagics are signatures found at fixed offsets from the start.
+var fsMagics = []struct {
+	offset int
+	magic  string
+	name   string
+}{
+	{0, "LUKS\xba\xbe", "LUKS"},
+	{0, "XFSB", "XFS"},
+	{3, "ReFS\x00\x00\x00\x00", "ReFS"},
+	{32, "NXSB", "APFS"},
+	{512, "LABELONE", "LVM"},
+	{1024, "H+\x00\x04", "HFS+"},
+	{1024, "HX\x00\x05", "HFS+"},
+	{4086, "SWAPSPACE2", "swap"},
+	{0x8001, "CD001", "ISO 9660"},
+}
+
+var fsDescriptions = map[string]string{
+	"BitLocker": "a BitLocker volume",
+	"LUKS":      "a LUKS encrypted volume",
+	"LVM":       "an LVM physical volume",
+	"swap":      "Linux swap space",
+	"ISO 9660":  "a CD/DVD image",
+}
+
+// describeFS describes a filesystem name from probeFilesystem.
+func describeFS(name string) string {
+	if d, ok := fsDescriptions[name]; ok {
+		return d
+	}
+	return "an unencrypted " + name + " filesystem"
+}
+
+// probeBootSector names the filesystem whose boot sector is in b, or
+// returns "" if b does not look like one.
+func probeBootSector(b []byte) string {
+	if len(b) < 512 || b[510] != 0x55 || b[511] != 0xaa {
+		return ""
+	}
+
+	switch string(b[3:11]) {
+	case "NTFS    ":
+		return "NTFS"
+	case "EXFAT   ":
+		return "exFAT"
+	case "-FVE-FS-":
+		return "BitLocker"
+	}
+
+	bps := int64(binary.LittleEndian.Uint16(b[11:]))
+	spc := b[13]
+	if !validSectorSize(bps) || spc == 0 || spc&(spc-1) != 0 || b[16] == 0 {
+		return ""
+	}
+	switch {
+	case string(b[82:87]) == "FAT32":
+		return "FAT32"
+	case string(b[54:59]) == "FAT16", string(b[54:59]) == "FAT12":
+		return string(b[54:59])
+	}
+	return ""
+}
+
+// probeFilesystem names the filesystem starting at off in r.
+func probeFilesystem(r io.ReaderAt, off int64) string {
+	buf := make([]byte, fsProbeSize)
+	n, _ := r.ReadAt(buf, off)
+	buf = buf[:n]
+
+	if fs := probeBootSector(buf); fs != "" {
+		return fs
+	}
+	for _, m := range fsMagics {
+		if len(buf) >= m.offset+len(m.magic) && string(buf[m.offset:m.offset+len(m.magic)]) == m.magic {
+			return m.name
+		}
+	}
+
+	// the ext superblock magic is short, so check the block size too
+	if len(buf) >= 2048 && binary.LittleEndian.Uint16(buf[1080:]) == 0xef53 &&
+		binary.LittleEndian.Uint32(buf[1048:]) <= 6 {
+		return "ext2/3/4"
+	}
+
+	var magic [8]byte
+	if _, err := r.ReadAt(magic[:], off+0x10040); err == nil && string(magic[:]) == "_BHRfS_M" {
+		return "Btrfs"
+	}
+	return ""
+}
+
+// diagnose explains what is at off in r instead of a BitLocker volume.
+func diagnose(r io.ReaderAt, off int64) string {
+	if text, ok := readTombstone(r, off); ok {
+		return "the volume was wiped, its tombstone reads:\n" + text
+	}
+	if fs := probeFilesystem(r, off); fs != "" {
+		return "this looks like " + describeFS(fs)
+	}
+
+	if parts, err := readPartitions(&subStorage{readOnlyStorage{r}, off}); err == nil && len(parts) > 0 {
+		var found []string
+		for _, p := range parts {
+			if probeFilesystem(r, off+p.Offset) == "BitLocker" {
+				found = append(found, fmt.Sprintf("0x%x", off+p.Offset))
+			}
+		}
+		if len(found) == 0 {
+			return "this looks like a partitioned disk without BitLocker volumes"
+		}
+		return "this looks like a partitioned disk, try -offset " + strings.Join(found, " or ")
+	}
+
+	sector := make([]byte, 512)
+	if err := readFullAt(r, sector, off); err != nil {
+		return ""
+	}
+	if probeBootSector(sector) == "" && shannonEntropy(sector) > 7 {
+		return "the header looks like random data, the volume may already have been wiped"
+	}
+	for _, c := range sector {
+		if c != 0 {
+			return ""
+		}
+	}
+	return "the header is all zeros, check the offset"
+}
+
+// verifyWiped looks for plaintext filesystems where a mount would find
+// them: the boot sector, the FAT32 and exFAT backup boot sectors, and the
+// NTFS backup boot sector in the last sector. It returns false if any are
+// found. The BitLocker header is expected at the start if headerKept is set.
+func verifyWiped(r io.ReaderAt, volumeSize, sectorSize int64, headerKept bool) bool {
+	started := time.Now()
+	defer func() { stats.VerifySeconds += time.Since(started).Seconds() }()
+
+	locations := []int64{0, 6 * sectorSize, 12 * sectorSize}
+	if volumeSize > sectorSize {
+		locations = append(locations, volumeSize-sectorSize)
+	}
+
+	ok := true
+	for _, off := range locations {
+		fs := probeFilesystem(r, off)
+		if fs == "BitLocker" && off == 0 && headerKept {
+			continue
+		}
+		if fs != "" {
+			fmt.Printf("verify: %s\n", warning(fmt.Sprintf("found %s boot sector at offset 0x%x", fs, off)))
+			ok = false
+		}
+	}
+	if ok {
+		fmt.Printf("verify: %s\n", success("no plaintext filesystem signatures found"))
+	}
+	return ok
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Recovery key escrow in Entra ID, queried through Microsoft Graph.
+
+const (
+	graphKeyURL = "https://graph.microsoft.com/v1.0/informationProtection/bitlocker/recoveryKeys/{guid}"
+	graphScope  = "https://graph.microsoft.com/.default"
+	loginURL    = "https://login.microsoftonline.com/"
+)
+
+type oauthToken struct {
+	AccessToken string `json:"access_token"`
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+
+	// device code flow
+	DeviceCode string `json:"device_code"`
+	Message    string `json:"message"`
+	Interval   int    `json:"interval"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+func postForm(client *http.Client, u string, form url.Values) (*oauthToken, error) {
+	resp, err := client.PostForm(u, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tok oauthToken
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return nil, fmt.Errorf("%s: %v", resp.Status, err)
+	}
+	return &tok, nil
+}
+
+// graphToken obtains an access token for Graph. A token can be supplied
+// directly in BLWIPE_ESCROW_TOKEN; with a client secret in
+// BLWIPE_ESCROW_PASSWORD the client credentials flow is used, and
+// otherwise the user is asked to sign in with a device code.
+func graphToken(client *http.Client, tenant, clientID string) (string, error) {
+	if tok := os.Getenv("BLWIPE_ESCROW_TOKEN"); tok != "" {
+		return tok, nil
+	}
+	if tenant == "" || clientID == "" {
+		return "", errors.New("graph: a tenant and client ID (-escrow-user) are needed to sign in")
+	}
+
+	endpoint := loginURL + url.PathEscape(tenant) + "/oauth2/v2.0/"
+	if secret := os.Getenv("BLWIPE_ESCROW_PASSWORD"); secret != "" {
+		tok, err := postForm(client, endpoint+"token", url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {clientID},
+			"client_secret": {secret},
+			"scope":         {graphScope},
+		})
+		if err != nil {
+			return "", err
+		}
+		if tok.AccessToken == "" {
+			return "", fmt.Errorf("graph: sign in failed: %s", tok.Description)
+		}
+		return tok.AccessToken, nil
+	}
+
+	dc, err := postForm(client, endpoint+"devicecode", url.Values{
+		"client_id": {clientID},
+		"scope":     {"https://graph.microsoft.com/BitlockerKey.ReadBasic.All"},
+	})
+	if err != nil {
+		return "", err
+	}
+	if dc.DeviceCode == "" {
+		return "", fmt.Errorf("graph: sign in failed: %s", dc.Description)
+	}
+	fmt.Fprintln(os.Stderr, dc.Message)
+
+	interval := time.Duration(dc.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(dc.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		tok, err := postForm(client, endpoint+"token", url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"client_id":   {clientID},
+			"device_code": {dc.DeviceCode},
+		})
+		if err != nil {
+			return "", err
+		}
+
+		switch tok.Error {
+		case "":
+			return tok.AccessToken, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return "", fmt.Errorf("graph: sign in failed: %s", tok.Description)
+		}
+	}
+	return "", errors.New("graph: timed out waiting for sign in")
+}
+
+// newGraphEscrow looks up recovery keys by key protector ID in Entra ID.
+func newGraphEscrow(tenant, clientID string) (escrowChecker, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	tok, err := graphToken(client, tenant, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpEscrow{
+		template:  graphKeyURL,
+		token:     tok,
+		client:    client,
+		lowercase: true,
+		header: http.Header{
+			"Ocp-Client-Name":    {"blwipe"},
+			"Ocp-Client-Version": {"1.0"},
+		},
+	}, nil
+}
+
+// graphTenant extracts the tenant from a graph://tenant escrow URL.
+func graphTenant(u *url.URL) string {
+	return strings.TrimSuffix(u.Host+u.Path, "/")
+}
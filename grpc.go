@@ -0,0 +1,287 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The gRPC interface of the daemon, the Daemon service in blwipe.proto.
+// gRPC is HTTP/2 with each message framed by a compression flag and its
+// length, and the status in the trailers, which is all net/http needs to
+// serve it without any generated code.
+
+const (
+	grpcPrefix     = "/blwipe.v1.Daemon/"
+	grpcMaxRequest = 1 << 20
+
+	// status codes
+	grpcOK                 = 0
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+)
+
+// grpcError is an error with the status code to return it with.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, a ...interface{}) error {
+	return &grpcError{code, fmt.Sprintf(format, a...)}
+}
+
+type grpcServer struct {
+	m *jobManager
+}
+
+func (g *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	err := g.call(w, r)
+	code := grpcOK
+	if err != nil {
+		code = grpcUnknown
+		if e, ok := err.(*grpcError); ok {
+			code = e.code
+		}
+		w.Header().Set("Grpc-Message", grpcEscape(err.Error()))
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+}
+
+// call reads the request message and sends the response messages.
+func (g *grpcServer) call(w http.ResponseWriter, r *http.Request) error {
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return err
+	}
+	send := func(m *protoMessage) error {
+		if err := writeGRPCMessage(w, m); err != nil {
+			return err
+		}
+		w.(http.Flusher).Flush()
+		return nil
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, grpcPrefix) {
+	case "ListDevices":
+		devs, err := g.m.listDevices()
+		if err != nil {
+			return grpcErrorf(grpcInternal, "%v", err)
+		}
+		var resp protoMessage
+		for _, d := range devs {
+			resp.message(1, d.proto())
+		}
+		return send(&resp)
+
+	case "StartWipe":
+		var wr WipeRequest
+		if err := wr.decode(req); err != nil {
+			return err
+		}
+		j, err := g.m.start(wr)
+		if err != nil {
+			return grpcErrorf(grpcFailedPrecondition, "%v", err)
+		}
+		return send(j.proto())
+
+	case "CancelWipe":
+		var id int64
+		err := decodeProto(req, func(f protoField) error {
+			if f.num == 1 && f.wire == wireVarint {
+				id = int64(int32(f.v))
+			}
+			return nil
+		})
+		if err != nil {
+			return grpcErrorf(grpcInvalidArgument, "%v", err)
+		}
+		j, err := g.m.cancel(int(id))
+		if err != nil {
+			return grpcErrorf(grpcFailedPrecondition, "%v", err)
+		}
+		return send(j.proto())
+
+	case "ListJobs":
+		var resp protoMessage
+		for _, j := range g.m.list() {
+			resp.message(1, j.proto())
+		}
+		return send(&resp)
+
+	case "WatchEvents":
+		var since, job int64
+		err := decodeProto(req, func(f protoField) error {
+			switch {
+			case f.num == 1 && f.wire == wireVarint:
+				since = int64(f.v)
+			case f.num == 2 && f.wire == wireVarint:
+				job = int64(int32(f.v))
+			}
+			return nil
+		})
+		if err != nil {
+			return grpcErrorf(grpcInvalidArgument, "%v", err)
+		}
+		return g.watch(r, int(since), int(job), send)
+	}
+	return grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+}
+
+// watch streams the events after since, of a single job if job is set,
+// until the client goes away or the job has finished.
+func (g *grpcServer) watch(r *http.Request, since, job int, send func(*protoMessage) error) error {
+	if _, ok := g.m.job(job); job != 0 && !ok {
+		return grpcErrorf(grpcNotFound, "no job %d", job)
+	}
+	for {
+		// whether it had finished before the events are fetched, which
+		// then include its last
+		j, _ := g.m.job(job)
+		finished := job != 0 && j.Finished != nil
+		for _, e := range g.m.eventsSince(since, time.Second) {
+			since = e.Seq
+			if job != 0 && e.Job != job {
+				continue
+			}
+			if err := send(e.proto()); err != nil {
+				return err
+			}
+		}
+		if finished {
+			return nil
+		}
+		select {
+		case <-r.Context().Done():
+			return grpcErrorf(grpcUnknown, "cancelled")
+		default:
+		}
+	}
+}
+
+// readGRPCMessage reads the single, uncompressed, message of a request.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "can't read request: %v", err)
+	}
+	if prefix[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed requests are not supported")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > grpcMaxRequest {
+		return nil, grpcErrorf(grpcInvalidArgument, "request of %d bytes is too large", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "can't read request: %v", err)
+	}
+	return b, nil
+}
+
+func writeGRPCMessage(w io.Writer, m *protoMessage) error {
+	b := make([]byte, 5, 5+len(m.b))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(m.b)))
+	_, err := w.Write(append(b, m.b...))
+	return err
+}
+
+// grpcEscape percent-encodes a status message as the trailer needs.
+func grpcEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func (req *WipeRequest) decode(b []byte) error {
+	err := decodeProto(b, func(f protoField) error {
+		if f.wire == wireBytes {
+			switch f.num {
+			case 1:
+				req.Device = string(f.b)
+			case 2:
+				req.Format = string(f.b)
+			case 4:
+				req.AssetTag = string(f.b)
+			case 5:
+				req.Operator = string(f.b)
+			case 6:
+				req.WorkOrder = string(f.b)
+			}
+		} else if f.num == 3 && f.wire == wireVarint {
+			req.Offset = int64(f.v)
+		}
+		return nil
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	if req.Offset < 0 {
+		return grpcErrorf(grpcInvalidArgument, "negative offset")
+	}
+	return nil
+}
+
+func (j *Job) proto() *protoMessage {
+	m := &protoMessage{}
+	m.int(1, int64(j.ID))
+	m.string(2, j.Device)
+	m.string(3, j.Drive)
+	m.string(4, j.Format)
+	m.string(5, j.State)
+	m.string(6, j.Error)
+	m.string(7, j.Report)
+	m.time(8, j.Started)
+	if j.Finished != nil {
+		m.time(9, *j.Finished)
+	}
+	return m
+}
+
+func (e *Event) proto() *protoMessage {
+	m := &protoMessage{}
+	m.int(1, int64(e.Seq))
+	m.int(2, int64(e.Job))
+	m.time(3, e.Time)
+	m.string(4, e.Message)
+	return m
+}
+
+func (d *DeviceEntry) proto() *protoMessage {
+	m := &protoMessage{}
+	m.string(1, d.Path)
+	m.int(2, d.Size)
+	m.string(3, d.Model)
+	m.bool(4, d.Partition)
+	m.string(5, d.Volume)
+	m.string(6, d.Error)
+	return m
+}
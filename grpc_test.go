@@ -0,0 +1,114 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// grpcCall makes a call with the encoded request req, and returns the
+// messages sent back and the status.
+func grpcCall(t *testing.T, g *grpcServer, method string, req []byte) ([][]byte, string, string) {
+	t.Helper()
+	body := make([]byte, 5, 5+len(req))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(req)))
+	r := httptest.NewRequest("POST", grpcPrefix+method, bytes.NewReader(append(body, req...)))
+	r.Header.Set("Content-Type", "application/grpc")
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("%s: HTTP status %d, content type %q", method, resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var msgs [][]byte
+	b := w.Body.Bytes()
+	for len(b) > 0 {
+		if len(b) < 5 || b[0] != 0 || uint32(len(b)-5) < binary.BigEndian.Uint32(b[1:]) {
+			t.Fatalf("%s: bad framing in %x", method, w.Body.Bytes())
+		}
+		n := 5 + int(binary.BigEndian.Uint32(b[1:]))
+		msgs, b = append(msgs, b[5:n]), b[n:]
+	}
+	return msgs, resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+}
+
+func TestGRPCDaemon(t *testing.T) {
+	m := newJobManager("", nil)
+	now := time.Now().UTC()
+	m.jobs = []*Job{{ID: 1, Device: "/dev/sdz", State: "done", Started: now, Finished: &now}}
+	m.event(1, "started wiping /dev/sdz")
+	m.event(2, "started wiping /dev/sdy")
+	m.event(1, "job done")
+	g := &grpcServer{m}
+
+	msgs, status, _ := grpcCall(t, g, "ListJobs", nil)
+	if status != "0" || len(msgs) != 1 {
+		t.Fatalf("ListJobs: status %s, %d messages", status, len(msgs))
+	}
+	var job Job
+	decodeProto(msgs[0], func(f protoField) error {
+		return decodeProto(f.b, func(f protoField) error {
+			switch f.num {
+			case 1:
+				job.ID = int(f.v)
+			case 2:
+				job.Device = string(f.b)
+			case 5:
+				job.State = string(f.b)
+			}
+			return nil
+		})
+	})
+	if job.ID != 1 || job.Device != "/dev/sdz" || job.State != "done" {
+		t.Errorf("ListJobs: got %+v", job)
+	}
+
+	// the events of job 1 after the first, and the stream ends as the
+	// job has finished
+	var req protoMessage
+	req.int(1, 1)
+	req.int(2, 1)
+	msgs, status, _ = grpcCall(t, g, "WatchEvents", req.b)
+	if status != "0" || len(msgs) != 1 {
+		t.Fatalf("WatchEvents: status %s, %d messages", status, len(msgs))
+	}
+	var ev Event
+	decodeProto(msgs[0], func(f protoField) error {
+		switch f.num {
+		case 1:
+			ev.Seq = int(f.v)
+		case 4:
+			ev.Message = string(f.b)
+		}
+		return nil
+	})
+	if ev.Seq != 3 || ev.Message != "job done" {
+		t.Errorf("WatchEvents: got %+v", ev)
+	}
+
+	tests := []struct {
+		method string
+		req    []byte
+		status string
+	}{
+		{"CancelWipe", []byte{1 << 3, 1}, "9"},  // not running
+		{"CancelWipe", []byte{1 << 3, 7}, "9"},  // no such job
+		{"WatchEvents", []byte{2 << 3, 7}, "5"}, // no such job
+		{"StartWipe", nil, "9"},                 // no device
+		{"StartWipe", []byte{1<<3 | 2, 9}, "3"}, // truncated
+		{"Format", nil, "12"},
+	}
+	for _, tt := range tests {
+		if _, status, msg := grpcCall(t, g, tt.method, tt.req); status != tt.status {
+			t.Errorf("%s %x: status %s (%s), want %s", tt.method, tt.req, status, msg, tt.status)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// Field by field decoding of the volume header, for info -v.
+
+// headerField describes the meaning of a volume header field, and checks
+// whether its value makes sense.
+type headerField struct {
+	meaning string
+	format  func(h *VolumeHeader) string
+	check   func(h *VolumeHeader, avail int64) string // "" if plausible
+}
+
+var headerFields = map[string]headerField{
+	"Jmp": {"boot code jump, unused by BitLocker",
+		func(h *VolumeHeader) string { return fmt.Sprintf("%x", h.Jmp[:]) }, nil},
+	"Signature": {"identifies a BitLocker volume",
+		func(h *VolumeHeader) string { return fmt.Sprintf("%q", h.Signature[:]) },
+		func(h *VolumeHeader, avail int64) string {
+			if !VerifySignature(h.Signature) {
+				return "not -FVE-FS-"
+			}
+			return ""
+		}},
+	"SectorSize": {"bytes per logical sector",
+		func(h *VolumeHeader) string { return fmt.Sprintf("%d bytes", h.SectorSize) },
+		func(h *VolumeHeader, avail int64) string {
+			if !validSectorSize(int64(h.SectorSize)) {
+				return "not a power of two from 512 to 4096"
+			}
+			return ""
+		}},
+	"SectorsPerCluster": {"sectors per cluster of the original filesystem",
+		func(h *VolumeHeader) string { return fmt.Sprintf("%d sectors", h.SectorsPerCluster) },
+		func(h *VolumeHeader, avail int64) string {
+			if n := h.SectorsPerCluster; n == 0 || n&(n-1) != 0 {
+				return "not a power of two"
+			}
+			return ""
+		}},
+	"ReservedClusters": {"reserved clusters, normally zero",
+		func(h *VolumeHeader) string { return fmt.Sprint(h.ReservedClusters) }, nil},
+	"NumSectors": {"size of the volume",
+		func(h *VolumeHeader) string {
+			return fmt.Sprintf("%d sectors (%s)", h.NumSectors, humanSize(int64(h.NumSectors)*int64(h.SectorSize)))
+		},
+		func(h *VolumeHeader, avail int64) string {
+			if h.NumSectors == 0 {
+				return "no size recorded"
+			}
+			if size := int64(h.NumSectors) * int64(h.SectorSize); avail >= 0 && size > avail {
+				return fmt.Sprintf("larger than the %d bytes present, the image may be truncated", avail)
+			}
+			return ""
+		}},
+	"MftStartCluster": {"MFT cluster of the original NTFS volume",
+		func(h *VolumeHeader) string { return fmt.Sprintf("cluster %d", h.MftStartCluster) }, nil},
+	"MetadataLcn": {"cluster of the first metadata block (Windows Vista)",
+		func(h *VolumeHeader) string {
+			return fmt.Sprintf("cluster %d (offset 0x%x)", h.MetadataLcn, headerClusterOffset(h, h.MetadataLcn))
+		},
+		func(h *VolumeHeader, avail int64) string {
+			off := headerClusterOffset(h, h.MetadataLcn)
+			if h.MetadataLcn != 0 && (off < 0 || outOfBounds(off, 1, headerVolumeSize(h))) {
+				return "points outside the volume"
+			}
+			return ""
+		}},
+	"Guid": {"volume header format identifier",
+		func(h *VolumeHeader) string { return "{" + h.Guid.String() + "}" },
+		func(h *VolumeHeader, avail int64) string {
+			if h.Guid.String() != INFO_GUID {
+				return "not the BitLocker identifier"
+			}
+			return ""
+		}},
+	"InfoOffsets": {"offsets of the three metadata blocks",
+		func(h *VolumeHeader) string { return formatFieldValue(h.InfoOffsets) },
+		func(h *VolumeHeader, avail int64) string {
+			for i, off := range h.InfoOffsets {
+				if outOfBounds(int64(off), 1, headerVolumeSize(h)) {
+					return fmt.Sprintf("block %d points outside the volume", i)
+				}
+				if validSectorSize(int64(h.SectorSize)) && off%uint64(h.SectorSize) != 0 {
+					return fmt.Sprintf("block %d is not sector aligned", i)
+				}
+			}
+			return ""
+		}},
+	"EOWOffsets": {"offsets of the encrypt-on-write information, zero if unused",
+		func(h *VolumeHeader) string { return formatFieldValue(h.EOWOffsets) }, nil},
+}
+
+// headerClusterOffset returns the byte offset of cluster lcn, or -1 if it
+// cannot be represented.
+func headerClusterOffset(h *VolumeHeader, lcn uint64) int64 {
+	clusterSize := uint64(h.SectorSize) * uint64(h.SectorsPerCluster)
+	if clusterSize == 0 || lcn > (1<<62)/clusterSize {
+		return -1
+	}
+	return int64(lcn * clusterSize)
+}
+
+// headerVolumeSize returns the volume size recorded in the header, or -1
+// if there is none.
+func headerVolumeSize(h *VolumeHeader) int64 {
+	if h.NumSectors == 0 {
+		return -1
+	}
+	return int64(h.NumSectors) * int64(h.SectorSize)
+}
+
+// printHeaderFields prints each field of the volume header with its
+// meaning and whether its value is plausible, given that avail bytes of
+// the volume are present (-1 if unknown).
+func printHeaderFields(h *VolumeHeader, avail int64) {
+	fmt.Printf("volume header:\n")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, f := range structFields(h, 0) {
+		desc, ok := headerFields[f.Name]
+		if !ok {
+			continue
+		}
+		result := "ok"
+		if desc.check != nil {
+			if problem := desc.check(h, avail); problem != "" {
+				result = "SUSPICIOUS: " + problem
+			}
+		}
+		fmt.Fprintf(tw, "  0x%02x\t%s\t%s\t%s\t%s\n", f.Offset, f.Name, desc.format(h), desc.meaning, result)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// Hooks are shell commands run before and after a wipe, which get the
+// report as JSON on stdin, so that blwipe can be part of an automated
+// disposal line: printing labels, updating an asset database and so on.
+
+type hookFlags struct {
+	pre, post string
+}
+
+func addHookFlags(fs *flag.FlagSet) *hookFlags {
+	h := &hookFlags{}
+	fs.StringVar(&h.pre, "pre-hook", "", "run this command with the report on stdin before wiping, a failure stops the wipe")
+	fs.StringVar(&h.post, "post-hook", "", "run this command with the final report on stdin")
+	return h
+}
+
+func (h *hookFlags) enabled() bool { return h != nil && (h.pre != "" || h.post != "") }
+
+// runHook runs command through the shell with r as JSON on stdin. Its
+// output goes to ours.
+func runHook(command string, r *Report) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// runPreHook runs the pre-hook, refusing to go on if it fails.
+func (h *hookFlags) runPreHook(r *Report) {
+	if h.pre == "" {
+		return
+	}
+	step := r.Step("pre-hook", "run", h.pre)
+	if err := runHook(h.pre, r); err != nil {
+		r.Done(step, "failed: "+err.Error())
+		fatal("refusing to wipe, the pre-hook failed: %v", err)
+	}
+	r.Done(step, "done")
+}
+
+// runPostHook is called by Finish, whatever the outcome.
+func runPostHook(command string, r *Report) {
+	if err := runHook(command, r); err != nil {
+		fmt.Fprintf(os.Stderr, "post-hook failed: %v\n", err)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The REST interface of the daemon, for asset disposal dashboards. It
+// offers the same operations as the RPC interface:
+//
+//	GET  /api/devices               devices and the encrypted volumes on them
+//	GET  /api/jobs                  all jobs
+//	POST /api/jobs                  start a wipe, with a WipeRequest as body
+//	GET  /api/jobs/<id>             a single job
+//	POST /api/jobs/<id>/cancel      cancel a running job
+//	GET  /api/jobs/<id>/report      the JSON report of a job
+//	GET  /api/events?since=&wait_ms= events after a sequence number
+
+type httpAPI struct {
+	m     *jobManager
+	token string
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (api *httpAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(auth[7:]), []byte(api.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid token"})
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "api" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case parts[1] == "devices" && len(parts) == 2 && r.Method == "GET":
+		devs, err := api.m.listDevices()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, devs)
+
+	case parts[1] == "events" && len(parts) == 2 && r.Method == "GET":
+		since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+		wait, _ := strconv.Atoi(r.URL.Query().Get("wait_ms"))
+		evs := api.m.eventsSince(since, time.Duration(wait)*time.Millisecond)
+		if evs == nil {
+			evs = []Event{}
+		}
+		writeJSON(w, http.StatusOK, evs)
+
+	case parts[1] == "jobs" && len(parts) == 2 && r.Method == "GET":
+		writeJSON(w, http.StatusOK, api.m.list())
+
+	case parts[1] == "jobs" && len(parts) == 2 && r.Method == "POST":
+		var req WipeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		j, err := api.m.start(req)
+		if err != nil {
+			httpError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, j)
+
+	case parts[1] == "jobs" && len(parts) >= 3:
+		api.serveJob(w, r, parts[2:])
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (api *httpAPI) serveJob(w http.ResponseWriter, r *http.Request, parts []string) {
+	id, _ := strconv.Atoi(parts[0])
+	jobs := api.m.list()
+	if id < 1 || id > len(jobs) {
+		http.NotFound(w, r)
+		return
+	}
+	j := jobs[id-1]
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		writeJSON(w, http.StatusOK, j)
+
+	case len(parts) == 2 && parts[1] == "cancel" && r.Method == "POST":
+		cj, err := api.m.cancel(id)
+		if err != nil {
+			httpError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, cj)
+
+	case len(parts) == 2 && parts[1] == "report" && r.Method == "GET":
+		if j.Report == "" {
+			http.NotFound(w, r)
+			return
+		}
+		b, err := os.ReadFile(j.Report)
+		if err != nil {
+			httpError(w, http.StatusNotFound, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+// Names like sdb and PhysicalDrive1 are handed out in the order drives
+// show up, so reports and audit logs also record names that stay with the
+// drive, for an audit trail that can't end up pointing at another one.
+
+// driveIdentity holds the persistent names of the drive a target is on.
+type driveIdentity struct {
+	ByID     string `json:"by_id,omitempty"`    // the link in /dev/disk/by-id, on Linux
+	Instance string `json:"instance,omitempty"` // the device instance path, on Windows
+	WWN      string `json:"wwn,omitempty"`
+	Serial   string `json:"serial,omitempty"`
+}
+
+// String returns the most specific of the names.
+func (d *driveIdentity) String() string {
+	switch {
+	case d.ByID != "":
+		return d.ByID
+	case d.Instance != "":
+		return d.Instance
+	case d.WWN != "":
+		return "wwn " + d.WWN
+	case d.Serial != "":
+		return "serial " + d.Serial
+	}
+	return ""
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const byIDDir = "/dev/disk/by-id"
+
+// identifyDrive returns the persistent names of the block device at path,
+// or nil if it is not one.
+func identifyDrive(path string) *driveIdentity {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(real, &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return nil
+	}
+
+	d := &driveIdentity{ByID: byIDLink(real)}
+	if sys, err := sysfsBlock(uint64(st.Rdev)); err == nil {
+		if _, err := os.Stat(filepath.Join(sys, "partition")); err == nil {
+			sys = filepath.Dir(sys)
+		}
+		d.WWN = readSysfs(filepath.Join(sys, "wwid"))
+		if d.WWN == "" {
+			d.WWN = readSysfs(filepath.Join(sys, "device", "wwid"))
+		}
+		d.Serial = readSysfs(filepath.Join(sys, "device", "serial"))
+	}
+	if *d == (driveIdentity{}) {
+		return nil
+	}
+	return d
+}
+
+// byIDLink returns the link in /dev/disk/by-id to dev, preferring those
+// naming the model and serial number over the WWN ones.
+func byIDLink(dev string) string {
+	entries, err := os.ReadDir(byIDDir)
+	if err != nil {
+		return ""
+	}
+	best := ""
+	for _, e := range entries {
+		link := filepath.Join(byIDDir, e.Name())
+		if target, err := filepath.EvalSymlinks(link); err != nil || target != dev {
+			continue
+		}
+		if best == "" || strings.HasPrefix(filepath.Base(best), "wwn-") {
+			best = link
+		}
+	}
+	return best
+}
@@ -0,0 +1,10 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+//go:build !linux && !windows
+
+package main
+
+// identifyDrive has no persistent names to find on this system.
+func identifyDrive(path string) *driveIdentity { return nil }
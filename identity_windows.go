@@ -0,0 +1,166 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	_IOCTL_STORAGE_QUERY_PROPERTY = 0x002d1400
+
+	_DIGCF_PRESENT         = 0x2
+	_DIGCF_DEVICEINTERFACE = 0x10
+	_ERROR_NO_MORE_ITEMS   = 259
+)
+
+var (
+	setupapi = syscall.NewLazyDLL("setupapi.dll")
+
+	procSetupDiGetClassDevs             = setupapi.NewProc("SetupDiGetClassDevsW")
+	procSetupDiEnumDeviceInterfaces     = setupapi.NewProc("SetupDiEnumDeviceInterfaces")
+	procSetupDiGetDeviceInterfaceDetail = setupapi.NewProc("SetupDiGetDeviceInterfaceDetailW")
+	procSetupDiGetDeviceInstanceId      = setupapi.NewProc("SetupDiGetDeviceInstanceIdW")
+	procSetupDiDestroyDeviceInfoList    = setupapi.NewProc("SetupDiDestroyDeviceInfoList")
+	guidDevinterfaceDisk                = syscall.GUID{Data1: 0x53f56307, Data2: 0xb6bf, Data3: 0x11d0,
+		Data4: [8]byte{0x94, 0xf2, 0x00, 0xa0, 0xc9, 0x1e, 0xfb, 0x8b}}
+)
+
+type spDevinfoData struct {
+	Size      uint32
+	ClassGUID syscall.GUID
+	DevInst   uint32
+	Reserved  uintptr
+}
+
+type spDeviceInterfaceData struct {
+	Size     uint32
+	ClassID  syscall.GUID
+	Flags    uint32
+	Reserved uintptr
+}
+
+// diskNumber returns the number of the drive that the volume or drive h
+// is on, as in PhysicalDriveN.
+func diskNumber(h syscall.Handle) (uint32, bool) {
+	var number struct {
+		DeviceType      uint32
+		DeviceNumber    uint32
+		PartitionNumber uint32
+	}
+	var returned uint32
+	err := syscall.DeviceIoControl(h, _IOCTL_STORAGE_GET_DEVICE_NUMBER, nil, 0,
+		(*byte)(unsafe.Pointer(&number)), uint32(unsafe.Sizeof(number)), &returned, nil)
+	return number.DeviceNumber, err == nil
+}
+
+// openQuery opens path without asking for access, which is all that
+// querying a drive needs.
+func openQuery(path string) (syscall.Handle, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	return syscall.CreateFile(name, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE,
+		nil, syscall.OPEN_EXISTING, 0, 0)
+}
+
+// identifyDrive returns the device instance path and serial number of
+// the drive that path, a drive or a volume, is on, or nil if it is not one.
+func identifyDrive(path string) *driveIdentity {
+	h, err := openQuery(path)
+	if err != nil {
+		return nil
+	}
+	defer syscall.CloseHandle(h)
+	number, ok := diskNumber(h)
+	if !ok {
+		return nil
+	}
+
+	d := &driveIdentity{Instance: diskInstance(number), Serial: driveSerial(h)}
+	if *d == (driveIdentity{}) {
+		return nil
+	}
+	return d
+}
+
+// driveSerial returns the serial number in the storage device descriptor.
+func driveSerial(h syscall.Handle) string {
+	query := make([]byte, 12) // StorageDeviceProperty, PropertyStandardQuery
+	buf := make([]byte, 1024)
+	var returned uint32
+	err := syscall.DeviceIoControl(h, _IOCTL_STORAGE_QUERY_PROPERTY, &query[0], uint32(len(query)),
+		&buf[0], uint32(len(buf)), &returned, nil)
+	if err != nil || returned < 28 {
+		return ""
+	}
+	off := *(*uint32)(unsafe.Pointer(&buf[24]))
+	if off == 0 || off >= returned {
+		return ""
+	}
+	s := buf[off:returned]
+	if i := strings.IndexByte(string(s), 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(string(s))
+}
+
+// diskInstance returns the device instance path of PhysicalDriveN, by
+// going through the disk interfaces for the one with that number.
+func diskInstance(number uint32) string {
+	devs, _, _ := procSetupDiGetClassDevs.Call(uintptr(unsafe.Pointer(&guidDevinterfaceDisk)), 0, 0,
+		_DIGCF_PRESENT|_DIGCF_DEVICEINTERFACE)
+	if syscall.Handle(devs) == syscall.InvalidHandle {
+		return ""
+	}
+	defer procSetupDiDestroyDeviceInfoList.Call(devs)
+
+	for i := uintptr(0); ; i++ {
+		iface := spDeviceInterfaceData{Size: uint32(unsafe.Sizeof(spDeviceInterfaceData{}))}
+		r, _, err := procSetupDiEnumDeviceInterfaces.Call(devs, 0,
+			uintptr(unsafe.Pointer(&guidDevinterfaceDisk)), i, uintptr(unsafe.Pointer(&iface)))
+		if r == 0 {
+			if err != syscall.Errno(_ERROR_NO_MORE_ITEMS) {
+				return ""
+			}
+			break
+		}
+
+		// SP_DEVICE_INTERFACE_DETAIL_DATA_W: its size, then the path
+		detail := make([]uint16, 1024)
+		size := uint32(6)
+		if unsafe.Sizeof(uintptr(0)) == 8 {
+			size = 8
+		}
+		*(*uint32)(unsafe.Pointer(&detail[0])) = size
+		info := spDevinfoData{Size: uint32(unsafe.Sizeof(spDevinfoData{}))}
+		r, _, _ = procSetupDiGetDeviceInterfaceDetail.Call(devs, uintptr(unsafe.Pointer(&iface)),
+			uintptr(unsafe.Pointer(&detail[0])), uintptr(2*len(detail)), 0, uintptr(unsafe.Pointer(&info)))
+		if r == 0 {
+			continue
+		}
+
+		h, err := openQuery(syscall.UTF16ToString(detail[2:]))
+		if err != nil {
+			continue
+		}
+		n, ok := diskNumber(h)
+		syscall.CloseHandle(h)
+		if !ok || n != number {
+			continue
+		}
+
+		id := make([]uint16, 512)
+		r, _, _ = procSetupDiGetDeviceInstanceId.Call(devs, uintptr(unsafe.Pointer(&info)),
+			uintptr(unsafe.Pointer(&id[0])), uintptr(len(id)), 0)
+		if r != 0 {
+			return syscall.UTF16ToString(id)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,281 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Image is a volume or disk image presented as a flat sequence of bytes,
+// regardless of the container format it is actually stored in. All access
+// is positional, so there is no current position to keep track of.
+type Image interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// storage is the file a container format is stored in.
+type storage interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// diskFormat is a container backend that maps virtual disk offsets onto
+// the file that stores them.
+type diskFormat interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() int64
+}
+
+// virtualDisk adapts a diskFormat to the Image interface.
+type virtualDisk struct {
+	disk     diskFormat
+	closer   io.Closer
+	readOnly bool
+}
+
+func (v *virtualDisk) ReadAt(p []byte, off int64) (int, error) { return v.disk.ReadAt(p, off) }
+
+func (v *virtualDisk) WriteAt(p []byte, off int64) (int, error) { return v.disk.WriteAt(p, off) }
+
+func (v *virtualDisk) Close() error { return v.closer.Close() }
+
+// imageStorage returns img for random access, which streams cannot do.
+func imageStorage(img Image) (storage, error) {
+	if _, ok := img.(*pipeImage); ok {
+		return nil, errors.New("image does not support random access")
+	}
+	return img, nil
+}
+
+// isReadOnly reports whether img is stored in a format that can never be
+// written to.
+func isReadOnly(img Image) bool {
+	switch v := img.(type) {
+	case *virtualDisk:
+		return v.readOnly
+	case *pipeImage, *mappedImage:
+		return true
+	}
+	return false
+}
+
+// imageSize returns the size of img in bytes, or -1 if it cannot be known
+// in advance, as with pipes.
+func imageSize(img Image) (int64, error) {
+	switch v := img.(type) {
+	case *virtualDisk:
+		return v.disk.Size(), nil
+	case *os.File:
+		fi, err := v.Stat()
+		if err == nil && fi.Mode().IsRegular() {
+			return fi.Size(), nil
+		}
+		return deviceSize(v)
+	case *mappedImage:
+		return int64(len(v.data)), nil
+	}
+	return -1, nil
+}
+
+// deviceFile returns the file that img is, or that it writes to directly,
+// for operations on the drive itself.
+func deviceFile(img Image) (*os.File, bool) {
+	if v, ok := img.(*virtualDisk); ok {
+		if d, ok := v.disk.(*directDisk); ok {
+			return d.f, true
+		}
+	}
+	f, ok := img.(*os.File)
+	return f, ok
+}
+
+// subStorage presents the part of s starting at off, such as a partition.
+type subStorage struct {
+	s   storage
+	off int64
+}
+
+func (s *subStorage) ReadAt(p []byte, off int64) (int, error) { return s.s.ReadAt(p, s.off+off) }
+
+func (s *subStorage) WriteAt(p []byte, off int64) (int, error) { return s.s.WriteAt(p, s.off+off) }
+
+// readOnlyStorage lets a plain reader be used as storage, refusing writes.
+type readOnlyStorage struct{ io.ReaderAt }
+
+func (readOnlyStorage) WriteAt(p []byte, off int64) (int, error) { return 0, errReadOnly }
+
+// readFullAt reads exactly len(p) bytes at off, treating a short read as
+// an error.
+func readFullAt(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// openImage opens the target at path, transparently unwrapping any
+// supported virtual disk container. Write access is only requested when
+// writable is set, so inspecting write-blocked media works.
+func openImage(path string, writable bool) (Image, error) {
+	mode := os.O_RDONLY
+	if writable {
+		mode = os.O_RDWR
+		if durability.writeThrough {
+			mode |= os.O_SYNC
+		}
+	}
+
+	if isFakeDevice(path) {
+		disk, err := openFakeDevice(path)
+		if err != nil {
+			return nil, err
+		}
+		return &virtualDisk{disk: disk, closer: disk}, nil
+	}
+
+	if isRemoteImage(path) {
+		if writable {
+			return nil, errors.New("images on web servers and S3 can only be inspected")
+		}
+		disk, err := openRemoteImage(path)
+		if err != nil {
+			return nil, err
+		}
+		return &virtualDisk{disk: disk, closer: disk, readOnly: true}, nil
+	}
+
+	if isNBD(path) {
+		disk, err := openNBD(path)
+		if err != nil {
+			return nil, err
+		}
+		if writable && disk.ReadOnly() {
+			disk.Close()
+			return nil, errors.New("the NBD export is read-only")
+		}
+		return &virtualDisk{disk: disk, closer: disk, readOnly: disk.ReadOnly()}, nil
+	}
+
+	// evidence containers are never opened for writing
+	if f, err := os.Open(path); err == nil {
+		ewf := isEWF(f)
+		f.Close()
+		if ewf {
+			disk, err := openEWF(path)
+			if err != nil {
+				return nil, err
+			}
+			return &virtualDisk{disk: disk, closer: disk, readOnly: true}, nil
+		}
+	}
+
+	if isSplitRaw(path) && !isContainerFile(path) {
+		disk, err := openSplitRaw(path, mode)
+		if err != nil {
+			return nil, err
+		}
+		return &virtualDisk{disk: disk, closer: disk, readOnly: !writable}, nil
+	}
+
+	f, err := os.OpenFile(path, mode, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if writable {
+		if err := lockTarget(path, f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	// also works for block devices, whose Stat size is zero
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// drives with PI interleaved, or images of them
+	if s, rawSize, sector := rawSectors(f); s != nil {
+		return &virtualDisk{disk: newInterleavedDisk(s, rawSize, sector), closer: f, readOnly: !writable}, nil
+	}
+	if rawSectorSize != 0 {
+		return &virtualDisk{disk: newInterleavedDisk(f, size, rawSectorSize), closer: f, readOnly: !writable}, nil
+	}
+
+	if isQCOW2(f) {
+		if writable {
+			f.Close()
+			return nil, errors.New("qcow2 images can only be inspected, convert them with qemu-img first")
+		}
+		disk, err := openQCOW2(f, size)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &virtualDisk{disk: disk, closer: f, readOnly: true}, nil
+	}
+	if isVMDK(f) {
+		if writable {
+			f.Close()
+			return nil, errors.New("sparse vmdk images can only be inspected, convert them with qemu-img first")
+		}
+		disk, err := openVMDK(f, size)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &virtualDisk{disk: disk, closer: f, readOnly: true}, nil
+	}
+
+	var disk diskFormat
+	switch {
+	case isVHDX(f):
+		disk, err = openVHDX(f, size)
+	case isVHD(f, size):
+		disk, err = openVHD(f, size)
+	default:
+		if writable && durability.direct {
+			d, err := openDirect(path, f, size)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			return &virtualDisk{disk: d, closer: d}, nil
+		}
+		return f, nil
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &virtualDisk{disk: disk, closer: f, readOnly: !writable}, nil
+}
+
+// isContainerFile reports whether the file at path is a qcow2, vmdk, VHD or
+// VHDX image, so a single image named like a split segment isn't taken as
+// raw.
+func isContainerFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false
+	}
+	return isQCOW2(f) || isVMDK(f) || isVHDX(f) || isVHD(f, size)
+}
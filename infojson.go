@@ -0,0 +1,173 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// The document printed by info -json. Its layout is described by
+// info.schema.json, and infoSchemaVersion goes up whenever a field is
+// removed or changes meaning. Adding fields doesn't change it.
+
+const infoSchemaVersion = 1
+
+//go:embed info.schema.json
+var infoSchema string
+
+type infoDocument struct {
+	SchemaVersion  int                 `json:"schema_version"`
+	Target         string              `json:"target"`
+	Offset         int64               `json:"offset"`
+	Format         string              `json:"format"`
+	Description    string              `json:"description,omitempty"`
+	Header         *infoHeader         `json:"header,omitempty"`
+	MetadataBlocks []infoMetadataBlock `json:"metadata_blocks,omitempty"`
+	Volume         *infoVolume         `json:"volume,omitempty"`
+	Protectors     []infoProtector     `json:"protectors,omitempty"`
+	Regions        []infoRegion        `json:"regions"`
+}
+
+type infoHeader struct {
+	SectorSize      int64    `json:"sector_size"`
+	Sectors         uint64   `json:"sectors"`
+	MetadataOffsets []uint64 `json:"metadata_offsets"`
+	EOWOffsets      []uint64 `json:"eow_offsets,omitempty"`
+}
+
+type infoMetadataBlock struct {
+	Index   int    `json:"index"`
+	Offset  int64  `json:"offset"`
+	Size    int64  `json:"size,omitempty"`
+	Valid   bool   `json:"valid"`
+	Version int    `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type infoVolume struct {
+	GUID             string    `json:"guid"`
+	Size             int64     `json:"size"`
+	EncryptionMethod string    `json:"encryption_method"`
+	Created          time.Time `json:"created"`
+	Suspended        bool      `json:"suspended"`
+	Truncated        bool      `json:"truncated"`
+	CreatedBy        string    `json:"created_by"`
+}
+
+type infoProtector struct {
+	ID           string    `json:"id"`
+	Type         string    `json:"type"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type infoRegion struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// infoJSON, if set by -json, is filled in by runOneVolume instead of the
+// usual output.
+var infoJSON *infoDocument
+
+var encryptionMethodNames = map[uint16]string{
+	0x8000: "AES-CBC-128 with diffuser",
+	0x8001: "AES-CBC-256 with diffuser",
+	0x8002: "AES-CBC-128",
+	0x8003: "AES-CBC-256",
+	0x8004: "AES-XTS-128",
+	0x8005: "AES-XTS-256",
+}
+
+func encryptionMethodName(m uint16) string {
+	if name, ok := encryptionMethodNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (0x%04x)", m)
+}
+
+func newInfoDocument(target string, offset int64) *infoDocument {
+	return &infoDocument{SchemaVersion: infoSchemaVersion, Target: target, Offset: offset}
+}
+
+func (d *infoDocument) addBlock(b infoMetadataBlock) {
+	if d != nil {
+		d.MetadataBlocks = append(d.MetadataBlocks, b)
+	}
+}
+
+func (d *infoDocument) addRegions(regions []RegionDesc) {
+	for _, r := range regions {
+		d.Regions = append(d.Regions, infoRegion{r.Name, r.Offset, r.Size})
+	}
+}
+
+// setBitLocker fills in what is known about a BitLocker volume once its
+// metadata blocks have been read.
+func (d *infoDocument) setBitLocker(hdr *VolumeHeader, sectorSize, volumeSize int64, truncated bool, copies [][]byte) {
+	d.Format = "bitlocker"
+	d.Header = &infoHeader{
+		SectorSize:      sectorSize,
+		Sectors:         hdr.NumSectors,
+		MetadataOffsets: hdr.InfoOffsets[:],
+	}
+	for _, off := range hdr.EOWOffsets {
+		if off != 0 {
+			d.Header.EOWOffsets = append(d.Header.EOWOffsets, off)
+		}
+	}
+
+	for _, raw := range copies {
+		if raw == nil {
+			continue
+		}
+		_, mh := parseMetadataBlock(raw)
+		gen, _ := windowsGeneration(hdr, raw)
+		d.Description = description(raw)
+		ps := protectors(raw)
+		d.Volume = &infoVolume{
+			GUID:             strings.ToLower(mh.VolumeGuid.String()),
+			Size:             volumeSize,
+			EncryptionMethod: encryptionMethodName(mh.EncryptionMethod),
+			Created:          filetimeToTime(mh.CreationTime).UTC(),
+			Suspended:        isSuspended(ps),
+			Truncated:        truncated,
+			CreatedBy:        gen,
+		}
+		d.Protectors = []infoProtector{}
+		for _, p := range ps {
+			d.Protectors = append(d.Protectors, infoProtector{
+				ID:           strings.ToLower(p.KeyId.String()),
+				Type:         p.TypeName(),
+				LastModified: filetimeToTime(p.LastModified).UTC(),
+			})
+		}
+		break
+	}
+}
+
+// write prints the document as JSON, or as the Info message of
+// blwipe.proto if format is "proto".
+func (d *infoDocument) write(w io.Writer, format string) {
+	if d.Regions == nil {
+		d.Regions = []infoRegion{}
+	}
+	var err error
+	if format == "proto" {
+		err = writeDelimited(w, d.proto())
+	} else {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(d)
+	}
+	if err != nil {
+		fatal("can't write %s: %v", format, err)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// iSCSI LUNs are reached through the sessions of the system's initiator
+// (open-iscsi on Linux), given as iscsi://portal[:port]/target-iqn[/lun].
+
+const iscsiDefaultPort = "3260"
+
+type iscsiTarget struct {
+	Portal string // host:port
+	IQN    string
+	LUN    int
+}
+
+func isISCSI(path string) bool {
+	return strings.HasPrefix(path, "iscsi://")
+}
+
+func parseISCSI(path string) (*iscsiTarget, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &iscsiTarget{Portal: u.Host}
+	if u.Port() == "" {
+		t.Portal = net.JoinHostPort(u.Hostname(), iscsiDefaultPort)
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	t.IQN = parts[0]
+	if t.IQN == "" || len(parts) > 2 {
+		return nil, fmt.Errorf("invalid iSCSI target %q, use iscsi://portal/iqn/lun", path)
+	}
+	if len(parts) == 2 {
+		if t.LUN, err = strconv.Atoi(parts[1]); err != nil || t.LUN < 0 {
+			return nil, fmt.Errorf("invalid LUN %q", parts[1])
+		}
+	}
+	return t, nil
+}
+
+// matchesPortal reports whether the address and port of a session
+// connection are those of the portal, which may be given by name.
+func (t *iscsiTarget) matchesPortal(addr, port string) bool {
+	host, tport, _ := net.SplitHostPort(t.Portal)
+	if port != tport {
+		return false
+	}
+	if host == addr {
+		return true
+	}
+	ips, _ := net.LookupHost(host)
+	for _, ip := range ips {
+		if net.ParseIP(ip).Equal(net.ParseIP(addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+// openISCSI finds the local device of an iSCSI LUN and opens it.
+func openISCSI(path string, writable bool) (Image, error) {
+	t, err := parseISCSI(path)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := iscsiDevice(t)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("%s is %s\n", path, dev)
+	return openImage(dev, writable)
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+const iscsiSessions = "/sys/class/iscsi_session"
+
+// iscsiDevice returns the block device of a LUN of a target that the
+// initiator is logged in to through the given portal.
+func iscsiDevice(t *iscsiTarget) (string, error) {
+	sessions, _ := filepath.Glob(filepath.Join(iscsiSessions, "session*"))
+	for _, s := range sessions {
+		if readSysfs(filepath.Join(s, "targetname")) != t.IQN {
+			continue
+		}
+
+		// the connection is in the session's device directory
+		dev := filepath.Join(s, "device")
+		conns, _ := filepath.Glob(filepath.Join(dev, "connection*", "iscsi_connection", "connection*"))
+		matched := false
+		for _, c := range conns {
+			if t.matchesPortal(readSysfs(filepath.Join(c, "persistent_address")),
+				readSysfs(filepath.Join(c, "persistent_port"))) {
+				matched = true
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		if state := readSysfs(filepath.Join(s, "state")); state != "" && state != "LOGGED_IN" {
+			return "", fmt.Errorf("the iSCSI session to %s is %s", t.IQN, state)
+		}
+
+		blocks, _ := filepath.Glob(filepath.Join(dev, "target*", "*:*:*:"+strconv.Itoa(t.LUN), "block", "*"))
+		if len(blocks) != 1 {
+			return "", fmt.Errorf("LUN %d of %s has no block device", t.LUN, t.IQN)
+		}
+		return "/dev/" + filepath.Base(blocks[0]), nil
+	}
+
+	return "", fmt.Errorf("not logged in to %s through %s, log in first with "+
+		"\"iscsiadm -m node -T %s -p %s --login\"", t.IQN, t.Portal, t.IQN, t.Portal)
+}
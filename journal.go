@@ -0,0 +1,250 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An undo journal holds the regions a wipe overwrote, encrypted with a
+// passphrase, so that the wipe can be reversed with "blwipe undo" for as
+// long as the journal is kept. Deleting the journal ends that window.
+//
+// The file is the magic, a 16-byte salt, the PBKDF2 iteration count, a
+// 12-byte nonce and the AES-256-GCM sealed JSON of a metadataBackup. All
+// but the sealed data are authenticated as additional data.
+
+const (
+	journalMagic      = "BLWJRNL1"
+	journalIterations = 600000
+	journalHeaderSize = len(journalMagic) + 16 + 4 + 12
+
+	journalPassphraseEnv = "BLWIPE_JOURNAL_PASSPHRASE"
+)
+
+var errBadPassphrase = errors.New("wrong passphrase or damaged journal")
+
+// journalPath, if set by -journal, is where wipeRegions saves the regions
+// before overwriting them.
+var journalPath string
+
+func journalPassphrase() []byte {
+	p := os.Getenv(journalPassphraseEnv)
+	if p == "" {
+		fatal("the journal passphrase must be set in %s", journalPassphraseEnv)
+	}
+	return []byte(p)
+}
+
+// pbkdf2 derives a key of keyLen bytes with HMAC-SHA256, as in RFC 8018.
+func pbkdf2(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+func journalCipher(passphrase, salt []byte, iter int) cipher.AEAD {
+	key := pbkdf2(passphrase, salt, iter, 32)
+	block, _ := aes.NewCipher(key)
+	zeroize(key)
+	gcm, _ := cipher.NewGCM(block)
+	return gcm
+}
+
+// saveJournal reads the regions of the volume at offset and saves them,
+// encrypted, to journalPath.
+func saveJournal(r io.ReaderAt, offset int64, regions []RegionDesc) {
+	hdr := make([]byte, journalHeaderSize)
+	copy(hdr, journalMagic)
+	salt, nonce := hdr[8:24], hdr[28:40]
+	binary.LittleEndian.PutUint32(hdr[24:28], journalIterations)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		fatal("not wiping, can't create journal: %v", err)
+	}
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		fatal("not wiping, can't create journal: %v", err)
+	}
+
+	// cleared before anything can fail, as fatal doesn't run deferred calls
+	b := readBackup(r, offset, regions)
+	plain, _ := json.Marshal(b)
+	b.zeroize()
+	passphrase := journalPassphrase()
+	sealed := journalCipher(passphrase, salt, journalIterations).Seal(nil, nonce, plain, hdr)
+	zeroize(passphrase)
+	zeroize(plain)
+
+	out := journalFile
+	journalFile = nil
+	if out == nil {
+		fatal("not wiping, the journal file was not created")
+	}
+	_, err := out.Write(append(hdr, sealed...))
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		shredOpenFile(out)
+	}
+	out.Close()
+	if err != nil {
+		fatal("not wiping, can't save journal: %v", err)
+	}
+	fmt.Printf("saved %d regions to the undo journal %s\n", len(regions), journalPath)
+}
+
+func readJournal(path string, passphrase []byte) (*metadataBackup, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < journalHeaderSize || !bytes.HasPrefix(data, []byte(journalMagic)) {
+		return nil, fmt.Errorf("%s is not an undo journal", path)
+	}
+	hdr := data[:journalHeaderSize]
+	iter := int(binary.LittleEndian.Uint32(hdr[24:28]))
+	if iter < 1 || iter > 100*journalIterations {
+		return nil, fmt.Errorf("%s is not an undo journal", path)
+	}
+	plain, err := journalCipher(passphrase, hdr[8:24], iter).Open(nil, hdr[28:40], data[journalHeaderSize:], hdr)
+	if err != nil {
+		return nil, errBadPassphrase
+	}
+	var b metadataBackup
+	err = json.Unmarshal(plain, &b)
+	zeroize(plain)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// discardJournal overwrites the journal before removing it, which ends the
+// window in which the wipe can be undone.
+func discardJournal(path string) error { return shredFile(path) }
+
+// journalMismatch lists the ways the target, opened from path, differs
+// from the one the journal b was taken of. The volume GUID can only be
+// compared while a copy of the metadata survives, as it is in what was
+// wiped.
+func journalMismatch(b *metadataBackup, path string, f Image) []string {
+	var problems []string
+	if !sameTarget(b.Target, path) {
+		problems = append(problems, fmt.Sprintf("the journal is of %s, not %s", b.Target, path))
+	}
+	if size, err := imageSize(f); err == nil && b.Size > 0 && size >= 0 && size != b.Size {
+		problems = append(problems, fmt.Sprintf("the journal is of a target of %s, not %s",
+			sizeString(b.Size), sizeString(size)))
+	}
+	if st, err := imageStorage(f); err == nil && b.Volume != "" {
+		if guid, err := volumeGuid(st, b.Offset); err == nil && !strings.EqualFold(guid.String(), b.Volume) {
+			problems = append(problems, fmt.Sprintf("the journal is of volume %s, not %s", b.Volume, guid))
+		}
+	}
+	return problems
+}
+
+// sameTarget reports whether the paths a and b name the same device or
+// file, through symlinks such as those in /dev/disk/by-id.
+func sameTarget(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	return err == nil && os.SameFile(fa, fb)
+}
+
+func cmdUndo(args []string) {
+	fs := newFlagSet("undo", "<device>")
+	journal := fs.String("journal", "", "undo journal saved by wipe -journal")
+	discard := fs.Bool("discard", false, "destroy the journal instead, so the wipe can no longer be undone")
+	force := fs.Bool("force", false, "restore even if the device doesn't look like the one the journal was taken of")
+	parseFlags(fs, args)
+
+	if *journal == "" || (*discard && fs.NArg() != 0) || (!*discard && fs.NArg() != 1) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if *discard {
+		if err := discardJournal(*journal); err != nil {
+			fatal("can't discard journal: %v", err)
+		}
+		result("journal %s destroyed, the wipe can no longer be undone", *journal)
+		return
+	}
+
+	passphrase := journalPassphrase()
+	b, err := readJournal(*journal, passphrase)
+	zeroize(passphrase)
+	if err != nil {
+		fatal("can't read journal: %v", err)
+	}
+	defer b.zeroize()
+
+	f, err := openTarget(fs.Arg(0), true)
+	if err != nil {
+		fatal("can't open file: %s", err)
+	}
+	defer f.Close()
+	if isReadOnly(f) {
+		fatal("%s is a read-only evidence container", fs.Arg(0))
+	}
+
+	fmt.Printf("journal of %s taken %s\n", b.Target, b.Created.UTC().Format(time.RFC3339))
+	if problems := journalMismatch(b, fs.Arg(0), f); len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Printf("%s\n", p)
+		}
+		if !*force {
+			fatal("not restoring, %s may not be the device the journal was taken of (use -force if it is)", fs.Arg(0))
+		}
+	}
+	for _, region := range b.Regions {
+		fmt.Printf("restoring %s at offset 0x%x size %s...\n", region.Name, region.Offset,
+			sizeString(int64(len(region.Data))))
+		if _, err := f.WriteAt(region.Data, region.Offset); err != nil {
+			fatal("can't restore %s: %v", region.Name, err)
+		}
+	}
+	if err := syncImage(f); err != nil {
+		fatal("can't sync: %v", err)
+	}
+	result("%d regions restored, delete or discard the journal when it is no longer needed", len(b.Regions))
+}
@@ -0,0 +1,282 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Finding copies of the keys of a volume that were saved elsewhere, such
+// as startup key (.BEK) files on USB sticks or recovery keys saved to a
+// text file.
+
+const maxKeyFileSize = 64 << 10
+
+// keyFileMatch identifies the key protector a file holds a key for.
+type keyFileMatch struct {
+	KeyId Guid
+	Kind  string
+}
+
+// matchKeyFile checks whether the file name with content data holds the
+// key of one of the protectors in ids.
+func matchKeyFile(name string, data []byte, ids map[Guid]bool) (keyFileMatch, bool) {
+	if strings.EqualFold(filepath.Ext(name), ".bek") {
+		if id, ok := bekKeyId(data); ok && ids[id] {
+			return keyFileMatch{id, "startup key"}, true
+		}
+	}
+	if strings.EqualFold(filepath.Ext(name), ".txt") {
+		text := strings.ToUpper(decodeText(data))
+		for id := range ids {
+			if strings.Contains(text, id.String()) {
+				return keyFileMatch{id, "recovery key"}, true
+			}
+		}
+	}
+	return keyFileMatch{}, false
+}
+
+// decodeText decodes text files, which Windows saves recovery keys to as
+// UTF-16 with a byte order mark.
+func decodeText(data []byte) string {
+	if len(data) >= 2 && data[0] == 0xff && data[1] == 0xfe {
+		return decodeUTF16(data[2:])
+	}
+	return string(data)
+}
+
+// bekKeyId returns the key protector GUID of a startup key file, which has
+// the same layout as the metadata of a volume.
+func bekKeyId(data []byte) (id Guid, ok bool) {
+	var mh MetadataHeader
+	if len(data) < binary.Size(mh) {
+		return
+	}
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, &mh)
+	for _, d := range parseDatums(data, int(mh.HeaderSize), int(mh.MetadataSize)) {
+		if d.EntryType == EntryTypeStartupKey && d.ValueType == ValueTypeExternalKey &&
+			len(d.Value) >= 16 {
+			binary.Read(bytes.NewReader(d.Value), binary.LittleEndian, &id)
+			return id, true
+		}
+	}
+	return
+}
+
+// shredExtents overwrites exts with random data from randSource.
+func shredExtents(w io.WriterAt, exts []extent) error {
+	buf := make([]byte, 1<<20)
+	for _, e := range exts {
+		for done := int64(0); done < e.Size; {
+			n := e.Size - done
+			if n > int64(len(buf)) {
+				n = int64(len(buf))
+			}
+			if _, err := io.ReadFull(randSource, buf[:n]); err != nil {
+				return err
+			}
+			if _, err := w.WriteAt(buf[:n], e.Offset+done); err != nil {
+				return err
+			}
+			done += n
+		}
+	}
+	return nil
+}
+
+// keyScanner looks for key files on media and optionally shreds them.
+type keyScanner struct {
+	ids   map[Guid]bool
+	shred bool
+	skip  int64 // partition offset not to scan, or -1
+	found int
+}
+
+func (s *keyScanner) report(where string, m keyFileMatch) {
+	s.found++
+	fmt.Printf("%s: %s for {%v}\n", where, m.Kind, m.KeyId)
+}
+
+// scanDir looks through the files of a mounted filesystem.
+func (s *keyScanner) scanDir(root string) error {
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			fmt.Printf("%s: %v\n", path, err)
+			return nil
+		}
+		if !fi.Mode().IsRegular() || fi.Size() > maxKeyFileSize {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("%s: %v\n", path, err)
+			return nil
+		}
+		m, ok := matchKeyFile(path, data, s.ids)
+		zeroize(data)
+		if !ok {
+			return nil
+		}
+		s.report(path, m)
+		if !s.shred {
+			return nil
+		}
+
+		if err := shredFile(path); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		fmt.Printf("%s: overwritten and removed\n", path)
+		return nil
+	})
+}
+
+// scanFAT looks through a FAT or exFAT filesystem stored in st.
+func (s *keyScanner) scanFAT(name string, st storage, fs *fatFS) error {
+	return fs.Walk(func(f *fatFile) error {
+		if f.Size > maxKeyFileSize {
+			return nil
+		}
+
+		data, err := readExtents(st, f.Extents, f.Size)
+		if err != nil {
+			fmt.Printf("%s%s: %v\n", name, f.Path, err)
+			return nil
+		}
+		m, ok := matchKeyFile(f.Path, data, s.ids)
+		zeroize(data)
+		if !ok {
+			return nil
+		}
+		s.report(name+f.Path, m)
+		if !s.shred {
+			return nil
+		}
+
+		if err := shredExtents(st, f.Extents); err != nil {
+			return fmt.Errorf("%s%s: %v", name, f.Path, err)
+		}
+		fmt.Printf("%s%s: overwritten\n", name, f.Path)
+		return nil
+	})
+}
+
+// scanImage looks through the filesystem on a device or image, or the
+// filesystems in each of its partitions.
+func (s *keyScanner) scanImage(path string) error {
+	img, err := openImage(path, s.shred)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	// as for a wipe, nothing else may write to the drive while shredding
+	if f, ok := deviceFile(img); ok && s.shred {
+		if err := lockTarget(path, f); err != nil {
+			return err
+		}
+	}
+
+	st, err := imageStorage(img)
+	if err != nil {
+		return err
+	}
+
+	if fs, err := openFAT(st); err == nil {
+		return s.scanFAT(path+":", st, fs)
+	}
+
+	parts, err := readPartitions(st)
+	if err != nil {
+		return fmt.Errorf("no FAT filesystem or partition table found")
+	}
+	for _, p := range parts {
+		if p.Offset == s.skip {
+			continue
+		}
+		part := &subStorage{st, p.Offset}
+		fs, err := openFAT(part)
+		if err != nil {
+			continue
+		}
+		if err := s.scanFAT(fmt.Sprintf("%s:%d:", path, p.Index), part, fs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *keyScanner) scan(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return s.scanDir(path)
+	}
+	return s.scanImage(path)
+}
+
+func cmdFindKeys(args []string) {
+	fs := newFlagSet("find-keys", "<bitlocker-vol.img> [media...]")
+	offset := fs.Int64("offset", 0, "offset into volume")
+	shred := fs.Bool("shred", false, "overwrite the key files that are found")
+	seed := seedFlag(fs)
+	addRNGFlag(fs)
+	parseFlags(fs, args)
+	useRNG(*seed)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	f, err := openTarget(fs.Arg(0), false)
+	if err != nil {
+		fatal("can't open file: %s", err)
+	}
+	hdr, err := readHeader(f, *offset)
+	if err != nil {
+		fatal("%v", err)
+	}
+	_, raw, _, err := readValidCopy(f, *offset, hdr)
+	f.Close()
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	s := &keyScanner{ids: map[Guid]bool{}, shred: *shred, skip: -1}
+	for _, p := range protectors(raw) {
+		s.ids[p.KeyId] = true
+	}
+	zeroize(raw)
+
+	// without any media, look at the other partitions of the same disk
+	media := fs.Args()[1:]
+	if len(media) == 0 {
+		media = fs.Args()
+		s.skip = *offset
+	}
+
+	for _, media := range media {
+		if err := s.scan(media); err != nil {
+			fmt.Printf("%s: %v\n", media, err)
+		}
+	}
+
+	switch {
+	case s.found == 0:
+		fmt.Printf("no key files found\n")
+	case !*shred:
+		fmt.Printf("%d key file(s) found, use -shred to overwrite them\n", s.found)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// A minimal LDAPv3 client, just enough to bind and run a search.
+
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berBoolean     = 0x01
+	berSequence    = 0x30
+	berSet         = 0x31
+
+	ldapBindRequest     = 0x60
+	ldapBindResponse    = 0x61
+	ldapUnbindRequest   = 0x42
+	ldapSearchRequest   = 0x63
+	ldapSearchEntry     = 0x64
+	ldapSearchDone      = 0x65
+	ldapSearchReference = 0x73
+
+	ldapFilterAnd      = 0xa0
+	ldapFilterEquality = 0xa3
+	ldapSimpleAuth     = 0x80
+)
+
+// ber encodes a single BER element with the given tag.
+func ber(tag byte, content ...[]byte) []byte {
+	var body []byte
+	for _, c := range content {
+		body = append(body, c...)
+	}
+
+	out := []byte{tag}
+	n := len(body)
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, body...)
+}
+
+func berInt(tag byte, v int) []byte {
+	if v < 0x80 {
+		return ber(tag, []byte{byte(v)})
+	}
+	return ber(tag, []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+func berString(s string) []byte { return ber(berOctetString, []byte(s)) }
+
+// readBER reads one BER element from r.
+func readBER(r io.Reader) (tag byte, content []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	tag = hdr[0]
+
+	n := int(hdr[1])
+	if n&0x80 != 0 {
+		nb := n & 0x7f
+		if nb == 0 || nb > 4 {
+			return 0, nil, errors.New("ldap: unsupported BER length")
+		}
+		lb := make([]byte, nb)
+		if _, err = io.ReadFull(r, lb); err != nil {
+			return
+		}
+		n = 0
+		for _, b := range lb {
+			n = n<<8 | int(b)
+		}
+	}
+	if n > 16<<20 {
+		return 0, nil, errors.New("ldap: message too large")
+	}
+
+	content = make([]byte, n)
+	_, err = io.ReadFull(r, content)
+	return
+}
+
+// splitBER splits concatenated BER elements.
+func splitBER(b []byte) (elems [][]byte, tags []byte, err error) {
+	r := strings.NewReader(string(b))
+	for r.Len() > 0 {
+		tag, content, err := readBER(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		elems = append(elems, content)
+		tags = append(tags, tag)
+	}
+	return
+}
+
+type ldapConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msgId int
+}
+
+// dialLDAP connects to an ldap:// or ldaps:// URL host.
+func dialLDAP(scheme, host string) (*ldapConn, error) {
+	dialer := &net.Dialer{Timeout: 15 * time.Second}
+
+	var conn net.Conn
+	var err error
+	switch scheme {
+	case "ldap":
+		if _, _, e := net.SplitHostPort(host); e != nil {
+			host = net.JoinHostPort(host, "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		if _, _, e := net.SplitHostPort(host); e != nil {
+			host = net.JoinHostPort(host, "636")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, nil)
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme %q", scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *ldapConn) send(op []byte) error {
+	c.msgId++
+	_, err := c.conn.Write(ber(berSequence, berInt(berInteger, c.msgId), op))
+	return err
+}
+
+// recv reads the next message and returns its protocol op.
+func (c *ldapConn) recv() (tag byte, op []byte, err error) {
+	tag, msg, err := readBER(c.r)
+	if err != nil {
+		return
+	}
+	if tag != berSequence {
+		return 0, nil, errors.New("ldap: malformed message")
+	}
+
+	elems, tags, err := splitBER(msg)
+	if err != nil || len(elems) < 2 {
+		return 0, nil, errors.New("ldap: malformed message")
+	}
+	return tags[1], elems[1], nil
+}
+
+// ldapResult checks the LDAPResult at the start of a response.
+func ldapResult(op []byte) error {
+	elems, _, err := splitBER(op)
+	if err != nil || len(elems) < 3 || len(elems[0]) != 1 {
+		return errors.New("ldap: malformed result")
+	}
+	if code := elems[0][0]; code != 0 {
+		return fmt.Errorf("ldap: error %d: %s", code, elems[2])
+	}
+	return nil
+}
+
+func (c *ldapConn) Bind(user, password string) error {
+	err := c.send(ber(ldapBindRequest,
+		berInt(berInteger, 3),
+		berString(user),
+		ber(ldapSimpleAuth, []byte(password))))
+	if err != nil {
+		return err
+	}
+
+	tag, op, err := c.recv()
+	if err != nil {
+		return err
+	}
+	if tag != ldapBindResponse {
+		return errors.New("ldap: unexpected response to bind")
+	}
+	return ldapResult(op)
+}
+
+// SearchEqual counts the entries under base whose attributes match all of
+// the given values exactly.
+func (c *ldapConn) SearchEqual(base string, match map[string][]byte, limit int) (int, error) {
+	var filters [][]byte
+	for attr, value := range match {
+		filters = append(filters, ber(ldapFilterEquality, berString(attr),
+			ber(berOctetString, value)))
+	}
+
+	err := c.send(ber(ldapSearchRequest,
+		berString(base),
+		berInt(berEnumerated, 2), // whole subtree
+		berInt(berEnumerated, 0), // never deref aliases
+		berInt(berInteger, limit),
+		berInt(berInteger, 30),
+		ber(berBoolean, []byte{0xff}), // types only
+		ber(ldapFilterAnd, filters...),
+		ber(berSequence, berString("cn"))))
+	if err != nil {
+		return 0, err
+	}
+
+	found := 0
+	for {
+		tag, op, err := c.recv()
+		if err != nil {
+			return found, err
+		}
+
+		switch tag {
+		case ldapSearchEntry:
+			found++
+		case ldapSearchReference:
+			// referrals are not followed
+		case ldapSearchDone:
+			if err := ldapResult(op); err != nil && found == 0 {
+				return 0, err
+			}
+			return found, nil
+		default:
+			return found, errors.New("ldap: unexpected response to search")
+		}
+	}
+}
+
+func (c *ldapConn) Close() error {
+	c.send(ber(ldapUnbindRequest))
+	return c.conn.Close()
+}
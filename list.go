@@ -0,0 +1,99 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// blockDevice is a disk or partition found on the system.
+type blockDevice struct {
+	Path      string
+	Size      int64
+	Partition bool
+	Model     string // of the drive
+}
+
+// volumeGuid returns the volume GUID recorded in the first valid metadata
+// block of the BitLocker volume at off.
+func volumeGuid(r io.ReaderAt, off int64) (Guid, error) {
+	hdr, err := readHeader(r, off)
+	if err != nil {
+		return Guid{}, err
+	}
+
+	for _, infoOff := range hdr.InfoOffsets {
+		var info InfoStruct
+		var raw []byte
+		raw, _, err = info.ReadRaw(r, off+int64(infoOff))
+		if err != nil {
+			continue
+		}
+		_, mh := parseMetadataBlock(raw)
+		zeroize(raw)
+		return mh.VolumeGuid, nil
+	}
+	return Guid{}, fmt.Errorf("no valid metadata block found: %w", err)
+}
+
+// describeVolume says what kind of encrypted volume r holds, if any.
+func describeVolume(r io.ReaderAt) string {
+	if probeFilesystem(r, 0) == "BitLocker" {
+		guid, err := volumeGuid(r, 0)
+		if err != nil {
+			return fmt.Sprintf("BitLocker (%v)", err)
+		}
+		return fmt.Sprintf("BitLocker {%v}", guid)
+	}
+	if vf, _ := findFormat(r, 0, ""); vf != nil {
+		return vf.name
+	}
+	return ""
+}
+
+func cmdList(args []string) {
+	fs := newFlagSet("list", "")
+	all := fs.Bool("a", false, "also list devices without encrypted volumes")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	devs, err := blockDevices()
+	if err != nil {
+		fatal("can't list block devices: %v", err)
+	}
+
+	found := 0
+	for _, d := range devs {
+		var desc string
+		f, err := os.Open(d.Path)
+		if err == nil {
+			desc = describeVolume(f)
+			f.Close()
+		}
+
+		switch {
+		case desc != "":
+			found++
+			desc = highlight(desc)
+		case !*all:
+			continue
+		case err != nil:
+			desc = fmt.Sprintf("can't open: %v", err)
+		}
+
+		name := d.Path
+		if d.Partition {
+			name = "  " + name
+		}
+		fmt.Printf("%-20s %10s %s\n", name, humanSize(d.Size), desc)
+	}
+	fmt.Printf("found %d encrypted volume(s)\n", found)
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Writing to a target locks it, so that two runs of blwipe, or a daemon
+// job and a command, never write to the same drive at once. Locks are
+// files in a runtime directory named after the device rather than the
+// path, as a drive has many names and its partitions are on it too. The
+// system releases them when the process exits, however it exits.
+
+const lockDirEnv = "BLWIPE_LOCK_DIR"
+
+var errLocked = errors.New("locked")
+
+// heldLocks are kept open until the process exits, by target ID, so that
+// the process can open a target it has locked again.
+var heldLocks = map[string]*os.File{}
+
+// lockDir returns the directory to keep lock files in.
+func lockDir() string {
+	if dir := os.Getenv(lockDirEnv); dir != "" {
+		return dir
+	}
+	return defaultLockDir()
+}
+
+// lockTarget locks the device or file that f, opened from path, is on,
+// for as long as the process runs.
+func lockTarget(path string, f *os.File) error {
+	id, err := targetID(f)
+	if err != nil {
+		return fmt.Errorf("can't identify %s to lock it: %v", path, err)
+	}
+	if _, ok := heldLocks[id]; ok {
+		return nil
+	}
+	dir := lockDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("can't create lock directory (set %s to use another): %v", lockDirEnv, err)
+	}
+
+	name := filepath.Join(dir, id+".lock")
+	lf, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("can't create lock file: %v", err)
+	}
+	if err := lockFile(lf); err != nil {
+		lf.Close()
+		if err != errLocked {
+			return fmt.Errorf("can't lock %s: %v", name, err)
+		}
+		owner := ""
+		if b, err := os.ReadFile(name); err == nil {
+			if fields := strings.Fields(string(b)); len(fields) > 0 {
+				owner = " (pid " + fields[0] + ")"
+			}
+		}
+		return fmt.Errorf("%s is in use by another blwipe%s", path, owner)
+	}
+
+	// who holds it, for the message above
+	lf.Truncate(0)
+	lf.WriteAt([]byte(fmt.Sprintf("%d %s\n", os.Getpid(), path)), 0)
+	heldLocks[id] = lf
+	return nil
+}
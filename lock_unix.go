@@ -0,0 +1,51 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// defaultLockDir is shared by everything running as root, so the daemon
+// and commands run with sudo see each other's locks.
+func defaultLockDir() string {
+	if os.Geteuid() == 0 {
+		return "/var/run/blwipe"
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "blwipe")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("blwipe-%d", os.Geteuid()))
+}
+
+// targetID names the drive a device is on, or a file by its inode.
+func targetID(f *os.File) (string, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", errors.New("no device number")
+	}
+	if fi.Mode()&os.ModeDevice != 0 {
+		return "dev-" + diskID(uint64(st.Rdev)), nil
+	}
+	return fmt.Sprintf("file-%x-%x", uint64(st.Dev), uint64(st.Ino)), nil
+}
+
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	_IOCTL_STORAGE_GET_DEVICE_NUMBER = 0x002d1080
+
+	_LOCKFILE_FAIL_IMMEDIATELY = 0x1
+	_LOCKFILE_EXCLUSIVE_LOCK   = 0x2
+	_ERROR_LOCK_VIOLATION      = 33
+
+	// well past the pid written to the file, which stays readable
+	lockOffset = 1 << 30
+)
+
+var procLockFileEx = kernel32.NewProc("LockFileEx")
+
+func defaultLockDir() string {
+	if dir := os.Getenv("ProgramData"); dir != "" {
+		return filepath.Join(dir, "blwipe")
+	}
+	return filepath.Join(os.TempDir(), "blwipe")
+}
+
+// targetID names the drive a volume or physical drive is on, or a file
+// by its index on its volume.
+func targetID(f *os.File) (string, error) {
+	h := syscall.Handle(f.Fd())
+	if number, ok := diskNumber(h); ok {
+		return fmt.Sprintf("disk-%d", number), nil
+	}
+
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(h, &info); err != nil {
+		return "", os.NewSyscallError("GetFileInformationByHandle", err)
+	}
+	return fmt.Sprintf("file-%x-%x%08x", info.VolumeSerialNumber, info.FileIndexHigh, info.FileIndexLow), nil
+}
+
+func lockFile(f *os.File) error {
+	ov := syscall.Overlapped{Offset: lockOffset}
+	r, _, err := procLockFileEx.Call(f.Fd(), _LOCKFILE_EXCLUSIVE_LOCK|_LOCKFILE_FAIL_IMMEDIATELY,
+		0, 1, 0, uintptr(unsafe.Pointer(&ov)))
+	if r != 0 {
+		return nil
+	}
+	if err == syscall.Errno(_ERROR_LOCK_VIOLATION) {
+		return errLocked
+	}
+	return os.NewSyscallError("LockFileEx", err)
+}
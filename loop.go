@@ -0,0 +1,107 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// blwipe reads images itself, but mount, cryptsetup and the like need a
+// block device. loop attaches a raw image to a loop device, with the
+// partitions on it scanned, for as long as a command runs or until it is
+// interrupted, and says what blwipe found on each partition.
+
+// loopDevice is an image attached to a loop device.
+type loopDevice struct {
+	Path string // /dev/loopN
+	f    *os.File
+}
+
+// loopPartition is a partition of a loop device, as the kernel sees it.
+type loopPartition struct {
+	Path   string
+	Offset int64
+}
+
+func cmdLoop(args []string) {
+	fs := newFlagSet("loop", "<disk.img> [command [args...]]")
+	writable := fs.Bool("w", false, "attach the image read-write instead of read-only")
+	parseFlags(fs, args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+
+	// the analysis is done on the image, as for any other command
+	img, err := openImage(path, false)
+	if err != nil {
+		fatal("can't open file: %s", err)
+	}
+	if _, ok := img.(*os.File); !ok {
+		fatal("%s is not a raw image, only those can be attached to a loop device", path)
+	}
+	st, err := imageStorage(img)
+	if err != nil {
+		fatal("%v", err)
+	}
+	describe := func(off int64) string {
+		for _, v := range findVolumes(&subStorage{st, off}) {
+			if v.Offset == 0 {
+				return highlight(v.Format)
+			}
+		}
+		return probeFilesystem(st, off)
+	}
+
+	loop, err := attachLoop(path, *writable)
+	if err != nil {
+		fatal("can't attach %s to a loop device: %v", path, err)
+	}
+	mode := "read-only"
+	if *writable {
+		mode = "read-write"
+	}
+	fmt.Printf("%s attached to %s, %s\n", path, loop.Path, mode)
+	if desc := describe(0); desc != "" {
+		fmt.Printf("%s: %s\n", loop.Path, desc)
+	}
+	for _, p := range loop.partitions() {
+		fmt.Printf("%s: offset 0x%x %s\n", p.Path, p.Offset, describe(p.Offset))
+	}
+	img.Close()
+
+	// Ctrl-C is for the command, or ends the wait, and the device is
+	// detached either way
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	status := 0
+	if fs.NArg() > 1 {
+		cmd := exec.Command(fs.Arg(1), fs.Args()[2:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		cmd.Env = append(os.Environ(), "BLWIPE_LOOP_DEVICE="+loop.Path)
+		if err := cmd.Run(); err != nil {
+			fmt.Printf("%s: %v\n", fs.Arg(1), err)
+			status = 1
+			if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() > 0 {
+				status = exit.ExitCode()
+			}
+		}
+	} else {
+		fmt.Printf("press Ctrl-C to detach\n")
+		<-sigs
+	}
+
+	if err := loop.detach(); err != nil {
+		fatal("can't detach %s: %v", loop.Path, err)
+	}
+	fmt.Printf("detached %s\n", loop.Path)
+	os.Exit(status)
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	_LOOP_SET_FD       = 0x4c00
+	_LOOP_CLR_FD       = 0x4c01
+	_LOOP_SET_STATUS64 = 0x4c04
+	_LOOP_CTL_GET_FREE = 0x4c82
+
+	_LO_FLAGS_AUTOCLEAR = 4
+	_LO_FLAGS_PARTSCAN  = 8
+)
+
+type loopInfo64 struct {
+	Device         uint64
+	Inode          uint64
+	Rdevice        uint64
+	Offset         uint64
+	SizeLimit      uint64
+	Number         uint32
+	EncryptType    uint32
+	EncryptKeySize uint32
+	Flags          uint32
+	FileName       [64]byte
+	CryptName      [64]byte
+	EncryptKey     [32]byte
+	Init           [2]uint64
+}
+
+// attachLoop attaches the image at path to a free loop device. The device
+// is set to detach itself once the last user closes it, so it doesn't
+// outlive blwipe even if it is killed.
+func attachLoop(path string, writable bool) (*loopDevice, error) {
+	mode := os.O_RDONLY
+	if writable {
+		mode = os.O_RDWR
+	}
+	img, err := os.OpenFile(path, mode, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close() // the loop device keeps its own reference
+
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer ctl.Close()
+
+	// another process can take the free device first
+	for tries := 0; ; tries++ {
+		n, err := ioctl(ctl, _LOOP_CTL_GET_FREE, nil)
+		if err != nil {
+			return nil, os.NewSyscallError("LOOP_CTL_GET_FREE", err)
+		}
+		l := &loopDevice{Path: fmt.Sprintf("/dev/loop%d", n)}
+		if l.f, err = os.OpenFile(l.Path, mode, 0); err != nil {
+			return nil, err
+		}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, l.f.Fd(), _LOOP_SET_FD, img.Fd())
+		if errno == syscall.EBUSY && tries < 5 {
+			l.f.Close()
+			continue
+		} else if errno != 0 {
+			l.f.Close()
+			return nil, os.NewSyscallError("LOOP_SET_FD", errno)
+		}
+
+		info := loopInfo64{Flags: _LO_FLAGS_AUTOCLEAR | _LO_FLAGS_PARTSCAN}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		copy(info.FileName[:len(info.FileName)-1], path)
+		if _, err := ioctl(l.f, _LOOP_SET_STATUS64, unsafe.Pointer(&info)); err != nil {
+			l.detach()
+			return nil, os.NewSyscallError("LOOP_SET_STATUS64", err)
+		}
+		return l, nil
+	}
+}
+
+// partitions lists the partitions the kernel found on the device, waiting
+// a little for their device nodes to be created.
+func (l *loopDevice) partitions() []loopPartition {
+	name := filepath.Base(l.Path)
+	sys := filepath.Join("/sys/block", name)
+	entries, _ := os.ReadDir(sys)
+	var parts []loopPartition
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), name+"p") {
+			continue
+		}
+		start, err := strconv.ParseInt(readSysfs(filepath.Join(sys, e.Name(), "start")), 10, 64)
+		if err != nil {
+			continue
+		}
+		parts = append(parts, loopPartition{"/dev/" + e.Name(), start * 512})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Offset < parts[j].Offset })
+
+	for _, p := range parts {
+		for i := 0; i < 20; i++ {
+			if _, err := os.Stat(p.Path); err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return parts
+}
+
+// detach detaches the image. If a partition is still in use, as when it
+// is mounted, that happens once it no longer is.
+func (l *loopDevice) detach() error {
+	_, err := ioctl(l.f, _LOOP_CLR_FD, nil)
+	l.f.Close()
+	if err != nil {
+		return os.NewSyscallError("LOOP_CLR_FD", err)
+	}
+	return nil
+}
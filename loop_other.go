@@ -0,0 +1,17 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+//go:build !linux
+
+package main
+
+import "errors"
+
+func attachLoop(path string, writable bool) (*loopDevice, error) {
+	return nil, errors.New("loop devices are only supported on Linux")
+}
+
+func (l *loopDevice) partitions() []loopPartition { return nil }
+
+func (l *loopDevice) detach() error { return nil }
@@ -0,0 +1,178 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// LUKS1 and LUKS2 volumes, whose key material is in the keyslots that
+// follow the header.
+
+const (
+	luksMagic          = "LUKS\xba\xbe"
+	luksSecondaryMagic = "SKUL\xba\xbe"
+	luksSectorSize     = 512
+	luks1KeyslotActive = 0x00ac71f3
+	luks2BinaryHdrSize = 4096
+)
+
+type luks1Keyslot struct {
+	Active         uint32
+	Iterations     uint32
+	Salt           [32]byte
+	KeyMaterialOff uint32 // in sectors
+	Stripes        uint32
+}
+
+type luks1Header struct {
+	Magic         [6]byte
+	Version       uint16
+	CipherName    [32]byte
+	CipherMode    [32]byte
+	HashSpec      [32]byte
+	PayloadOffset uint32 // in sectors
+	KeyBytes      uint32
+	MkDigest      [20]byte
+	MkDigestSalt  [32]byte
+	MkDigestIter  uint32
+	Uuid          [40]byte
+	Keyslots      [8]luks1Keyslot
+}
+
+type luks2Header struct {
+	Magic     [6]byte
+	Version   uint16
+	HdrSize   uint64
+	SeqId     uint64
+	Label     [48]byte
+	CsumAlg   [32]byte
+	Salt      [64]byte
+	Uuid      [40]byte
+	Subsystem [48]byte
+	HdrOffset uint64
+}
+
+// luks2Metadata is the part of the LUKS2 JSON area needed to find the
+// keyslots. Numbers are stored as strings.
+type luks2Metadata struct {
+	Keyslots map[string]struct {
+		Area struct {
+			Offset string `json:"offset"`
+			Size   string `json:"size"`
+		} `json:"area"`
+	} `json:"keyslots"`
+	Config struct {
+		KeyslotsSize string `json:"keyslots_size"`
+	} `json:"config"`
+}
+
+func isLUKS(r io.ReaderAt) bool {
+	var magic [6]byte
+	_, err := r.ReadAt(magic[:], 0)
+	return err == nil && string(magic[:]) == luksMagic
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func inspectLUKS(r io.ReaderAt, size int64) (string, []RegionDesc, error) {
+	buf := make([]byte, luks2BinaryHdrSize)
+	if err := readFullAt(r, buf, 0); err != nil {
+		return "", nil, fmt.Errorf("can't read LUKS header: %v", err)
+	}
+	if string(buf[:6]) != luksMagic {
+		return "", nil, errors.New("no LUKS header found")
+	}
+
+	switch v := binary.BigEndian.Uint16(buf[6:]); v {
+	case 1:
+		return inspectLUKS1(buf)
+	case 2:
+		return inspectLUKS2(r, buf)
+	default:
+		return "", nil, fmt.Errorf("unsupported LUKS version %d", v)
+	}
+}
+
+func inspectLUKS1(buf []byte) (string, []RegionDesc, error) {
+	var hdr luks1Header
+	binary.Read(bytes.NewReader(buf), binary.BigEndian, &hdr)
+
+	regions := []RegionDesc{{"LUKS header", 0, luksSectorSize}}
+	active := 0
+	for i, ks := range hdr.Keyslots {
+		if ks.Active == luks1KeyslotActive {
+			active++
+		}
+		if ks.KeyMaterialOff == 0 || ks.Stripes == 0 {
+			continue
+		}
+
+		// inactive keyslots may still hold old key material
+		size := roundUp(int64(hdr.KeyBytes)*int64(ks.Stripes), luksSectorSize)
+		regions = append(regions, RegionDesc{fmt.Sprintf("keyslot %d", i),
+			int64(ks.KeyMaterialOff) * luksSectorSize, size})
+	}
+
+	desc := fmt.Sprintf("LUKS1 volume %s, cipher %s-%s, %d active keyslot(s)",
+		cString(hdr.Uuid[:]), cString(hdr.CipherName[:]), cString(hdr.CipherMode[:]), active)
+	return desc, regions, nil
+}
+
+func inspectLUKS2(r io.ReaderAt, buf []byte) (string, []RegionDesc, error) {
+	var hdr luks2Header
+	binary.Read(bytes.NewReader(buf), binary.BigEndian, &hdr)
+
+	hdrSize := int64(hdr.HdrSize)
+	if hdrSize < luks2BinaryHdrSize || hdrSize > 4<<20 || hdrSize%luks2BinaryHdrSize != 0 {
+		return "", nil, fmt.Errorf("invalid LUKS2 header size %d", hdrSize)
+	}
+
+	area := make([]byte, hdrSize-luks2BinaryHdrSize)
+	if err := readFullAt(r, area, luks2BinaryHdrSize); err != nil {
+		return "", nil, fmt.Errorf("can't read LUKS2 metadata: %v", err)
+	}
+	var meta luks2Metadata
+	if err := json.Unmarshal(bytes.TrimRight(area, "\x00"), &meta); err != nil {
+		return "", nil, fmt.Errorf("invalid LUKS2 metadata: %v", err)
+	}
+
+	regions := []RegionDesc{
+		{"LUKS2 primary header", 0, hdrSize},
+		{"LUKS2 secondary header", hdrSize, hdrSize},
+	}
+
+	// the keyslots area follows both headers
+	if n, err := strconv.ParseInt(meta.Config.KeyslotsSize, 10, 64); err == nil && n > 0 {
+		regions = append(regions, RegionDesc{"LUKS2 keyslots area", 2 * hdrSize, n})
+	} else {
+		for id, ks := range meta.Keyslots {
+			off, err1 := strconv.ParseInt(ks.Area.Offset, 10, 64)
+			size, err2 := strconv.ParseInt(ks.Area.Size, 10, 64)
+			if err1 != nil || err2 != nil {
+				return "", nil, fmt.Errorf("invalid area of LUKS2 keyslot %s", id)
+			}
+			regions = append(regions, RegionDesc{"keyslot " + id, off, size})
+		}
+	}
+
+	desc := fmt.Sprintf("LUKS2 volume %s, %d keyslot(s)", cString(hdr.Uuid[:]), len(meta.Keyslots))
+	if label := cString(hdr.Label[:]); label != "" {
+		desc += fmt.Sprintf(", label %q", strings.TrimSpace(label))
+	}
+	return desc, regions, nil
+}
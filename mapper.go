@@ -0,0 +1,90 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A BitLocker volume opened with cryptsetup (bitlk) shows up twice: as the
+// partition holding the metadata and the encrypted data, and as a
+// device-mapper device with the decrypted data. Only the first can be
+// crypto-erased, so the one given is explained in terms of the other.
+
+// mapperDevice is a device-mapper device: a dm-crypt mapping, an LVM
+// logical volume, or the like.
+type mapperDevice struct {
+	Name   string   // as in /dev/mapper
+	UUID   string   // whose prefix tells what made it
+	Slaves []string // the devices it is built on
+}
+
+func (m *mapperDevice) Path() string { return "/dev/mapper/" + m.Name }
+
+func (m *mapperDevice) crypt() bool { return strings.HasPrefix(m.UUID, "CRYPT-") }
+
+// kind describes what the mapping is, from the prefix cryptsetup, LVM and
+// multipath give their UUIDs.
+func (m *mapperDevice) kind() string {
+	switch {
+	case strings.HasPrefix(m.UUID, "CRYPT-BITLK"):
+		return "a dm-crypt mapping of a BitLocker volume"
+	case strings.HasPrefix(m.UUID, "CRYPT-LUKS"):
+		return "a dm-crypt mapping of a LUKS volume"
+	case strings.HasPrefix(m.UUID, "CRYPT-TCRYPT"):
+		return "a dm-crypt mapping of a TrueCrypt or VeraCrypt volume"
+	case m.crypt():
+		return "a dm-crypt mapping"
+	case strings.HasPrefix(m.UUID, "LVM-"):
+		return "an LVM logical volume"
+	case strings.HasPrefix(m.UUID, "mpath-"):
+		return "a multipath device"
+	}
+	return "a device-mapper device"
+}
+
+// explainMapper tells how the device img was opened from relates to the
+// device-mapper devices, and points to the one to use instead. A wipe of a
+// dm-crypt mapping would overwrite decrypted data and leave the keys, so
+// that stops unless force is set.
+func explainMapper(path string, img Image, wipe, force bool) {
+	f, ok := deviceFile(img)
+	if !ok {
+		return
+	}
+	self, above, err := deviceMappers(f)
+	if err != nil {
+		return
+	}
+
+	if self != nil {
+		under := strings.Join(self.Slaves, ", ")
+		name := path
+		if path != self.Path() {
+			name = fmt.Sprintf("%s (%s)", path, self.Path())
+		}
+		fmt.Printf("%s is %s on %s\n", name, self.kind(), under)
+		if self.crypt() {
+			fmt.Printf("it holds the decrypted data, the key material is on %s: use that to inspect or wipe the volume\n", under)
+			if wipe && !force {
+				fatal("refusing to overwrite decrypted data, close the mapping with `cryptsetup close %s` and wipe %s, or use -force to override",
+					self.Name, under)
+			}
+		}
+	}
+
+	for _, m := range above {
+		fmt.Printf("%s is used by %s (%s)\n", path, m.kind(), m.Path())
+		switch {
+		case m.crypt():
+			fmt.Printf("the decrypted data is on %s, close it with `cryptsetup close %s` before wiping\n", m.Path(), m.Name)
+		case strings.HasPrefix(m.UUID, "LVM-"):
+			fmt.Printf("deactivate it with `lvchange -an` before wiping\n")
+		default:
+			fmt.Printf("remove it with `dmsetup remove %s` before wiping\n", m.Name)
+		}
+	}
+}
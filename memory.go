@@ -0,0 +1,82 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Preboot and recovery environments can have only tens of megabytes of
+// RAM, so the buffers that scans and wipes use can be capped with
+// -max-memory. Without it, they are sized for speed.
+
+// byteSize is a flag holding a number of bytes, with an optional binary
+// suffix such as 64M or 64MiB.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	if *b == 0 {
+		return "0"
+	}
+	return humanSize(int64(*b))
+}
+
+func (b *byteSize) Set(value string) error {
+	s := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B"), "I")
+	shift := uint(0)
+	if s != "" {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			shift = 10 * uint(i+1)
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)>>shift {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(n << shift)
+	return nil
+}
+
+// maxMemory is the most that buffers may take up, or 0 for no limit.
+var maxMemory byteSize
+
+// minBuffer is the smallest buffer worth reading or writing with.
+const minBuffer = 64 << 10
+
+func addMemoryFlag(fs *flag.FlagSet) {
+	fs.Var(&maxMemory, "max-memory", "limit the buffers used to this many bytes, e.g. 32M")
+}
+
+// checkMaxMemory rejects a limit too small to do anything with.
+func checkMaxMemory() error {
+	if maxMemory != 0 && maxMemory < minBuffer {
+		return fmt.Errorf("-max-memory must be at least %s", humanSize(minBuffer))
+	}
+	return nil
+}
+
+// bufferShare splits the memory limit between n buffers that would each
+// rather be size bytes, keeping them a multiple of align. It returns the
+// number of buffers that fit, at least 1, and the size to make them.
+func bufferShare(n int, size, align int64) (int, int64) {
+	if maxMemory == 0 || size <= 0 {
+		return n, size
+	}
+	limit := int64(maxMemory)
+	if fit := int(limit / size); fit < n {
+		n = fit
+	}
+	if n < 1 {
+		n = 1
+	}
+	if size > limit {
+		size = limit / align * align
+	}
+	return n, size
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// MetadataHeader follows the InfoStruct at the start of each metadata
+// block, and is followed by the metadata entries.
+type MetadataHeader struct {
+	MetadataSize     uint32
+	Version          uint32
+	HeaderSize       uint32
+	MetadataSizeCopy uint32
+	VolumeGuid       Guid
+	NextNonce        uint32
+	EncryptionMethod uint16
+	_                uint16
+	CreationTime     uint64
+}
+
+// metadataHeaderOffset is where the MetadataHeader starts in a block.
+const metadataHeaderOffset = 64
+
+// parseMetadataBlock decodes the fixed headers of a raw metadata block.
+func parseMetadataBlock(raw []byte) (info InfoStruct, mh MetadataHeader) {
+	r := bytes.NewReader(raw)
+	binary.Read(r, binary.LittleEndian, &info)
+	if len(raw) >= metadataHeaderOffset+binary.Size(mh) {
+		r.Seek(metadataHeaderOffset, 0)
+		binary.Read(r, binary.LittleEndian, &mh)
+	}
+	return
+}
+
+// diffFields lists the names of the exported fields that differ between
+// structs a and b, descending into embedded structs.
+func diffFields(a, b interface{}) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	var diffs []string
+	for i := 0; i < va.NumField(); i++ {
+		f := va.Type().Field(i)
+		if f.Name == "_" {
+			continue
+		}
+		if f.Anonymous {
+			diffs = append(diffs, diffFields(va.Field(i).Interface(), vb.Field(i).Interface())...)
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			diffs = append(diffs, fmt.Sprintf("%s (%v vs %v)", f.Name,
+				va.Field(i).Interface(), vb.Field(i).Interface()))
+		}
+	}
+	return diffs
+}
+
+// diffRanges returns the byte ranges, as [start, end) pairs, where a and b
+// differ, starting from offset from.
+func diffRanges(a, b []byte, from int) [][2]int {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+
+	var ranges [][2]int
+	start := -1
+	for i := from; i <= n; i++ {
+		differ := i < n && (i >= len(a) || i >= len(b) || a[i] != b[i])
+		if differ && start < 0 {
+			start = i
+		} else if !differ && start >= 0 {
+			ranges = append(ranges, [2]int{start, i})
+			start = -1
+		}
+	}
+	return ranges
+}
+
+// reportMetadataDiff compares the valid metadata copies against each other
+// and prints any divergence, which may indicate tampering or an
+// interrupted BitLocker operation.
+func reportMetadataDiff(copies [][]byte) {
+	ref := -1
+	valid := 0
+	for i, c := range copies {
+		if c == nil {
+			continue
+		}
+		if ref < 0 {
+			ref = i
+		}
+		valid++
+	}
+	if valid < 2 {
+		return
+	}
+
+	same := true
+	refInfo, refHdr := parseMetadataBlock(copies[ref])
+	for i, c := range copies {
+		if c == nil || i == ref || bytes.Equal(c, copies[ref]) {
+			continue
+		}
+		same = false
+
+		fmt.Printf("metadata block %d differs from block %d:\n", i, ref)
+		info, hdr := parseMetadataBlock(c)
+		diffs := append(diffFields(refInfo, info), diffFields(refHdr, hdr)...)
+		for _, d := range diffs {
+			fmt.Printf("  field %s\n", d)
+		}
+
+		entriesStart := metadataHeaderOffset + binary.Size(hdr)
+		datums := metadataDatums(copies[ref])
+		for _, r := range diffRanges(copies[ref], c, entriesStart) {
+			fmt.Printf("  entry bytes 0x%x-0x%x", r[0], r[1]-1)
+			for _, d := range datums {
+				if r[0] < d.Offset+int(d.Size) && r[1] > d.Offset {
+					fmt.Printf(" (%v at 0x%x)", &d, d.Offset)
+				}
+			}
+			fmt.Printf("\n")
+		}
+	}
+
+	if same {
+		fmt.Printf("%s\n", success(fmt.Sprintf("all %d valid metadata blocks are identical", valid)))
+	}
+}
+
+// firstProtectors returns the key protectors of the first valid copy.
+func firstProtectors(copies [][]byte) []Protector {
+	for _, raw := range copies {
+		if raw != nil {
+			return protectors(raw)
+		}
+	}
+	return nil
+}
+
+// printProtectors lists the key protectors from the first valid copy, one
+// per line with the identifier first, for cross-checking against escrowed
+// recovery keys.
+func printProtectors(copies [][]byte) {
+	for _, raw := range copies {
+		if raw == nil {
+			continue
+		}
+
+		_, mh := parseMetadataBlock(raw)
+		fmt.Printf("volume identifier: %v\n", mh.VolumeGuid)
+		if desc := description(raw); desc != "" {
+			fmt.Printf("description: %s\n", desc)
+		}
+
+		ps := protectors(raw)
+		fmt.Printf("%d key protector(s):\n", len(ps))
+		for _, p := range ps {
+			fmt.Printf("  {%v} %s, last modified %s\n", p.KeyId, p.TypeName(),
+				filetimeToTime(p.LastModified).Format(time.RFC3339))
+		}
+		return
+	}
+}
+
+// windowsGeneration guesses which Windows release created a volume from
+// the features its metadata uses, returning the guess and the reasons for
+// it. Later releases can still create volumes that look older, for
+// compatibility, so it is only a lower bound unless the diffuser is used.
+func windowsGeneration(hdr *VolumeHeader, raw []byte) (string, []string) {
+	info, mh := parseMetadataBlock(raw)
+	if info.Version == 1 {
+		return "Windows Vista", []string{"metadata version 1"}
+	}
+
+	switch mh.EncryptionMethod {
+	case 0x8004, 0x8005:
+		return "Windows 10 version 1511 or later", []string{encryptionMethodName(mh.EncryptionMethod) + " cipher"}
+	case 0x8000, 0x8001:
+		// the diffuser was dropped in Windows 8
+		return "Windows 7", []string{"metadata version 2", encryptionMethodName(mh.EncryptionMethod) + " cipher"}
+	}
+	for _, off := range hdr.EOWOffsets {
+		if off != 0 {
+			return "Windows 8 or later", []string{"encrypt-on-write information"}
+		}
+	}
+	return "Windows 7 or later", []string{"metadata version 2"}
+}
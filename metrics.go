@@ -0,0 +1,48 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Metrics of the daemon in the Prometheus text format.
+
+var jobStates = []string{"done", "failed", "cancelled"}
+
+func (m *jobManager) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		http.NotFound(w, r)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	running := 0
+	for _, j := range m.jobs {
+		if j.State == "running" {
+			running++
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("blwipe_devices_scanned_total", "counter", "Block devices probed for encrypted volumes.")
+	fmt.Fprintf(w, "blwipe_devices_scanned_total %d\n", m.devicesScanned)
+	metric("blwipe_wipes_in_progress", "gauge", "Wipes currently running.")
+	fmt.Fprintf(w, "blwipe_wipes_in_progress %d\n", running)
+	metric("blwipe_wipes_total", "counter", "Wipes that have finished, by outcome.")
+	for _, s := range jobStates {
+		fmt.Fprintf(w, "blwipe_wipes_total{state=%q} %d\n", s, m.wipesFinished[s])
+	}
+	metric("blwipe_bytes_written_total", "counter", "Bytes of key material overwritten.")
+	fmt.Fprintf(w, "blwipe_bytes_written_total %d\n", m.bytesWritten)
+	metric("blwipe_verification_failures_total", "counter", "Wipes after which plaintext filesystems remained.")
+	fmt.Fprintf(w, "blwipe_verification_failures_total %d\n", m.verifyFailures)
+}
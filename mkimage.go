@@ -0,0 +1,274 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Synthesizing small BitLocker volumes for tests, demos and training. The
+// structures are valid enough for blwipe and other parsers, but the keys
+// are random bytes, so nothing can ever be decrypted from them.
+
+const (
+	mkimageMetadataAlign  = 64 << 10
+	mkimageHeaderSectors  = 16
+	mkimageValidationSize = 0x50
+	methodAESXTS128       = 0x8004
+)
+
+// encodeDatum returns a datum with the given value.
+func encodeDatum(entryType, valueType uint16, value []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, DatumHeader{
+		Size:      uint16(datumHeaderSize + len(value)),
+		EntryType: entryType,
+		ValueType: valueType,
+		Version:   1,
+	})
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(randSource, b); err != nil {
+		fatal("unable to generate rand bytes: %v", err)
+	}
+	return b
+}
+
+func randomGuid() Guid {
+	var g Guid
+	binary.Read(bytes.NewReader(randomBytes(16)), binary.LittleEndian, &g)
+	g.C = g.C&0x0fff | 0x4000 // version 4
+	g.D[0] = g.D[0]&0x3f | 0x80
+	return g
+}
+
+func timeToFiletime(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100) + 116444736000000000
+}
+
+func encodeUTF16(s string) []byte {
+	u := append(utf16.Encode([]rune(s)), 0)
+	b := make([]byte, len(u)*2)
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+	return b
+}
+
+// protectorDatum returns a VMK datum of the given protection type, with
+// a random key that is "encrypted" unless it is a clear key.
+func protectorDatum(protection uint16, now uint64) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, Protector{
+		KeyId:          randomGuid(),
+		LastModified:   now,
+		ProtectionType: protection,
+	})
+	if protection == ProtectionClearKey {
+		key := make([]byte, 4, 36)
+		binary.LittleEndian.PutUint32(key, methodAESXTS128)
+		buf.Write(encodeDatum(EntryTypeProperty, ValueTypeKey, append(key, randomBytes(32)...)))
+	} else {
+		// nonce, MAC and the wrapped key
+		buf.Write(encodeDatum(EntryTypeProperty, ValueTypeAesCcmKey, randomBytes(12+16+44)))
+	}
+	return encodeDatum(EntryTypeVMK, ValueTypeVMK, buf.Bytes())
+}
+
+// buildMetadataBlock returns a metadata block, including its validation
+// structure, of the given version.
+func buildMetadataBlock(info InfoStruct, mh MetadataHeader, entries []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &info)
+	binary.Write(&buf, binary.LittleEndian, &mh)
+	buf.Write(entries)
+	block := buf.Bytes()
+
+	metaSize := uint32(len(block) - metadataHeaderOffset)
+	binary.LittleEndian.PutUint32(block[metadataHeaderOffset:], metaSize)
+	binary.LittleEndian.PutUint32(block[metadataHeaderOffset+12:], metaSize)
+
+	// version 2 sizes are in 16-byte units
+	if info.Version == 2 {
+		for len(block)%16 != 0 {
+			block = append(block, 0)
+		}
+		binary.LittleEndian.PutUint16(block[8:], uint16(len(block)/16))
+	} else {
+		binary.LittleEndian.PutUint16(block[8:], uint16(len(block)))
+	}
+
+	v := make([]byte, mkimageValidationSize)
+	binary.LittleEndian.PutUint16(v, mkimageValidationSize)
+	binary.LittleEndian.PutUint16(v[2:], 1)
+	binary.LittleEndian.PutUint32(v[4:], crc32.ChecksumIEEE(block))
+	return append(block, v...)
+}
+
+func cmdMkimage(args []string) {
+	fs := newFlagSet("mkimage", "<output.img>")
+	size := fs.Int64("size", 16<<20, "size of the volume in bytes")
+	sectorSize := fs.Int("sector-size", 512, "logical sector size")
+	version := fs.Int("version", 2, "metadata version, 1 (Windows Vista) or 2")
+	protectorList := fs.String("protectors", "recovery-password,tpm", "comma-separated key protector types")
+	guidStr := fs.String("guid", "", "volume GUID, random if not given")
+	desc := fs.String("description", "", "volume description")
+	fill := fs.Bool("fill", false, "fill the data area with random bytes, like real ciphertext")
+	force := fs.Bool("force", false, "overwrite the output file if it exists")
+	seed := seedFlag(fs)
+	addRNGFlag(fs)
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ss := int64(*sectorSize)
+	if !validSectorSize(ss) {
+		fatal("invalid sector size: %d", *sectorSize)
+	}
+	if *version != 1 && *version != 2 {
+		fatal("metadata version must be 1 or 2")
+	}
+	if *size < 1<<20 || *size%ss != 0 {
+		fatal("size must be at least 1 MiB and a multiple of the sector size")
+	}
+
+	// the same seed always creates the same image
+	created := time.Now()
+	useRNG(*seed)
+	if *seed != "" {
+		created = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if *desc == "" {
+		*desc = "BLWIPE-TEST C: " + created.Format("1/2/2006")
+	}
+
+	volumeGuid := randomGuid()
+	if *guidStr != "" {
+		g, err := parseGuid(*guidStr)
+		if err != nil {
+			fatal("%v", err)
+		}
+		volumeGuid = g
+	}
+
+	now := timeToFiletime(created)
+	var entries []byte
+	for _, name := range strings.Split(*protectorList, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		t, err := parseProtectionType(name)
+		if err != nil {
+			fatal("%v", err)
+		}
+		entries = append(entries, protectorDatum(t, now)...)
+	}
+	entries = append(entries, encodeDatum(EntryTypeFVEK, ValueTypeAesCcmKey, randomBytes(12+16+72))...)
+	entries = append(entries, encodeDatum(EntryTypeDescription, ValueTypeUnicodeString, encodeUTF16(*desc))...)
+
+	// the copies are spread over the volume, as Windows does
+	var offsets [3]uint64
+	for i := range offsets {
+		offsets[i] = uint64(*size / 4 * int64(i+1) / mkimageMetadataAlign * mkimageMetadataAlign)
+	}
+	headerSectorsOffset := offsets[0] + mkimageMetadataAlign
+	vhb := make([]byte, 16)
+	binary.LittleEndian.PutUint64(vhb, headerSectorsOffset)
+	binary.LittleEndian.PutUint64(vhb[8:], uint64(mkimageHeaderSectors*ss))
+	entries = append(entries, encodeDatum(EntryTypeVolumeHeaderBlock, ValueTypeOffsetSize, vhb)...)
+
+	info := InfoStruct{
+		InfoStructHeader:    InfoStructHeader{Version: uint16(*version)},
+		VolumeSize:          uint64(*size),
+		HeaderSectors:       mkimageHeaderSectors,
+		InfoOffsets:         offsets,
+		HeaderSectorsOffset: headerSectorsOffset,
+	}
+	copy(info.Signature[:], "-FVE-FS-")
+	mh := MetadataHeader{
+		Version:          1,
+		HeaderSize:       uint32(binary.Size(MetadataHeader{})),
+		VolumeGuid:       volumeGuid,
+		NextNonce:        1,
+		EncryptionMethod: methodAESXTS128,
+		CreationTime:     now,
+	}
+	block := buildMetadataBlock(info, mh, entries)
+	if len(block) > mkimageMetadataAlign {
+		fatal("too many protectors for a metadata block")
+	}
+
+	hdr := VolumeHeader{
+		Jmp:               [3]byte{0xeb, 0x58, 0x90},
+		SectorSize:        uint16(ss),
+		SectorsPerCluster: 8,
+		NumSectors:        uint64(*size / ss),
+		MetadataLcn:       offsets[0] / uint64(ss*8),
+		InfoOffsets:       offsets,
+	}
+	copy(hdr.Signature[:], "-FVE-FS-")
+	hdr.Guid, _ = parseGuid(INFO_GUID)
+	var hdrBuf bytes.Buffer
+	binary.Write(&hdrBuf, binary.LittleEndian, &hdr)
+	header := make([]byte, ss)
+	copy(header, hdrBuf.Bytes())
+	header[510], header[511] = 0x55, 0xaa
+
+	mode := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	if *force {
+		mode = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(fs.Arg(0), mode, 0644)
+	if err != nil {
+		fatal("can't create image: %v", err)
+	}
+	defer f.Close()
+
+	if err := f.Truncate(*size); err != nil {
+		fatal("%v", err)
+	}
+	if *fill {
+		if _, err := io.CopyN(f, randSource, *size); err != nil {
+			fatal("unable to fill the data area: %v", err)
+		}
+	}
+
+	writes := []struct {
+		name string
+		off  int64
+		data []byte
+	}{
+		{"volume header", 0, header},
+		{"metadata block 0", int64(offsets[0]), block},
+		{"metadata block 1", int64(offsets[1]), block},
+		{"metadata block 2", int64(offsets[2]), block},
+		{"header sectors", int64(headerSectorsOffset), make([]byte, mkimageHeaderSectors*ss)},
+	}
+	for _, w := range writes {
+		if _, err := f.WriteAt(w.data, w.off); err != nil {
+			fatal("unable to write %s: %v", w.name, err)
+		}
+		fmt.Printf("%s at offset 0x%x size %s\n", w.name, w.off, sizeString(int64(len(w.data))))
+	}
+	if err := f.Sync(); err != nil {
+		fatal("%v", err)
+	}
+	fmt.Printf("created BitLocker test volume {%v}, %s\n", volumeGuid, humanSize(*size))
+}
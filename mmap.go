@@ -0,0 +1,76 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+)
+
+// Image files that are only analyzed are mapped into memory, so scans and
+// comparisons that read them piece by piece do not need a system call for
+// every read.
+
+var useMmap = true
+
+func addMmapFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&useMmap, "mmap", true, "map image files into memory instead of reading them")
+}
+
+// mappedImage is an image file mapped read-only into memory.
+type mappedImage struct {
+	data []byte
+	f    *os.File
+}
+
+func (m *mappedImage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// slice returns up to n bytes at off, without copying them.
+func (m *mappedImage) slice(off int64, n int) ([]byte, error) {
+	if off < 0 || off >= int64(len(m.data)) {
+		return nil, io.EOF
+	}
+	if rem := int64(len(m.data)) - off; int64(n) > rem {
+		n = int(rem)
+	}
+	return m.data[off : off+int64(n)], nil
+}
+
+func (m *mappedImage) WriteAt(p []byte, off int64) (int, error) { return 0, errReadOnly }
+
+func (m *mappedImage) Close() error {
+	unmapFile(m.data)
+	return m.f.Close()
+}
+
+// mapImage returns img mapped into memory if it is a plain image file that
+// was opened read-only, or img itself otherwise. A file that is truncated
+// while it is mapped crashes the program, so -mmap=false avoids this for
+// images that others may be writing to.
+func mapImage(img Image) Image {
+	f, ok := img.(*os.File)
+	if !ok || !useMmap {
+		return img
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() == 0 || int64(int(fi.Size())) != fi.Size() {
+		return img
+	}
+	data := mapFile(f, int(fi.Size()))
+	if data == nil {
+		return img
+	}
+	return &mappedImage{data: data, f: f}
+}
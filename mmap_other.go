@@ -0,0 +1,14 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package main
+
+import "os"
+
+// mapFile is not implemented here, image files are always read instead.
+func mapFile(f *os.File, size int) []byte { return nil }
+
+func unmapFile(data []byte) {}
@@ -0,0 +1,286 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NBD (network block device) client, for volumes exported by nbd-server,
+// qemu-nbd or nbdkit. Only the fixed newstyle handshake and simple replies
+// are used. All NBD structures are big-endian.
+
+const (
+	nbdDefaultPort = "10809"
+	nbdMaxRequest  = 1 << 20
+
+	nbdMagic        = 0x4e42444d41474943 // "NBDMAGIC"
+	nbdOptMagic     = 0x49484156454f5054 // "IHAVEOPT"
+	nbdRepMagic     = 0x3e889045565a9
+	nbdRequestMagic = 0x25609513
+	nbdReplyMagic   = 0x67446698
+
+	nbdFlagFixedNewstyle = 1 << 0
+	nbdFlagNoZeroes      = 1 << 1
+
+	nbdOptExportName = 1
+	nbdOptGo         = 7
+
+	nbdRepAck      = 1
+	nbdRepInfo     = 3
+	nbdRepErrUnsup = 1<<31 + 1
+	nbdInfoExport  = 0
+
+	nbdTransReadOnly  = 1 << 1
+	nbdTransSendFlush = 1 << 2
+
+	nbdCmdRead  = 0
+	nbdCmdWrite = 1
+	nbdCmdDisc  = 2
+	nbdCmdFlush = 3
+)
+
+type nbdDisk struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	size     int64
+	flags    uint16
+	handle   uint64
+	modified bool
+}
+
+// isNBD reports whether path names an NBD export.
+func isNBD(path string) bool {
+	return strings.HasPrefix(path, "nbd://")
+}
+
+// openNBD connects to an export given as nbd://host[:port]/name.
+func openNBD(path string) (*nbdDisk, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), nbdDefaultPort)
+	}
+
+	conn, err := net.DialTimeout("tcp", host, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	d := &nbdDisk{conn: conn}
+	if err := d.handshake(strings.TrimPrefix(u.Path, "/")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("nbd: %v", err)
+	}
+	return d, nil
+}
+
+func (d *nbdDisk) handshake(name string) error {
+	var hello struct {
+		Magic, OptMagic uint64
+		Flags           uint16
+	}
+	if err := binary.Read(d.conn, binary.BigEndian, &hello); err != nil {
+		return err
+	}
+	if hello.Magic != nbdMagic || hello.OptMagic != nbdOptMagic {
+		return errors.New("not a newstyle NBD server")
+	}
+	if hello.Flags&nbdFlagFixedNewstyle == 0 {
+		return errors.New("server does not support the fixed newstyle handshake")
+	}
+	clientFlags := uint32(nbdFlagFixedNewstyle)
+	if hello.Flags&nbdFlagNoZeroes != 0 {
+		clientFlags |= nbdFlagNoZeroes
+	}
+	if err := binary.Write(d.conn, binary.BigEndian, clientFlags); err != nil {
+		return err
+	}
+
+	// NBD_OPT_GO, asking for no information beyond the export size
+	opt := make([]byte, 4+len(name)+2)
+	binary.BigEndian.PutUint32(opt, uint32(len(name)))
+	copy(opt[4:], name)
+	if err := d.sendOption(nbdOptGo, opt); err != nil {
+		return err
+	}
+
+	for {
+		var rep struct {
+			Magic  uint64
+			Option uint32
+			Type   uint32
+			Length uint32
+		}
+		if err := binary.Read(d.conn, binary.BigEndian, &rep); err != nil {
+			return err
+		}
+		if rep.Magic != nbdRepMagic {
+			return errors.New("invalid option reply")
+		}
+		data := make([]byte, rep.Length)
+		if _, err := io.ReadFull(d.conn, data); err != nil {
+			return err
+		}
+
+		switch {
+		case rep.Type == nbdRepInfo && len(data) >= 12 && binary.BigEndian.Uint16(data) == nbdInfoExport:
+			d.size = int64(binary.BigEndian.Uint64(data[2:]))
+			d.flags = binary.BigEndian.Uint16(data[10:])
+		case rep.Type == nbdRepAck:
+			return nil
+		case rep.Type == nbdRepErrUnsup:
+			return d.exportName(name, clientFlags&nbdFlagNoZeroes != 0)
+		case rep.Type&(1<<31) != 0:
+			msg := fmt.Sprintf("export %q refused (error 0x%x)", name, rep.Type)
+			if len(data) > 0 {
+				msg += ": " + string(data)
+			}
+			return errors.New(msg)
+		}
+	}
+}
+
+// exportName selects the export the old way, for servers without NBD_OPT_GO.
+func (d *nbdDisk) exportName(name string, noZeroes bool) error {
+	if err := d.sendOption(nbdOptExportName, []byte(name)); err != nil {
+		return err
+	}
+	var reply struct {
+		Size  uint64
+		Flags uint16
+	}
+	if err := binary.Read(d.conn, binary.BigEndian, &reply); err != nil {
+		return fmt.Errorf("export %q refused", name)
+	}
+	if !noZeroes {
+		if _, err := io.ReadFull(d.conn, make([]byte, 124)); err != nil {
+			return err
+		}
+	}
+	d.size, d.flags = int64(reply.Size), reply.Flags
+	return nil
+}
+
+func (d *nbdDisk) sendOption(option uint32, data []byte) error {
+	hdr := make([]byte, 16)
+	binary.BigEndian.PutUint64(hdr, nbdOptMagic)
+	binary.BigEndian.PutUint32(hdr[8:], option)
+	binary.BigEndian.PutUint32(hdr[12:], uint32(len(data)))
+	_, err := d.conn.Write(append(hdr, data...))
+	return err
+}
+
+// request sends a command and waits for its reply, reading len(read)
+// bytes of data with it.
+func (d *nbdDisk) request(cmd uint16, off int64, length int, write, read []byte) error {
+	d.handle++
+	req := make([]byte, 28, 28+len(write))
+	binary.BigEndian.PutUint32(req, nbdRequestMagic)
+	binary.BigEndian.PutUint16(req[6:], cmd)
+	binary.BigEndian.PutUint64(req[8:], d.handle)
+	binary.BigEndian.PutUint64(req[16:], uint64(off))
+	binary.BigEndian.PutUint32(req[24:], uint32(length))
+	if _, err := d.conn.Write(append(req, write...)); err != nil {
+		return err
+	}
+	if cmd == nbdCmdDisc {
+		return nil
+	}
+
+	var reply struct {
+		Magic  uint32
+		Error  uint32
+		Handle uint64
+	}
+	if err := binary.Read(d.conn, binary.BigEndian, &reply); err != nil {
+		return err
+	}
+	if reply.Magic != nbdReplyMagic || reply.Handle != d.handle {
+		return errors.New("nbd: invalid reply")
+	}
+	if reply.Error != 0 {
+		return fmt.Errorf("nbd: request failed with error %d", reply.Error)
+	}
+	_, err := io.ReadFull(d.conn, read)
+	return err
+}
+
+func (d *nbdDisk) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		if off+int64(n) >= d.size {
+			return n, io.EOF
+		}
+		chunk := p[n:]
+		if len(chunk) > nbdMaxRequest {
+			chunk = chunk[:nbdMaxRequest]
+		}
+		if rest := d.size - off - int64(n); int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		if err := d.request(nbdCmdRead, off+int64(n), len(chunk), nil, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+func (d *nbdDisk) WriteAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.flags&nbdTransReadOnly != 0 {
+		return 0, errReadOnly
+	}
+	if off+int64(len(p)) > d.size {
+		return 0, errors.New("nbd: write beyond the end of the export")
+	}
+
+	d.modified = true
+	for n := 0; n < len(p); {
+		chunk := p[n:]
+		if len(chunk) > nbdMaxRequest {
+			chunk = chunk[:nbdMaxRequest]
+		}
+		if err := d.request(nbdCmdWrite, off+int64(n), len(chunk), chunk, nil); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return len(p), nil
+}
+
+func (d *nbdDisk) Size() int64 { return d.size }
+
+func (d *nbdDisk) ReadOnly() bool { return d.flags&nbdTransReadOnly != 0 }
+
+// Close makes sure writes reached the server's storage before disconnecting.
+func (d *nbdDisk) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var err error
+	if d.modified && d.flags&nbdTransSendFlush != 0 {
+		err = d.request(nbdCmdFlush, 0, 0, nil, nil)
+	}
+	d.request(nbdCmdDisc, 0, 0, nil, nil)
+	d.conn.Close()
+	return err
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Encrypted virtual machines can hide inside an otherwise plain disk:
+// scan -nested reads the NTFS and FAT filesystems on it, opens the virtual
+// disks stored as files there, and looks in those for volumes, and for
+// more virtual disks.
+
+// nestedMaxDepth is how many virtual disks deep to look.
+const nestedMaxDepth = 4
+
+// virtualDiskExts are the names of files opened as virtual disks.
+var virtualDiskExts = map[string]bool{".vhd": true, ".vhdx": true, ".vmdk": true}
+
+// extentFile reads a file on a filesystem from the extents it occupies on
+// the filesystem's device. Extents at offset -1 are holes.
+type extentFile struct {
+	r      io.ReaderAt
+	exts   []extent
+	starts []int64 // the file offset of each extent
+	size   int64
+}
+
+func newExtentFile(r io.ReaderAt, exts []extent, size int64) *extentFile {
+	f := &extentFile{r: r, exts: exts, size: size}
+	pos := int64(0)
+	for _, e := range exts {
+		f.starts = append(f.starts, pos)
+		pos += e.Size
+	}
+	if f.size > pos {
+		f.size = pos
+	}
+	return f
+}
+
+func (f *extentFile) Size() int64 { return f.size }
+
+func (f *extentFile) ReadAt(p []byte, off int64) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if off >= f.size {
+			return total, io.EOF
+		}
+		i := sort.Search(len(f.starts), func(i int) bool { return f.starts[i] > off }) - 1
+		within := off - f.starts[i]
+		n := len(p)
+		if rem := f.exts[i].Size - within; int64(n) > rem {
+			n = int(rem)
+		}
+		if rem := f.size - off; int64(n) > rem {
+			n = int(rem)
+		}
+
+		if f.exts[i].Offset < 0 {
+			for j := range p[:n] {
+				p[j] = 0
+			}
+		} else if err := readFullAt(f.r, p[:n], f.exts[i].Offset+within); err != nil {
+			return total, err
+		}
+
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
+
+func (f *extentFile) WriteAt(p []byte, off int64) (int, error) { return 0, errReadOnly }
+
+// openNestedDisk opens the virtual disk in f, returning its format name.
+// Files in no format known are taken to be raw images.
+func openNestedDisk(f *extentFile) (diskFormat, string, error) {
+	switch {
+	case isVHDX(f):
+		d, err := openVHDX(f, f.Size())
+		return d, "vhdx", err
+	case isVHD(f, f.Size()):
+		d, err := openVHD(f, f.Size())
+		return d, "vhd", err
+	case isQCOW2(f):
+		d, err := openQCOW2(f, f.Size())
+		return d, "qcow2", err
+	case isVMDK(f):
+		d, err := openVMDK(f, f.Size())
+		return d, "vmdk", err
+	}
+	return f, "raw", nil
+}
+
+type nestedScan struct {
+	disks   int // virtual disks found in filesystems
+	volumes int
+	nested  int // volumes inside virtual disks
+	errors  int
+}
+
+// disk looks for volumes on st, and for virtual disks in the filesystems
+// on it. trail names how st was reached from the target.
+func (n *nestedScan) disk(st storage, trail []string, depth int) {
+	where := strings.Join(trail, " > ")
+	for _, v := range findVolumes(st) {
+		n.volumes++
+		if depth > 0 {
+			n.nested++
+		}
+		extra := ""
+		if v.Format == "bitlocker" {
+			metadata, createdBy := summarizeBitLocker(st, v.Offset)
+			extra = ", metadata " + metadata
+			if createdBy != "" {
+				extra += ", created by " + createdBy
+			}
+		}
+		fmt.Printf("%s > 0x%012x: %s%s\n", where, v.Offset, highlight(v.Format), extra)
+	}
+
+	if fs := probeFilesystem(st, 0); fs != "" {
+		n.filesystem(st, fs, append(trail, fs), depth)
+		return
+	}
+	parts, _ := readPartitions(st)
+	for _, p := range parts {
+		if fs := probeFilesystem(st, p.Offset); fs != "" {
+			n.filesystem(&subStorage{st, p.Offset}, fs, append(trail, fmt.Sprintf("partition %d (%s)", p.Index, fs)), depth)
+		}
+	}
+}
+
+// filesystem opens the virtual disks in the filesystem on st, if it is one
+// that can be read.
+func (n *nestedScan) filesystem(st storage, fs string, trail []string, depth int) {
+	var walk func(fn func(f *fatFile) error) error
+	switch fs {
+	case "NTFS":
+		ntfs, err := openNTFS(st)
+		if err != nil {
+			n.fail(trail, err)
+			return
+		}
+		walk = ntfs.Walk
+	case "exFAT", "FAT12", "FAT16", "FAT32":
+		fat, err := openFAT(st)
+		if err != nil {
+			n.fail(trail, err)
+			return
+		}
+		walk = fat.Walk
+	default:
+		return
+	}
+
+	err := walk(func(f *fatFile) error {
+		if !virtualDiskExts[strings.ToLower(path.Ext(f.Path))] {
+			return nil
+		}
+		n.disks++
+		ef := newExtentFile(st, f.Extents, f.Size)
+		d, format, err := openNestedDisk(ef)
+		inner := append(trail[:len(trail):len(trail)], fmt.Sprintf("%s (%s)", f.Path, format))
+		switch {
+		case err != nil:
+			n.fail(inner, err)
+		case depth >= nestedMaxDepth:
+			n.fail(inner, fmt.Errorf("virtual disks nested more than %d deep", nestedMaxDepth))
+		default:
+			fmt.Printf("%s: %s\n", strings.Join(inner, " > "), humanSize(d.Size()))
+			n.disk(d, inner, depth+1)
+		}
+		return nil
+	})
+	if err != nil {
+		n.fail(trail, err)
+	}
+}
+
+func (n *nestedScan) fail(trail []string, err error) {
+	n.errors++
+	fmt.Printf("%s: %s\n", strings.Join(trail, " > "), warning(err.Error()))
+}
+
+// scanNested looks for volumes on the target and in the virtual disks
+// stored on it.
+func scanNested(target string) {
+	img, err := openImage(target, false)
+	if err != nil {
+		fatal("%v", err)
+	}
+	defer img.Close()
+	giveUpPrivileges()
+	st, err := imageStorage(img)
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	var n nestedScan
+	n.disk(st, []string{target}, 0)
+	result("%d virtual disk(s) in filesystems, %d encrypted volume(s), %d of them inside virtual disks, %d error(s)",
+		n.disks, n.volumes, n.nested, n.errors)
+}
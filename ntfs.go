@@ -0,0 +1,307 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"unicode/utf16"
+)
+
+// A minimal NTFS reader, enough to list the files in the MFT and locate
+// the clusters they occupy. Files that NTFS compresses or encrypts can't
+// be read as extents, and are left out.
+
+const (
+	ntfsRecordInUse = 0x0001
+	ntfsRecordDir   = 0x0002
+
+	ntfsAttrFileName = 0x30
+	ntfsAttrData     = 0x80
+	ntfsAttrEnd      = 0xffffffff
+
+	ntfsDataCompressed = 0x0001
+	ntfsDataEncrypted  = 0x4000
+
+	ntfsNamespaceDOS = 2
+	ntfsRootRecord   = 5
+
+	ntfsMaxRecordSize = 64 << 10
+	ntfsMaxRecords    = 1 << 28
+)
+
+type ntfsFS struct {
+	r           io.ReaderAt
+	clusterSize int64
+	recordSize  int64
+	mft         *extentFile
+}
+
+// ntfsEntry is what the first pass over the MFT keeps of each record, to
+// build paths from.
+type ntfsEntry struct {
+	name   string
+	parent uint32
+	dir    bool
+}
+
+// ntfsRun is part of the unnamed $DATA attribute of a file, which can be
+// spread over extension records when it is heavily fragmented.
+type ntfsRun struct {
+	vcn     int64
+	size    int64 // the file size, in the run starting at VCN 0
+	extents []extent
+	skip    bool // compressed or encrypted
+}
+
+// openNTFS opens the NTFS filesystem whose boot sector is at the start
+// of r.
+func openNTFS(r io.ReaderAt) (*ntfsFS, error) {
+	bs := make([]byte, 512)
+	if err := readFullAt(r, bs, 0); err != nil {
+		return nil, err
+	}
+	if string(bs[3:11]) != "NTFS    " || bs[510] != 0x55 || bs[511] != 0xaa {
+		return nil, errors.New("not an NTFS filesystem")
+	}
+
+	le := binary.LittleEndian
+	bps := int64(le.Uint16(bs[11:]))
+	spc := int64(bs[13])
+	if spc > 0x80 {
+		spc = 1 << (256 - uint(spc))
+	}
+	if !validSectorSize(bps) || spc == 0 || spc&(spc-1) != 0 || spc > 4096 {
+		return nil, errors.New("invalid NTFS boot sector")
+	}
+	fs := &ntfsFS{r: r, clusterSize: bps * spc}
+
+	if c := int8(bs[64]); c < 0 {
+		fs.recordSize = 1 << uint(-c)
+	} else {
+		fs.recordSize = int64(c) * fs.clusterSize
+	}
+	if fs.recordSize < 512 || fs.recordSize > ntfsMaxRecordSize {
+		return nil, fmt.Errorf("invalid NTFS record size %d", fs.recordSize)
+	}
+
+	// the MFT describes itself in record 0
+	rec := make([]byte, fs.recordSize)
+	if err := readFullAt(r, rec, int64(le.Uint64(bs[48:]))*fs.clusterSize); err != nil {
+		return nil, fmt.Errorf("can't read the MFT: %v", err)
+	}
+	if !fs.fixup(rec) {
+		return nil, errors.New("corrupt MFT record 0")
+	}
+	runs := fs.dataRuns(rec)
+	if len(runs) == 0 || runs[0].vcn != 0 {
+		return nil, errors.New("the MFT has no data")
+	}
+	fs.mft = newExtentFile(r, runs[0].extents, runs[0].size)
+	return fs, nil
+}
+
+// fixup checks a record's update sequence and puts back the last two bytes
+// of each sector, which NTFS swaps with it on disk.
+func (fs *ntfsFS) fixup(rec []byte) bool {
+	le := binary.LittleEndian
+	if string(rec[:4]) != "FILE" {
+		return false
+	}
+	usa, count := int(le.Uint16(rec[4:])), int(le.Uint16(rec[6:]))
+	if count < 2 || usa+2*count > len(rec) || (count-1)*512 > len(rec) {
+		return false
+	}
+	for i := 1; i < count; i++ {
+		end := i*512 - 2
+		if rec[end] != rec[usa] || rec[end+1] != rec[usa+1] {
+			return false
+		}
+		copy(rec[end:end+2], rec[usa+2*i:])
+	}
+	return true
+}
+
+// attributes calls fn with the type, header and body of every attribute in
+// a record.
+func attributes(rec []byte, fn func(typ uint32, attr []byte)) {
+	le := binary.LittleEndian
+	off := int(le.Uint16(rec[20:]))
+	for off+16 <= len(rec) {
+		typ := le.Uint32(rec[off:])
+		n := int(le.Uint32(rec[off+4:]))
+		if typ == ntfsAttrEnd || n < 16 || off+n > len(rec) {
+			return
+		}
+		fn(typ, rec[off:off+n])
+		off += n
+	}
+}
+
+// dataRuns returns the unnamed, non-resident $DATA attributes in rec.
+func (fs *ntfsFS) dataRuns(rec []byte) []ntfsRun {
+	le := binary.LittleEndian
+	var runs []ntfsRun
+	attributes(rec, func(typ uint32, attr []byte) {
+		if typ != ntfsAttrData || attr[8] == 0 || attr[9] != 0 || len(attr) < 64 {
+			return
+		}
+		run := ntfsRun{
+			vcn:  int64(le.Uint64(attr[16:])),
+			skip: le.Uint16(attr[12:])&(ntfsDataCompressed|ntfsDataEncrypted) != 0,
+		}
+		if run.vcn == 0 {
+			run.size = int64(le.Uint64(attr[48:]))
+		}
+		if off := int(le.Uint16(attr[32:])); off < len(attr) {
+			run.extents = fs.decodeRunList(attr[off:])
+		}
+		runs = append(runs, run)
+	})
+	return runs
+}
+
+// decodeRunList turns a mapping pairs array into extents, with sparse runs
+// at offset -1.
+func (fs *ntfsFS) decodeRunList(b []byte) []extent {
+	var exts []extent
+	lcn := int64(0)
+	for len(b) > 0 && b[0] != 0 {
+		lenSize, offSize := int(b[0]&0x0f), int(b[0]>>4)
+		if lenSize == 0 || lenSize > 8 || offSize > 8 || 1+lenSize+offSize > len(b) {
+			break
+		}
+		length := int64(0)
+		for i := lenSize; i > 0; i-- {
+			length = length<<8 | int64(b[i])
+		}
+		if offSize == 0 {
+			exts = append(exts, extent{-1, length * fs.clusterSize})
+		} else {
+			delta := int64(int8(b[lenSize+offSize])) // sign-extended
+			for i := lenSize + offSize - 1; i > lenSize; i-- {
+				delta = delta<<8 | int64(b[i])
+			}
+			lcn += delta
+			exts = append(exts, extent{lcn * fs.clusterSize, length * fs.clusterSize})
+		}
+		b = b[1+lenSize+offSize:]
+	}
+	return exts
+}
+
+// fileName returns the long name of the file in rec and the record number
+// of its directory.
+func fileName(rec []byte) (name string, parent uint32, ok bool) {
+	le := binary.LittleEndian
+	attributes(rec, func(typ uint32, attr []byte) {
+		if typ != ntfsAttrFileName || attr[8] != 0 || len(attr) < 24 || int(le.Uint16(attr[20:])) > len(attr) {
+			return
+		}
+		v := attr[le.Uint16(attr[20:]):]
+		if len(v) < 66 || ok && v[65] == ntfsNamespaceDOS {
+			return
+		}
+		n := int(v[64])
+		if 66+2*n > len(v) {
+			return
+		}
+		u := make([]uint16, n)
+		for i := range u {
+			u[i] = le.Uint16(v[66+2*i:])
+		}
+		name, parent, ok = string(utf16.Decode(u)), uint32(le.Uint64(v)&0xffffffffffff), true
+	})
+	return
+}
+
+// records calls fn with the number and contents of every record in use,
+// stopping at the first error.
+func (fs *ntfsFS) records(fn func(n uint32, rec []byte) error) error {
+	count := fs.mft.size / fs.recordSize
+	if count > ntfsMaxRecords {
+		return fmt.Errorf("too many MFT records (%d)", count)
+	}
+	const batch = 256
+	buf := make([]byte, batch*fs.recordSize)
+	for first := int64(0); first < count; first += batch {
+		n := count - first
+		if n > batch {
+			n = batch
+		}
+		if err := readFullAt(fs.mft, buf[:n*fs.recordSize], first*fs.recordSize); err != nil {
+			return fmt.Errorf("can't read the MFT: %v", err)
+		}
+		for i := int64(0); i < n; i++ {
+			rec := buf[i*fs.recordSize : (i+1)*fs.recordSize]
+			if !fs.fixup(rec) || binary.LittleEndian.Uint16(rec[22:])&ntfsRecordInUse == 0 {
+				continue
+			}
+			if err := fn(uint32(first+i), rec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for every file on the filesystem that can be read.
+func (fs *ntfsFS) Walk(fn func(f *fatFile) error) error {
+	// first the names, and the data of fragmented files kept in extension
+	// records
+	entries := make(map[uint32]ntfsEntry)
+	extra := make(map[uint32][]ntfsRun)
+	err := fs.records(func(n uint32, rec []byte) error {
+		if base := uint32(binary.LittleEndian.Uint64(rec[32:]) & 0xffffffffffff); base != 0 {
+			extra[base] = append(extra[base], fs.dataRuns(rec)...)
+		} else if name, parent, ok := fileName(rec); ok {
+			entries[n] = ntfsEntry{name, parent, binary.LittleEndian.Uint16(rec[22:])&ntfsRecordDir != 0}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	path := func(n uint32) (string, bool) {
+		p := ""
+		for depth := 0; n != ntfsRootRecord; depth++ {
+			e, ok := entries[n]
+			if !ok || depth > fatMaxDepth*4 {
+				return "", false
+			}
+			p = "/" + e.name + p
+			n = e.parent
+		}
+		return p, true
+	}
+
+	// then the files, in the order of their records
+	return fs.records(func(n uint32, rec []byte) error {
+		e, ok := entries[n]
+		if !ok || e.dir || n < 16 {
+			return nil // the metadata files come first
+		}
+		runs := append(fs.dataRuns(rec), extra[n]...)
+		if len(runs) == 0 {
+			return nil // resident, and too small to matter
+		}
+		sort.Slice(runs, func(i, j int) bool { return runs[i].vcn < runs[j].vcn })
+		if runs[0].vcn != 0 || runs[0].skip {
+			return nil
+		}
+		f := &fatFile{Size: runs[0].size}
+		for _, r := range runs {
+			f.Extents = append(f.Extents, r.extents...)
+		}
+		if f.Path, ok = path(n); !ok {
+			return nil
+		}
+		return fn(f)
+	})
+}
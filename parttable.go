@@ -0,0 +1,566 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Partition tables, MBR (including extended partitions) and GPT.
+
+type partition struct {
+	Index  int    // 1-based, in the order found
+	Offset int64  // in bytes
+	Size   int64  // in bytes
+	Type   string // MBR type byte in hex, or GPT type GUID
+	Name   string // GPT partition name
+	GUID   string // GPT unique partition GUID
+}
+
+const (
+	mbrProtective = 0xee
+	gptSignature  = "EFI PART"
+	maxPartitions = 256
+)
+
+// isExtended reports whether an MBR type is an extended partition.
+func isExtended(t byte) bool { return t == 0x05 || t == 0x0f || t == 0x85 }
+
+type mbrEntry struct {
+	Status   byte
+	_        [3]byte
+	Type     byte
+	_        [3]byte
+	StartLBA uint32
+	Sectors  uint32
+}
+
+// readMBR returns the 4 primary entries of an MBR, or nil if sector is not
+// a valid MBR.
+func readMBR(sector []byte) []mbrEntry {
+	if len(sector) < 512 || sector[510] != 0x55 || sector[511] != 0xaa {
+		return nil
+	}
+
+	entries := make([]mbrEntry, 4)
+	binary.Read(bytes.NewReader(sector[446:]), binary.LittleEndian, entries)
+	for _, e := range entries {
+		if e.Status != 0 && e.Status != 0x80 {
+			return nil
+		}
+	}
+	return entries
+}
+
+// isProtective reports whether an MBR protects a GPT. A hybrid MBR has
+// other entries besides the protective one.
+func isProtective(entries []mbrEntry) bool {
+	for _, e := range entries {
+		if e.Type == mbrProtective {
+			return true
+		}
+	}
+	return false
+}
+
+// hybridMismatches compares the entries of a hybrid MBR with the GPT
+// partitions they mirror, and describes where they disagree. Only the
+// disagreements about the partition at offset are returned, or all of them
+// if offset is negative.
+func hybridMismatches(r io.ReaderAt, offset int64) []string {
+	sector := make([]byte, 512)
+	if err := readFullAt(r, sector, 0); err != nil {
+		return nil
+	}
+	entries := readMBR(sector)
+	if !isProtective(entries) {
+		return nil
+	}
+	parts, err := readPartitions(r)
+	if err != nil {
+		return nil
+	}
+
+	var found []string
+	for i, e := range entries {
+		if e.Type == mbrProtective || e.Type == 0 || e.Sectors == 0 || isExtended(e.Type) {
+			continue
+		}
+		start, size := int64(e.StartLBA)*512, int64(e.Sectors)*512
+
+		var desc string
+		match := int64(-1)
+		for _, p := range parts {
+			if p.Offset == start {
+				match = p.Offset
+				if p.Size != size {
+					desc = fmt.Sprintf("MBR partition %d is %s, but GPT partition %d at the same offset is %s",
+						i+1, sizeString(size), p.Index, sizeString(p.Size))
+				}
+				break
+			}
+		}
+		for _, p := range parts {
+			if match < 0 && start < p.Offset+p.Size && p.Offset < start+size {
+				match = p.Offset
+				desc = fmt.Sprintf("MBR partition %d starts at 0x%x, but GPT partition %d starts at 0x%x",
+					i+1, start, p.Index, p.Offset)
+			}
+		}
+		if match < 0 {
+			desc = fmt.Sprintf("MBR partition %d at 0x%x has no GPT partition", i+1, start)
+		}
+		if desc != "" && (offset < 0 || offset == start || offset == match) {
+			found = append(found, desc)
+		}
+	}
+	return found
+}
+
+// readPartitions reads the partition table at the start of a disk.
+func readPartitions(r io.ReaderAt) ([]partition, error) {
+	sector := make([]byte, 512)
+	if err := readFullAt(r, sector, 0); err != nil {
+		return nil, err
+	}
+
+	entries := readMBR(sector)
+	if entries == nil {
+		return nil, errors.New("no partition table found")
+	}
+
+	// the GPT is used for hybrid MBRs too, since it is what the partitions
+	// were created with and the MBR entries only mirror some of them
+	if isProtective(entries) {
+		// GPT can use logical blocks larger than 512 bytes
+		for _, ss := range []int64{512, 4096} {
+			if parts, err := readGPT(r, ss); err == nil {
+				return parts, nil
+			}
+		}
+		return nil, errors.New("invalid GPT header")
+	}
+
+	var parts []partition
+	for _, e := range entries {
+		switch {
+		case e.Type == 0 || e.Sectors == 0:
+		case isExtended(e.Type):
+			logical, err := readEBRs(r, int64(e.StartLBA))
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, logical...)
+		default:
+			parts = append(parts, partition{
+				Offset: int64(e.StartLBA) * 512,
+				Size:   int64(e.Sectors) * 512,
+				Type:   fmt.Sprintf("%02x", e.Type),
+			})
+		}
+	}
+
+	for i := range parts {
+		parts[i].Index = i + 1
+	}
+	return parts, nil
+}
+
+// readEBRs follows the chain of extended boot records starting at the
+// extended partition at sector base.
+func readEBRs(r io.ReaderAt, base int64) ([]partition, error) {
+	var parts []partition
+	sector := make([]byte, 512)
+	for next := base; len(parts) < maxPartitions; {
+		if err := readFullAt(r, sector, next*512); err != nil {
+			return parts, err
+		}
+		entries := readMBR(sector)
+		if entries == nil {
+			return parts, fmt.Errorf("invalid extended boot record at sector %d", next)
+		}
+
+		if e := entries[0]; e.Type != 0 && e.Sectors != 0 {
+			parts = append(parts, partition{
+				Offset: (next + int64(e.StartLBA)) * 512,
+				Size:   int64(e.Sectors) * 512,
+				Type:   fmt.Sprintf("%02x", e.Type),
+			})
+		}
+
+		link := entries[1]
+		if !isExtended(link.Type) || link.StartLBA == 0 {
+			return parts, nil
+		}
+		next = base + int64(link.StartLBA)
+	}
+	return parts, errors.New("too many logical partitions")
+}
+
+type gptHeader struct {
+	Signature      [8]byte
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCrc32    uint32
+	_              uint32
+	CurrentLBA     uint64
+	BackupLBA      uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGuid       Guid
+	EntriesLBA     uint64
+	NumEntries     uint32
+	EntrySize      uint32
+	EntriesCrc32   uint32
+}
+
+type gptEntry struct {
+	TypeGuid   Guid
+	UniqueGuid Guid
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       [72]byte
+}
+
+func readGPT(r io.ReaderAt, sectorSize int64) ([]partition, error) {
+	hdr, err := readGPTHeader(r, sectorSize)
+	if err != nil {
+		return nil, err
+	}
+
+	table := make([]byte, int64(hdr.NumEntries)*int64(hdr.EntrySize))
+	if err := readFullAt(r, table, int64(hdr.EntriesLBA)*sectorSize); err != nil {
+		return nil, err
+	}
+
+	var parts []partition
+	for i := 0; i < int(hdr.NumEntries); i++ {
+		var e gptEntry
+		binary.Read(bytes.NewReader(table[i*int(hdr.EntrySize):]), binary.LittleEndian, &e)
+		if e.TypeGuid == (Guid{}) || e.LastLBA < e.FirstLBA {
+			continue
+		}
+
+		parts = append(parts, partition{
+			Index:  i + 1,
+			Offset: int64(e.FirstLBA) * sectorSize,
+			Size:   int64(e.LastLBA-e.FirstLBA+1) * sectorSize,
+			Type:   e.TypeGuid.String(),
+			Name:   decodeUTF16(e.Name[:]),
+			GUID:   e.UniqueGuid.String(),
+		})
+	}
+	return parts, nil
+}
+
+// partitionSelector picks one partition of a disk, by its index, its unique
+// GUID or its type. Only the fields that are set are compared.
+type partitionSelector struct {
+	index    int
+	guid     string
+	typeGuid string
+}
+
+func (s partitionSelector) enabled() bool {
+	return s.index != 0 || s.guid != "" || s.typeGuid != ""
+}
+
+func (s partitionSelector) String() string {
+	var c []string
+	if s.index != 0 {
+		c = append(c, fmt.Sprintf("number %d", s.index))
+	}
+	if s.guid != "" {
+		c = append(c, "GUID "+s.guid)
+	}
+	if s.typeGuid != "" {
+		c = append(c, "type "+s.typeGuid)
+	}
+	return strings.Join(c, ", ")
+}
+
+// normalizeGuid accepts a GUID with or without braces, in either case. An
+// MBR type byte is accepted for -part-type too.
+func normalizeGuid(s string) (string, error) {
+	if t, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 8); err == nil && len(s) <= 4 {
+		return fmt.Sprintf("%02x", t), nil
+	}
+	g, err := parseGuid(s)
+	if err != nil {
+		return "", err
+	}
+	return g.String(), nil
+}
+
+// selectPartition finds the only partition of the disk matching s.
+func selectPartition(r io.ReaderAt, s partitionSelector) (partition, error) {
+	parts, err := readPartitions(r)
+	if err != nil {
+		return partition{}, err
+	}
+
+	var found []partition
+	for _, p := range parts {
+		if (s.index == 0 || p.Index == s.index) &&
+			(s.guid == "" || strings.EqualFold(p.GUID, s.guid)) &&
+			(s.typeGuid == "" || strings.EqualFold(p.Type, s.typeGuid)) {
+			found = append(found, p)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return partition{}, fmt.Errorf("no partition with %s", s)
+	case 1:
+		return found[0], nil
+	}
+	var idx []string
+	for _, p := range found {
+		idx = append(idx, strconv.Itoa(p.Index))
+	}
+	return partition{}, fmt.Errorf("%d partitions with %s (%s), use -partition to pick one",
+		len(found), s, strings.Join(idx, ", "))
+}
+
+// clearPartitionEntry removes the partition starting at byte offset from
+// the partition table, so that the disk no longer advertises it. Both
+// copies of a GPT are updated, along with their checksums. It returns a
+// description of the entry that was cleared.
+func clearPartitionEntry(st storage, offset int64) (string, error) {
+	if offset == 0 {
+		return "", errors.New("the volume is not on a partition of this disk")
+	}
+	sector := make([]byte, 512)
+	if err := readFullAt(st, sector, 0); err != nil {
+		return "", err
+	}
+	entries := readMBR(sector)
+	if entries == nil {
+		return "", errors.New("no partition table found")
+	}
+
+	if isProtective(entries) {
+		for _, ss := range []int64{512, 4096} {
+			desc, err := clearGPTEntry(st, ss, offset)
+			if errors.Is(err, errNoGPT) {
+				continue
+			} else if err != nil {
+				return "", err
+			}
+
+			// a hybrid MBR may mirror the partition as well
+			for i, e := range entries {
+				if e.Type != mbrProtective && e.Sectors != 0 && int64(e.StartLBA)*512 == offset {
+					copy(sector[446+16*i:446+16*(i+1)], make([]byte, 16))
+					if _, err := st.WriteAt(sector, 0); err != nil {
+						return "", err
+					}
+					desc += fmt.Sprintf(" and hybrid MBR partition %d", i+1)
+				}
+			}
+			return desc, nil
+		}
+		return "", errors.New("invalid GPT header")
+	}
+
+	for i, e := range entries {
+		switch {
+		case e.Type == 0 || e.Sectors == 0:
+		case isExtended(e.Type):
+			if desc, err := clearEBREntry(st, int64(e.StartLBA), offset); err == nil || !errors.Is(err, errNoPartition) {
+				return desc, err
+			}
+		case int64(e.StartLBA)*512 == offset:
+			copy(sector[446+16*i:446+16*(i+1)], make([]byte, 16))
+			if _, err := st.WriteAt(sector, 0); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("MBR partition %d", i+1), nil
+		}
+	}
+	return "", errNoPartition
+}
+
+var (
+	errNoGPT       = errors.New("invalid GPT signature")
+	errNoPartition = errors.New("no partition starts at the volume")
+)
+
+// clearEBREntry clears the logical partition at offset in the chain of
+// extended boot records starting at sector base.
+func clearEBREntry(st storage, base, offset int64) (string, error) {
+	sector := make([]byte, 512)
+	for n, next := 0, base; n < maxPartitions; n++ {
+		if err := readFullAt(st, sector, next*512); err != nil {
+			return "", err
+		}
+		entries := readMBR(sector)
+		if entries == nil {
+			return "", fmt.Errorf("invalid extended boot record at sector %d", next)
+		}
+
+		if e := entries[0]; e.Type != 0 && (next+int64(e.StartLBA))*512 == offset {
+			// the link to the next record is kept
+			copy(sector[446:462], make([]byte, 16))
+			if _, err := st.WriteAt(sector, next*512); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("logical partition at sector %d", next), nil
+		}
+
+		link := entries[1]
+		if !isExtended(link.Type) || link.StartLBA == 0 {
+			break
+		}
+		next = base + int64(link.StartLBA)
+	}
+	return "", errNoPartition
+}
+
+// clearGPTEntry clears the GPT entry of the partition at offset, in the
+// primary table and then the backup.
+func clearGPTEntry(st storage, sectorSize, offset int64) (string, error) {
+	primary, err := readGPTHeader(st, sectorSize)
+	if err != nil {
+		return "", err
+	}
+
+	index := -1
+	for _, lba := range []int64{sectorSize, int64(primary.BackupLBA) * sectorSize} {
+		hdr, err := readGPTHeader(st, lba)
+		if err != nil {
+			if lba != sectorSize {
+				// the primary is cleared, so carry on without the backup
+				return fmt.Sprintf("GPT partition %d (backup GPT not updated: %v)", index+1, err), nil
+			}
+			return "", err
+		}
+		table := make([]byte, int64(hdr.NumEntries)*int64(hdr.EntrySize))
+		tableOff := int64(hdr.EntriesLBA) * sectorSize
+		if err := readFullAt(st, table, tableOff); err != nil {
+			return "", err
+		}
+
+		if index < 0 {
+			for i := 0; i < int(hdr.NumEntries); i++ {
+				var e gptEntry
+				binary.Read(bytes.NewReader(table[i*int(hdr.EntrySize):]), binary.LittleEndian, &e)
+				if e.TypeGuid != (Guid{}) && int64(e.FirstLBA)*sectorSize == offset {
+					index = i
+					break
+				}
+			}
+			if index < 0 {
+				return "", errNoPartition
+			}
+		}
+		if index >= int(hdr.NumEntries) {
+			return "", fmt.Errorf("GPT at LBA %d has only %d entries", lba/sectorSize, hdr.NumEntries)
+		}
+
+		entry := table[index*int(hdr.EntrySize) : (index+1)*int(hdr.EntrySize)]
+		copy(entry, make([]byte, len(entry)))
+		if _, err := st.WriteAt(table, tableOff); err != nil {
+			return "", err
+		}
+		hdr.EntriesCrc32 = crc32.ChecksumIEEE(table)
+		if err := writeGPTHeader(st, lba, hdr); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("GPT partition %d", index+1), nil
+}
+
+// readGPTHeader reads and checks the GPT header at byte offset off.
+func readGPTHeader(r io.ReaderAt, off int64) (*gptHeader, error) {
+	buf := make([]byte, 512)
+	if err := readFullAt(r, buf, off); err != nil {
+		return nil, err
+	}
+	var hdr gptHeader
+	binary.Read(bytes.NewReader(buf), binary.LittleEndian, &hdr)
+	if string(hdr.Signature[:]) != gptSignature {
+		return nil, errNoGPT
+	}
+	if hdr.EntrySize < 128 || hdr.NumEntries > 4096 {
+		return nil, errors.New("unsupported GPT entry layout")
+	}
+	if hdr.HeaderSize < uint32(binary.Size(hdr)) || hdr.HeaderSize > 512 {
+		return nil, fmt.Errorf("unsupported GPT header size %d", hdr.HeaderSize)
+	}
+	return &hdr, nil
+}
+
+// writeGPTHeader writes hdr at off with its checksum updated, keeping the
+// rest of the header as it is.
+func writeGPTHeader(st storage, off int64, hdr *gptHeader) error {
+	buf := make([]byte, hdr.HeaderSize)
+	if err := readFullAt(st, buf, off); err != nil {
+		return err
+	}
+	hdr.HeaderCrc32 = 0
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, hdr)
+	copy(buf, b.Bytes())
+	binary.LittleEndian.PutUint32(buf[16:], crc32.ChecksumIEEE(buf))
+	_, err := st.WriteAt(buf, off)
+	return err
+}
+
+// partitionTableRegions returns where the partition table of a disk of
+// the given size is kept: the MBR, and the headers and entries of both
+// copies of a GPT.
+func partitionTableRegions(r io.ReaderAt, size int64) ([]RegionDesc, error) {
+	sector := make([]byte, 512)
+	if err := readFullAt(r, sector, 0); err != nil {
+		return nil, err
+	}
+	entries := readMBR(sector)
+	if entries == nil {
+		return nil, errors.New("no partition table found")
+	}
+	regions := []RegionDesc{{"MBR", 0, 512}}
+
+	gpt := false
+	for _, e := range entries {
+		gpt = gpt || e.Type == mbrProtective
+	}
+	if !gpt {
+		return regions, nil
+	}
+
+	for _, ss := range []int64{512, 4096} {
+		hdr, err := readGPTHeader(r, ss)
+		if err != nil {
+			continue
+		}
+		tableSize := roundUp(int64(hdr.NumEntries)*int64(hdr.EntrySize), ss)
+		regions = append(regions,
+			RegionDesc{"primary GPT header", ss, ss},
+			RegionDesc{"primary GPT entries", int64(hdr.EntriesLBA) * ss, tableSize})
+
+		// the backup is normally at the end, where it is looked for if
+		// the primary does not point at a valid one
+		backup := int64(hdr.BackupLBA) * ss
+		backupTable := backup - tableSize
+		if b, err := readGPTHeader(r, backup); err == nil {
+			backupTable = int64(b.EntriesLBA) * ss
+		} else if size >= 0 {
+			backup = size - ss
+			backupTable = backup - tableSize
+		}
+		return append(regions,
+			RegionDesc{"backup GPT entries", backupTable, tableSize},
+			RegionDesc{"backup GPT header", backup, ss}), nil
+	}
+	return nil, errors.New("invalid GPT header")
+}
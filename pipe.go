@@ -0,0 +1,81 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// pipeKeep is how much already-read data is kept around so that parsers
+// can go back a little, e.g. to re-read a header they just peeked at.
+const pipeKeep = 64 * 1024
+
+// pipeImage presents a forward-only stream as a read-only Image. Only a
+// small window behind the furthest read is buffered; reading further
+// ahead discards data, and reading back beyond the window is an error.
+type pipeImage struct {
+	mu       sync.Mutex
+	r        io.Reader
+	buf      []byte
+	bufStart int64 // stream offset of buf[0]
+	eof      bool
+}
+
+func newPipeImage(r io.Reader) *pipeImage {
+	return &pipeImage{r: r}
+}
+
+func (p *pipeImage) ReadAt(b []byte, off int64) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if off < p.bufStart {
+		return 0, fmt.Errorf("cannot seek back to offset 0x%x on a pipe", off)
+	}
+
+	// skip forward without keeping anything
+	if end := p.bufStart + int64(len(p.buf)); off > end {
+		n, err := io.CopyN(io.Discard, p.r, off-end)
+		p.buf = p.buf[:0]
+		p.bufStart = end + n
+		if err != nil {
+			p.eof = true
+			return 0, io.EOF
+		}
+	}
+
+	// fill the buffer up to what is requested
+	want := off - p.bufStart + int64(len(b))
+	for int64(len(p.buf)) < want && !p.eof {
+		chunk := make([]byte, want-int64(len(p.buf)))
+		n, err := io.ReadFull(p.r, chunk)
+		p.buf = append(p.buf, chunk[:n]...)
+		if err != nil {
+			p.eof = true
+		}
+	}
+
+	n := 0
+	if start := off - p.bufStart; start < int64(len(p.buf)) {
+		n = copy(b, p.buf[start:])
+	}
+
+	// trim data that is too far behind
+	if drop := off + int64(n) - p.bufStart - pipeKeep; drop > 0 {
+		p.buf = append(p.buf[:0], p.buf[drop:]...)
+		p.bufStart += drop
+	}
+
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (p *pipeImage) WriteAt(b []byte, off int64) (int, error) { return 0, errReadOnly }
+
+func (p *pipeImage) Close() error { return nil }
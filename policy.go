@@ -0,0 +1,115 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// A policy lists conditions that must hold before anything is written,
+// so that an organization can make sure every wipe follows its rules.
+type wipePolicy struct {
+	RequireEscrow           bool     `json:"require_escrow"`
+	RequireAllMetadataValid bool     `json:"require_all_metadata_valid"`
+	ForbidClearKey          bool     `json:"forbid_clear_key"`
+	RequireVerification     bool     `json:"require_verification"`
+	RequireReport           bool     `json:"require_report"`
+	RequireDurableWrites    bool     `json:"require_durable_writes"`
+	RequireFields           []string `json:"require_fields"` // asset_tag, operator, work_order
+	RequireRNG              string   `json:"require_rng"`    // as given to -rng
+}
+
+// policyFacts is what a policy is checked against.
+type policyFacts struct {
+	escrowChecked bool
+	escrowed      bool
+	validCopies   int
+	copies        int
+	clearKey      bool
+	verifiable    bool // the wipe can be checked afterwards
+}
+
+func loadPolicy(path string) (*wipePolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var p wipePolicy
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %v", path, err)
+	}
+	for _, name := range p.RequireFields {
+		if name != "asset_tag" && name != "operator" && name != "work_order" {
+			return nil, fmt.Errorf("invalid policy %s: unknown field %q in require_fields", path, name)
+		}
+	}
+	if p.RequireRNG != "" && !validRNG(p.RequireRNG) {
+		return nil, fmt.Errorf("invalid policy %s: unknown random source %q in require_rng", path, p.RequireRNG)
+	}
+	return &p, nil
+}
+
+// checkRun returns the violations that can be found before the target is
+// looked at.
+func (p *wipePolicy) checkRun(rec *recordInfo, reportPath string) []string {
+	var v []string
+	if p.RequireReport && reportPath == "" {
+		v = append(v, "a report must be written with -report")
+	}
+	if p.RequireDurableWrites && !(durability.syncRegions && durability.flushCache) {
+		v = append(v, "writes must be made durable with -fsync and -flush-cache")
+	}
+	if p.RequireRNG != "" && rngName != p.RequireRNG {
+		v = append(v, fmt.Sprintf("the random data must come from -rng %s", p.RequireRNG))
+	}
+	values := map[string]string{"asset_tag": rec.AssetTag, "operator": rec.Operator, "work_order": rec.WorkOrder}
+	for _, name := range p.RequireFields {
+		if values[name] == "" {
+			v = append(v, fmt.Sprintf("the %s must be recorded", name))
+		}
+	}
+	return v
+}
+
+// checkVolume returns the violations of the volume about to be wiped.
+func (p *wipePolicy) checkVolume(facts policyFacts) []string {
+	var v []string
+	if p.RequireEscrow && !facts.escrowChecked {
+		v = append(v, "recovery key escrow must be checked with -escrow")
+	} else if p.RequireEscrow && !facts.escrowed {
+		v = append(v, "all recovery passwords must be escrowed")
+	}
+	if p.RequireAllMetadataValid && facts.validCopies < facts.copies {
+		v = append(v, fmt.Sprintf("all metadata blocks must be valid, only %d of %d are", facts.validCopies, facts.copies))
+	}
+	if p.ForbidClearKey && facts.clearKey {
+		v = append(v, "protection must not be suspended (clear key present)")
+	}
+	if p.RequireVerification && !facts.verifiable {
+		v = append(v, "the wipe must be verifiable, which needs random access to the target")
+	}
+	return v
+}
+
+// enforcePolicy lists the violations and refuses to go on if there are
+// any.
+func enforcePolicy(violations []string) {
+	if len(violations) == 0 {
+		return
+	}
+	for _, v := range violations {
+		fmt.Printf("%s %s\n", warning("policy violation:"), v)
+		if activeReport != nil {
+			activeReport.Step("policy", "skip", v)
+		}
+	}
+	fatal("refusing to wipe, %d policy violation(s)", len(violations))
+}
@@ -0,0 +1,34 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Opening a drive takes root or administrator rights, but reading the
+// structures on it does not. With -drop-privileges, they are given up as
+// soon as the target is open, so that a bug in parsing a hostile disk
+// cannot be used to take over the machine.
+
+var dropPrivs bool
+
+func addPrivilegeFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&dropPrivs, "drop-privileges", false, "give up root or administrator rights once the target is open")
+}
+
+// giveUpPrivileges drops the privileges of the process if -drop-privileges
+// was given, and stops if that fails.
+func giveUpPrivileges() {
+	if !dropPrivs {
+		return
+	}
+	what, err := dropPrivileges()
+	if err != nil {
+		fatal("can't drop privileges: %v", err)
+	}
+	fmt.Printf("%s\n", what)
+}
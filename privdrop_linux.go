@@ -0,0 +1,33 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const _LINUX_CAPABILITY_VERSION_3 = 0x20080522
+
+// clearCapabilities gives up the capabilities that a binary without root
+// can be granted with setcap, on every thread. It reports whether there
+// were any.
+func clearCapabilities() (bool, error) {
+	status, err := os.ReadFile("/proc/self/status")
+	if err == nil && strings.Contains(string(status), "\nCapPrm:\t0000000000000000\n") {
+		return false, nil
+	}
+	hdr := struct{ version, pid uint32 }{_LINUX_CAPABILITY_VERSION_3, 0}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data)), 0)
+	if errno != 0 {
+		return false, fmt.Errorf("capset: %v", errno)
+	}
+	return true, nil
+}
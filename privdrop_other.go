@@ -0,0 +1,9 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+//go:build !linux && !windows
+
+package main
+
+func clearCapabilities() (bool, error) { return false, nil }
@@ -0,0 +1,69 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// unprivilegedIDs picks the user to become: the one who ran sudo, the real
+// user of a setuid binary, or else nobody.
+func unprivilegedIDs() (uid, gid int) {
+	uid, errU := strconv.Atoi(os.Getenv("SUDO_UID"))
+	gid, errG := strconv.Atoi(os.Getenv("SUDO_GID"))
+	if errU == nil && errG == nil && uid != 0 {
+		return uid, gid
+	}
+	if os.Getuid() != 0 {
+		return os.Getuid(), os.Getgid()
+	}
+	uid, gid = 65534, 65534
+	if u, err := user.Lookup("nobody"); err == nil {
+		if n, err := strconv.Atoi(u.Uid); err == nil {
+			uid = n
+		}
+		if n, err := strconv.Atoi(u.Gid); err == nil {
+			gid = n
+		}
+	}
+	return uid, gid
+}
+
+// dropPrivileges switches every thread of the process to an unprivileged
+// user, which also clears its capabilities.
+func dropPrivileges() (string, error) {
+	if os.Geteuid() != 0 {
+		cleared, err := clearCapabilities()
+		switch {
+		case err != nil:
+			return "", err
+		case cleared:
+			return "dropped the capabilities of the process", nil
+		}
+		return "not running as root, no privileges to drop", nil
+	}
+
+	uid, gid := unprivilegedIDs()
+	if err := syscall.Setgroups(nil); err != nil {
+		return "", fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return "", fmt.Errorf("setgid: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return "", fmt.Errorf("setuid: %v", err)
+	}
+	if syscall.Setuid(0) == nil {
+		return "", errors.New("root privileges could be regained")
+	}
+	return fmt.Sprintf("dropped root privileges, running as uid %d gid %d", uid, gid), nil
+}
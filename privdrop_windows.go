@@ -0,0 +1,77 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const _SE_PRIVILEGE_REMOVED = 0x00000004
+
+var (
+	procAdjustTokenPrivileges = advapi32.NewProc("AdjustTokenPrivileges")
+	procLookupPrivilegeValue  = advapi32.NewProc("LookupPrivilegeValueW")
+)
+
+type luidAndAttributes struct {
+	LowPart    uint32
+	HighPart   int32
+	Attributes uint32
+}
+
+// dropPrivileges removes every privilege from the token of the process for
+// good, except the one to traverse directories, which opening files needs.
+// Membership of Administrators can't be given up, but without privileges
+// such as SeBackupPrivilege and SeDebugPrivilege it is worth much less.
+func dropPrivileges() (string, error) {
+	proc, _ := syscall.GetCurrentProcess()
+	var token syscall.Token
+	if err := syscall.OpenProcessToken(proc, syscall.TOKEN_ADJUST_PRIVILEGES|syscall.TOKEN_QUERY, &token); err != nil {
+		return "", os.NewSyscallError("OpenProcessToken", err)
+	}
+	defer token.Close()
+
+	var n uint32
+	syscall.GetTokenInformation(token, syscall.TokenPrivileges, nil, 0, &n)
+	if n < 4 {
+		return "", fmt.Errorf("GetTokenInformation: unexpected size %d", n)
+	}
+	buf := make([]byte, n)
+	if err := syscall.GetTokenInformation(token, syscall.TokenPrivileges, &buf[0], n, &n); err != nil {
+		return "", os.NewSyscallError("GetTokenInformation", err)
+	}
+
+	var traverse luidAndAttributes
+	name, _ := syscall.UTF16PtrFromString("SeChangeNotifyPrivilege")
+	procLookupPrivilegeValue.Call(0, uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&traverse)))
+
+	// TOKEN_PRIVILEGES: a count, then the LUID and attributes of each
+	count := *(*uint32)(unsafe.Pointer(&buf[0]))
+	size := unsafe.Sizeof(luidAndAttributes{})
+	if uintptr(count)*size+4 > uintptr(len(buf)) {
+		return "", fmt.Errorf("GetTokenInformation: %d privileges don't fit in %d bytes", count, len(buf))
+	}
+	removed := uint32(0)
+	for i := uintptr(0); i < uintptr(count); i++ {
+		p := (*luidAndAttributes)(unsafe.Pointer(&buf[4+i*size]))
+		if p.LowPart == traverse.LowPart && p.HighPart == traverse.HighPart {
+			continue
+		}
+		p.Attributes = _SE_PRIVILEGE_REMOVED
+		removed++
+	}
+	if removed == 0 {
+		return "no privileges to drop", nil
+	}
+
+	r, _, err := procAdjustTokenPrivileges.Call(uintptr(token), 0, uintptr(unsafe.Pointer(&buf[0])), 0, 0, 0)
+	if r == 0 {
+		return "", os.NewSyscallError("AdjustTokenPrivileges", err)
+	}
+	return fmt.Sprintf("removed %d privileges from the process token", removed), nil
+}
@@ -0,0 +1,285 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The probe command prints what is on a device as blkid does, with
+// TYPE, UUID and VERSION tags, so scripts written for blkid output can use
+// it. For BitLocker volumes it adds what blkid doesn't know, in tags
+// starting with BITLOCKER_.
+
+type probeTag struct {
+	name, value string
+}
+
+// blkidTypes maps the names from probeFilesystem to the TYPE blkid uses.
+var blkidTypes = map[string]string{
+	"NTFS":     "ntfs",
+	"exFAT":    "exfat",
+	"FAT12":    "vfat",
+	"FAT16":    "vfat",
+	"FAT32":    "vfat",
+	"XFS":      "xfs",
+	"ReFS":     "ReFS",
+	"APFS":     "apfs",
+	"LVM":      "LVM2_member",
+	"HFS+":     "hfsplus",
+	"swap":     "swap",
+	"ISO 9660": "iso9660",
+	"Btrfs":    "btrfs",
+}
+
+// blkidUsages are the USAGE of the encrypted and raid types, the others
+// are filesystems.
+var blkidUsages = map[string]string{
+	"BitLocker":   "crypto",
+	"crypto_LUKS": "crypto",
+	"LVM2_member": "raid",
+	"swap":        "other",
+}
+
+// probeTags identifies the volume or partition table at the start of r.
+func probeTags(r io.ReaderAt) []probeTag {
+	var tags []probeTag
+	switch fs := probeFilesystem(r, 0); fs {
+	case "BitLocker":
+		tags = bitlockerTags(r)
+	case "LUKS":
+		tags = luksTags(r)
+	case "ext2/3/4":
+		tags = []probeTag{{"TYPE", extType(r)}}
+	case "":
+		if vf, _ := findFormat(r, 0, ""); vf != nil {
+			tags = []probeTag{{"TYPE", vf.name}}
+		} else {
+			return partitionTableTags(r)
+		}
+	default:
+		if t, ok := blkidTypes[fs]; ok {
+			tags = []probeTag{{"TYPE", t}}
+		}
+		if strings.HasPrefix(fs, "FAT") {
+			tags = append([]probeTag{{"VERSION", fs}}, tags...)
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+
+	usage := "filesystem"
+	for _, t := range tags {
+		if u, ok := blkidUsages[t.value]; ok && t.name == "TYPE" {
+			usage = u
+		}
+	}
+	return append(tags, probeTag{"USAGE", usage})
+}
+
+func bitlockerTags(r io.ReaderAt) []probeTag {
+	hdr, err := readHeader(r, 0)
+	if err != nil {
+		return []probeTag{{"TYPE", "BitLocker"}}
+	}
+
+	var first []byte
+	valid := 0
+	for _, off := range hdr.InfoOffsets {
+		var info InfoStruct
+		raw, _, err := info.ReadRaw(r, int64(off))
+		if err != nil {
+			continue
+		}
+		if first == nil {
+			first = raw
+		} else {
+			zeroize(raw)
+		}
+		valid++
+	}
+	if first == nil {
+		return []probeTag{{"BLOCK_SIZE", strconv.Itoa(int(hdr.SectorSize))}, {"TYPE", "BitLocker"}}
+	}
+	defer zeroize(first)
+
+	info, mh := parseMetadataBlock(first)
+	tags := []probeTag{
+		{"UUID", strings.ToLower(mh.VolumeGuid.String())},
+		{"VERSION", strconv.Itoa(int(info.Version))},
+		{"BLOCK_SIZE", strconv.Itoa(int(hdr.SectorSize))},
+		{"TYPE", "BitLocker"},
+		{"BITLOCKER_METADATA_VALID", fmt.Sprintf("%d/%d", valid, len(hdr.InfoOffsets))},
+	}
+	if desc := description(first); desc != "" {
+		tags = append(tags, probeTag{"BITLOCKER_DESCRIPTION", desc})
+	}
+	ps := protectors(first)
+	var names []string
+	for _, p := range ps {
+		names = append(names, p.TypeName())
+	}
+	tags = append(tags, probeTag{"BITLOCKER_PROTECTORS", strings.Join(names, ",")})
+	if isSuspended(ps) {
+		tags = append(tags, probeTag{"BITLOCKER_SUSPENDED", "1"})
+	}
+	return tags
+}
+
+func luksTags(r io.ReaderAt) []probeTag {
+	buf := make([]byte, luks2BinaryHdrSize)
+	if err := readFullAt(r, buf, 0); err != nil {
+		return []probeTag{{"TYPE", "crypto_LUKS"}}
+	}
+	var tags []probeTag
+	switch v := binary.BigEndian.Uint16(buf[6:]); v {
+	case 1:
+		var hdr luks1Header
+		binary.Read(bytes.NewReader(buf), binary.BigEndian, &hdr)
+		tags = append(tags, probeTag{"UUID", cString(hdr.Uuid[:])})
+	case 2:
+		var hdr luks2Header
+		binary.Read(bytes.NewReader(buf), binary.BigEndian, &hdr)
+		if label := cString(hdr.Label[:]); label != "" {
+			tags = append(tags, probeTag{"LABEL", label})
+		}
+		tags = append(tags, probeTag{"UUID", cString(hdr.Uuid[:])})
+	}
+	return append(tags,
+		probeTag{"VERSION", strconv.Itoa(int(binary.BigEndian.Uint16(buf[6:])))},
+		probeTag{"TYPE", "crypto_LUKS"})
+}
+
+// extType tells ext2, ext3 and ext4 apart by their feature flags.
+func extType(r io.ReaderAt) string {
+	sb := make([]byte, 1024)
+	if err := readFullAt(r, sb, 1024); err != nil {
+		return "ext2"
+	}
+	compat := binary.LittleEndian.Uint32(sb[0x5c:])
+	incompat := binary.LittleEndian.Uint32(sb[0x60:])
+	switch {
+	case incompat&^0x16 != 0: // anything beyond filetype, recover and journal_dev
+		return "ext4"
+	case compat&0x4 != 0: // has_journal
+		return "ext3"
+	}
+	return "ext2"
+}
+
+func partitionTableTags(r io.ReaderAt) []probeTag {
+	sector := make([]byte, 512)
+	if err := readFullAt(r, sector, 0); err != nil {
+		return nil
+	}
+	entries := readMBR(sector)
+	if entries == nil {
+		return nil
+	}
+	if isProtective(entries) {
+		for _, ss := range []int64{512, 4096} {
+			if hdr, err := readGPTHeader(r, ss); err == nil {
+				return []probeTag{{"PTUUID", strings.ToLower(hdr.DiskGuid.String())}, {"PTTYPE", "gpt"}}
+			}
+		}
+		return nil
+	}
+	return []probeTag{{"PTUUID", fmt.Sprintf("%08x", binary.LittleEndian.Uint32(sector[440:]))}, {"PTTYPE", "dos"}}
+}
+
+// blkidQuote quotes a value for the full output, as blkid does.
+func blkidQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// blkidEscape escapes a value for the export output, so that it can be
+// used by a shell.
+func blkidEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("+,-./:=@_", c)) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func cmdProbe(args []string) {
+	fs := newFlagSet("probe", "<device>...")
+	output := fs.String("o", "full", "output format: full, export or value")
+	only := fs.String("s", "", "show only these tags, comma-separated")
+	parseFlags(fs, args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	switch *output {
+	case "full", "export", "value":
+	default:
+		fatal("-o must be full, export or value")
+	}
+
+	found := 0
+	for _, path := range fs.Args() {
+		f, err := openTarget(path, false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			continue
+		}
+		tags := probeTags(f)
+		f.Close()
+
+		if *only != "" {
+			var kept []probeTag
+			for _, t := range tags {
+				for _, name := range strings.Split(*only, ",") {
+					if t.name == name {
+						kept = append(kept, t)
+					}
+				}
+			}
+			tags = kept
+		}
+		if len(tags) == 0 {
+			continue
+		}
+		found++
+
+		switch *output {
+		case "full":
+			fmt.Printf("%s:", path)
+			for _, t := range tags {
+				fmt.Printf(" %s=%s", t.name, blkidQuote(t.value))
+			}
+			fmt.Printf("\n")
+		case "export":
+			if found > 1 {
+				fmt.Printf("\n")
+			}
+			fmt.Printf("DEVNAME=%s\n", blkidEscape(path))
+			for _, t := range tags {
+				fmt.Printf("%s=%s\n", t.name, blkidEscape(t.value))
+			}
+		case "value":
+			for _, t := range tags {
+				fmt.Printf("%s\n", t.value)
+			}
+		}
+	}
+
+	// like blkid, nothing identified is exit status 2
+	if found == 0 {
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+)
+
+// Progress events for programs that wrap blwipe, written as one JSON
+// object per line to a descriptor of their choosing, so that they never
+// have to parse the human-oriented output.
+
+type progressEvent struct {
+	Phase   string  `json:"phase"`
+	Region  string  `json:"region,omitempty"`
+	Offset  int64   `json:"offset"`
+	Bytes   int64   `json:"bytes"`
+	Done    int64   `json:"done"`
+	Total   int64   `json:"total"`
+	Percent float64 `json:"percent"`
+	Error   string  `json:"error,omitempty"`
+	Message string  `json:"message,omitempty"`
+}
+
+// progressOut receives the events, if -progress-fd was given.
+var progressOut *json.Encoder
+
+// progressFlag adds the -progress-fd flag to fs.
+func progressFlag(fs *flag.FlagSet) *int {
+	return fs.Int("progress-fd", -1, "write progress events as JSON lines to this file descriptor")
+}
+
+// openProgress starts sending events to descriptor fd, which on Windows
+// is a handle inherited from the parent.
+func openProgress(fd int) {
+	if fd < 0 {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "progress")
+	if f == nil {
+		fatal("invalid progress descriptor %d", fd)
+	}
+	if _, err := f.Stat(); err != nil {
+		fatal("progress descriptor %d is not open: %v", fd, err)
+	}
+	progressOut = json.NewEncoder(f)
+}
+
+// progress sends ev, filling in the percentage.
+func progress(ev progressEvent) {
+	if progressOut == nil {
+		return
+	}
+	if ev.Total > 0 {
+		ev.Percent = float64(ev.Done*1000/ev.Total) / 10
+	}
+	// a reader that went away must not stop the wipe
+	progressOut.Encode(&ev)
+}
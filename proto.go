@@ -0,0 +1,304 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Encoding of the messages in blwipe.proto, for -output proto and the
+// gRPC interface of the daemon. Only what those messages need is
+// supported, and fields with their default value are left out as in
+// proto3.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+type protoMessage struct {
+	b []byte
+}
+
+func (m *protoMessage) tag(field, wire int) {
+	m.b = appendVarint(m.b, uint64(field)<<3|uint64(wire))
+}
+
+func (m *protoMessage) uint(field int, v uint64) {
+	if v != 0 {
+		m.tag(field, wireVarint)
+		m.b = appendVarint(m.b, v)
+	}
+}
+
+func (m *protoMessage) int(field int, v int64) { m.uint(field, uint64(v)) }
+
+func (m *protoMessage) bool(field int, v bool) {
+	if v {
+		m.uint(field, 1)
+	}
+}
+
+func (m *protoMessage) double(field int, v float64) {
+	if v != 0 {
+		m.tag(field, wireFixed64)
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+		m.b = append(m.b, buf[:]...)
+	}
+}
+
+func (m *protoMessage) bytes(field int, b []byte) {
+	m.tag(field, wireBytes)
+	m.b = appendVarint(m.b, uint64(len(b)))
+	m.b = append(m.b, b...)
+}
+
+func (m *protoMessage) string(field int, s string) {
+	if s != "" {
+		m.bytes(field, []byte(s))
+	}
+}
+
+// message adds an embedded message, which is kept even if it is empty.
+func (m *protoMessage) message(field int, sub *protoMessage) {
+	m.bytes(field, sub.b)
+}
+
+// packed adds a repeated integer field, packed as proto3 does by default.
+func (m *protoMessage) packed(field int, vs []uint64) {
+	if len(vs) == 0 {
+		return
+	}
+	var p []byte
+	for _, v := range vs {
+		p = appendVarint(p, v)
+	}
+	m.bytes(field, p)
+}
+
+// time adds a google.protobuf.Timestamp.
+func (m *protoMessage) time(field int, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	var ts protoMessage
+	ts.int(1, t.Unix())
+	ts.int(2, int64(t.Nanosecond()))
+	m.message(field, &ts)
+}
+
+// writeDelimited writes m preceded by its length.
+func writeDelimited(w io.Writer, m *protoMessage) error {
+	_, err := w.Write(append(appendVarint(nil, uint64(len(m.b))), m.b...))
+	return err
+}
+
+func (d *infoDocument) proto() *protoMessage {
+	m := &protoMessage{}
+	m.uint(1, uint64(d.SchemaVersion))
+	m.string(2, d.Target)
+	m.int(3, d.Offset)
+	m.string(4, d.Format)
+	m.string(5, d.Description)
+	if h := d.Header; h != nil {
+		var hm protoMessage
+		hm.int(1, h.SectorSize)
+		hm.uint(2, h.Sectors)
+		hm.packed(3, h.MetadataOffsets)
+		hm.packed(4, h.EOWOffsets)
+		m.message(6, &hm)
+	}
+	for _, b := range d.MetadataBlocks {
+		var bm protoMessage
+		bm.int(1, int64(b.Index))
+		bm.int(2, b.Offset)
+		bm.int(3, b.Size)
+		bm.bool(4, b.Valid)
+		bm.int(5, int64(b.Version))
+		bm.string(6, b.Error)
+		m.message(7, &bm)
+	}
+	if v := d.Volume; v != nil {
+		var vm protoMessage
+		vm.string(1, v.GUID)
+		vm.int(2, v.Size)
+		vm.string(3, v.EncryptionMethod)
+		vm.time(4, v.Created)
+		vm.bool(5, v.Suspended)
+		vm.bool(6, v.Truncated)
+		vm.string(7, v.CreatedBy)
+		m.message(8, &vm)
+	}
+	for _, p := range d.Protectors {
+		var pm protoMessage
+		pm.string(1, p.ID)
+		pm.string(2, p.Type)
+		pm.time(3, p.LastModified)
+		m.message(9, &pm)
+	}
+	for _, r := range d.Regions {
+		var rm protoMessage
+		rm.string(1, r.Name)
+		rm.int(2, r.Offset)
+		rm.int(3, r.Size)
+		m.message(10, &rm)
+	}
+	return m
+}
+
+func stepProto(s *reportStep) *protoMessage {
+	m := &protoMessage{}
+	m.string(1, s.Name)
+	m.string(2, s.Decision)
+	m.string(3, s.Reason)
+	m.string(4, s.Result)
+	return m
+}
+
+func (r *Report) proto() *protoMessage {
+	m := &protoMessage{}
+	m.string(1, r.ID)
+	m.string(2, r.Command)
+	m.string(3, r.Target)
+	m.string(4, r.Host)
+	m.time(5, r.Started)
+	if r.Finished != nil {
+		m.time(6, *r.Finished)
+	}
+	if d := r.Device; d != nil {
+		var dm protoMessage
+		dm.string(1, d.Name)
+		dm.string(2, d.Model)
+		dm.bool(3, d.Partition)
+		dm.string(4, d.Transport)
+		dm.bool(5, d.Rotational)
+		dm.bool(6, d.Discard)
+		dm.bool(7, d.Opal)
+		dm.bool(8, d.Locking)
+		m.message(7, &dm)
+	}
+	for _, s := range r.Steps {
+		m.message(8, stepProto(s))
+	}
+	for _, v := range r.Volumes {
+		var vm protoMessage
+		vm.int(1, v.Offset)
+		for _, s := range v.Steps {
+			vm.message(2, stepProto(s))
+		}
+		vm.string(3, v.Result)
+		vm.string(4, v.CreatedBy)
+		m.message(9, &vm)
+	}
+	m.string(10, r.Result)
+	m.string(11, r.Error)
+	var bad []uint64
+	for _, lba := range r.BadSectors {
+		bad = append(bad, uint64(lba))
+	}
+	m.packed(12, bad)
+	m.string(13, r.AssetTag)
+	m.string(14, r.Operator)
+	m.string(15, r.WorkOrder)
+	m.string(16, r.CreatedBy)
+	if st := r.Stats; st != nil {
+		var sm protoMessage
+		sm.int(1, st.BytesWritten)
+		sm.double(2, st.WriteSeconds)
+		sm.double(3, st.BytesPerSec)
+		sm.int(4, int64(st.Retries))
+		sm.double(5, st.VerifySeconds)
+		for _, r := range st.Regions {
+			var rm protoMessage
+			rm.string(1, r.Name)
+			rm.int(2, r.Offset)
+			rm.int(3, r.Size)
+			rm.double(4, r.Seconds)
+			rm.int(5, int64(r.Retries))
+			sm.message(6, &rm)
+		}
+		m.message(17, &sm)
+	}
+	if id := r.Identity; id != nil {
+		var im protoMessage
+		im.string(1, id.ByID)
+		im.string(2, id.Instance)
+		im.string(3, id.WWN)
+		im.string(4, id.Serial)
+		m.message(18, &im)
+	}
+	m.string(19, r.RNG)
+	return m
+}
+
+// protoField is a field of an encoded message: the value of a varint or
+// fixed-size field in v, or the contents of a length-delimited one in b.
+type protoField struct {
+	num  int
+	wire int
+	v    uint64
+	b    []byte
+}
+
+const wireFixed32 = 5
+
+var errProtoTruncated = errors.New("truncated protobuf message")
+
+// decodeProto calls fn with each field of the message in b, in order.
+func decodeProto(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		b = b[n:]
+		f := protoField{num: int(key >> 3), wire: int(key & 7)}
+		if f.num == 0 || key>>3 > math.MaxInt32 {
+			return fmt.Errorf("invalid protobuf field number %d", key>>3)
+		}
+
+		switch f.wire {
+		case wireVarint:
+			if f.v, n = binary.Uvarint(b); n <= 0 {
+				return errProtoTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errProtoTruncated
+			}
+			f.v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errProtoTruncated
+			}
+			f.v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errProtoTruncated
+			}
+			f.b, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", f.wire)
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// QEMU copy-on-write (qcow2) image support, read-only. Clusters are found
+// through a two-level table; unallocated and zero clusters read as zeros,
+// and compressed clusters are inflated. All structures are big-endian.
+
+const (
+	qcow2Magic = "QFI\xfb"
+
+	qcow2OffsetMask     = 0x00fffffffffffe00
+	qcow2Compressed     = 1 << 62
+	qcow2ZeroCluster    = 1
+	qcow2DirtyFlag      = 1 << 0
+	qcow2CorruptFlag    = 1 << 1
+	qcow2CompressionBit = 1 << 3
+)
+
+type qcow2Header struct {
+	Magic                 [4]byte
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+
+	// version 3 only
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+	CompressionType      uint8
+}
+
+type qcow2Disk struct {
+	f           io.ReaderAt
+	size        int64
+	clusterBits uint
+	l1          []uint64
+
+	// the L2 table last looked at, as scans go through them in order
+	l2Offset uint64
+	l2       []uint64
+}
+
+func isQCOW2(f io.ReaderAt) bool {
+	magic := make([]byte, 4)
+	return readFullAt(f, magic, 0) == nil && string(magic) == qcow2Magic
+}
+
+func openQCOW2(f io.ReaderAt, fileSize int64) (*qcow2Disk, error) {
+	var hdr qcow2Header
+	if err := binary.Read(io.NewSectionReader(f, 0, int64(binary.Size(hdr))), binary.BigEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("qcow2: can't read header: %v", err)
+	}
+
+	switch {
+	case hdr.Version != 2 && hdr.Version != 3:
+		return nil, fmt.Errorf("qcow2: unsupported version %d", hdr.Version)
+	case hdr.ClusterBits < 9 || hdr.ClusterBits > 21:
+		return nil, fmt.Errorf("qcow2: invalid cluster size 2^%d", hdr.ClusterBits)
+	case hdr.CryptMethod != 0:
+		return nil, errors.New("qcow2: encrypted images are not supported")
+	case hdr.BackingFileOffset != 0:
+		return nil, errors.New("qcow2: images with a backing file are not supported")
+	case hdr.Size > 1<<62:
+		return nil, fmt.Errorf("qcow2: invalid size %d", hdr.Size)
+	}
+	if hdr.Version == 3 {
+		if hdr.IncompatibleFeatures&^(qcow2DirtyFlag|qcow2CorruptFlag|qcow2CompressionBit) != 0 {
+			return nil, fmt.Errorf("qcow2: unsupported features 0x%x", hdr.IncompatibleFeatures)
+		}
+		if hdr.IncompatibleFeatures&qcow2CompressionBit != 0 && hdr.HeaderLength > 104 && hdr.CompressionType != 0 {
+			return nil, errors.New("qcow2: only deflate compression is supported")
+		}
+	}
+
+	d := &qcow2Disk{f: f, size: int64(hdr.Size), clusterBits: uint(hdr.ClusterBits)}
+	entries := (d.size + d.clusterSize()*d.clusterSize()/8 - 1) / (d.clusterSize() * d.clusterSize() / 8)
+	if int64(hdr.L1Size) < entries || hdr.L1Size > 32<<20 {
+		return nil, fmt.Errorf("qcow2: invalid L1 table size %d", hdr.L1Size)
+	}
+	// it is read whole, so it has to be in the file
+	if hdr.L1TableOffset > uint64(fileSize) || 8*uint64(hdr.L1Size) > uint64(fileSize)-hdr.L1TableOffset {
+		return nil, fmt.Errorf("qcow2: L1 table at 0x%x of %d entries is past the end of the file",
+			hdr.L1TableOffset, hdr.L1Size)
+	}
+
+	buf := make([]byte, 8*int64(hdr.L1Size))
+	if err := readFullAt(f, buf, int64(hdr.L1TableOffset)); err != nil {
+		return nil, fmt.Errorf("qcow2: can't read L1 table: %v", err)
+	}
+	d.l1 = make([]uint64, hdr.L1Size)
+	for i := range d.l1 {
+		d.l1[i] = binary.BigEndian.Uint64(buf[8*i:])
+	}
+	return d, nil
+}
+
+func (d *qcow2Disk) clusterSize() int64 { return 1 << d.clusterBits }
+
+func (d *qcow2Disk) Size() int64 { return d.size }
+
+// l2Entry returns the L2 table entry of the cluster at off, or 0 if it is
+// not allocated.
+func (d *qcow2Disk) l2Entry(off int64) (uint64, error) {
+	perTable := d.clusterSize() / 8
+	cluster := off >> d.clusterBits
+	l2Offset := d.l1[cluster/perTable] & qcow2OffsetMask
+	if l2Offset == 0 {
+		return 0, nil
+	}
+	if l2Offset != d.l2Offset || d.l2 == nil {
+		buf := make([]byte, d.clusterSize())
+		if err := readFullAt(d.f, buf, int64(l2Offset)); err != nil {
+			return 0, fmt.Errorf("qcow2: can't read L2 table: %v", err)
+		}
+		d.l2 = make([]uint64, perTable)
+		for i := range d.l2 {
+			d.l2[i] = binary.BigEndian.Uint64(buf[8*i:])
+		}
+		d.l2Offset = l2Offset
+	}
+	return d.l2[cluster%perTable], nil
+}
+
+func (d *qcow2Disk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("qcow2: negative offset")
+	}
+
+	total := 0
+	for len(p) > 0 {
+		if off >= d.size {
+			return total, io.EOF
+		}
+
+		within := off & (d.clusterSize() - 1)
+		n := len(p)
+		if rem := d.clusterSize() - within; int64(n) > rem {
+			n = int(rem)
+		}
+		if rem := d.size - off; int64(n) > rem {
+			n = int(rem)
+		}
+		if err := d.readCluster(p[:n], off, within); err != nil {
+			return total, err
+		}
+
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
+
+// readCluster reads p from within a single cluster.
+func (d *qcow2Disk) readCluster(p []byte, off, within int64) error {
+	entry, err := d.l2Entry(off)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case entry&qcow2Compressed != 0:
+		// the offset and the number of extra 512-byte sectors it spans
+		bits := 62 - (d.clusterBits - 8)
+		host := int64(entry & (1<<bits - 1))
+		sectors := int64(entry>>bits) & (1<<(d.clusterBits-8) - 1)
+		compressed := make([]byte, (sectors+1)*512-host%512)
+		if _, err := d.f.ReadAt(compressed, host); err != nil && err != io.EOF {
+			return err
+		}
+		cluster := make([]byte, d.clusterSize())
+		if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(compressed)), cluster); err != nil {
+			return fmt.Errorf("qcow2: corrupt compressed cluster at 0x%x: %v", host, err)
+		}
+		copy(p, cluster[within:])
+	case entry&qcow2OffsetMask == 0 || entry&qcow2ZeroCluster != 0:
+		for i := range p {
+			p[i] = 0
+		}
+	default:
+		return readFullAt(d.f, p, int64(entry&qcow2OffsetMask)+within)
+	}
+	return nil
+}
+
+func (d *qcow2Disk) WriteAt(p []byte, off int64) (int, error) { return 0, errReadOnly }
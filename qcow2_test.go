@@ -0,0 +1,136 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// qcow2TestImage describes a qcow2 image of four 512-byte clusters: one
+// filled with 0x11, a zero cluster, an unallocated one, and one of 0x33
+// that is compressed. The L1 table is at 512, the L2 table at 1024, and
+// the data from 1536.
+type qcow2TestImage struct {
+	hdr      qcow2Header
+	fileSize int // to truncate to, if set
+}
+
+func newQCOW2TestImage() *qcow2TestImage {
+	im := &qcow2TestImage{hdr: qcow2Header{
+		Version:       2,
+		ClusterBits:   9,
+		Size:          4 * 512,
+		L1Size:        1,
+		L1TableOffset: 512,
+	}}
+	copy(im.hdr.Magic[:], qcow2Magic)
+	return im
+}
+
+func (im *qcow2TestImage) bytes() []byte {
+	b := make([]byte, 2048)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &im.hdr)
+	copy(b, buf.Bytes())
+
+	binary.BigEndian.PutUint64(b[512:], 1024)
+	binary.BigEndian.PutUint64(b[1024:], 1536)
+	binary.BigEndian.PutUint64(b[1024+8:], qcow2ZeroCluster)
+	binary.BigEndian.PutUint64(b[1024+24:], qcow2Compressed|2048)
+	copy(b[1536:], bytes.Repeat([]byte{0x11}, 512))
+
+	var z bytes.Buffer
+	w, _ := flate.NewWriter(&z, flate.BestCompression)
+	w.Write(bytes.Repeat([]byte{0x33}, 512))
+	w.Close()
+	b = append(b, z.Bytes()...)
+
+	if im.fileSize != 0 {
+		b = b[:im.fileSize]
+	}
+	return b
+}
+
+func openQCOW2TestImage(b []byte) (*qcow2Disk, error) {
+	return openQCOW2(&memDisk{data: b}, int64(len(b)))
+}
+
+func TestQCOW2(t *testing.T) {
+	d, err := openQCOW2TestImage(newQCOW2TestImage().bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != 2048 {
+		t.Errorf("size %d, want 2048", d.Size())
+	}
+	p := make([]byte, 2048)
+	if _, err := d.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := append(bytes.Repeat([]byte{0x11}, 512), make([]byte, 1024)...)
+	want = append(want, bytes.Repeat([]byte{0x33}, 512)...)
+	if !bytes.Equal(p, want) {
+		t.Errorf("reads back as %x", p)
+	}
+	if n, err := d.ReadAt(p[:2], 2047); n != 1 || err == nil {
+		t.Errorf("read past the end: %d, %v, want 1 and an error", n, err)
+	}
+	if _, err := d.WriteAt(p[:1], 0); err != errReadOnly {
+		t.Errorf("write: %v, want %v", err, errReadOnly)
+	}
+}
+
+func TestQCOW2Malformed(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*qcow2TestImage)
+		want string
+	}{
+		{"version", func(im *qcow2TestImage) { im.hdr.Version = 4 }, "unsupported version"},
+		{"small clusters", func(im *qcow2TestImage) { im.hdr.ClusterBits = 8 }, "invalid cluster size"},
+		{"huge clusters", func(im *qcow2TestImage) { im.hdr.ClusterBits = 63 }, "invalid cluster size"},
+		{"encrypted", func(im *qcow2TestImage) { im.hdr.CryptMethod = 1 }, "encrypted"},
+		{"backing file", func(im *qcow2TestImage) { im.hdr.BackingFileOffset = 1024 }, "backing file"},
+		{"negative size", func(im *qcow2TestImage) { im.hdr.Size = 1 << 63 }, "invalid size"},
+		{"v3 features", func(im *qcow2TestImage) {
+			im.hdr.Version = 3
+			im.hdr.IncompatibleFeatures = 1 << 4
+		}, "unsupported features"},
+		{"L1 too small", func(im *qcow2TestImage) { im.hdr.Size = 1 << 30 }, "invalid L1 table size"},
+		{"oversized L1", func(im *qcow2TestImage) { im.hdr.L1Size = 0xffffffff }, "invalid L1 table size"},
+		{"L1 past the end", func(im *qcow2TestImage) { im.hdr.L1Size = 1 << 20 }, "past the end"},
+		{"L1 offset past the end", func(im *qcow2TestImage) { im.hdr.L1TableOffset = 1 << 62 }, "past the end"},
+		{"truncated", func(im *qcow2TestImage) { im.fileSize = 515 }, "past the end"},
+		{"truncated header", func(im *qcow2TestImage) { im.fileSize = 50 }, "can't read header"},
+	}
+	for _, tt := range tests {
+		im := newQCOW2TestImage()
+		tt.edit(im)
+		d, err := openQCOW2TestImage(im.bytes())
+		if err == nil {
+			t.Errorf("%s: opened, size %d", tt.name, d.Size())
+		} else if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want an error about %q", tt.name, err, tt.want)
+		}
+	}
+
+	// a corrupt compressed cluster is an error when it's read
+	b := newQCOW2TestImage().bytes()
+	for i := 2048; i < len(b); i++ {
+		b[i] = 0xff
+	}
+	d, err := openQCOW2TestImage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 512)
+	if _, err := d.ReadAt(p, 1536); err == nil || !strings.Contains(err.Error(), "corrupt compressed cluster") {
+		t.Errorf("corrupt compressed cluster: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Region lists are plain text, one "offset length" pair per line, with
+// anything after a # being a comment. They are written by scan -o, so the
+// regions can be reviewed and edited before they are wiped.
+
+func writeRegions(w io.Writer, regions []RegionDesc, commented bool) {
+	prefix := ""
+	if commented {
+		prefix = "# "
+	}
+	for _, r := range regions {
+		fmt.Fprintf(w, "%s0x%x %d # %s\n", prefix, r.Offset, r.Size, r.Name)
+	}
+}
+
+func readRegionsFile(path string) ([]RegionDesc, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var regions []RegionDesc
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text, comment := s.Text(), ""
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text, comment = text[:i], strings.TrimSpace(text[i+1:])
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected an offset and a length", path, line)
+		}
+
+		off, err1 := strconv.ParseInt(fields[0], 0, 64)
+		size, err2 := strconv.ParseInt(fields[1], 0, 64)
+		if err1 != nil || err2 != nil || off < 0 || size <= 0 {
+			return nil, fmt.Errorf("%s:%d: invalid offset or length", path, line)
+		}
+		if comment == "" {
+			comment = fmt.Sprintf("region on line %d", line)
+		}
+		regions = append(regions, RegionDesc{comment, off, size})
+	}
+	return regions, s.Err()
+}
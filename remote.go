@@ -0,0 +1,267 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Running blwipe on another machine over ssh, using the system's ssh
+// client so that its configuration, keys and agent are used as usual.
+
+// unameArch maps GOARCH to what uname -m reports.
+var unameArch = map[string]string{
+	"amd64": "x86_64",
+	"386":   "i686",
+	"arm64": "aarch64",
+	"arm":   "armv7l",
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			strings.ContainsRune("-_./:=@,+", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+type sshSession struct {
+	host       string
+	opts       []string
+	controlDir string
+	tmpFiles   []string // removed from the remote host on Close
+	sudo       bool     // files may end up owned by root
+}
+
+func newSSHSession(host string) (*sshSession, error) {
+	if strings.HasPrefix(host, "-") {
+		return nil, fmt.Errorf("invalid host %q", host)
+	}
+	s := &sshSession{host: host}
+
+	// share one connection, so that the user authenticates only once
+	if runtime.GOOS != "windows" {
+		dir, err := os.MkdirTemp("", "blwipe-ssh")
+		if err != nil {
+			return nil, err
+		}
+		s.controlDir = dir
+		s.opts = []string{"-o", "ControlMaster=auto",
+			"-o", "ControlPath=" + filepath.Join(dir, "%C"), "-o", "ControlPersist=60"}
+	}
+	return s, nil
+}
+
+// command returns the ssh command running args on the remote host.
+func (s *sshSession) command(args ...string) *exec.Cmd {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	cmdArgs := append(append([]string{}, s.opts...), "--", s.host, strings.Join(quoted, " "))
+	return exec.Command("ssh", cmdArgs...)
+}
+
+// output runs a shell command line on the remote host.
+func (s *sshSession) output(line string, stdin []byte) (string, error) {
+	cmdArgs := append(append([]string{}, s.opts...), "--", s.host, line)
+	cmd := exec.Command("ssh", cmdArgs...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// tempFile creates a temporary file on the remote host.
+func (s *sshSession) tempFile(stdin []byte) (string, error) {
+	line := "mktemp"
+	if stdin != nil {
+		line = `f=$(mktemp) && cat > "$f" && chmod 700 "$f" && echo "$f"`
+	}
+	path, err := s.output(line, stdin)
+	if err == nil {
+		s.tmpFiles = append(s.tmpFiles, path)
+	}
+	return path, err
+}
+
+func (s *sshSession) Close() {
+	if len(s.tmpFiles) > 0 {
+		quoted := make([]string, len(s.tmpFiles))
+		for i, f := range s.tmpFiles {
+			quoted[i] = shellQuote(f)
+		}
+		rm := "rm -f "
+		if s.sudo {
+			rm = "sudo " + rm
+		}
+		s.output(rm+strings.Join(quoted, " "), nil)
+		s.tmpFiles = nil
+	}
+	if s.controlDir != "" {
+		exec.Command("ssh", append(append([]string{}, s.opts...), "-O", "exit", "--", s.host)...).Run()
+		os.RemoveAll(s.controlDir)
+		s.controlDir = ""
+	}
+}
+
+// pushBinary copies this program to a temporary file on the remote host,
+// if it runs there, and returns its path.
+func (s *sshSession) pushBinary() (string, error) {
+	uname, err := s.output("uname -sm", nil)
+	if err != nil {
+		return "", err
+	}
+	want := strings.ToLower(runtime.GOOS) + " " + unameArch[runtime.GOARCH]
+	if strings.ToLower(uname) != want {
+		return "", fmt.Errorf("remote host is %s, but this binary is for %s/%s",
+			uname, runtime.GOOS, runtime.GOARCH)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		return "", err
+	}
+	return s.tempFile(data)
+}
+
+// signFile writes an Ed25519 signature of path to path.sig, using the
+// PKCS #8 private key in keyPath (as made by "openssl genpkey -algorithm ed25519").
+// It is made here, after the report was fetched, so it only shows that the
+// report hasn't changed since, not that the remote host wrote it.
+func signFile(path, keyPath string) error {
+	pemData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return errors.New("no PEM data in the key file")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return errors.New("the signing key is not an Ed25519 key")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+".sig", ed25519.Sign(edKey, data), 0644)
+}
+
+func cmdRemote(args []string) {
+	fs := newFlagSet("remote", "[user@]host:<device> [command [flags]]")
+	push := fs.Bool("push", false, "copy this blwipe binary to the remote host instead of using an installed one")
+	binary := fs.String("binary", "blwipe", "blwipe binary to run on the remote host")
+	sudo := fs.Bool("sudo", false, "run blwipe with sudo on the remote host")
+	reportPath := fs.String("report", "", "fetch the JSON report of a wipe or sanitize to this file")
+	signKey := fs.String("sign-key", "", "sign the report as fetched with this Ed25519 private key, to detect later changes to it")
+	parseFlags(fs, args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	i := strings.LastIndex(fs.Arg(0), ":")
+	if i <= 0 || i == len(fs.Arg(0))-1 {
+		fatal("target must be given as [user@]host:<device>")
+	}
+	host, device := fs.Arg(0)[:i], fs.Arg(0)[i+1:]
+
+	command := []string{"wipe"}
+	if fs.NArg() > 1 {
+		command = fs.Args()[1:]
+	}
+	if *signKey != "" && *reportPath == "" {
+		fatal("-sign-key needs -report")
+	}
+	if *reportPath != "" && command[0] != "wipe" && command[0] != "sanitize" {
+		fatal("only wipe and sanitize write reports")
+	}
+
+	s, err := newSSHSession(host)
+	if err != nil {
+		fatal("%v", err)
+	}
+	fail := func(format string, a ...interface{}) {
+		s.Close()
+		fatal(format, a...)
+	}
+
+	bin := *binary
+	if *push {
+		if bin, err = s.pushBinary(); err != nil {
+			fail("can't copy blwipe to %s: %v", host, err)
+		}
+	}
+
+	remote := []string{bin}
+	if *sudo {
+		remote = []string{"sudo", bin}
+		s.sudo = true
+	}
+	remote = append(remote, command...)
+
+	var remoteReport string
+	if *reportPath != "" {
+		if remoteReport, err = s.tempFile(nil); err != nil {
+			fail("can't create a temporary file on %s: %v", host, err)
+		}
+		remote = append(remote, "-report", remoteReport)
+	}
+	remote = append(remote, "--", device)
+
+	// output is passed through as it comes, so progress is seen live
+	cmd := s.command(remote...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	runErr := cmd.Run()
+
+	if *reportPath != "" {
+		report, err := s.output("cat "+shellQuote(remoteReport), nil)
+		if err != nil || report == "" {
+			fmt.Fprintf(os.Stderr, "can't fetch the report from %s: %v\n", host, err)
+		} else if err := os.WriteFile(*reportPath, []byte(report+"\n"), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "can't save the report: %v\n", err)
+		} else if *signKey != "" {
+			if err := signFile(*reportPath, *signKey); err != nil {
+				fmt.Fprintf(os.Stderr, "can't sign the report: %v\n", err)
+			}
+		}
+	}
+
+	// the exit status of the remote blwipe (or of ssh) is passed on
+	if e, ok := runErr.(*exec.ExitError); ok && e.ExitCode() > 0 {
+		fmt.Fprintf(os.Stderr, "remote %s failed: %v\n", command[0], runErr)
+		s.Close()
+		os.Exit(e.ExitCode())
+	} else if runErr != nil {
+		fail("remote %s failed: %v", command[0], runErr)
+	}
+	s.Close()
+}
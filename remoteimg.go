@@ -0,0 +1,248 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Images stored on web servers or in S3, read with range requests so that
+// only the parts that are looked at are downloaded. They are read-only.
+
+const (
+	httpBlockSize  = 64 << 10
+	httpCacheLimit = 256 // blocks
+)
+
+type httpDisk struct {
+	client *http.Client
+	url    string
+	size   int64
+	sign   func(req *http.Request) // adds authentication, if needed
+
+	cache map[int64][]byte
+	order []int64 // oldest cached block first
+}
+
+func isRemoteImage(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") ||
+		strings.HasPrefix(path, "s3://")
+}
+
+func openRemoteImage(path string) (*httpDisk, error) {
+	d := &httpDisk{
+		client: &http.Client{Timeout: 60 * time.Second},
+		url:    path,
+		sign:   func(*http.Request) {},
+		cache:  map[int64][]byte{},
+	}
+	if strings.HasPrefix(path, "s3://") {
+		if err := d.setupS3(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// the size comes from the Content-Range of the first block
+	if _, err := d.block(0); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// fetch gets n bytes at off with a range request.
+func (d *httpDisk) fetch(off, n int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	d.sign(req)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, io.EOF
+	case http.StatusOK:
+		return nil, errors.New("server does not support range requests")
+	default:
+		return nil, fmt.Errorf("%s: %s", d.url, resp.Status)
+	}
+
+	// Content-Range: bytes first-last/size
+	cr := resp.Header.Get("Content-Range")
+	if i := strings.LastIndexByte(cr, '/'); i >= 0 {
+		if size, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+			d.size = size
+		}
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, n))
+}
+
+// block returns the cached block starting at off, fetching it if needed.
+func (d *httpDisk) block(off int64) ([]byte, error) {
+	if b, ok := d.cache[off]; ok {
+		return b, nil
+	}
+	b, err := d.fetch(off, httpBlockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(d.order) >= httpCacheLimit {
+		delete(d.cache, d.order[0])
+		d.order = d.order[1:]
+	}
+	d.cache[off] = b
+	d.order = append(d.order, off)
+	return b, nil
+}
+
+func (d *httpDisk) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= d.size {
+			return n, io.EOF
+		}
+
+		// large reads, as made by scan, bypass the cache
+		if rest := int64(len(p) - n); rest >= 4*httpBlockSize {
+			if rest > d.size-pos {
+				rest = d.size - pos
+			}
+			b, err := d.fetch(pos, rest)
+			n += copy(p[n:], b)
+			if err != nil {
+				return n, err
+			}
+			if len(b) == 0 {
+				return n, io.ErrUnexpectedEOF
+			}
+			continue
+		}
+
+		start := pos - pos%httpBlockSize
+		b, err := d.block(start)
+		if err != nil {
+			return n, err
+		}
+		if pos-start >= int64(len(b)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], b[pos-start:])
+	}
+	return n, nil
+}
+
+func (d *httpDisk) WriteAt(p []byte, off int64) (int, error) { return 0, errReadOnly }
+
+func (d *httpDisk) Size() int64 { return d.size }
+
+func (d *httpDisk) Close() error { return nil }
+
+// setupS3 turns an s3://bucket/key URL into an HTTPS URL, signing the
+// requests with the credentials from the usual AWS_* variables, if set.
+// AWS_ENDPOINT_URL selects an S3-compatible service other than AWS.
+func (d *httpDisk) setupS3(path string) error {
+	u, err := url.Parse(path)
+	if err != nil {
+		return err
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return fmt.Errorf("invalid S3 URL %q, use s3://bucket/key", path)
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	escapedKey := (&url.URL{Path: "/" + key}).EscapedPath()
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		d.url = strings.TrimRight(endpoint, "/") + "/" + bucket + escapedKey
+	} else {
+		d.url = fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", bucket, region, escapedKey)
+	}
+
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey != "" && secretKey != "" {
+		token := os.Getenv("AWS_SESSION_TOKEN")
+		d.sign = func(req *http.Request) {
+			signS3(req, accessKey, secretKey, token, region, time.Now().UTC())
+		}
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signS3 adds an AWS Signature Version 4 to a request without a body.
+func signS3(req *http.Request, accessKey, secretKey, token, region string, now time.Time) {
+	const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyHash)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(v[0])
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		canonHeaders.String(), signed, emptyHash}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signed, sig))
+}
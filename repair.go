@@ -0,0 +1,124 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// volumeHeaderInfoOffsets is where InfoOffsets lives in the VolumeHeader.
+const volumeHeaderInfoOffsets = 176
+
+func cmdRepair(args []string) {
+	fs := newFlagSet("repair", "<bitlocker-vol.img>")
+	offset := fs.Int64("offset", 0, "offset into volume")
+	fixHeader := fs.Bool("fix-header", false, "also rewrite metadata offsets in the volume header")
+	dryRun := fs.Bool("n", false, "only show what would be repaired")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if *offset < 0 {
+		fatal("offset cannot be negative")
+	}
+
+	f, err := openTarget(fs.Arg(0), !*dryRun)
+	if err != nil {
+		fatal("can't open file: %s", err)
+	}
+	defer f.Close()
+
+	if !*dryRun && isReadOnly(f) {
+		fatal("%s is a read-only evidence container", fs.Arg(0))
+	}
+
+	hdr, err := readHeader(f, *offset)
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	// find a good copy to rebuild the others from
+	var good InfoStruct
+	var goodRaw []byte
+	var bad []int
+	for i, off := range hdr.InfoOffsets {
+		var info InfoStruct
+		size, err := info.Read(f, *offset+int64(off))
+		if err != nil {
+			fmt.Printf("metadata block %d at 0x%x is bad: %v\n", i, off, err)
+			bad = append(bad, i)
+			continue
+		}
+		fmt.Printf("metadata block %d at 0x%x is valid\n", i, off)
+
+		if goodRaw == nil {
+			// the whole block, including the validation structure
+			goodRaw = make([]byte, size)
+			if err := readFullAt(f, goodRaw, *offset+int64(off)); err != nil {
+				fatal("can't read metadata block %d: %v", i, err)
+			}
+			good = info
+		}
+	}
+
+	if goodRaw == nil {
+		fatal("no valid metadata block to repair from")
+	}
+	defer zeroize(goodRaw)
+
+	// the offsets recorded in the good copy are authoritative
+	headerStale := hdr.InfoOffsets != good.InfoOffsets
+	if headerStale {
+		fmt.Printf("volume header metadata offsets %x differ from metadata block offsets %x\n",
+			hdr.InfoOffsets, good.InfoOffsets)
+	}
+
+	if len(bad) == 0 && (!headerStale || !*fixHeader) {
+		fmt.Printf("nothing to repair\n")
+		return
+	}
+
+	for _, i := range bad {
+		off := int64(good.InfoOffsets[i])
+		fmt.Printf("rewriting metadata block %d at 0x%x size %s...\n", i, off, sizeString(int64(len(goodRaw))))
+		if *dryRun {
+			continue
+		}
+
+		if _, err := f.WriteAt(goodRaw, *offset+off); err != nil {
+			fatal("unable to write metadata block %d: %v", i, err)
+		}
+	}
+
+	if headerStale && *fixHeader {
+		fmt.Printf("rewriting metadata offsets in volume header...\n")
+		if !*dryRun {
+			var buf bytes.Buffer
+			binary.Write(&buf, binary.LittleEndian, good.InfoOffsets)
+			if _, err := f.WriteAt(buf.Bytes(), *offset+volumeHeaderInfoOffsets); err != nil {
+				fatal("unable to write volume header: %v", err)
+			}
+		}
+	}
+
+	if *dryRun {
+		return
+	}
+
+	// read back what we wrote
+	for _, i := range bad {
+		var info InfoStruct
+		if _, err := info.Read(f, *offset+int64(good.InfoOffsets[i])); err != nil {
+			fatal("metadata block %d is still bad after repair: %v", i, err)
+		}
+	}
+	fmt.Printf("repaired %d metadata block(s)\n", len(bad))
+}
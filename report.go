@@ -0,0 +1,316 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Report records what was done to a target and why, as a JSON file that
+// can be kept as evidence of sanitization. It is saved after every change,
+// so an interrupted run still leaves a record behind.
+type Report struct {
+	recordInfo
+	ID       string          `json:"id"`
+	Command  string          `json:"command"`
+	Target   string          `json:"target"`
+	Host     string          `json:"host"`
+	Started  time.Time       `json:"started"`
+	Finished *time.Time      `json:"finished,omitempty"`
+	Device   *deviceInfo     `json:"device,omitempty"`
+	Identity *driveIdentity  `json:"identity,omitempty"`
+	Steps    []*reportStep   `json:"steps"`
+	Volumes  []*reportVolume `json:"volumes,omitempty"`
+	Result   string          `json:"result"`
+	Error    string          `json:"error,omitempty"`
+
+	// the Windows release that created the volume, for BitLocker
+	CreatedBy string `json:"created_by,omitempty"`
+
+	// LBAs of the sectors that could not be overwritten
+	BadSectors []int64 `json:"bad_sectors,omitempty"`
+
+	// how long the writes and the verification took
+	Stats *runStats `json:"stats,omitempty"`
+
+	// where the random data written came from, as chosen with -rng
+	RNG string `json:"rng,omitempty"`
+
+	path     string
+	file     *os.File      // path held open, with -drop-privileges
+	volume   *reportVolume // that steps are added to, if any
+	postHook string        // run once finished
+
+	// where the finished report is printed by -output, as json or proto
+	out       io.Writer
+	outFormat string
+}
+
+// reportVolume is the section of a report on one of several volumes of
+// the target.
+type reportVolume struct {
+	Offset    int64         `json:"offset"`
+	Steps     []*reportStep `json:"steps"`
+	Result    string        `json:"result"`
+	CreatedBy string        `json:"created_by,omitempty"`
+}
+
+// recordInfo identifies the asset and the job a report belongs to, so it
+// can be matched up with a ticketing system.
+type recordInfo struct {
+	AssetTag  string `json:"asset_tag,omitempty"`
+	Operator  string `json:"operator,omitempty"`
+	WorkOrder string `json:"work_order,omitempty"`
+}
+
+// recordFlags adds the flags that fill in a recordInfo. The asset tag is
+// left out for commands that handle several drives.
+func recordFlags(fs *flag.FlagSet, assetTag bool) *recordInfo {
+	rec := &recordInfo{}
+	if assetTag {
+		fs.StringVar(&rec.AssetTag, "asset-tag", "", "asset tag of the drive, recorded in the report")
+	}
+	fs.StringVar(&rec.Operator, "operator", "", "name of the operator, recorded in the report")
+	fs.StringVar(&rec.WorkOrder, "work-order", "", "work order or ticket number, recorded in the report")
+	return rec
+}
+
+// args returns the flags to pass the record on to a wipe.
+func (rec recordInfo) args() []string {
+	var args []string
+	for _, a := range []struct{ flag, value string }{
+		{"-asset-tag", rec.AssetTag},
+		{"-operator", rec.Operator},
+		{"-work-order", rec.WorkOrder},
+	} {
+		if a.value != "" {
+			args = append(args, a.flag, a.value)
+		}
+	}
+	return args
+}
+
+// reportName picks a file name in dir for the report on a drive. The
+// asset tag can come from a daemon client, so it is made a plain name.
+func (rec recordInfo) reportName(dir, device string) string {
+	name := rec.AssetTag
+	if name == "" {
+		name = filepath.Base(device) + "-" + time.Now().UTC().Format("20060102T150405Z")
+	}
+	return filepath.Join(dir, fileNamePart(name)+".json")
+}
+
+// fileNamePart replaces path separators, "..", and control and other
+// characters that don't belong in a file name with underscores.
+func fileNamePart(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	return strings.ReplaceAll(s, "..", "__")
+}
+
+type reportStep struct {
+	Name     string `json:"name"`
+	Decision string `json:"decision"` // "run" or "skip"
+	Reason   string `json:"reason"`
+	Result   string `json:"result,omitempty"`
+}
+
+// activeReport is marked as failed if the program exits through fatal.
+var activeReport *Report
+
+// newReport starts a report that is saved to path, if it is not empty.
+func newReport(command, target, path string, rec recordInfo) *Report {
+	host, _ := os.Hostname()
+	r := &Report{
+		recordInfo: rec,
+		ID:         newReportID(),
+		Command:    command,
+		Target:     target,
+		Identity:   identifyDrive(target),
+		Host:       host,
+		Started:    time.Now().UTC(),
+		Result:     "in progress",
+		path:       path,
+	}
+	if path != "" && dropPrivs {
+		// rewritten in place, as its directory may not be writable once
+		// privileges are given up
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			fatal("can't create report: %v", err)
+		}
+		r.file = f
+	}
+	activeReport = r
+	r.save()
+	audit(r, nil, sevNotice, "%s of %s started", command, r.targetName())
+	return r
+}
+
+// newReportID returns a random identifier for a report, which is left
+// unaffected by -seed.
+func newReportID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// targetName names the target, and the drive it is on if that is known.
+func (r *Report) targetName() string {
+	if id := r.identityString(); id != "" {
+		return fmt.Sprintf("%s (%s)", r.Target, id)
+	}
+	return r.Target
+}
+
+// identityString returns the most specific persistent name of the drive,
+// if any.
+func (r *Report) identityString() string {
+	if r.Identity == nil {
+		return ""
+	}
+	return r.Identity.String()
+}
+
+// Step adds a decision to the report.
+func (r *Report) Step(name, decision, reason string) *reportStep {
+	s := &reportStep{Name: name, Decision: decision, Reason: reason}
+	if r.volume != nil {
+		r.volume.Steps = append(r.volume.Steps, s)
+	} else {
+		r.Steps = append(r.Steps, s)
+	}
+	r.save()
+	return s
+}
+
+// BeginVolume starts the section on the volume at offset, which the
+// following steps are added to.
+func (r *Report) BeginVolume(offset int64) {
+	r.volume = &reportVolume{Offset: offset, Result: "in progress"}
+	r.Volumes = append(r.Volumes, r.volume)
+	r.save()
+}
+
+// SetCreatedBy records which Windows release created the volume, in the
+// current volume section if there is one.
+func (r *Report) SetCreatedBy(gen string) {
+	if r.volume != nil {
+		r.volume.CreatedBy = gen
+	} else {
+		r.CreatedBy = gen
+	}
+	r.save()
+}
+
+// EndVolume records the result of the current volume.
+func (r *Report) EndVolume(result string) {
+	r.volume.Result = result
+	r.volume = nil
+	r.save()
+}
+
+// Done records the result of a step.
+func (r *Report) Done(s *reportStep, result string) {
+	s.Result = result
+	r.save()
+
+	severity := sevNotice
+	if strings.HasPrefix(result, "failed") {
+		severity = sevError
+	}
+	audit(r, s, severity, "%s of %s: %s: %s", r.Command, r.targetName(), s.Name, result)
+}
+
+// Finish records the outcome of the whole run.
+func (r *Report) Finish(err error) {
+	now := time.Now().UTC()
+	r.Finished = &now
+	switch {
+	case err != nil:
+		r.Error = err.Error()
+		if r.Result == "in progress" {
+			r.Result = "failed"
+		}
+	case r.Result == "in progress":
+		r.Result = "success"
+	}
+	if r.volume != nil {
+		r.volume.Result = r.Result
+		r.volume = nil
+	}
+	r.save()
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	activeReport = nil
+	if r.out != nil {
+		r.print()
+	}
+	if r.postHook != "" {
+		runPostHook(r.postHook, r)
+	}
+
+	severity := sevNotice
+	if err != nil {
+		severity = sevError
+	}
+	msg := fmt.Sprintf("%s of %s finished: %s", r.Command, r.targetName(), r.Result)
+	if err != nil {
+		msg += ": " + r.Error
+	}
+	audit(r, nil, severity, "%s", msg)
+}
+
+// print writes the finished report to out, for -output.
+func (r *Report) print() {
+	var err error
+	if r.outFormat == "proto" {
+		err = writeDelimited(r.out, r.proto())
+	} else {
+		enc := json.NewEncoder(r.out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(r)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't print report: %v\n", err)
+	}
+}
+
+// save writes the report, replacing the previous version atomically.
+func (r *Report) save() {
+	if r.path == "" {
+		return
+	}
+
+	b, err := json.MarshalIndent(r, "", "  ")
+	b = append(b, '\n')
+	if err == nil && r.file != nil {
+		if _, err = r.file.WriteAt(b, 0); err == nil {
+			err = r.file.Truncate(int64(len(b)))
+		}
+	} else if err == nil {
+		tmp := filepath.Join(filepath.Dir(r.path), "."+filepath.Base(r.path)+".tmp")
+		if err = os.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, r.path)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't save report: %v\n", err)
+	}
+}
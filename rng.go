@@ -0,0 +1,186 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// The random data written comes from the system's generator by default.
+// -rng picks another source: the /dev/urandom or /dev/hwrng devices, or a
+// NIST SP 800-90A CTR_DRBG, for sanitization policies that require an
+// approved generator.
+
+const defaultRNG = "getrandom"
+
+// rngName is the source chosen with -rng.
+var rngName = defaultRNG
+
+var rngSources = []string{"getrandom", "urandom", "hwrng", "drbg"}
+
+// addRNGFlag adds the -rng flag to fs.
+func addRNGFlag(fs *flag.FlagSet) {
+	fs.StringVar(&rngName, "rng", defaultRNG, "source of the random data written: getrandom, urandom, hwrng or drbg")
+}
+
+func validRNG(name string) bool {
+	for _, s := range rngSources {
+		if name == s {
+			return true
+		}
+	}
+	return false
+}
+
+// useRNG makes randSource the source chosen with -rng, unless seed, from
+// -seed, replaces it.
+func useRNG(seed string) {
+	if !validRNG(rngName) {
+		fatal("-rng must be one of getrandom, urandom, hwrng or drbg")
+	}
+	if seed != "" {
+		if rngName != defaultRNG {
+			fatal("-seed cannot be combined with -rng")
+		}
+		useSeed(seed)
+		rngName = "seed"
+		return
+	}
+
+	switch rngName {
+	case "urandom", "hwrng":
+		f, err := os.Open("/dev/" + rngName)
+		if err != nil {
+			fatal("can't use -rng %s: %v", rngName, err)
+		}
+		randSource = f
+		fmt.Printf("random data from /dev/%s\n", rngName)
+	case "drbg":
+		d, err := newCTRDRBG(rand.Reader)
+		if err != nil {
+			fatal("can't use -rng drbg: %v", err)
+		}
+		randSource = d
+		fmt.Printf("random data from CTR_DRBG (AES-256), seeded from the system's generator\n")
+	}
+}
+
+const (
+	drbgKeyLen   = 32
+	drbgSeedLen  = drbgKeyLen + aes.BlockSize
+	drbgMaxBytes = 1 << 16 // per request, the limit being 2^19 bits
+	drbgReseed   = 1 << 16 // requests between reseeds, well under 2^48
+)
+
+// ctrDRBG is CTR_DRBG from NIST SP 800-90A, with AES-256 and without a
+// derivation function, so its entropy input is a full seed. It is
+// reseeded from entropy as often as drbgReseed requests.
+type ctrDRBG struct {
+	mu       sync.Mutex
+	entropy  io.Reader
+	key      [drbgKeyLen]byte
+	v        [aes.BlockSize]byte
+	block    cipher.Block
+	requests int
+}
+
+func newCTRDRBG(entropy io.Reader) (*ctrDRBG, error) {
+	d := &ctrDRBG{entropy: entropy}
+	if err := d.reseed(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// reseed mixes a full seed of fresh entropy into the state, which for
+// instantiation starts with the key and V all zeros.
+func (d *ctrDRBG) reseed() error {
+	var seed [drbgSeedLen]byte
+	if _, err := io.ReadFull(d.entropy, seed[:]); err != nil {
+		return fmt.Errorf("can't read entropy: %v", err)
+	}
+	if d.block == nil {
+		d.setKey(d.key[:])
+	}
+	d.update(&seed)
+	zeroize(seed[:])
+	d.requests = 1
+	return nil
+}
+
+func (d *ctrDRBG) setKey(key []byte) {
+	copy(d.key[:], key)
+	d.block, _ = aes.NewCipher(d.key[:]) // never fails for 32 bytes
+}
+
+// keystream fills p with the encryptions of V+1, V+2, ..., advancing V.
+func (d *ctrDRBG) keystream(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+	d.increment()
+	cipher.NewCTR(d.block, d.v[:]).XORKeyStream(p, p)
+	// V is left at the last block used
+	for n := (len(p) + aes.BlockSize - 1) / aes.BlockSize; n > 1; n-- {
+		d.increment()
+	}
+}
+
+func (d *ctrDRBG) increment() {
+	for i := len(d.v) - 1; i >= 0; i-- {
+		d.v[i]++
+		if d.v[i] != 0 {
+			break
+		}
+	}
+}
+
+// update is CTR_DRBG_Update, deriving a new key and V from the state and
+// provided, which is nil when there is nothing to mix in.
+func (d *ctrDRBG) update(provided *[drbgSeedLen]byte) {
+	var temp [drbgSeedLen]byte
+	d.keystream(temp[:])
+	if provided != nil {
+		for i := range temp {
+			temp[i] ^= provided[i]
+		}
+	}
+	d.setKey(temp[:drbgKeyLen])
+	copy(d.v[:], temp[drbgKeyLen:])
+	zeroize(temp[:])
+}
+
+// Read generates len(p) bytes, a request of at most drbgMaxBytes at a
+// time.
+func (d *ctrDRBG) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	total := 0
+	for len(p) > 0 {
+		if d.requests > drbgReseed {
+			if err := d.reseed(); err != nil {
+				return total, err
+			}
+		}
+		n := len(p)
+		if n > drbgMaxBytes {
+			n = drbgMaxBytes
+		}
+		d.keystream(p[:n])
+		d.update(nil)
+		d.requests++
+		p = p[n:]
+		total += n
+	}
+	return total, nil
+}
@@ -0,0 +1,327 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// deviceInfo describes the drive a target is on.
+type deviceInfo struct {
+	Name       string `json:"name"`
+	Model      string `json:"model,omitempty"`
+	Partition  bool   `json:"partition"` // the target is a partition of the drive
+	Transport  string `json:"transport"`
+	Rotational bool   `json:"rotational"`
+	Discard    bool   `json:"discard"`
+	Opal       bool   `json:"opal"`    // self-encrypting drive
+	Locking    bool   `json:"locking"` // with its hardware encryption in use
+}
+
+// foundVolume is an encrypted volume on the target.
+type foundVolume struct {
+	Offset int64
+	Format string
+}
+
+// findVolumes lists the encrypted volumes on a target, either the target
+// itself or the partitions on it.
+func findVolumes(st storage) []foundVolume {
+	probe := func(off int64) string {
+		if fs := probeFilesystem(st, off); fs == "BitLocker" {
+			return "bitlocker"
+		}
+		if vf, _ := findFormat(st, off, ""); vf != nil {
+			return vf.name
+		}
+		return ""
+	}
+
+	if format := probe(0); format != "" {
+		return []foundVolume{{0, format}}
+	}
+
+	parts, err := readPartitions(st)
+	if err != nil {
+		return nil
+	}
+	var vols []foundVolume
+	for _, p := range parts {
+		if format := probe(p.Offset); format != "" {
+			vols = append(vols, foundVolume{p.Offset, format})
+		}
+	}
+	return vols
+}
+
+// findPartitionedVolume decides whether a target given without an offset
+// is a volume by itself (a "superfloppy", as BitLocker To Go formats some
+// removable media) or a partitioned disk, and for the latter returns the
+// partition of its only encrypted volume. It fails if there are several to
+// choose from.
+func findPartitionedVolume(st storage, format string) (partition, bool) {
+	var vols []foundVolume
+	for _, v := range findVolumes(st) {
+		if v.Offset == 0 {
+			return partition{}, false
+		}
+		if format == "" || v.Format == format {
+			vols = append(vols, v)
+		}
+	}
+	if len(vols) == 0 {
+		return partition{}, false
+	}
+	parts, _ := readPartitions(st)
+	if len(vols) > 1 {
+		fmt.Printf("the disk has %d encrypted volumes:\n", len(vols))
+		for _, v := range vols {
+			for _, p := range parts {
+				if p.Offset == v.Offset {
+					fmt.Printf("  partition %d at offset 0x%x: %s\n", p.Index, p.Offset, v.Format)
+				}
+			}
+		}
+		fatal("pick one with -partition, or use -all")
+	}
+	for _, p := range parts {
+		if p.Offset == vols[0].Offset {
+			return p, true
+		}
+	}
+	return partition{}, false
+}
+
+// afterFlag adds the -after flag, for what to do with a drive once it is
+// done.
+func afterFlag(fs *flag.FlagSet) *string {
+	return fs.String("after", "", "when done, \"eject\", \"standby\" (spin down) or \"poweroff\" the drive")
+}
+
+func checkAfter(action string) {
+	switch action {
+	case "", "eject", "standby", "poweroff":
+	default:
+		fatal("-after must be eject, standby or poweroff")
+	}
+}
+
+// runAfter carries out the -after action on the drive that img is on. The
+// work is done by then, so failing to is only a warning.
+func runAfter(img Image, action string) {
+	if action == "" {
+		return
+	}
+	f, ok := deviceFile(img)
+	if !ok {
+		fmt.Printf("%s\n", warning("-after "+action+": the target is not a drive"))
+		return
+	}
+	fmt.Printf("%s the drive...\n", map[string]string{
+		"eject": "ejecting", "standby": "spinning down", "poweroff": "powering off"}[action])
+	if err := deviceAction(f, action); err != nil {
+		fmt.Printf("%s\n", warning(fmt.Sprintf("-after %s failed: %v", action, err)))
+	}
+}
+
+// ataFrozen reports whether the security of the ATA drive f is frozen,
+// after trying to unfreeze it if asked to.
+func ataFrozen(f *os.File, unfreeze bool) bool {
+	frozen, err := ataSecurityFrozen(f)
+	if err != nil || !frozen || !unfreeze {
+		return frozen
+	}
+	if err := unfreezeBySuspend(); err != nil {
+		fmt.Printf("can't unfreeze the drive: %v\n", err)
+		return true
+	}
+	frozen, err = ataSecurityFrozen(f)
+	return err != nil || frozen
+}
+
+func cmdSanitize(args []string) {
+	fs := newFlagSet("sanitize", "<device>")
+	dryRun := fs.Bool("n", false, "only show the plan")
+	noSecureErase := fs.Bool("no-secure-erase", false, "do not use the drive's secure erase command")
+	after := afterFlag(fs)
+	unfreeze := fs.Bool("unfreeze", false, "suspend and resume the machine to unfreeze ATA drives")
+	force := fs.Bool("force", false, "sanitize the drive even if it is in use")
+	reportPath := fs.String("report", "", "write a JSON report of the decisions and results to this file")
+	addRNGFlag(fs)
+	rec := recordFlags(fs, true)
+	auditCfg := auditFlags(fs)
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	path := fs.Arg(0)
+	checkAfter(*after)
+	useRNG("")
+
+	mode := os.O_RDWR
+	if *dryRun {
+		mode = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, mode, 0)
+	if err != nil {
+		fatal("can't open file: %s", err)
+	}
+	defer f.Close()
+	if !*dryRun {
+		if err := lockTarget(path, f); err != nil {
+			fatal("%v", err)
+		}
+	}
+
+	if auditCfg.enabled() {
+		auditCfg.open()
+	}
+	rep := newReport("sanitize", path, *reportPath, *rec)
+	rep.RNG = rngName
+	explainMapper(path, f, !*dryRun, *force)
+	if !*dryRun {
+		refuseInUse(path, f, *force)
+	}
+	dev, err := probeDevice(f)
+	if err != nil {
+		fatal("can't identify device: %v", err)
+	}
+	rep.Device = dev
+
+	size, err := imageSize(f)
+	if err != nil {
+		fatal("can't determine size of %s: %v", path, err)
+	}
+
+	if dev != nil {
+		fmt.Printf("device %s (%s), transport %s, rotational %v, discard %v, opal %v\n",
+			dev.Name, dev.Model, dev.Transport, dev.Rotational, dev.Discard, dev.Opal)
+	}
+
+	// work out the plan first, so it is recorded even if a step fails
+	vols := findVolumes(f)
+	var overwrite []*reportStep
+	for _, v := range vols {
+		reason := fmt.Sprintf("%s volume at offset 0x%x", v.Format, v.Offset)
+		if dev != nil && dev.Locking {
+			reason += ", but the drive's own hardware encryption is also in use"
+		}
+		overwrite = append(overwrite, rep.Step("metadata overwrite", "run", reason))
+	}
+	if len(vols) == 0 {
+		rep.Step("metadata overwrite", "skip", "no encrypted volumes found")
+	}
+
+	discard := rep.Step("discard", "skip", "")
+	switch {
+	case dev == nil:
+		discard.Reason = "not a block device"
+	case dev.Rotational:
+		discard.Reason = "rotational drive"
+	case !dev.Discard:
+		discard.Reason = "drive does not support discard"
+	default:
+		discard.Decision = "run"
+		discard.Reason = "solid state drive, discarding the whole target"
+	}
+
+	erase := rep.Step("secure erase", "skip", "")
+	switch {
+	case dev == nil:
+		erase.Reason = "not a block device"
+	case *noSecureErase:
+		erase.Reason = "disabled with -no-secure-erase"
+	case dev.Partition:
+		erase.Reason = "target is a partition, secure erase affects the whole drive"
+	case dev.Transport == "usb":
+		erase.Reason = "USB bridges do not pass secure erase through reliably"
+	case dev.Transport == "nvme":
+		erase.Decision = "run"
+		erase.Reason = "NVMe format with user data erase"
+	case dev.Transport == "ata" && ataFrozen(f, *unfreeze && !*dryRun):
+		erase.Reason = "drive security is frozen by the BIOS"
+		fmt.Printf("%s\n", warning("the drive's security is frozen, so it cannot be secure erased."))
+		fmt.Printf("The BIOS freezes drives at boot so that malware cannot set a password on them.\n" +
+			"To unfreeze it, suspend and resume the machine (e.g. \"rtcwake -m mem -s 10\"),\n" +
+			"or unplug and reconnect the drive's power while it is running, then run sanitize\n" +
+			"again. With -unfreeze, blwipe suspends and resumes the machine itself.\n")
+	case dev.Transport == "ata":
+		erase.Decision = "run"
+		erase.Reason = "ATA security erase"
+	default:
+		erase.Reason = "secure erase is not supported over " + dev.Transport
+	}
+	if erase.Decision == "run" && dev.Opal {
+		erase.Reason += ", which also replaces the media key of this self-encrypting drive"
+	}
+	verify := rep.Step("verification", "run", "check that no volumes or filesystems remain")
+
+	for _, s := range rep.Steps {
+		fmt.Printf("%-20s %-4s %s\n", s.Name, s.Decision, s.Reason)
+	}
+	if *dryRun {
+		rep.Result = "dry run"
+		rep.Finish(nil)
+		return
+	}
+
+	for i, v := range vols {
+		opts := &volumeOptions{
+			force:          *force,
+			format:         v.Format,
+			wipe:           true,
+			metadataBlocks: []int{0, 1, 2},
+		}
+		runOneVolume(f, opts, v.Offset, size-v.Offset)
+		rep.Done(overwrite[i], "done")
+	}
+
+	if discard.Decision == "run" {
+		fmt.Printf("discarding %d bytes (%s)...\n", size, humanSize(size))
+		if err := discardRange(f, 0, size); err != nil {
+			rep.Done(discard, "failed: "+err.Error())
+			fmt.Printf("discard failed: %v\n", err)
+		} else {
+			rep.Done(discard, "done")
+		}
+	}
+
+	if erase.Decision == "run" {
+		if err := secureErase(f, dev); err != nil {
+			rep.Done(erase, "failed: "+err.Error())
+			fatal("secure erase failed: %v", err)
+		}
+		rep.Done(erase, "done")
+	}
+
+	sectorSize := logicalSectorSize(f)
+	if sectorSize == 0 {
+		sectorSize = 512
+	}
+	ok := true
+	for _, v := range vols {
+		if !verifyWiped(&subStorage{f, v.Offset}, size-v.Offset, sectorSize, false) {
+			ok = false
+		}
+	}
+	if left := findVolumes(f); len(left) > 0 {
+		for _, v := range left {
+			fmt.Printf("verify: %s volume remains at offset 0x%x\n", v.Format, v.Offset)
+		}
+		ok = false
+	}
+	if !ok {
+		rep.Done(verify, "failed")
+		fatal("verification failed")
+	}
+	rep.Done(verify, "passed")
+	rep.Finish(nil)
+	fmt.Printf("sanitize completed\n")
+	runAfter(f, *after)
+}
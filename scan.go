@@ -0,0 +1,420 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
+)
+
+// Carving a whole disk for BitLocker structures, to find metadata left
+// behind by volumes that were since shrunk, moved or reformatted.
+
+const (
+	carveChunkSize = 4 << 20
+	carveAlign     = 512
+	fveSignature   = "-FVE-FS-"
+)
+
+type carvedBlock struct {
+	Offset int64
+	Size   int64
+	Kind   string // "volume header" or "metadata block"
+	Valid  bool   // checksum matches
+	Volume int64  // offset of the volume it belongs to, or -1 if orphaned
+
+	header *VolumeHeader
+}
+
+// carvedChunk is what was found in one chunk of the disk.
+type carvedChunk struct {
+	seq   int // the order the chunks are reported in
+	base  int64
+	found []carvedBlock
+	end   bool // nothing left to read
+	err   error
+}
+
+// errScanInterrupted stops a scan whose progress was saved.
+var errScanInterrupted = errors.New("interrupted, the progress was saved")
+
+// carveFVE looks for volume headers and metadata blocks at every sector
+// of the first size bytes of r. Where r allows, chunks are searched by
+// several goroutines at once, but the results come out in disk order.
+// If cp is set, the scan starts where it left off and its progress is
+// saved there, and a signal stops it with errScanInterrupted.
+func carveFVE(r io.ReaderAt, size int64, cp *scanCheckpoint) ([]carvedBlock, error) {
+	workers := 1
+	if concurrentIO(r) {
+		workers = runtime.NumCPU()
+	}
+	workers, chunk := bufferShare(workers, carveChunkSize, carveAlign)
+
+	type job struct {
+		seq  int
+		base int64
+	}
+	jobs := make(chan job)
+	results := make(chan *carvedChunk)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		defer close(jobs)
+		sparse := sparseFile(r)
+		seq := 0
+		start := int64(0)
+		if cp != nil {
+			start = cp.Scanned
+		}
+		for base := start; base < size; base += chunk {
+			// skip the chunks that lie entirely in a hole
+			if sparse != nil {
+				base += (nextData(sparse, base, size) - base) / chunk * chunk
+				if base >= size {
+					break
+				}
+			}
+			select {
+			case jobs <- job{seq, base}:
+				seq++
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf []byte
+			if _, mapped := r.(*mappedImage); !mapped {
+				buf = make([]byte, int(chunk)+len(fveSignature))
+			}
+			for j := range jobs {
+				c := carveChunkAt(r, j.base, chunk, buf)
+				c.seq = j.seq
+				select {
+				case results <- c:
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var found []carvedBlock
+	var sigs chan os.Signal
+	if cp != nil {
+		found = cp.found(r)
+		sigs = make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(sigs)
+	}
+
+	pending := make(map[int]*carvedChunk)
+	next := 0
+	for {
+		var res *carvedChunk
+		select {
+		case res = <-results:
+		case <-sigs:
+			cp.save()
+			return found, errScanInterrupted
+		}
+		if res == nil {
+			break
+		}
+		pending[res.seq] = res
+		for c, ok := pending[next]; ok; c, ok = pending[next] {
+			delete(pending, next)
+			next++
+			if c.err != nil {
+				return found, c.err
+			} else if c.end {
+				return found, nil
+			}
+			found = append(found, c.found...)
+
+			done := c.base + chunk
+			if done > size {
+				done = size
+			}
+			if cp != nil {
+				cp.update(done, found)
+			}
+			progress(progressEvent{Phase: "scan", Offset: c.base, Bytes: done - c.base, Done: done, Total: size})
+		}
+	}
+	return found, nil
+}
+
+// carveChunkAt searches the chunk bytes of r at base, reading them and
+// what follows into buf.
+func carveChunkAt(r io.ReaderAt, base, chunk int64, buf []byte) *carvedChunk {
+	c := &carvedChunk{base: base}
+	var n int
+	var err error
+	if mapped, ok := r.(*mappedImage); ok {
+		// searched in place, without copying
+		buf, err = mapped.slice(base, int(chunk)+len(fveSignature))
+		n = len(buf)
+	} else {
+		n, err = r.ReadAt(buf, base)
+	}
+	if n == 0 && err != nil {
+		if err == io.EOF {
+			c.end = true
+		} else {
+			c.err = err
+		}
+		return c
+	}
+
+	for i := 0; i < n && int64(i) < chunk; {
+		idx := bytes.Index(buf[i:n], []byte(fveSignature))
+		if idx < 0 {
+			break
+		}
+		pos := i + idx
+		if int64(pos) >= chunk {
+			break // found again at the start of the next chunk
+		}
+		i = pos + 1
+
+		switch off := base + int64(pos); pos % carveAlign {
+		case 0:
+			if b, ok := carveMetadata(r, off); ok {
+				c.found = append(c.found, b)
+			}
+		case 3:
+			if b, ok := carveHeader(r, off-3); ok {
+				c.found = append(c.found, b)
+			}
+		}
+	}
+	return c
+}
+
+func carveMetadata(r io.ReaderAt, off int64) (carvedBlock, bool) {
+	var hdr InfoStructHeader
+	if binary.Read(io.NewSectionReader(r, off, 64), binary.LittleEndian, &hdr) != nil {
+		return carvedBlock{}, false
+	}
+
+	size := int64(hdr.Size)
+	switch hdr.Version {
+	case 1:
+	case 2:
+		size *= 16
+	default:
+		return carvedBlock{}, false
+	}
+
+	// even a block with a bad checksum may still hold key material
+	var info InfoStruct
+	validSize, err := info.Read(r, off)
+	b := carvedBlock{Offset: off, Size: roundUp(size, carveAlign), Kind: "metadata block",
+		Valid: err == nil, Volume: -1}
+	if b.Valid {
+		b.Size = roundUp(validSize, carveAlign)
+	}
+	return b, true
+}
+
+func carveHeader(r io.ReaderAt, off int64) (carvedBlock, bool) {
+	hdr, err := readHeader(r, off)
+	if err != nil {
+		return carvedBlock{}, false
+	}
+
+	size := int64(hdr.SectorSize)
+	if !validSectorSize(size) {
+		size = carveAlign
+	}
+	return carvedBlock{Offset: off, Size: size, Kind: "volume header", Valid: true,
+		Volume: -1, header: hdr}, true
+}
+
+// classifyCarved works out which blocks belong to a volume whose header is
+// still present, leaving the rest marked as orphaned.
+func classifyCarved(blocks []carvedBlock) {
+	at := map[int64]int{}
+	for i, b := range blocks {
+		at[b.Offset] = i
+	}
+
+	for i, b := range blocks {
+		if b.header == nil {
+			continue
+		}
+		for _, off := range b.header.InfoOffsets {
+			if j, ok := at[b.Offset+int64(off)]; ok && blocks[j].Kind == "metadata block" {
+				blocks[j].Volume = b.Offset
+				if blocks[j].Valid {
+					blocks[i].Volume = b.Offset
+				}
+			}
+		}
+	}
+}
+
+func cmdScan(args []string) {
+	fs := newFlagSet("scan", "<disk.img> | -nested <disk.img> | -r <directory>")
+	wipe := fs.Bool("wipe", false, "overwrite the orphaned structures that are found")
+	output := fs.String("o", "", "write the regions found to this file, for wipe -regions-file")
+	progressFd := progressFlag(fs)
+	addMmapFlag(fs)
+	addMemoryFlag(fs)
+	addPrivilegeFlag(fs)
+	checkpointPath := fs.String("checkpoint", "", "save the progress to this file every so often and when interrupted")
+	resume := fs.Bool("resume", false, "carry on from the progress saved by -checkpoint")
+	recursive := fs.Bool("r", false, "probe every image in the directory tree given instead, for volumes")
+	reportPath := fs.String("report", "", "with -r, save the list of images and volumes to this JSON file")
+	nested := fs.Bool("nested", false, "look for volumes in the virtual disks stored on NTFS and FAT filesystems instead")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *resume && *checkpointPath == "" {
+		fatal("-resume needs the -checkpoint file to resume from")
+	}
+	if err := checkMaxMemory(); err != nil {
+		fatal("%v", err)
+	}
+
+	if *nested {
+		if *recursive || *wipe || *output != "" || *checkpointPath != "" || *reportPath != "" {
+			fatal("-nested cannot be combined with -r, -report, -wipe, -o or -checkpoint")
+		}
+		scanNested(fs.Arg(0))
+		return
+	}
+	if *recursive {
+		if *wipe || *output != "" || *checkpointPath != "" || dropPrivs {
+			fatal("-r cannot be combined with -wipe, -o, -checkpoint or -drop-privileges")
+		}
+		scanTree(fs.Arg(0), *reportPath)
+		return
+	} else if *reportPath != "" {
+		fatal("-report is only for -r")
+	}
+
+	openProgress(*progressFd)
+
+	f, err := openTarget(fs.Arg(0), *wipe)
+	if err != nil {
+		fatal("can't open file: %s", err)
+	}
+	if !*wipe {
+		f = mapImage(f)
+	}
+	defer f.Close()
+	giveUpPrivileges()
+
+	st, err := imageStorage(f)
+	if err != nil {
+		fatal("%v", err)
+	}
+	size, err := imageSize(f)
+	if err != nil {
+		fatal("can't determine size of %s: %v", fs.Arg(0), err)
+	}
+
+	var cp *scanCheckpoint
+	if *checkpointPath != "" {
+		if cp, err = newCheckpoint(*checkpointPath, fs.Arg(0), size, *resume); err != nil {
+			fatal("%v", err)
+		}
+	}
+
+	blocks, err := carveFVE(st, size, cp)
+	if err == errScanInterrupted {
+		// nothing is listed or wiped on the strength of half a scan
+		fmt.Printf("scan %v to %s, at offset 0x%x\n", err, *checkpointPath, cp.Scanned)
+		os.Exit(exitInterrupted)
+	} else if err != nil {
+		fmt.Printf("scan stopped: %v\n", err)
+	} else if cp != nil {
+		cp.remove()
+	}
+	classifyCarved(blocks)
+
+	// structures are searched for every 512 bytes, but are made up of
+	// whole sectors of the target, which is what is written
+	sectorSize := carvedSectorSize(f, blocks)
+	var orphans, current []RegionDesc
+	for _, b := range blocks {
+		r := alignRegion(RegionDesc{Offset: b.Offset, Size: b.Size}, sectorSize)
+		b.Offset, b.Size = r.Offset, r.Size
+		state := fmt.Sprintf("volume at 0x%x", b.Volume)
+		shown := highlight(state)
+		if b.Volume < 0 {
+			shown = warning("ORPHANED")
+			state = "ORPHANED"
+			orphans = append(orphans, RegionDesc{fmt.Sprintf("orphaned %s", b.Kind), b.Offset, b.Size})
+		} else {
+			current = append(current, RegionDesc{fmt.Sprintf("%s of %s", b.Kind, state), b.Offset, b.Size})
+		}
+		checksum := ""
+		if !b.Valid {
+			checksum = ", bad checksum"
+		}
+		fmt.Printf("0x%012x %s, size %s%s: %s\n", b.Offset, b.Kind, sizeString(b.Size), checksum, shown)
+	}
+	fmt.Printf("found %d structure(s), %d orphaned\n", len(blocks), len(orphans))
+
+	// structures of current volumes are listed, but left commented out
+	if *output != "" {
+		out, err := os.Create(*output)
+		if err != nil {
+			fatal("%v", err)
+		}
+		fmt.Fprintf(out, "# BitLocker structures found on %s\n", fs.Arg(0))
+		writeRegions(out, orphans, false)
+		writeRegions(out, current, true)
+		if err := out.Close(); err != nil {
+			fatal("%v", err)
+		}
+	}
+
+	if *wipe && len(orphans) > 0 {
+		wipeRegions(f, 0, size, sectorSize, orphans)
+	}
+}
+
+// carvedSectorSize returns the logical sector size of the target: that of
+// the drive, or for an image, the largest recorded in the volume headers
+// found on it.
+func carvedSectorSize(img Image, blocks []carvedBlock) int64 {
+	if f, ok := deviceFile(img); ok {
+		if n := logicalSectorSize(f); validSectorSize(n) {
+			return n
+		}
+	}
+	size := int64(carveAlign)
+	for _, b := range blocks {
+		if b.header != nil && validSectorSize(int64(b.header.SectorSize)) && int64(b.header.SectorSize) > size {
+			size = int64(b.header.SectorSize)
+		}
+	}
+	return size
+}
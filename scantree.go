@@ -0,0 +1,186 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Triage of a collection of disk images: scan -r probes every image in a
+// directory tree for encrypted volumes, and sums them up in one report.
+
+type treeReport struct {
+	Root    string       `json:"root"`
+	Scanned time.Time    `json:"scanned"`
+	Images  []*treeImage `json:"images"`
+	Volumes int          `json:"volumes"` // in all the images
+	Errors  int          `json:"errors"`
+}
+
+type treeImage struct {
+	Path      string        `json:"path"`
+	Container string        `json:"container,omitempty"`
+	Size      int64         `json:"size"`
+	Volumes   []*treeVolume `json:"volumes,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+type treeVolume struct {
+	Offset    int64  `json:"offset"`
+	Format    string `json:"format"`
+	Metadata  string `json:"metadata,omitempty"` // valid copies, for BitLocker
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
+// containerName names the format img is stored in.
+func containerName(img Image) string {
+	if v, ok := img.(*virtualDisk); ok {
+		switch v.disk.(type) {
+		case *vhdDisk:
+			return "vhd"
+		case *vhdxDisk:
+			return "vhdx"
+		case *qcow2Disk:
+			return "qcow2"
+		case *vmdkDisk:
+			return "vmdk"
+		case *ewfDisk:
+			return "ewf"
+		case *splitDisk:
+			return "split raw"
+		case *interleavedDisk:
+			return "raw with PI"
+		}
+	}
+	return "raw"
+}
+
+// isLaterSegment reports whether path is the second or a later file of a
+// split raw or EWF set, which is scanned along with the first.
+func isLaterSegment(path string) bool {
+	if splitSegmentNumber(path) > 1 {
+		return true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	seg := make([]byte, 2)
+	return isEWF(f) && readFullAt(f, seg, 9) == nil && binary.LittleEndian.Uint16(seg) > 1
+}
+
+// probeImage opens the image at path and looks for encrypted volumes.
+func probeImage(path string) *treeImage {
+	ti := &treeImage{Path: path}
+	img, err := openImage(path, false)
+	if err != nil {
+		ti.Error = err.Error()
+		return ti
+	}
+	defer img.Close()
+
+	ti.Container = containerName(img)
+	ti.Size, _ = imageSize(img)
+	st, err := imageStorage(img)
+	if err != nil {
+		ti.Error = err.Error()
+		return ti
+	}
+
+	for _, v := range findVolumes(st) {
+		tv := &treeVolume{Offset: v.Offset, Format: v.Format}
+		if v.Format == "bitlocker" {
+			tv.Metadata, tv.CreatedBy = summarizeBitLocker(st, v.Offset)
+		}
+		ti.Volumes = append(ti.Volumes, tv)
+	}
+	return ti
+}
+
+// summarizeBitLocker counts the valid metadata copies of the BitLocker
+// volume at offset, and tells which Windows release created it.
+func summarizeBitLocker(r storage, offset int64) (metadata, createdBy string) {
+	hdr, err := readHeader(r, offset)
+	if err != nil {
+		return "bad header", ""
+	}
+	valid := 0
+	var info InfoStruct
+	for _, off := range hdr.InfoOffsets {
+		raw, _, err := info.ReadRaw(r, offset+int64(off))
+		if err != nil {
+			continue
+		}
+		if valid == 0 {
+			createdBy, _ = windowsGeneration(hdr, raw)
+		}
+		zeroize(raw)
+		valid++
+	}
+	return fmt.Sprintf("%d of %d valid", valid, len(hdr.InfoOffsets)), createdBy
+}
+
+// scanTree probes the images under root, printing those with volumes on
+// them, and optionally saves the consolidated report to reportPath.
+func scanTree(root, reportPath string) {
+	rep := &treeReport{Root: root, Scanned: time.Now().UTC()}
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			rep.Images = append(rep.Images, &treeImage{Path: path, Error: err.Error()})
+			return nil
+		}
+		if !fi.Mode().IsRegular() || fi.Size() == 0 || isLaterSegment(path) {
+			return nil
+		}
+		rep.Images = append(rep.Images, probeImage(path))
+		return nil
+	})
+	if err != nil {
+		fatal("%v", err)
+	}
+	sort.Slice(rep.Images, func(i, j int) bool { return rep.Images[i].Path < rep.Images[j].Path })
+
+	with := 0
+	for _, ti := range rep.Images {
+		switch {
+		case ti.Error != "":
+			rep.Errors++
+			fmt.Printf("%s: %s\n", ti.Path, warning(ti.Error))
+		case len(ti.Volumes) > 0:
+			with++
+			rep.Volumes += len(ti.Volumes)
+			fmt.Printf("%s (%s, %s):\n", ti.Path, ti.Container, humanSize(ti.Size))
+			for _, v := range ti.Volumes {
+				extra := ""
+				if v.Metadata != "" {
+					extra = fmt.Sprintf(", metadata %s", v.Metadata)
+				}
+				if v.CreatedBy != "" {
+					extra += ", created by " + v.CreatedBy
+				}
+				fmt.Printf("  0x%012x %s%s\n", v.Offset, highlight(v.Format), extra)
+			}
+		}
+	}
+	result("%d image(s), %d with encrypted volumes, %d volume(s) in all, %d error(s)",
+		len(rep.Images), with, rep.Volumes, rep.Errors)
+
+	if reportPath != "" {
+		b, err := json.MarshalIndent(rep, "", "  ")
+		if err == nil {
+			err = os.WriteFile(reportPath, append(b, '\n'), 0644)
+		}
+		if err != nil {
+			fatal("can't save report: %v", err)
+		}
+	}
+}
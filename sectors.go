@@ -0,0 +1,108 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// Enterprise SAS drives can be formatted with 520 or 528-byte sectors,
+// where 512 bytes of data are followed by 8 or 16 bytes of protection
+// information (PI). Neither Windows nor BitLocker know about these, so
+// the volume is only made up of the data part of each sector.
+
+const dataSectorSize = 512
+
+// rawSectorSize overrides the sector size of the target, for images that
+// were taken of such drives with their PI included.
+var rawSectorSize int
+
+func addSectorFlags(fs *flag.FlagSet) {
+	fs.IntVar(&rawSectorSize, "raw-sector-size", 0, "treat the target as 520 or 528-byte sectors with protection information")
+}
+
+// isPISectorSize reports whether n is a sector size with PI interleaved.
+func isPISectorSize(n int) bool {
+	return n == 520 || n == 528
+}
+
+func checkRawSectorSize() error {
+	if rawSectorSize != 0 && !isPISectorSize(rawSectorSize) {
+		return fmt.Errorf("unsupported raw sector size %d, must be 520 or 528", rawSectorSize)
+	}
+	return nil
+}
+
+// interleavedDisk presents the data part of each raw sector of s as a
+// contiguous image. Writes leave the PI of each sector untouched.
+type interleavedDisk struct {
+	s       storage
+	sector  int64
+	sectors int64
+}
+
+func newInterleavedDisk(s storage, rawSize int64, sector int) *interleavedDisk {
+	return &interleavedDisk{s: s, sector: int64(sector), sectors: rawSize / int64(sector)}
+}
+
+func (d *interleavedDisk) Size() int64 { return d.sectors * dataSectorSize }
+
+// span returns the raw offset of off and how much of p fits in its sector.
+func (d *interleavedDisk) span(off int64, n int) (int64, int) {
+	lba, within := off/dataSectorSize, off%dataSectorSize
+	if rem := dataSectorSize - within; int64(n) > rem {
+		n = int(rem)
+	}
+	return lba*d.sector + within, n
+}
+
+func (d *interleavedDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("interleaved: negative offset")
+	}
+
+	total := 0
+	for len(p) > 0 {
+		if off >= d.Size() {
+			return total, io.EOF
+		}
+
+		raw, n := d.span(off, len(p))
+		if err := readFullAt(d.s, p[:n], raw); err != nil {
+			return total, err
+		}
+
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
+
+func (d *interleavedDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("interleaved: negative offset")
+	}
+
+	total := 0
+	for len(p) > 0 {
+		if off >= d.Size() {
+			return total, errors.New("interleaved: write past the end of the image")
+		}
+
+		raw, n := d.span(off, len(p))
+		if _, err := d.s.WriteAt(p[:n], raw); err != nil {
+			return total, err
+		}
+
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
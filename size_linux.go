@@ -0,0 +1,24 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const _BLKGETSIZE64 = 0x80081272
+
+// deviceSize returns the size of the block device opened as f.
+func deviceSize(f *os.File) (int64, error) {
+	var size uint64
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), _BLKGETSIZE64,
+		uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0, os.NewSyscallError("BLKGETSIZE64", errno)
+	}
+	return int64(size), nil
+}
@@ -0,0 +1,23 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+//go:build !linux && !windows
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// deviceSize returns the size of the device opened as f. Most systems
+// report it as the offset of the end of the device.
+func deviceSize(f *os.File) (int64, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return size, err
+}
@@ -0,0 +1,25 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const _IOCTL_DISK_GET_LENGTH_INFO = 0x0007405C
+
+// deviceSize returns the size of the disk or volume opened as f.
+func deviceSize(f *os.File) (int64, error) {
+	var size int64
+	var returned uint32
+	err := syscall.DeviceIoControl(syscall.Handle(f.Fd()), _IOCTL_DISK_GET_LENGTH_INFO,
+		nil, 0, (*byte)(unsafe.Pointer(&size)), 8, &returned, nil)
+	if err != nil {
+		return 0, os.NewSyscallError("IOCTL_DISK_GET_LENGTH_INFO", err)
+	}
+	return size, nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Holes in sparse image files read as zeros, so there is nothing to find
+// in them. Where the system can tell where the data is, scans skip the
+// holes instead of reading through terabytes of zeros.
+
+// sparseFile returns the file behind r if it may have holes to skip.
+func sparseFile(r interface{}) *os.File {
+	var f *os.File
+	switch v := r.(type) {
+	case *os.File:
+		f = v
+	case *mappedImage:
+		f = v.f
+	default:
+		return nil
+	}
+	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	return f
+}
+
+// nextData returns the offset of the first data at or after off in f, or
+// size if there is only a hole left. It returns off itself if this is not
+// known.
+func nextData(f *os.File, off, size int64) int64 {
+	if seekData == 0 {
+		return off
+	}
+	n, err := f.Seek(off, seekData)
+	if errors.Is(err, syscall.ENXIO) {
+		return size
+	} else if err != nil || n < off {
+		return off
+	}
+	return n
+}
@@ -0,0 +1,8 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+// SEEK_DATA for lseek, which is not the same as on Linux
+const seekData = 4
@@ -0,0 +1,10 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+//go:build !linux && !freebsd && !darwin
+
+package main
+
+// seekData is zero where holes cannot be found, so none are skipped.
+const seekData = 0
@@ -0,0 +1,166 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Split raw image support: a set of files named image.001, image.002, ...
+// whose concatenation is the raw image.
+
+type splitDisk struct {
+	segs   []*os.File
+	starts []int64 // offset of each segment within the image
+	size   int64
+}
+
+// splitSegmentNumber returns the segment number of path if it is named
+// like a split raw segment, or -1.
+func splitSegmentNumber(path string) int {
+	ext := filepath.Ext(path)
+	if len(ext) != 4 {
+		return -1
+	}
+	// Atoi would take "+01" or "-00" too
+	n := 0
+	for _, c := range ext[1:] {
+		if c < '0' || c > '9' {
+			return -1
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n
+}
+
+// isSplitRaw reports whether path is the first segment of a split raw set.
+func isSplitRaw(path string) bool {
+	n := splitSegmentNumber(path)
+	return n == 0 || n == 1
+}
+
+func openSplitRaw(path string, flag int) (*splitDisk, error) {
+	d := &splitDisk{}
+	base := path[:len(path)-3]
+
+	for n := splitSegmentNumber(path); n <= 999; n++ {
+		f, err := os.OpenFile(fmt.Sprintf("%s%03d", base, n), flag, 0644)
+		if os.IsNotExist(err) && len(d.segs) > 0 {
+			break
+		} else if err != nil {
+			d.Close()
+			return nil, err
+		}
+
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			if err := lockTarget(f.Name(), f); err != nil {
+				f.Close()
+				d.Close()
+				return nil, err
+			}
+		}
+
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			f.Close()
+			d.Close()
+			return nil, err
+		}
+
+		d.segs = append(d.segs, f)
+		d.starts = append(d.starts, d.size)
+		d.size += size
+	}
+
+	return d, nil
+}
+
+func (d *splitDisk) Size() int64 { return d.size }
+
+// segment returns the index of the segment containing off.
+func (d *splitDisk) segment(off int64) int {
+	i := len(d.starts) - 1
+	for i > 0 && d.starts[i] > off {
+		i--
+	}
+	return i
+}
+
+// segEnd returns the image offset just past the end of segment i.
+func (d *splitDisk) segEnd(i int) int64 {
+	if i+1 < len(d.starts) {
+		return d.starts[i+1]
+	}
+	return d.size
+}
+
+func (d *splitDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("split: negative offset")
+	}
+
+	total := 0
+	for len(p) > 0 {
+		if off >= d.size {
+			return total, io.EOF
+		}
+
+		i := d.segment(off)
+		n := len(p)
+		if rem := d.segEnd(i) - off; int64(n) > rem {
+			n = int(rem)
+		}
+
+		if err := readFullAt(d.segs[i], p[:n], off-d.starts[i]); err != nil {
+			return total, err
+		}
+
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
+
+// WriteAt splits writes that straddle segment boundaries. Writes are never
+// allowed to extend the last segment.
+func (d *splitDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("split: negative offset")
+	}
+
+	total := 0
+	for len(p) > 0 {
+		if off >= d.size {
+			return total, errors.New("split: write past end of image")
+		}
+
+		i := d.segment(off)
+		n := len(p)
+		if rem := d.segEnd(i) - off; int64(n) > rem {
+			n = int(rem)
+		}
+
+		if _, err := d.segs[i].WriteAt(p[:n], off-d.starts[i]); err != nil {
+			return total, err
+		}
+
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
+
+func (d *splitDisk) Close() error {
+	for _, f := range d.segs {
+		f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitSegmentNumber(t *testing.T) {
+	tests := []struct {
+		path  string
+		want  int
+		first bool
+	}{
+		{"disk.001", 1, true},
+		{"disk.000", 0, true},
+		{"/evidence/disk.raw.002", 2, false},
+		{"disk.999", 999, false},
+		{"disk.+01", -1, false},
+		{"disk.-00", -1, false},
+		{"disk. 01", -1, false},
+		{"disk.01", -1, false},
+		{"disk.0001", -1, false},
+		{"disk.0x1", -1, false},
+		{"disk.img", -1, false},
+		{"disk", -1, false},
+	}
+	for _, tt := range tests {
+		if got := splitSegmentNumber(tt.path); got != tt.want {
+			t.Errorf("splitSegmentNumber(%q) = %d, want %d", tt.path, got, tt.want)
+		}
+		if got := isSplitRaw(tt.path); got != tt.first {
+			t.Errorf("isSplitRaw(%q) = %v, want %v", tt.path, got, tt.first)
+		}
+	}
+}
+
+// writeSegments writes data to segments of the given sizes in dir, and
+// returns the path of the first.
+func writeSegments(t *testing.T, dir string, data []byte, sizes ...int) string {
+	t.Helper()
+	for i, n := range sizes {
+		name := filepath.Join(dir, fmt.Sprintf("disk.%03d", i+1))
+		if err := os.WriteFile(name, data[:n], 0644); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	return filepath.Join(dir, "disk.001")
+}
+
+func TestSplitRaw(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(lockDirEnv, dir)
+	data := make([]byte, 1800)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	// an empty segment in the middle is just skipped over
+	path := writeSegments(t, dir, data, 1000, 0, 500, 300)
+
+	d, err := openSplitRaw(path, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.Size() != 1800 {
+		t.Errorf("size %d, want 1800", d.Size())
+	}
+	p := make([]byte, 1800)
+	if _, err := d.ReadAt(p, 0); err != nil || !bytes.Equal(p, data) {
+		t.Errorf("read: %v, or it differs", err)
+	}
+
+	// across all three boundaries
+	w := bytes.Repeat([]byte{0xee}, 1000)
+	if n, err := d.WriteAt(w, 700); n != 1000 || err != nil {
+		t.Fatalf("write: %d, %v", n, err)
+	}
+	copy(data[700:], w)
+	if _, err := d.ReadAt(p, 0); err != nil || !bytes.Equal(p, data) {
+		t.Errorf("read after the write: %v, or it differs", err)
+	}
+	if n, err := d.WriteAt([]byte{1, 2}, 1799); n != 1 || err == nil {
+		t.Errorf("write past the end: %d, %v, want 1 and an error", n, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "disk.004")); err != nil || fi.Size() != 300 {
+		t.Errorf("last segment was extended: %v, %v", fi.Size(), err)
+	}
+	if _, err := d.ReadAt(p[:1], -1); err == nil {
+		t.Errorf("read at a negative offset succeeded")
+	}
+}
+
+func TestSplitRawOpen(t *testing.T) {
+	// a gap ends the set
+	dir := t.TempDir()
+	path := writeSegments(t, dir, make([]byte, 300), 100, 100, 100)
+	os.Remove(filepath.Join(dir, "disk.002"))
+	d, err := openSplitRaw(path, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != 100 {
+		t.Errorf("with a gap, size %d, want 100", d.Size())
+	}
+	d.Close()
+
+	if _, err := openSplitRaw(filepath.Join(t.TempDir(), "disk.001"), os.O_RDONLY); err == nil {
+		t.Errorf("opened a missing first segment")
+	}
+
+	// a single VHD named like a first segment is a VHD
+	dir = t.TempDir()
+	vhd := makeFixedVHD(8192, nil)
+	path = writeSegments(t, dir, append(vhd, make([]byte, 512)...), len(vhd), 512)
+	img, err := openImage(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	if v, ok := img.(*virtualDisk); !ok {
+		t.Errorf("%s opened as %T", path, img)
+	} else if _, ok := v.disk.(*vhdDisk); !ok {
+		t.Errorf("%s opened as %T", path, v.disk)
+	}
+}
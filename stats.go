@@ -0,0 +1,75 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Timings of a wipe, printed at the end and kept in the report, so that
+// slow drives and slowdowns between versions show up without having to
+// time runs by hand.
+
+type runStats struct {
+	BytesWritten  int64          `json:"bytes_written"`
+	WriteSeconds  float64        `json:"write_seconds"`
+	BytesPerSec   float64        `json:"bytes_per_second"`
+	Retries       int            `json:"retries"`
+	VerifySeconds float64        `json:"verify_seconds"`
+	Regions       []*regionStats `json:"regions"`
+}
+
+type regionStats struct {
+	Name    string  `json:"name"`
+	Offset  int64   `json:"offset"`
+	Size    int64   `json:"size"`
+	Seconds float64 `json:"seconds"`
+	Retries int     `json:"retries,omitempty"`
+}
+
+// stats covers every volume wiped by this run.
+var stats runStats
+
+// addRegion records a region that was overwritten in d, with retries
+// writes that had to be repeated.
+func (s *runStats) addRegion(r RegionDesc, offset int64, d time.Duration, retries int) {
+	s.Regions = append(s.Regions, &regionStats{r.Name, offset + r.Offset, r.Size, d.Seconds(), retries})
+	s.BytesWritten += r.Size
+	s.Retries += retries
+}
+
+// addWriting adds d to the time spent writing. Regions written at the same
+// time are only counted once, unlike the sum of their durations.
+func (s *runStats) addWriting(d time.Duration) {
+	s.WriteSeconds += d.Seconds()
+	if s.WriteSeconds > 0 {
+		s.BytesPerSec = float64(s.BytesWritten) / s.WriteSeconds
+	}
+}
+
+func seconds(f float64) time.Duration {
+	return time.Duration(f * float64(time.Second)).Round(time.Microsecond)
+}
+
+// printStats prints the summary at the end of a wipe.
+func printStats() {
+	if len(stats.Regions) == 0 {
+		return
+	}
+	fmt.Printf("statistics:\n")
+	for _, r := range stats.Regions {
+		retries := ""
+		if r.Retries > 0 {
+			retries = fmt.Sprintf(", %d retries", r.Retries)
+		}
+		fmt.Printf("  %-40s %s in %v%s\n", r.Name, humanSize(r.Size), seconds(r.Seconds), retries)
+	}
+	fmt.Printf("  %s written in %v, %s/s, %d retries\n", humanSize(stats.BytesWritten),
+		seconds(stats.WriteSeconds), humanSize(int64(stats.BytesPerSec)), stats.Retries)
+	if stats.VerifySeconds > 0 {
+		fmt.Printf("  verification took %v\n", seconds(stats.VerifySeconds))
+	}
+}
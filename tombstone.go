@@ -0,0 +1,74 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// A tombstone is a sector of plain text written at the start of a wiped
+// volume, so that whoever looks at it later sees that it was erased on
+// purpose. It has no boot signature or jump instruction, so nothing will
+// try to boot or mount it.
+
+// version is set when building releases, with
+// -ldflags "-X main.version=1.2.3".
+var version = "devel"
+
+const tombstoneMagic = "BLWIPE TOMBSTONE\r\n"
+
+// tombstone returns the marker sector for a wipe finished at t.
+func tombstone(sectorSize int64, t time.Time, reportID string) []byte {
+	var b bytes.Buffer
+	b.WriteString(tombstoneMagic)
+	b.WriteString("This volume was cryptographically erased: its keys were destroyed\r\n")
+	b.WriteString("and the data that remains cannot be decrypted.\r\n")
+	fmt.Fprintf(&b, "tool: blwipe %s\r\n", version)
+	fmt.Fprintf(&b, "time: %s\r\n", t.UTC().Format(time.RFC3339))
+	if reportID != "" {
+		fmt.Fprintf(&b, "report: %s\r\n", reportID)
+	}
+
+	sector := make([]byte, sectorSize)
+	copy(sector, b.Bytes())
+	return sector
+}
+
+// readTombstone returns the text of the tombstone at off, if there is one.
+func readTombstone(r io.ReaderAt, off int64) (string, bool) {
+	sector := make([]byte, 512)
+	if err := readFullAt(r, sector, off); err != nil || !bytes.HasPrefix(sector, []byte(tombstoneMagic)) {
+		return "", false
+	}
+	text := string(bytes.TrimRight(sector[len(tombstoneMagic):], "\x00"))
+	return strings.TrimSpace(strings.Replace(text, "\r\n", "\n", -1)), true
+}
+
+// writeTombstone writes the marker at the start of the wiped volume at
+// offset.
+func writeTombstone(w io.WriterAt, offset, sectorSize int64) {
+	id := ""
+	if activeReport != nil {
+		id = activeReport.ID
+	}
+	var step *reportStep
+	if activeReport != nil {
+		step = activeReport.Step("write tombstone", "run", "mark the volume as erased")
+	}
+	if _, err := w.WriteAt(tombstone(sectorSize, time.Now(), id), offset); err != nil {
+		if step != nil {
+			activeReport.Done(step, "failed: "+err.Error())
+		}
+		fatal("unable to write tombstone: %v", err)
+	}
+	if step != nil {
+		activeReport.Done(step, "done")
+	}
+	fmt.Printf("wrote tombstone at offset 0x%x\n", offset)
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A menu for technicians: pick from the volumes found on the system,
+// confirm, and watch them being wiped one by one.
+
+const progressWidth = 40
+
+type menuEntry struct {
+	blockDevice
+	desc   string
+	format string
+}
+
+// findMenuEntries lists the block devices that hold an encrypted volume.
+func findMenuEntries() ([]menuEntry, error) {
+	devs, err := blockDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []menuEntry
+	for _, d := range devs {
+		f, err := os.Open(d.Path)
+		if err != nil {
+			continue
+		}
+		if desc := describeVolume(f); desc != "" {
+			vols := findVolumes(f)
+			entries = append(entries, menuEntry{d, desc, vols[0].Format})
+		}
+		f.Close()
+	}
+	return entries, nil
+}
+
+// parseSelection turns "1 3", "1,3" or "all" into indexes into a list of n.
+func parseSelection(s string, n int) ([]int, error) {
+	s = strings.TrimSpace(s)
+	if s == "all" {
+		sel := make([]int, n)
+		for i := range sel {
+			sel[i] = i
+		}
+		return sel, nil
+	}
+
+	var sel []int
+	seen := map[int]bool{}
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' }) {
+		i, err := strconv.Atoi(f)
+		if err != nil || i < 1 || i > n {
+			return nil, fmt.Errorf("no volume %q", f)
+		}
+		if !seen[i-1] {
+			seen[i-1] = true
+			sel = append(sel, i-1)
+		}
+	}
+	return sel, nil
+}
+
+func progressBar(w io.Writer, name string, done, total int64) {
+	filled := progressWidth
+	if total > 0 {
+		filled = int(done * progressWidth / total)
+	}
+	fmt.Fprintf(w, "\r%-16s [%s%s] %3d%%", name,
+		strings.Repeat("#", filled), strings.Repeat(" ", progressWidth-filled),
+		filled*100/progressWidth)
+}
+
+// prompt asks for a line of input, keeping def if nothing is entered.
+func prompt(in *bufio.Reader, question, def string) string {
+	if def != "" {
+		question += " [" + def + "]"
+	}
+	fmt.Printf("%s: ", question)
+	line, _ := in.ReadString('\n')
+	if line = strings.TrimSpace(line); line != "" {
+		return line
+	}
+	return def
+}
+
+// wipeWithProgress wipes one entry, drawing a progress bar on stdout and
+// printing the detailed output of the wipe afterwards.
+func wipeWithProgress(e menuEntry, extra []string) {
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		fatal("%v", err)
+	}
+	var log bytes.Buffer
+	copied := make(chan bool)
+	go func() {
+		io.Copy(&log, r)
+		close(copied)
+	}()
+
+	os.Stdout = w
+	wipeProgress = func(done, total int64) { progressBar(stdout, e.Path, done, total) }
+	progressBar(stdout, e.Path, 0, 1)
+	args := append([]string{"-format", e.format}, extra...)
+	runVolume("wipe", append(args, e.Path), true)
+
+	wipeProgress = nil
+	os.Stdout = stdout
+	w.Close()
+	<-copied
+	r.Close()
+
+	fmt.Printf("\n")
+	for _, line := range strings.Split(strings.TrimRight(log.String(), "\n"), "\n") {
+		fmt.Printf("    %s\n", line)
+	}
+}
+
+func cmdInteractive(args []string) {
+	fs := newFlagSet("interactive", "")
+	reportDir := fs.String("report-dir", "", "write a JSON report of each wipe to this directory")
+	rec := recordFlags(fs, false)
+	auditCfg := auditFlags(fs)
+	parseFlags(fs, args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	entries, err := findMenuEntries()
+	if err != nil {
+		fatal("can't list block devices: %v", err)
+	}
+	if len(entries) == 0 {
+		fmt.Printf("no encrypted volumes found\n")
+		return
+	}
+
+	for i, e := range entries {
+		fmt.Printf("%3d) %-16s %10s  %-20s %s\n", i+1, e.Path, humanSize(e.Size), e.Model, highlight(e.desc))
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	var sel []int
+	for len(sel) == 0 {
+		fmt.Printf("\nvolumes to wipe (e.g. \"1 3\" or \"all\", empty to quit): ")
+		line, err := in.ReadString('\n')
+		if strings.TrimSpace(line) == "" {
+			return
+		}
+		if sel, err = parseSelection(line, len(entries)); err != nil {
+			fmt.Printf("%v\n", err)
+		}
+	}
+
+	fmt.Printf("\n%s\n", warning("the key material of these volumes will be destroyed, making their data unrecoverable:"))
+	for _, i := range sel {
+		e := entries[i]
+		fmt.Printf("     %-16s %10s  %-20s %s\n", e.Path, humanSize(e.Size), e.Model, highlight(e.desc))
+	}
+	fmt.Printf("type \"yes\" to continue: ")
+	line, _ := in.ReadString('\n')
+	if strings.TrimSpace(line) != "yes" {
+		fmt.Printf("nothing wiped\n")
+		return
+	}
+
+	// ask for the details that go into the reports
+	tags := make([]string, len(entries))
+	if *reportDir != "" {
+		fmt.Printf("\n")
+		rec.Operator = prompt(in, "operator", rec.Operator)
+		rec.WorkOrder = prompt(in, "work order", rec.WorkOrder)
+		for _, i := range sel {
+			tags[i] = prompt(in, "asset tag of "+entries[i].Path, "")
+		}
+	}
+
+	fmt.Printf("\n")
+	for _, i := range sel {
+		extra := auditCfg.args()
+		if *reportDir != "" {
+			r := *rec
+			r.AssetTag = tags[i]
+			extra = append(extra, r.args()...)
+			extra = append(extra, "-report", r.reportName(*reportDir, entries[i].Path))
+		}
+		wipeWithProgress(entries[i], extra)
+	}
+	fmt.Printf("wiped %d volume(s)\n", len(sel))
+}
@@ -0,0 +1,45 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// VeraCrypt and TrueCrypt volumes keep their headers in a 128 KiB area at
+// the start (normal and hidden volume header) and a backup of both in the
+// last 128 KiB. The headers are entirely encrypted, so the format cannot
+// be detected and the headers cannot be told apart from random data.
+
+const veracryptHeaderArea = 128 << 10
+
+func inspectVeraCrypt(r io.ReaderAt, size int64) (string, []RegionDesc, error) {
+	if size < 0 {
+		return "", nil, errors.New("the volume size must be known to find the backup headers")
+	}
+	if size < 2*veracryptHeaderArea {
+		return "", nil, fmt.Errorf("volume of %d bytes is too small for VeraCrypt", size)
+	}
+
+	// the best that can be done is to rule out things that are not it
+	if fs := probeFilesystem(r, 0); fs != "" {
+		return "", nil, fmt.Errorf("not a VeraCrypt volume, this looks like %s", describeFS(fs))
+	}
+	hdr := make([]byte, 512)
+	if err := readFullAt(r, hdr, 0); err != nil {
+		return "", nil, err
+	}
+	if shannonEntropy(hdr) < 7 {
+		return "", nil, errors.New("not a VeraCrypt volume, the header does not look encrypted")
+	}
+
+	regions := []RegionDesc{
+		{"VeraCrypt headers", 0, veracryptHeaderArea},
+		{"VeraCrypt backup headers", size - veracryptHeaderArea, veracryptHeaderArea},
+	}
+	return "VeraCrypt/TrueCrypt volume (assumed, headers cannot be verified)", regions, nil
+}
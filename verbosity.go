@@ -0,0 +1,67 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Output levels: -q leaves only errors and the final result, while -v and
+// -vv show progressively more detail.
+const (
+	levelQuiet   = -1
+	levelNormal  = 0
+	levelVerbose = 1
+	levelDebug   = 2
+)
+
+var verbosity = levelNormal
+
+// resultOut receives the final result when -q sends everything else away.
+var resultOut io.Writer
+
+type verbosityFlags struct {
+	quiet, verbose, debug *bool
+}
+
+func addVerbosityFlags(fs *flag.FlagSet) *verbosityFlags {
+	return &verbosityFlags{
+		quiet:   fs.Bool("q", false, "only show errors and the final result"),
+		verbose: fs.Bool("v", false, "show more information"),
+		debug:   fs.Bool("vv", false, "show even more information, including hexdumps"),
+	}
+}
+
+// apply sets the output level chosen on the command line.
+func (f *verbosityFlags) apply() {
+	switch {
+	case *f.quiet && (*f.verbose || *f.debug):
+		fatal("-q cannot be combined with -v or -vv")
+	case *f.quiet:
+		null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			fatal("%v", err)
+		}
+		verbosity = levelQuiet
+		resultOut, os.Stdout = os.Stdout, null
+	case *f.debug:
+		verbosity = levelDebug
+	case *f.verbose:
+		verbosity = levelVerbose
+	}
+}
+
+// result prints the outcome of a command, which is shown even with -q.
+func result(format string, a ...interface{}) {
+	w := resultOut
+	if w == nil {
+		w = os.Stdout
+	}
+	fmt.Fprintf(w, format+"\n", a...)
+	progress(progressEvent{Phase: "result", Message: fmt.Sprintf(format, a...)})
+}
@@ -0,0 +1,349 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// VHD (Virtual PC / Hyper-V generation 1) disk image support.
+// All VHD structures are big-endian.
+
+const (
+	vhdSectorSize = 512
+
+	vhdTypeFixed        = 2
+	vhdTypeDynamic      = 3
+	vhdTypeDifferencing = 4
+
+	vhdUnallocated = 0xFFFFFFFF
+)
+
+type vhdFooter struct {
+	Cookie         [8]byte
+	Features       uint32
+	Version        uint32
+	DataOffset     uint64
+	Timestamp      uint32
+	CreatorApp     [4]byte
+	CreatorVersion uint32
+	CreatorHostOS  uint32
+	OriginalSize   uint64
+	CurrentSize    uint64
+	Geometry       uint32
+	DiskType       uint32
+	Checksum       uint32
+	UniqueId       [16]byte
+	SavedState     uint8
+	_              [427]byte
+}
+
+type vhdDynamicHeader struct {
+	Cookie          [8]byte
+	DataOffset      uint64
+	TableOffset     uint64
+	Version         uint32
+	MaxTableEntries uint32
+	BlockSize       uint32
+	Checksum        uint32
+	ParentUniqueId  [16]byte
+	ParentTimestamp uint32
+	_               [4]byte
+	ParentName      [512]byte
+	ParentLocators  [8 * 24]byte
+	_               [256]byte
+}
+
+// vhdChecksum computes the one's complement sum used by both the footer
+// and the dynamic header, skipping the stored checksum at csumOff.
+func vhdChecksum(b []byte, csumOff int) uint32 {
+	var sum uint32
+	for i, c := range b {
+		if i >= csumOff && i < csumOff+4 {
+			continue
+		}
+		sum += uint32(c)
+	}
+	return ^sum
+}
+
+func readVHDFooter(f io.ReaderAt, off int64) (*vhdFooter, error) {
+	buf := make([]byte, vhdSectorSize)
+	if err := readFullAt(f, buf, off); err != nil {
+		return nil, err
+	}
+
+	var ftr vhdFooter
+	binary.Read(bytes.NewReader(buf), binary.BigEndian, &ftr)
+	if string(ftr.Cookie[:]) != "conectix" {
+		return nil, errors.New("vhd: footer cookie not found")
+	}
+	if sum := vhdChecksum(buf, 64); sum != ftr.Checksum {
+		return nil, fmt.Errorf("vhd: footer checksum mismatch: stored %08x, computed %08x",
+			ftr.Checksum, sum)
+	}
+	return &ftr, nil
+}
+
+func isVHD(f io.ReaderAt, size int64) bool {
+	if size < vhdSectorSize {
+		return false
+	}
+	cookie := make([]byte, 8)
+	if readFullAt(f, cookie, size-vhdSectorSize) != nil {
+		return false
+	}
+	return string(cookie) == "conectix"
+}
+
+type vhdDisk struct {
+	f    storage
+	size int64
+
+	// only used for dynamic disks
+	dynamic    bool
+	blockSize  int64
+	bitmapSize int64
+	bat        []uint32
+}
+
+func openVHD(f storage, fileSize int64) (*vhdDisk, error) {
+	ftr, err := readVHDFooter(f, fileSize-vhdSectorSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if ftr.CurrentSize > math.MaxInt64 {
+		return nil, fmt.Errorf("vhd: invalid disk size %d", ftr.CurrentSize)
+	}
+	d := &vhdDisk{f: f, size: int64(ftr.CurrentSize)}
+
+	switch ftr.DiskType {
+	case vhdTypeFixed:
+		if d.size > fileSize-vhdSectorSize {
+			return nil, errors.New("vhd: fixed disk is larger than the file")
+		}
+		return d, nil
+
+	case vhdTypeDynamic:
+		// handled below
+
+	case vhdTypeDifferencing:
+		return nil, errors.New("vhd: differencing disks are not supported")
+
+	default:
+		return nil, fmt.Errorf("vhd: unknown disk type %d", ftr.DiskType)
+	}
+
+	buf := make([]byte, 1024)
+	if err := readFullAt(f, buf, int64(ftr.DataOffset)); err != nil {
+		return nil, fmt.Errorf("vhd: cannot read dynamic header: %v", err)
+	}
+
+	var dh vhdDynamicHeader
+	binary.Read(bytes.NewReader(buf), binary.BigEndian, &dh)
+	if string(dh.Cookie[:]) != "cxsparse" {
+		return nil, errors.New("vhd: invalid dynamic header cookie")
+	}
+	if sum := vhdChecksum(buf, 36); sum != dh.Checksum {
+		return nil, fmt.Errorf("vhd: dynamic header checksum mismatch: stored %08x, computed %08x",
+			dh.Checksum, sum)
+	}
+	if dh.BlockSize == 0 || dh.BlockSize%vhdSectorSize != 0 {
+		return nil, fmt.Errorf("vhd: invalid block size %d", dh.BlockSize)
+	}
+
+	d.dynamic = true
+	d.blockSize = int64(dh.BlockSize)
+
+	// one bit per sector, padded to a sector boundary
+	sectorsPerBlock := d.blockSize / vhdSectorSize
+	d.bitmapSize = ((sectorsPerBlock+7)/8 + vhdSectorSize - 1) / vhdSectorSize * vhdSectorSize
+
+	// the table has to be in the file, which bounds what is allocated for
+	// it whatever the header claims
+	if dh.TableOffset >= uint64(fileSize) {
+		return nil, fmt.Errorf("vhd: block allocation table offset 0x%x is past the end of the file", dh.TableOffset)
+	}
+	entries := int64(dh.MaxTableEntries)
+	if max := (fileSize - int64(dh.TableOffset)) / 4; entries > max {
+		return nil, fmt.Errorf("vhd: block allocation table of %d entries doesn't fit in the file", entries)
+	}
+
+	// rounding up without overflowing for sizes near the limit
+	numBlocks := d.size / d.blockSize
+	if d.size%d.blockSize != 0 {
+		numBlocks++
+	}
+	if numBlocks > entries {
+		return nil, errors.New("vhd: block allocation table is too small for disk")
+	}
+
+	batBuf := make([]byte, numBlocks*4)
+	if err := readFullAt(f, batBuf, int64(dh.TableOffset)); err != nil {
+		return nil, fmt.Errorf("vhd: cannot read block allocation table: %v", err)
+	}
+	d.bat = make([]uint32, numBlocks)
+	for i := range d.bat {
+		d.bat[i] = binary.BigEndian.Uint32(batBuf[i*4:])
+	}
+
+	return d, nil
+}
+
+func (d *vhdDisk) Size() int64 { return d.size }
+
+// span limits an access at off of length n to the disk size, and for
+// dynamic disks, to the block containing off.
+func (d *vhdDisk) span(off int64, n int) int {
+	if rem := d.size - off; int64(n) > rem {
+		n = int(rem)
+	}
+	if d.dynamic {
+		if rem := d.blockSize - off%d.blockSize; int64(n) > rem {
+			n = int(rem)
+		}
+	}
+	return n
+}
+
+func (d *vhdDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("vhd: negative offset")
+	}
+
+	total := 0
+	for len(p) > 0 {
+		if off >= d.size {
+			return total, io.EOF
+		}
+
+		n := d.span(off, len(p))
+		if !d.dynamic {
+			if err := readFullAt(d.f, p[:n], off); err != nil {
+				return total, err
+			}
+		} else if err := d.readBlock(p[:n], off); err != nil {
+			return total, err
+		}
+
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
+
+// readBlock reads a range contained within a single dynamic disk block.
+// Unallocated blocks, and sectors not marked present in the block
+// bitmap, read as zeros.
+func (d *vhdDisk) readBlock(p []byte, off int64) error {
+	entry := d.bat[off/d.blockSize]
+	if entry == vhdUnallocated {
+		for i := range p {
+			p[i] = 0
+		}
+		return nil
+	}
+
+	base := int64(entry) * vhdSectorSize
+	within := off % d.blockSize
+	if err := readFullAt(d.f, p, base+d.bitmapSize+within); err != nil {
+		return err
+	}
+
+	bitmap := make([]byte, d.bitmapSize)
+	if err := readFullAt(d.f, bitmap, base); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(p); {
+		sector := (within + int64(i)) / vhdSectorSize
+		end := (sector+1)*vhdSectorSize - within
+		if end > int64(len(p)) {
+			end = int64(len(p))
+		}
+		if bitmap[sector/8]&(0x80>>uint(sector%8)) == 0 {
+			for j := i; j < int(end); j++ {
+				p[j] = 0
+			}
+		}
+		i = int(end)
+	}
+	return nil
+}
+
+func (d *vhdDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("vhd: negative offset")
+	}
+
+	total := 0
+	for len(p) > 0 {
+		if off >= d.size {
+			return total, errors.New("vhd: write past end of disk")
+		}
+
+		n := d.span(off, len(p))
+		if !d.dynamic {
+			if _, err := d.f.WriteAt(p[:n], off); err != nil {
+				return total, err
+			}
+		} else if err := d.writeBlock(p[:n], off); err != nil {
+			return total, err
+		}
+
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
+
+// writeBlock writes a range contained within a single dynamic disk block.
+// Unallocated blocks read back as zeros, so writing zeros to them is done
+// already, but anything else would need the image to grow and is refused.
+func (d *vhdDisk) writeBlock(p []byte, off int64) error {
+	entry := d.bat[off/d.blockSize]
+	if entry == vhdUnallocated {
+		if allZero(p) {
+			return nil
+		}
+		return fmt.Errorf("vhd: can't write at 0x%x, in block %d which isn't allocated", off, off/d.blockSize)
+	}
+
+	base := int64(entry) * vhdSectorSize
+	within := off % d.blockSize
+	if _, err := d.f.WriteAt(p, base+d.bitmapSize+within); err != nil {
+		return err
+	}
+
+	// mark the written sectors as present
+	bitmap := make([]byte, d.bitmapSize)
+	if err := readFullAt(d.f, bitmap, base); err != nil {
+		return err
+	}
+
+	changed := false
+	last := (within + int64(len(p)) - 1) / vhdSectorSize
+	for sector := within / vhdSectorSize; sector <= last; sector++ {
+		mask := byte(0x80 >> uint(sector%8))
+		if bitmap[sector/8]&mask == 0 {
+			bitmap[sector/8] |= mask
+			changed = true
+		}
+	}
+
+	if changed {
+		_, err := d.f.WriteAt(bitmap, base)
+		return err
+	}
+	return nil
+}
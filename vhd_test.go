@@ -0,0 +1,164 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// vhdStruct encodes a VHD footer or dynamic header, with its checksum at
+// csumOff.
+func vhdStruct(v interface{}, size, csumOff int) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, v)
+	b := make([]byte, size)
+	copy(b, buf.Bytes())
+	binary.BigEndian.PutUint32(b[csumOff:], vhdChecksum(b, csumOff))
+	return b
+}
+
+func vhdTestFooter(diskType uint32, size, dataOffset uint64) vhdFooter {
+	ftr := vhdFooter{DiskType: diskType, CurrentSize: size, OriginalSize: size, DataOffset: dataOffset}
+	copy(ftr.Cookie[:], "conectix")
+	return ftr
+}
+
+// makeFixedVHD returns a fixed VHD of size bytes, which hold their own
+// offsets divided by 512 in each sector.
+func makeFixedVHD(size int64, edit func(*vhdFooter)) []byte {
+	b := make([]byte, size)
+	for off := int64(0); off < size; off += vhdSectorSize {
+		binary.BigEndian.PutUint32(b[off:], uint32(off/vhdSectorSize))
+	}
+	ftr := vhdTestFooter(vhdTypeFixed, uint64(size), ^uint64(0))
+	if edit != nil {
+		edit(&ftr)
+	}
+	return append(b, vhdStruct(&ftr, vhdSectorSize, 64)...)
+}
+
+// makeDynamicVHD returns a dynamic VHD of two 4 KiB blocks, of which only
+// the first is allocated, with its first sector present and filled with
+// 0xaa.
+func makeDynamicVHD(edit func(*vhdFooter, *vhdDynamicHeader)) []byte {
+	const blockSize = 4096
+	ftr := vhdTestFooter(vhdTypeDynamic, 2*blockSize, 512)
+	dh := vhdDynamicHeader{TableOffset: 1536, Version: 0x10000, MaxTableEntries: 2, BlockSize: blockSize}
+	copy(dh.Cookie[:], "cxsparse")
+	dh.DataOffset = ^uint64(0)
+	if edit != nil {
+		edit(&ftr, &dh)
+	}
+
+	footer := vhdStruct(&ftr, vhdSectorSize, 64)
+	b := append([]byte{}, footer...)
+	b = append(b, vhdStruct(&dh, 1024, 36)...)
+
+	bat := make([]byte, vhdSectorSize)
+	binary.BigEndian.PutUint32(bat, 2048/vhdSectorSize)
+	binary.BigEndian.PutUint32(bat[4:], vhdUnallocated)
+	b = append(b, bat...)
+
+	bitmap := make([]byte, vhdSectorSize)
+	bitmap[0] = 0x80
+	b = append(b, bitmap...)
+	b = append(b, bytes.Repeat([]byte{0xaa}, blockSize)...)
+	return append(b, footer...)
+}
+
+func TestVHD(t *testing.T) {
+	fixed := makeFixedVHD(8192, nil)
+	d, err := openVHD(&memDisk{data: fixed}, int64(len(fixed)))
+	if err != nil {
+		t.Fatalf("fixed: %v", err)
+	}
+	p := make([]byte, 4)
+	if _, err := d.ReadAt(p, 5*512); err != nil || binary.BigEndian.Uint32(p) != 5 {
+		t.Errorf("fixed: sector 5 reads %x, %v", p, err)
+	}
+
+	dyn := makeDynamicVHD(nil)
+	d, err = openVHD(&memDisk{data: dyn}, int64(len(dyn)))
+	if err != nil {
+		t.Fatalf("dynamic: %v", err)
+	}
+	p = make([]byte, 8192)
+	if _, err := d.ReadAt(p, 0); err != nil {
+		t.Fatalf("dynamic: %v", err)
+	}
+	want := append(bytes.Repeat([]byte{0xaa}, 512), make([]byte, 8192-512)...)
+	if !bytes.Equal(p, want) {
+		t.Errorf("dynamic: reads back as %x...", p[:1024])
+	}
+
+	// the second sector of the first block becomes present when written
+	if n, err := d.WriteAt([]byte{1, 2, 3}, 512); n != 3 || err != nil {
+		t.Errorf("dynamic: write to an allocated block: %d, %v", n, err)
+	}
+	d.ReadAt(p[:3], 512)
+	if !bytes.Equal(p[:3], []byte{1, 2, 3}) {
+		t.Errorf("dynamic: write to an allocated block reads back as %x", p[:3])
+	}
+
+	// the unallocated block can only be "written" with what it reads as
+	if n, err := d.WriteAt(make([]byte, 4096), 4096); n != 4096 || err != nil {
+		t.Errorf("dynamic: zeroing an unallocated block: %d, %v", n, err)
+	}
+	if n, err := d.WriteAt([]byte{1}, 4096+100); n != 0 || err == nil {
+		t.Errorf("dynamic: writing data to an unallocated block: %d, %v, want an error", n, err)
+	}
+}
+
+func TestVHDMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		image []byte
+		want  string
+	}{
+		{"fixed larger than the file", makeFixedVHD(8192, func(f *vhdFooter) { f.CurrentSize = 8193 }),
+			"larger than the file"},
+		{"negative size", makeFixedVHD(8192, func(f *vhdFooter) { f.CurrentSize = 1 << 63 }),
+			"invalid disk size"},
+		{"differencing", makeFixedVHD(8192, func(f *vhdFooter) { f.DiskType = vhdTypeDifferencing }),
+			"differencing"},
+		{"unknown type", makeFixedVHD(8192, func(f *vhdFooter) { f.DiskType = 9 }), "unknown disk type"},
+		{"truncated", makeFixedVHD(8192, nil)[:8192], "cookie"},
+		{"bad footer checksum", func() []byte {
+			b := makeFixedVHD(8192, nil)
+			b[8192+100] ^= 1
+			return b
+		}(), "footer checksum"},
+		{"bad dynamic header cookie", makeDynamicVHD(func(_ *vhdFooter, dh *vhdDynamicHeader) {
+			dh.Cookie[0] = 'x'
+		}), "dynamic header cookie"},
+		{"dynamic header past the end", makeDynamicVHD(func(f *vhdFooter, _ *vhdDynamicHeader) {
+			f.DataOffset = 1 << 40
+		}), "dynamic header"},
+		{"block size", makeDynamicVHD(func(_ *vhdFooter, dh *vhdDynamicHeader) { dh.BlockSize = 1000 }),
+			"invalid block size"},
+		{"oversized BAT", makeDynamicVHD(func(_ *vhdFooter, dh *vhdDynamicHeader) {
+			dh.MaxTableEntries = 0xffffffff
+		}), "doesn't fit in the file"},
+		{"BAT past the end", makeDynamicVHD(func(_ *vhdFooter, dh *vhdDynamicHeader) {
+			dh.TableOffset = 1 << 40
+		}), "past the end of the file"},
+		{"BAT too small", makeDynamicVHD(func(_ *vhdFooter, dh *vhdDynamicHeader) { dh.MaxTableEntries = 1 }),
+			"too small"},
+		{"disk larger than the BAT", makeDynamicVHD(func(f *vhdFooter, _ *vhdDynamicHeader) {
+			f.CurrentSize = 1<<63 - 1
+		}), "too small"},
+	}
+	for _, tt := range tests {
+		d, err := openVHD(&memDisk{data: tt.image}, int64(len(tt.image)))
+		if err == nil {
+			t.Errorf("%s: opened, size %d", tt.name, d.Size())
+		} else if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want an error about %q", tt.name, err, tt.want)
+		}
+	}
+}
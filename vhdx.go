@@ -0,0 +1,414 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// VHDX (Hyper-V generation 2) disk image support.
+// All VHDX structures are little-endian.
+
+const (
+	vhdxHeader1Offset     = 64 * 1024
+	vhdxHeader2Offset     = 128 * 1024
+	vhdxRegionTableOffset = 192 * 1024
+
+	vhdxHeaderSize      = 4096
+	vhdxRegionTableSize = 64 * 1024
+
+	vhdxBATGuid      = "2DC27766-F623-4200-9D64-115E9BFD4A08"
+	vhdxMetadataGuid = "8B7CA206-4790-4B9A-B8FE-575F050F886E"
+
+	vhdxFileParametersGuid = "CAA16737-FA36-4D43-B3B6-33F0AA44E76B"
+	vhdxVirtualSizeGuid    = "2FA54224-CD1B-4876-B211-5DBED83BF4B8"
+	vhdxLogicalSectorGuid  = "8141BF1D-A96F-4709-BA47-F233A8FAAB5F"
+
+	vhdxHasParent = 2
+
+	vhdxBlockNotPresent   = 0
+	vhdxBlockFullyPresent = 6
+	vhdxBlockPartial      = 7
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type vhdxHeader struct {
+	Signature      [4]byte
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGuid  Guid
+	DataWriteGuid  Guid
+	LogGuid        Guid
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+}
+
+type vhdxRegionTableHeader struct {
+	Signature  [4]byte
+	Checksum   uint32
+	EntryCount uint32
+	_          uint32
+}
+
+type vhdxRegionEntry struct {
+	Guid       Guid
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+type vhdxMetadataTableHeader struct {
+	Signature  [8]byte
+	_          uint16
+	EntryCount uint16
+	_          [20]byte
+}
+
+type vhdxMetadataEntry struct {
+	ItemId Guid
+	Offset uint32
+	Length uint32
+	Flags  uint32
+	_      uint32
+}
+
+// vhdxChecksum computes the CRC-32C of a structure with its checksum field
+// (always at offset 4) treated as zero.
+func vhdxChecksum(b []byte) uint32 {
+	tmp := make([]byte, len(b))
+	copy(tmp, b)
+	binary.LittleEndian.PutUint32(tmp[4:], 0)
+	return crc32.Checksum(tmp, crc32c)
+}
+
+func isVHDX(f io.ReaderAt) bool {
+	sig := make([]byte, 8)
+	return readFullAt(f, sig, 0) == nil && string(sig) == "vhdxfile"
+}
+
+type vhdxDisk struct {
+	f    storage
+	size int64
+
+	blockSize  int64
+	chunkRatio int64
+	bat        []uint64
+
+	// the header to be replaced by the next update
+	hdr      vhdxHeader
+	hdrSlot  int64
+	updated  bool
+	needsLog bool
+}
+
+func openVHDX(f storage, fileSize int64) (*vhdxDisk, error) {
+	d := &vhdxDisk{f: f}
+
+	// pick the valid header with the highest sequence number
+	valid := 0
+	for _, off := range []int64{vhdxHeader1Offset, vhdxHeader2Offset} {
+		buf := make([]byte, vhdxHeaderSize)
+		if readFullAt(f, buf, off) != nil {
+			continue
+		}
+
+		var h vhdxHeader
+		binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h)
+		if string(h.Signature[:]) != "head" ||
+			vhdxChecksum(buf) != h.Checksum {
+			continue
+		}
+
+		if valid == 0 || h.SequenceNumber > d.hdr.SequenceNumber {
+			d.hdr = h
+			d.hdrSlot = vhdxHeader1Offset + vhdxHeader2Offset - off
+		}
+		valid++
+	}
+	if valid == 0 {
+		return nil, errors.New("vhdx: no valid header found")
+	}
+
+	// a non-empty log must be replayed before the image is consistent
+	d.needsLog = d.hdr.LogGuid != Guid{}
+
+	regions, err := readVHDXRegions(f)
+	if err != nil {
+		return nil, err
+	}
+
+	batRegion, ok := regions[vhdxBATGuid]
+	if !ok {
+		return nil, errors.New("vhdx: BAT region not found")
+	}
+	metaRegion, ok := regions[vhdxMetadataGuid]
+	if !ok {
+		return nil, errors.New("vhdx: metadata region not found")
+	}
+
+	// both are read whole, so they have to be in the file
+	for _, r := range []struct {
+		name string
+		vhdxRegionEntry
+	}{{"BAT", batRegion}, {"metadata", metaRegion}} {
+		if r.FileOffset > uint64(fileSize) || uint64(r.Length) > uint64(fileSize)-r.FileOffset {
+			return nil, fmt.Errorf("vhdx: %s region at 0x%x length %d is past the end of the file",
+				r.name, r.FileOffset, r.Length)
+		}
+	}
+
+	items, err := readVHDXMetadata(f, metaRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	params, ok1 := items[vhdxFileParametersGuid]
+	vsize, ok2 := items[vhdxVirtualSizeGuid]
+	lsect, ok3 := items[vhdxLogicalSectorGuid]
+	if !ok1 || !ok2 || !ok3 || len(params) < 8 || len(vsize) < 8 || len(lsect) < 4 {
+		return nil, errors.New("vhdx: required metadata items missing")
+	}
+
+	d.blockSize = int64(binary.LittleEndian.Uint32(params))
+	flags := binary.LittleEndian.Uint32(params[4:])
+	virtualSize := binary.LittleEndian.Uint64(vsize)
+	sectorSize := int64(binary.LittleEndian.Uint32(lsect))
+
+	if virtualSize == 0 || virtualSize > math.MaxInt64 {
+		return nil, fmt.Errorf("vhdx: invalid virtual size %d", virtualSize)
+	}
+	d.size = int64(virtualSize)
+	if flags&vhdxHasParent != 0 {
+		return nil, errors.New("vhdx: differencing disks are not supported")
+	}
+	if d.blockSize < 1<<20 || d.blockSize > 256<<20 || d.blockSize&(d.blockSize-1) != 0 {
+		return nil, fmt.Errorf("vhdx: invalid block size %d", d.blockSize)
+	}
+	if sectorSize != 512 && sectorSize != 4096 {
+		return nil, fmt.Errorf("vhdx: invalid logical sector size %d", sectorSize)
+	}
+
+	d.chunkRatio = (1 << 23) * sectorSize / d.blockSize
+
+	// payload entries are interleaved with one sector bitmap entry per chunk
+	numBlocks := d.size / d.blockSize
+	if d.size%d.blockSize != 0 {
+		numBlocks++
+	}
+	numEntries := numBlocks + (numBlocks-1)/d.chunkRatio
+	if numEntries*8 > int64(batRegion.Length) {
+		return nil, errors.New("vhdx: BAT region is too small for disk")
+	}
+
+	batBuf := make([]byte, numEntries*8)
+	if err := readFullAt(f, batBuf, int64(batRegion.FileOffset)); err != nil {
+		return nil, fmt.Errorf("vhdx: cannot read BAT: %v", err)
+	}
+	d.bat = make([]uint64, numEntries)
+	for i := range d.bat {
+		d.bat[i] = binary.LittleEndian.Uint64(batBuf[i*8:])
+	}
+
+	return d, nil
+}
+
+func readVHDXRegions(f io.ReaderAt) (map[string]vhdxRegionEntry, error) {
+	buf := make([]byte, vhdxRegionTableSize)
+	if err := readFullAt(f, buf, vhdxRegionTableOffset); err != nil {
+		return nil, fmt.Errorf("vhdx: cannot read region table: %v", err)
+	}
+
+	r := bytes.NewReader(buf)
+	var th vhdxRegionTableHeader
+	binary.Read(r, binary.LittleEndian, &th)
+	if string(th.Signature[:]) != "regi" {
+		return nil, errors.New("vhdx: invalid region table signature")
+	}
+	if sum := vhdxChecksum(buf); sum != th.Checksum {
+		return nil, fmt.Errorf("vhdx: region table checksum mismatch: stored %08x, computed %08x",
+			th.Checksum, sum)
+	}
+	if th.EntryCount > 2047 {
+		return nil, errors.New("vhdx: too many region table entries")
+	}
+
+	regions := make(map[string]vhdxRegionEntry)
+	for i := uint32(0); i < th.EntryCount; i++ {
+		var e vhdxRegionEntry
+		binary.Read(r, binary.LittleEndian, &e)
+		regions[e.Guid.String()] = e
+	}
+	return regions, nil
+}
+
+func readVHDXMetadata(f io.ReaderAt, region vhdxRegionEntry) (map[string][]byte, error) {
+	buf := make([]byte, region.Length)
+	if err := readFullAt(f, buf, int64(region.FileOffset)); err != nil {
+		return nil, fmt.Errorf("vhdx: cannot read metadata region: %v", err)
+	}
+
+	r := bytes.NewReader(buf)
+	var th vhdxMetadataTableHeader
+	binary.Read(r, binary.LittleEndian, &th)
+	if string(th.Signature[:]) != "metadata" {
+		return nil, errors.New("vhdx: invalid metadata table signature")
+	}
+	if th.EntryCount > 2047 {
+		return nil, errors.New("vhdx: too many metadata entries")
+	}
+
+	items := make(map[string][]byte)
+	for i := uint16(0); i < th.EntryCount; i++ {
+		var e vhdxMetadataEntry
+		binary.Read(r, binary.LittleEndian, &e)
+
+		end := uint64(e.Offset) + uint64(e.Length)
+		if end > uint64(len(buf)) {
+			return nil, fmt.Errorf("vhdx: metadata item %v out of bounds", e.ItemId)
+		}
+		items[e.ItemId.String()] = buf[e.Offset:end]
+	}
+	return items, nil
+}
+
+func (d *vhdxDisk) Size() int64 { return d.size }
+
+// blockOffset returns the file offset of the payload block containing off,
+// or -1 if the block has no data stored in the file.
+func (d *vhdxDisk) blockOffset(off int64) (int64, error) {
+	block := off / d.blockSize
+	entry := d.bat[block+block/d.chunkRatio]
+
+	switch entry & 7 {
+	case vhdxBlockFullyPresent:
+		return int64(entry>>20) << 20, nil
+	case vhdxBlockPartial:
+		return 0, errors.New("vhdx: partially present blocks are not supported")
+	default:
+		// not present, undefined, zero or unmapped
+		return -1, nil
+	}
+}
+
+func (d *vhdxDisk) span(off int64, n int) int {
+	if rem := d.size - off; int64(n) > rem {
+		n = int(rem)
+	}
+	if rem := d.blockSize - off%d.blockSize; int64(n) > rem {
+		n = int(rem)
+	}
+	return n
+}
+
+func (d *vhdxDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("vhdx: negative offset")
+	}
+
+	total := 0
+	for len(p) > 0 {
+		if off >= d.size {
+			return total, io.EOF
+		}
+
+		n := d.span(off, len(p))
+		base, err := d.blockOffset(off)
+		if err != nil {
+			return total, err
+		}
+
+		if base < 0 {
+			for i := range p[:n] {
+				p[i] = 0
+			}
+		} else if err := readFullAt(d.f, p[:n], base+off%d.blockSize); err != nil {
+			return total, err
+		}
+
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
+
+// WriteAt writes into blocks already present in the file. Blocks without
+// stored data read back as zeros, so writing zeros to them is done already,
+// but anything else would need a block to be allocated and is refused.
+func (d *vhdxDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("vhdx: negative offset")
+	}
+	if d.needsLog {
+		return 0, errors.New("vhdx: image has a pending log, open it in Hyper-V first")
+	}
+	if !d.updated {
+		if err := d.updateHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	total := 0
+	for len(p) > 0 {
+		if off >= d.size {
+			return total, errors.New("vhdx: write past end of disk")
+		}
+
+		n := d.span(off, len(p))
+		base, err := d.blockOffset(off)
+		if err != nil {
+			return total, err
+		}
+
+		if base >= 0 {
+			if _, err := d.f.WriteAt(p[:n], base+off%d.blockSize); err != nil {
+				return total, err
+			}
+		} else if !allZero(p[:n]) {
+			return total, fmt.Errorf("vhdx: can't write at 0x%x, in block %d which isn't allocated", off, off/d.blockSize)
+		}
+
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
+
+// updateHeader marks the image as modified before the first write, by
+// writing a new header with fresh write GUIDs over the older header slot.
+func (d *vhdxDisk) updateHeader() error {
+	h := d.hdr
+	h.SequenceNumber++
+
+	var guids [32]byte
+	if _, err := rand.Read(guids[:]); err != nil {
+		return err
+	}
+	binary.Read(bytes.NewReader(guids[:]), binary.LittleEndian, &h.FileWriteGuid)
+	binary.Read(bytes.NewReader(guids[16:]), binary.LittleEndian, &h.DataWriteGuid)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &h)
+	b := make([]byte, vhdxHeaderSize)
+	copy(b, buf.Bytes())
+	binary.LittleEndian.PutUint32(b[4:], vhdxChecksum(b))
+
+	if _, err := d.f.WriteAt(b, d.hdrSlot); err != nil {
+		return fmt.Errorf("vhdx: cannot update header: %v", err)
+	}
+	d.updated = true
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// vhdxTestImage describes the image that its bytes method makes, for the
+// tests to break.
+type vhdxTestImage struct {
+	hdr         vhdxHeader
+	bat, meta   vhdxRegionEntry
+	blockSize   uint32
+	virtualSize uint64
+	sectorSize  uint32
+	fileSize    int
+}
+
+func vhdxGuid(s string) Guid {
+	g, err := parseGuid(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// newVHDXTestImage describes a VHDX of two 1 MiB blocks, of which only the
+// first is present in the file.
+func newVHDXTestImage() *vhdxTestImage {
+	im := &vhdxTestImage{
+		hdr:         vhdxHeader{SequenceNumber: 1, Version: 1},
+		bat:         vhdxRegionEntry{Guid: vhdxGuid(vhdxBATGuid), FileOffset: 2 << 20, Length: 1 << 20, Required: 1},
+		meta:        vhdxRegionEntry{Guid: vhdxGuid(vhdxMetadataGuid), FileOffset: 1 << 20, Length: 64 << 10, Required: 1},
+		blockSize:   1 << 20,
+		virtualSize: 2 << 20,
+		sectorSize:  512,
+		fileSize:    4 << 20,
+	}
+	copy(im.hdr.Signature[:], "head")
+	return im
+}
+
+// vhdxPut encodes v at off in b, and sets its checksum over size bytes.
+func vhdxPut(b []byte, off int, v interface{}, size int) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, v)
+	copy(b[off:], buf.Bytes())
+	if size > 0 {
+		binary.LittleEndian.PutUint32(b[off+4:], vhdxChecksum(b[off:off+size]))
+	}
+}
+
+func (im *vhdxTestImage) bytes() []byte {
+	b := make([]byte, 4<<20)
+	copy(b, "vhdxfile")
+	vhdxPut(b, vhdxHeader1Offset, &im.hdr, vhdxHeaderSize)
+
+	th := vhdxRegionTableHeader{EntryCount: 2}
+	copy(th.Signature[:], "regi")
+	vhdxPut(b, vhdxRegionTableOffset, &th, 0)
+	vhdxPut(b, vhdxRegionTableOffset+16, &im.bat, 0)
+	vhdxPut(b, vhdxRegionTableOffset+48, &im.meta, 0)
+	binary.LittleEndian.PutUint32(b[vhdxRegionTableOffset+4:],
+		vhdxChecksum(b[vhdxRegionTableOffset:vhdxRegionTableOffset+vhdxRegionTableSize]))
+
+	mt := vhdxMetadataTableHeader{EntryCount: 3}
+	copy(mt.Signature[:], "metadata")
+	meta := 1 << 20
+	vhdxPut(b, meta, &mt, 0)
+	params, vsize, lsect := make([]byte, 8), make([]byte, 8), make([]byte, 4)
+	binary.LittleEndian.PutUint32(params, im.blockSize)
+	binary.LittleEndian.PutUint64(vsize, im.virtualSize)
+	binary.LittleEndian.PutUint32(lsect, im.sectorSize)
+	items := []struct {
+		guid string
+		data []byte
+	}{{vhdxFileParametersGuid, params}, {vhdxVirtualSizeGuid, vsize}, {vhdxLogicalSectorGuid, lsect}}
+	for i, it := range items {
+		off := 0x1000 + 0x100*i
+		e := vhdxMetadataEntry{ItemId: vhdxGuid(it.guid), Offset: uint32(off), Length: uint32(len(it.data))}
+		vhdxPut(b, meta+32+32*i, &e, 0)
+		copy(b[meta+off:], it.data)
+	}
+
+	binary.LittleEndian.PutUint64(b[2<<20:], 3<<20|vhdxBlockFullyPresent)
+	copy(b[3<<20:], bytes.Repeat([]byte{0xaa}, 1<<20))
+	return b[:im.fileSize]
+}
+
+func openVHDXTestImage(b []byte) (*vhdxDisk, error) {
+	return openVHDX(&memDisk{data: b}, int64(len(b)))
+}
+
+func TestVHDX(t *testing.T) {
+	d, err := openVHDXTestImage(newVHDXTestImage().bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != 2<<20 {
+		t.Errorf("size %d, want %d", d.Size(), 2<<20)
+	}
+	p := make([]byte, 2)
+	if _, err := d.ReadAt(p, 1<<20-1); err != nil || p[0] != 0xaa || p[1] != 0 {
+		t.Errorf("across the blocks: %x, %v", p, err)
+	}
+
+	if n, err := d.WriteAt([]byte{1}, 100); n != 1 || err != nil {
+		t.Errorf("write to a present block: %d, %v", n, err)
+	}
+	if d.ReadAt(p[:1], 100); p[0] != 1 {
+		t.Errorf("write to a present block reads back as %x", p[0])
+	}
+	if n, err := d.WriteAt(make([]byte, 4096), 1<<20); n != 4096 || err != nil {
+		t.Errorf("zeroing a block not present: %d, %v", n, err)
+	}
+	if n, err := d.WriteAt([]byte{0, 1}, 1<<20-1); n != 1 || err == nil {
+		t.Errorf("writing data across into a block not present: %d, %v, want 1 and an error", n, err)
+	}
+}
+
+func TestVHDXMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*vhdxTestImage)
+		want string
+	}{
+		{"no header", func(im *vhdxTestImage) { im.hdr.Signature[0] = 'x' }, "no valid header"},
+		{"zero size", func(im *vhdxTestImage) { im.virtualSize = 0 }, "invalid virtual size"},
+		{"negative size", func(im *vhdxTestImage) { im.virtualSize = 1 << 63 }, "invalid virtual size"},
+		{"oversized disk", func(im *vhdxTestImage) { im.virtualSize = 1<<63 - 1 }, "BAT region is too small"},
+		{"block size", func(im *vhdxTestImage) { im.blockSize = 3 << 20 }, "invalid block size"},
+		{"sector size", func(im *vhdxTestImage) { im.sectorSize = 1024 }, "invalid logical sector size"},
+		{"BAT too small", func(im *vhdxTestImage) { im.bat.Length = 8 }, "BAT region is too small"},
+		{"BAT past the end", func(im *vhdxTestImage) { im.bat.FileOffset = 1 << 40 }, "past the end"},
+		{"oversized BAT", func(im *vhdxTestImage) { im.bat.Length = 0xffffffff }, "past the end"},
+		{"metadata past the end", func(im *vhdxTestImage) { im.meta.FileOffset = 4<<20 - 4096 }, "past the end"},
+		{"truncated", func(im *vhdxTestImage) { im.fileSize = 2<<20 + 4096 }, "past the end"},
+		{"truncated region table", func(im *vhdxTestImage) { im.fileSize = 200 << 10 }, "region table"},
+		{"truncated header", func(im *vhdxTestImage) { im.fileSize = 66 << 10 }, "no valid header"},
+	}
+	for _, tt := range tests {
+		im := newVHDXTestImage()
+		tt.edit(im)
+		d, err := openVHDXTestImage(im.bytes())
+		if err == nil {
+			t.Errorf("%s: opened, size %d", tt.name, d.Size())
+		} else if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want an error about %q", tt.name, err, tt.want)
+		}
+	}
+}
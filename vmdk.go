@@ -0,0 +1,238 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// VMware sparse extent (monolithic sparse and stream-optimized .vmdk)
+// support, read-only. Grains are found through a grain directory of grain
+// tables; unallocated grains read as zeros, and compressed grains are
+// inflated. Flat extents are raw already, and descriptor files only point
+// at the extents holding the data.
+
+const (
+	vmdkMagic     = "KDMV"
+	vmdkGDAtEnd   = 0xffffffffffffffff
+	vmdkSector    = 512
+	vmdkFooterOff = 1024 // from the end of a stream-optimized file
+
+	vmdkZeroedGTE  = 1 << 2
+	vmdkCompressed = 1 << 16
+)
+
+type vmdkHeader struct {
+	Magic              [4]byte
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64 // in sectors
+	GrainSize          uint64 // in sectors
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RgdOffset          uint64
+	GdOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  uint8
+	NonEndLineChar     uint8
+	DoubleEndLineChar1 uint8
+	DoubleEndLineChar2 uint8
+	CompressAlgorithm  uint16
+}
+
+type vmdkDisk struct {
+	f          io.ReaderAt
+	size       int64
+	grainSize  int64
+	compressed bool
+	zeroedGTE  bool // grain table entries of 1 are zeroed grains
+	perTable   int64
+	gd         []uint32
+
+	// the grain table last looked at, as scans go through them in order
+	gtSector uint32
+	gt       []uint32
+}
+
+func isVMDK(f io.ReaderAt) bool {
+	magic := make([]byte, 4)
+	return readFullAt(f, magic, 0) == nil && string(magic) == vmdkMagic
+}
+
+func readVMDKHeader(f io.ReaderAt, off int64) (*vmdkHeader, error) {
+	var hdr vmdkHeader
+	if err := binary.Read(io.NewSectionReader(f, off, int64(binary.Size(hdr))), binary.LittleEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("vmdk: can't read header: %v", err)
+	}
+	if string(hdr.Magic[:]) != vmdkMagic {
+		return nil, errors.New("vmdk: invalid header")
+	}
+	return &hdr, nil
+}
+
+func openVMDK(f io.ReaderAt, fileSize int64) (*vmdkDisk, error) {
+	hdr, err := readVMDKHeader(f, 0)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.GdOffset == vmdkGDAtEnd {
+		// stream-optimized, with the real header in the footer
+		if fileSize < vmdkFooterOff+vmdkSector {
+			return nil, errors.New("vmdk: file too short for its footer")
+		}
+		if hdr, err = readVMDKHeader(f, fileSize-vmdkFooterOff); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case hdr.Version < 1 || hdr.Version > 3:
+		return nil, fmt.Errorf("vmdk: unsupported version %d", hdr.Version)
+	case hdr.GrainSize < 1 || hdr.GrainSize > 1<<16 || hdr.GrainSize&(hdr.GrainSize-1) != 0:
+		return nil, fmt.Errorf("vmdk: invalid grain size %d", hdr.GrainSize)
+	case hdr.NumGTEsPerGT < 1 || hdr.NumGTEsPerGT > 1<<16:
+		return nil, fmt.Errorf("vmdk: invalid grain table size %d", hdr.NumGTEsPerGT)
+	case hdr.Capacity > 1<<53:
+		return nil, fmt.Errorf("vmdk: invalid capacity %d", hdr.Capacity)
+	case hdr.Flags&vmdkCompressed != 0 && hdr.CompressAlgorithm != 1:
+		return nil, fmt.Errorf("vmdk: unsupported compression %d", hdr.CompressAlgorithm)
+	}
+
+	d := &vmdkDisk{
+		f:          f,
+		size:       int64(hdr.Capacity) * vmdkSector,
+		grainSize:  int64(hdr.GrainSize) * vmdkSector,
+		compressed: hdr.Flags&vmdkCompressed != 0,
+		zeroedGTE:  hdr.Flags&vmdkZeroedGTE != 0,
+		perTable:   int64(hdr.NumGTEsPerGT),
+	}
+	tableSpan := d.grainSize * d.perTable
+	entries := (d.size + tableSpan - 1) / tableSpan
+	if entries > 32<<20 {
+		return nil, errors.New("vmdk: grain directory too large")
+	}
+	if hdr.GdOffset > uint64(fileSize)/vmdkSector || 4*entries > fileSize-int64(hdr.GdOffset)*vmdkSector {
+		return nil, fmt.Errorf("vmdk: grain directory at sector %d of %d entries is past the end of the file",
+			hdr.GdOffset, entries)
+	}
+
+	buf := make([]byte, 4*entries)
+	if err := readFullAt(f, buf, int64(hdr.GdOffset)*vmdkSector); err != nil {
+		return nil, fmt.Errorf("vmdk: can't read grain directory: %v", err)
+	}
+	d.gd = make([]uint32, entries)
+	for i := range d.gd {
+		d.gd[i] = binary.LittleEndian.Uint32(buf[4*i:])
+	}
+	return d, nil
+}
+
+func (d *vmdkDisk) Size() int64 { return d.size }
+
+// grainEntry returns the sector of the grain at off, or 0 if it is not
+// allocated.
+func (d *vmdkDisk) grainEntry(off int64) (uint32, error) {
+	grain := off / d.grainSize
+	gtSector := d.gd[grain/d.perTable]
+	if gtSector == 0 {
+		return 0, nil
+	}
+	if gtSector != d.gtSector || d.gt == nil {
+		buf := make([]byte, 4*d.perTable)
+		if err := readFullAt(d.f, buf, int64(gtSector)*vmdkSector); err != nil {
+			return 0, fmt.Errorf("vmdk: can't read grain table: %v", err)
+		}
+		d.gt = make([]uint32, d.perTable)
+		for i := range d.gt {
+			d.gt[i] = binary.LittleEndian.Uint32(buf[4*i:])
+		}
+		d.gtSector = gtSector
+	}
+	return d.gt[grain%d.perTable], nil
+}
+
+func (d *vmdkDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("vmdk: negative offset")
+	}
+
+	total := 0
+	for len(p) > 0 {
+		if off >= d.size {
+			return total, io.EOF
+		}
+
+		within := off % d.grainSize
+		n := len(p)
+		if rem := d.grainSize - within; int64(n) > rem {
+			n = int(rem)
+		}
+		if rem := d.size - off; int64(n) > rem {
+			n = int(rem)
+		}
+		if err := d.readGrain(p[:n], off, within); err != nil {
+			return total, err
+		}
+
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
+
+// readGrain reads p from within a single grain.
+func (d *vmdkDisk) readGrain(p []byte, off, within int64) error {
+	sector, err := d.grainEntry(off)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case sector == 0, sector == 1 && d.zeroedGTE:
+		for i := range p {
+			p[i] = 0
+		}
+	case d.compressed:
+		// a grain marker: the LBA and the size of the deflated data
+		host := int64(sector) * vmdkSector
+		marker := make([]byte, 12)
+		if err := readFullAt(d.f, marker, host); err != nil {
+			return err
+		}
+		size := binary.LittleEndian.Uint32(marker[8:])
+		if int64(size) > 2*d.grainSize+vmdkSector {
+			return fmt.Errorf("vmdk: corrupt compressed grain at 0x%x", host)
+		}
+		compressed := make([]byte, size)
+		if err := readFullAt(d.f, compressed, host+12); err != nil {
+			return err
+		}
+		grain := make([]byte, d.grainSize)
+		zr, err := zlib.NewReader(bytes.NewReader(compressed))
+		if err == nil {
+			_, err = io.ReadFull(zr, grain)
+		}
+		if err == io.ErrUnexpectedEOF && off-within+d.grainSize > d.size {
+			err = nil // the last grain can be short
+		}
+		if err != nil {
+			return fmt.Errorf("vmdk: corrupt compressed grain at 0x%x: %v", host, err)
+		}
+		copy(p, grain[within:])
+	default:
+		return readFullAt(d.f, p, int64(sector)*vmdkSector+within)
+	}
+	return nil
+}
+
+func (d *vmdkDisk) WriteAt(p []byte, off int64) (int, error) { return 0, errReadOnly }
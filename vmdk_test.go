@@ -0,0 +1,130 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// vmdkTestImage describes a sparse extent of four one-sector grains: one
+// filled with 0x11, a zeroed one, an unallocated one, and one of 0x44. The
+// grain directory is in sector 1, its one grain table in sector 2, and the
+// grains from sector 3.
+type vmdkTestImage struct {
+	hdr      vmdkHeader
+	fileSize int // to truncate to, if set
+}
+
+func newVMDKTestImage() *vmdkTestImage {
+	im := &vmdkTestImage{hdr: vmdkHeader{
+		Version:      1,
+		Flags:        vmdkZeroedGTE,
+		Capacity:     4,
+		GrainSize:    1,
+		NumGTEsPerGT: 4,
+		GdOffset:     1,
+	}}
+	copy(im.hdr.Magic[:], vmdkMagic)
+	return im
+}
+
+func (im *vmdkTestImage) bytes() []byte {
+	b := make([]byte, 5*vmdkSector)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &im.hdr)
+	copy(b, buf.Bytes())
+
+	binary.LittleEndian.PutUint32(b[vmdkSector:], 2)
+	for i, sector := range []uint32{3, 1, 0, 4} {
+		binary.LittleEndian.PutUint32(b[2*vmdkSector+4*i:], sector)
+	}
+	copy(b[3*vmdkSector:], bytes.Repeat([]byte{0x11}, vmdkSector))
+	copy(b[4*vmdkSector:], bytes.Repeat([]byte{0x44}, vmdkSector))
+
+	if im.fileSize != 0 {
+		b = b[:im.fileSize]
+	}
+	return b
+}
+
+func openVMDKTestImage(b []byte) (*vmdkDisk, error) {
+	return openVMDK(&memDisk{data: b}, int64(len(b)))
+}
+
+func TestVMDK(t *testing.T) {
+	d, err := openVMDKTestImage(newVMDKTestImage().bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != 4*vmdkSector {
+		t.Errorf("size %d, want %d", d.Size(), 4*vmdkSector)
+	}
+	p := make([]byte, 4*vmdkSector)
+	if _, err := d.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := append(bytes.Repeat([]byte{0x11}, vmdkSector), make([]byte, 2*vmdkSector)...)
+	want = append(want, bytes.Repeat([]byte{0x44}, vmdkSector)...)
+	if !bytes.Equal(p, want) {
+		t.Errorf("reads back as %x", p)
+	}
+	if n, err := d.ReadAt(p[:2], 4*vmdkSector-1); n != 1 || err == nil {
+		t.Errorf("read past the end: %d, %v, want 1 and an error", n, err)
+	}
+	if _, err := d.WriteAt(p[:1], 0); err != errReadOnly {
+		t.Errorf("write: %v, want %v", err, errReadOnly)
+	}
+}
+
+func TestVMDKMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*vmdkTestImage)
+		want string
+	}{
+		{"magic", func(im *vmdkTestImage) { im.hdr.Magic[0] = 'x' }, "invalid header"},
+		{"version", func(im *vmdkTestImage) { im.hdr.Version = 4 }, "unsupported version"},
+		{"grain size", func(im *vmdkTestImage) { im.hdr.GrainSize = 3 }, "invalid grain size"},
+		{"huge grains", func(im *vmdkTestImage) { im.hdr.GrainSize = 1 << 17 }, "invalid grain size"},
+		{"no grain table entries", func(im *vmdkTestImage) { im.hdr.NumGTEsPerGT = 0 }, "invalid grain table size"},
+		{"negative size", func(im *vmdkTestImage) { im.hdr.Capacity = 1 << 63 }, "invalid capacity"},
+		{"compression", func(im *vmdkTestImage) { im.hdr.Flags |= vmdkCompressed }, "unsupported compression"},
+		{"oversized grain directory", func(im *vmdkTestImage) { im.hdr.Capacity = 1 << 53 }, "too large"},
+		{"grain directory past the end", func(im *vmdkTestImage) { im.hdr.Capacity = 1 << 20 }, "past the end"},
+		{"grain directory offset past the end", func(im *vmdkTestImage) { im.hdr.GdOffset = 1 << 62 }, "past the end"},
+		{"stream-optimized without a footer", func(im *vmdkTestImage) { im.hdr.GdOffset = vmdkGDAtEnd }, "invalid header"},
+		{"stream-optimized too short", func(im *vmdkTestImage) {
+			im.hdr.GdOffset = vmdkGDAtEnd
+			im.fileSize = 1000
+		}, "too short"},
+		{"truncated", func(im *vmdkTestImage) { im.fileSize = vmdkSector + 2 }, "past the end"},
+		{"truncated header", func(im *vmdkTestImage) { im.fileSize = 40 }, "can't read header"},
+	}
+	for _, tt := range tests {
+		im := newVMDKTestImage()
+		tt.edit(im)
+		d, err := openVMDKTestImage(im.bytes())
+		if err == nil {
+			t.Errorf("%s: opened, size %d", tt.name, d.Size())
+		} else if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want an error about %q", tt.name, err, tt.want)
+		}
+	}
+
+	// a grain table past the end is an error when it's read
+	b := newVMDKTestImage().bytes()
+	binary.LittleEndian.PutUint32(b[vmdkSector:], 1000)
+	d, err := openVMDKTestImage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, vmdkSector)
+	if _, err := d.ReadAt(p, 0); err == nil || !strings.Contains(err.Error(), "grain table") {
+		t.Errorf("grain table past the end: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Watching for drives being attached, for recycling benches where drives
+// are plugged in one after another.
+
+// watchNew returns the devices that were not in seen, and updates seen to
+// hold exactly the current devices.
+func watchNew(seen map[string]bool, devs []blockDevice) []blockDevice {
+	var added []blockDevice
+	current := map[string]bool{}
+	for _, d := range devs {
+		current[d.Path] = true
+		if !seen[d.Path] {
+			added = append(added, d)
+		}
+	}
+	for p := range seen {
+		if !current[p] {
+			fmt.Printf("%s detached\n", p)
+			delete(seen, p)
+		}
+	}
+	for p := range current {
+		seen[p] = true
+	}
+	return added
+}
+
+// wipeInChild wipes a volume with a separate blwipe process, so that a
+// failure does not stop the watch.
+func wipeInChild(path, format string, extra []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := append([]string{"wipe", "-format", format}, extra...)
+	out, err := exec.Command(exe, append(args, path)...).CombinedOutput()
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		fmt.Printf("    %s\n", line)
+	}
+	return err
+}
+
+func cmdWatch(args []string) {
+	fs := newFlagSet("watch", "")
+	wipe := fs.Bool("wipe", false, "wipe the encrypted volumes on drives that are attached")
+	interval := fs.Duration("interval", 2*time.Second, "how often to look for new drives")
+	reportDir := fs.String("report-dir", "", "write a JSON report of each wipe to this directory")
+	askTag := fs.Bool("ask-asset-tag", false, "ask for the asset tag of each drive before wiping it")
+	rec := recordFlags(fs, false)
+	auditCfg := auditFlags(fs)
+	parseFlags(fs, args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// drives already attached are never touched
+	seen := map[string]bool{}
+	devs, err := blockDevices()
+	if err != nil {
+		fatal("can't list block devices: %v", err)
+	}
+	watchNew(seen, devs)
+
+	in := bufio.NewReader(os.Stdin)
+	action := "reporting"
+	if *wipe {
+		action = "wiping"
+	}
+	fmt.Printf("watching for new drives, %s encrypted volumes found on them\n", action)
+
+	for {
+		time.Sleep(*interval)
+		devs, err := blockDevices()
+		if err != nil {
+			fmt.Printf("can't list block devices: %v\n", err)
+			continue
+		}
+
+		for _, d := range watchNew(seen, devs) {
+			f, err := os.Open(d.Path)
+			if err != nil {
+				fmt.Printf("%s attached, can't open: %v\n", d.Path, err)
+				continue
+			}
+			desc := describeVolume(f)
+			var vols []foundVolume
+			if desc != "" {
+				vols = findVolumes(f)
+			}
+			f.Close()
+
+			if desc == "" {
+				desc = "no encrypted volume"
+			} else {
+				desc = highlight(desc)
+			}
+			ident := humanSize(d.Size)
+			if d.Model != "" {
+				ident = d.Model + ", " + ident
+			}
+			fmt.Printf("%s attached (%s): %s\n", d.Path, ident, desc)
+			if !*wipe || len(vols) == 0 {
+				continue
+			}
+
+			r := *rec
+			if *askTag {
+				r.AssetTag = prompt(in, "asset tag of "+d.Path, "")
+			}
+			extra := append(auditCfg.args(), r.args()...)
+			if *reportDir != "" {
+				extra = append(extra, "-report", r.reportName(*reportDir, d.Path))
+			}
+			if err := wipeInChild(d.Path, vols[0].Format, extra); err != nil {
+				fmt.Printf("%s: %s %v\n", d.Path, warning("FAILED:"), err)
+			} else {
+				fmt.Printf("%s: %s\n", d.Path, success("wiped"))
+			}
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The wipefs command behaves like wipefs from util-linux, for those used
+// to it: without flags it lists the signatures on a device, -a erases them
+// all, and -b saves each one first to ~/wipefs-<device>-<offset>.bak. For
+// encrypted volumes, the regions holding their key material are treated as
+// their signatures, so that erasing them makes the volume unrecoverable.
+
+type signature struct {
+	Offset int64
+	Size   int64
+	Type   string
+	UUID   string
+	Label  string
+}
+
+// bootSectorMagics are the signature fields of the filesystems that
+// probeBootSector recognizes, erased as wipefs does.
+var bootSectorMagics = map[string][]RegionDesc{
+	"NTFS":  {{"", 3, 8}, {"", 0x1fe, 2}},
+	"exFAT": {{"", 3, 8}, {"", 0x1fe, 2}},
+	"FAT32": {{"", 0x52, 8}, {"", 0x1fe, 2}},
+	"FAT16": {{"", 0x36, 8}, {"", 0x1fe, 2}},
+	"FAT12": {{"", 0x36, 8}, {"", 0x1fe, 2}},
+}
+
+// findSignatures lists the signatures at the start of r, the volume or
+// the partition table. size is -1 if unknown.
+func findSignatures(r io.ReaderAt, size int64) []signature {
+	var typ, uuid, label string
+	for _, t := range probeTags(r) {
+		switch t.name {
+		case "TYPE", "PTTYPE":
+			typ = t.value
+		case "UUID", "PTUUID":
+			uuid = t.value
+		case "LABEL":
+			label = t.value
+		}
+	}
+	sig := func(offset, n int64) signature {
+		return signature{offset, n, typ, uuid, label}
+	}
+
+	var sigs []signature
+	switch fs := probeFilesystem(r, 0); {
+	case fs == "BitLocker":
+		hdr, err := readHeader(r, 0)
+		if err != nil {
+			return []signature{sig(0, 512)}
+		}
+		sigs = append(sigs, sig(0, int64(hdr.SectorSize)))
+		for _, off := range hdr.InfoOffsets {
+			var info InfoStruct
+			n, err := info.Read(r, int64(off))
+			if err == nil {
+				n, err = metadataExtent(n, int64(hdr.SectorSize))
+			}
+			if err == nil {
+				sigs = append(sigs, sig(int64(off), n))
+			}
+		}
+	case bootSectorMagics[fs] != nil:
+		for _, m := range bootSectorMagics[fs] {
+			sigs = append(sigs, sig(m.Offset, m.Size))
+		}
+	case fs == "ext2/3/4":
+		sigs = append(sigs, sig(0x438, 2))
+	case fs == "Btrfs":
+		sigs = append(sigs, sig(0x10040, 8))
+	case fs != "" && fs != "LUKS" && fs != "APFS":
+		for _, m := range fsMagics {
+			if m.name == fs {
+				sigs = append(sigs, sig(int64(m.offset), int64(len(m.magic))))
+			}
+		}
+	default:
+		// encrypted volumes are known by where their key material is
+		if vf, _ := findFormat(r, 0, ""); vf != nil {
+			if _, regions, err := vf.inspect(r, size); err == nil {
+				for _, region := range regions {
+					sigs = append(sigs, sig(region.Offset, region.Size))
+				}
+			}
+			break
+		}
+
+		regions, err := partitionTableRegions(r, size)
+		if err != nil {
+			break
+		}
+		for _, region := range regions {
+			switch region.Name {
+			case "MBR":
+				s := sig(0x1fe, 2)
+				if typ == "gpt" {
+					s.Type, s.UUID = "PMBR", ""
+				}
+				sigs = append(sigs, s)
+			case "primary GPT header", "backup GPT header":
+				sigs = append(sigs, sig(region.Offset, 8))
+			}
+		}
+	}
+	return sigs
+}
+
+// matchTypes reports whether typ is in the comma-separated list types.
+// Like wipefs, a list starting with "no" matches the types not in it.
+func matchTypes(types, typ string) bool {
+	if types == "" {
+		return true
+	}
+	negate := strings.HasPrefix(types, "no")
+	for _, t := range strings.Split(strings.TrimPrefix(types, "no"), ",") {
+		if strings.EqualFold(t, typ) {
+			return !negate
+		}
+	}
+	return negate
+}
+
+// wipefsBackupName is where -b saves a signature, named as by wipefs.
+func wipefsBackupName(dev string, offset int64) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		fatal("can't find the home directory for -b: %v", err)
+	}
+	return filepath.Join(home, fmt.Sprintf("wipefs-%s-0x%08x.bak", filepath.Base(dev), offset))
+}
+
+func hexPreview(b []byte) string {
+	var s []string
+	for i, c := range b {
+		if i == 8 {
+			s = append(s, "...")
+			break
+		}
+		s = append(s, fmt.Sprintf("%02x", c))
+	}
+	return strings.Join(s, " ")
+}
+
+func cmdWipefs(args []string) {
+	fs := newFlagSet("wipefs", "<device>")
+	all := fs.Bool("all", false, "erase all signatures")
+	fs.BoolVar(all, "a", false, "short for -all")
+	backup := fs.Bool("backup", false, "save each signature to ~/wipefs-<device>-<offset>.bak before erasing it")
+	fs.BoolVar(backup, "b", false, "short for -backup")
+	noAct := fs.Bool("no-act", false, "do everything except writing")
+	fs.BoolVar(noAct, "n", false, "short for -no-act")
+	force := fs.Bool("force", false, "erase even if the device is in use")
+	fs.BoolVar(force, "f", false, "short for -force")
+	offset := fs.Int64("offset", -1, "erase the signature at this offset")
+	fs.Int64Var(offset, "o", -1, "short for -offset")
+	types := fs.String("types", "", "only these types, comma-separated (\"no\" in front to exclude them)")
+	fs.StringVar(types, "t", "", "short for -types")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	dev := fs.Arg(0)
+	erase := *all || *offset >= 0
+
+	f, err := openTarget(dev, erase && !*noAct)
+	if err != nil {
+		fatal("can't open file: %s", err)
+	}
+	defer f.Close()
+	if erase && !*noAct && isReadOnly(f) {
+		fatal("%s is a read-only evidence container", dev)
+	}
+	if erase && !*noAct {
+		refuseInUse(dev, f, *force)
+	}
+
+	size, err := imageSize(f)
+	if err != nil {
+		fatal("can't determine size of %s: %v", dev, err)
+	}
+
+	var sigs []signature
+	for _, s := range findSignatures(f, size) {
+		if matchTypes(*types, s.Type) && (*offset < 0 || s.Offset == *offset) {
+			sigs = append(sigs, s)
+		}
+	}
+
+	if !erase {
+		if len(sigs) == 0 {
+			return
+		}
+		fmt.Printf("%-16s %-10s %-12s %-36s %s\n", "DEVICE", "OFFSET", "TYPE", "UUID", "LABEL")
+		for _, s := range sigs {
+			fmt.Printf("%-16s 0x%-8x %-12s %-36s %s\n", filepath.Base(dev), s.Offset, s.Type, s.UUID, s.Label)
+		}
+		return
+	}
+	if *offset >= 0 && len(sigs) == 0 {
+		fatal("no signature at offset 0x%x", *offset)
+	}
+
+	for _, s := range sigs {
+		data := make([]byte, s.Size)
+		if err := readFullAt(f, data, s.Offset); err != nil {
+			fatal("can't read signature at 0x%x: %v", s.Offset, err)
+		}
+		if *backup {
+			name := wipefsBackupName(dev, s.Offset)
+			if err := os.WriteFile(name, data, 0600); err != nil {
+				fatal("can't save backup: %v", err)
+			}
+		}
+		if !*noAct {
+			if _, err := f.WriteAt(make([]byte, s.Size), s.Offset); err != nil {
+				fatal("can't erase signature at 0x%x: %v", s.Offset, err)
+			}
+		}
+		fmt.Printf("%s: %d bytes were erased at offset 0x%08x (%s): %s\n",
+			dev, s.Size, s.Offset, s.Type, hexPreview(data))
+	}
+	if !*noAct && len(sigs) > 0 {
+		if err := syncImage(f); err != nil {
+			fatal("can't sync: %v", err)
+		}
+	}
+}
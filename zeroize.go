@@ -0,0 +1,60 @@
+// Copyright 2018 Darell Tan. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the README.
+
+package main
+
+import (
+	"os"
+	"runtime"
+)
+
+// Metadata blocks carry the volume master key wrapped by each protector,
+// and a clear key when protection is suspended. Buffers that held them are
+// cleared once they are done with, rather than left for the garbage
+// collector, and so are files that only held them for a while.
+
+// zeroize clears bufs.
+func zeroize(bufs ...[]byte) {
+	for _, b := range bufs {
+		for i := range b {
+			b[i] = 0
+		}
+		runtime.KeepAlive(b)
+	}
+}
+
+// zeroize clears the data saved in a backup.
+func (b *metadataBackup) zeroize() {
+	for _, r := range b.Regions {
+		zeroize(r.Data)
+	}
+}
+
+// shredFile overwrites the file at path with random data before removing
+// it.
+func shredFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = shredOpenFile(f)
+	f.Close()
+	return err
+}
+
+// shredOpenFile is shredFile for a file that is already open for writing,
+// which it might no longer be allowed to open once privileges are given up.
+func shredOpenFile(f *os.File) error {
+	fi, err := f.Stat()
+	if err == nil {
+		err = shredExtents(f, []extent{{0, fi.Size()}})
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(f.Name())
+}